@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata snapshot format. A snapshot is a gzip-compressed stream of JSON
+// lines: a header followed by one line per file, policy, audit event and worker.
+const (
+	SnapshotFormat  = "frostbyte-metadata"
+	SnapshotVersion = 1
+)
+
+// Snapshot entry types
+const (
+	snapshotFile   = "file"
+	snapshotPolicy = "policy"
+	snapshotAudit  = "audit"
+	snapshotWorker = "worker"
+)
+
+// SnapshotHeader is the first line of a metadata snapshot
+type SnapshotHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// snapshotEntry is one line of a metadata snapshot after the header
+type snapshotEntry struct {
+	Type   string           `json:"type"`
+	File   *FileDocument    `json:"file,omitempty"`
+	Policy *LifecyclePolicy `json:"policy,omitempty"`
+	Audit  *AuditEvent      `json:"audit,omitempty"`
+	Worker *WorkerRecord    `json:"worker,omitempty"`
+}
+
+// SnapshotCounts is the number of records exported or restored
+type SnapshotCounts struct {
+	Files       int `json:"files"`
+	Policies    int `json:"policies"`
+	AuditEvents int `json:"auditEvents"`
+	Workers     int `json:"workers"`
+	Retained    int `json:"retained,omitempty"` // Files not restored because the existing file is under retention or legal hold
+}
+
+// ChunkSidecar is the description workers keep next to every chunk, so file
+// metadata can be rebuilt from the workers alone. The sidecar of a pack chunk
+// also lists the small files appended to it.
+type ChunkSidecar struct {
+	Filename string       `json:"filename"`
+	Index    int          `json:"index"`
+	Size     int64        `json:"size"`
+	Checksum string       `json:"checksum"`
+	Members  []PackMember `json:"members,omitempty"`
+}
+
+// PackMember is a file appended to a pack chunk, as listed in its sidecar
+type PackMember struct {
+	Filename string    `json:"filename"`
+	Offset   int64     `json:"offset"`
+	Length   int64     `json:"length"`
+	PackedAt time.Time `json:"packedAt"`
+}
+
+// ExportMetadata writes a compressed snapshot of the whole metadata store
+func ExportMetadata(ctx context.Context, w io.Writer) (SnapshotCounts, error) {
+	var counts SnapshotCounts
+	compressed := gzip.NewWriter(w)
+	encoder := json.NewEncoder(compressed)
+
+	header := SnapshotHeader{Format: SnapshotFormat, Version: SnapshotVersion, CreatedAt: time.Now().UTC()}
+	if err := encoder.Encode(header); err != nil {
+		return counts, err
+	}
+
+	err := ForEachFileDocument(ctx, func(doc FileDocument) error {
+		counts.Files++
+		return encoder.Encode(snapshotEntry{Type: snapshotFile, File: &doc})
+	})
+	if err != nil {
+		return counts, fmt.Errorf("failed to export files: %v", err)
+	}
+
+	policies, err := GetLifecyclePolicies(ctx)
+	if err != nil {
+		return counts, fmt.Errorf("failed to export lifecycle policies: %v", err)
+	}
+	for i := range policies {
+		counts.Policies++
+		if err := encoder.Encode(snapshotEntry{Type: snapshotPolicy, Policy: &policies[i]}); err != nil {
+			return counts, err
+		}
+	}
+
+	// The audit log is written oldest first, so a restore appends it in order
+	events, err := GetAuditEvents(ctx, math.MaxInt64)
+	if err != nil {
+		return counts, fmt.Errorf("failed to export audit log: %v", err)
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		counts.AuditEvents++
+		if err := encoder.Encode(snapshotEntry{Type: snapshotAudit, Audit: &events[i]}); err != nil {
+			return counts, err
+		}
+	}
+
+	workers, err := metadata.LoadWorkerRecords(ctx)
+	if err != nil {
+		return counts, fmt.Errorf("failed to export worker registry: %v", err)
+	}
+	for i := range workers {
+		counts.Workers++
+		if err := encoder.Encode(snapshotEntry{Type: snapshotWorker, Worker: &workers[i]}); err != nil {
+			return counts, err
+		}
+	}
+
+	return counts, compressed.Close()
+}
+
+// RestoreMetadata loads a snapshot into the metadata store. Files, policies and
+// workers in the snapshot replace existing records with the same name; records
+// that are not in the snapshot are kept. Existing files under retention or legal
+// hold are not replaced, unless governance retention is bypassed, which is audited.
+// Audit events are only restored into an empty audit log, so restoring twice does
+// not duplicate them.
+func RestoreMetadata(ctx context.Context, r io.Reader, bypass *governanceBypass) (SnapshotCounts, error) {
+	var counts SnapshotCounts
+	compressed, err := gzip.NewReader(r)
+	if err != nil {
+		return counts, fmt.Errorf("not a compressed metadata snapshot: %v", err)
+	}
+	defer compressed.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(compressed))
+	var header SnapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return counts, fmt.Errorf("failed to read snapshot header: %v", err)
+	}
+	if header.Format != SnapshotFormat {
+		return counts, fmt.Errorf("not a metadata snapshot: format %q", header.Format)
+	}
+	if header.Version < 1 || header.Version > SnapshotVersion {
+		return counts, fmt.Errorf("unsupported snapshot version %d, this master reads up to version %d", header.Version, SnapshotVersion)
+	}
+
+	existingEvents, err := GetAuditEvents(ctx, 1)
+	if err != nil {
+		return counts, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	restoreAudit := len(existingEvents) == 0
+
+	for {
+		var entry snapshotEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return counts, fmt.Errorf("failed to read snapshot entry: %v", err)
+		}
+
+		switch {
+		case entry.Type == snapshotFile && entry.File != nil:
+			err = enforceRetention(ctx, entry.File.Filename, "restore", bypass)
+			if isRetentionError(err) {
+				slog.WarnContext(ctx, "Not restoring retained file", "filename", entry.File.Filename, "error", err)
+				counts.Retained++
+				continue
+			}
+			if err == nil {
+				err = metadata.PutFileDocument(ctx, *entry.File)
+				counts.Files++
+			}
+		case entry.Type == snapshotPolicy && entry.Policy != nil:
+			err = StoreLifecyclePolicy(ctx, *entry.Policy)
+			counts.Policies++
+		case entry.Type == snapshotAudit && entry.Audit != nil:
+			if !restoreAudit {
+				continue
+			}
+			err = StoreAuditEvent(ctx, *entry.Audit)
+			counts.AuditEvents++
+		case entry.Type == snapshotWorker && entry.Worker != nil:
+			err = metadata.StoreWorkerRecord(ctx, *entry.Worker)
+			counts.Workers++
+		default:
+			return counts, fmt.Errorf("invalid snapshot entry of type %q", entry.Type)
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+
+	slog.InfoContext(ctx, "Restored metadata snapshot", "createdAt", header.CreatedAt.Format(time.RFC3339),
+		"files", counts.Files, "retained", counts.Retained, "policies", counts.Policies, "auditEvents", counts.AuditEvents, "workers", counts.Workers)
+	return counts, nil
+}
+
+// RebuiltFile is a file whose metadata was reconstructed from chunk sidecars
+type RebuiltFile struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Chunks   int    `json:"chunks"`
+	Replicas int    `json:"replicas"`
+	Pack     string `json:"pack,omitempty"` // Pack the file was recovered from, if it was packed
+}
+
+// RebuildReport is the outcome of rebuilding metadata from a worker scan
+type RebuildReport struct {
+	StartedAt      time.Time     `json:"startedAt"`
+	DryRun         bool          `json:"dryRun"`
+	WorkersScanned int           `json:"workersScanned"`
+	Rebuilt        []RebuiltFile `json:"rebuilt"`
+	Existing       int           `json:"existing"`
+	Incomplete     []string      `json:"incomplete"`
+	Unidentified   int           `json:"unidentified"`
+	Errors         []string      `json:"errors,omitempty"`
+}
+
+// MetadataRecovery rebuilds file metadata from the chunk sidecars on the workers
+type MetadataRecovery struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+}
+
+func NewMetadataRecovery(wm *WorkerManager, cm *ChunkManager) *MetadataRecovery {
+	return &MetadataRecovery{
+		workerManager: wm,
+		chunkManager:  cm,
+	}
+}
+
+// Rebuild scans every registered worker and recreates the metadata of files that
+// are missing from the store. Files already in the store are left alone, and
+// files with a gap in their chunks are reported instead of rebuilt. Small files
+// are recovered from the member lists of their packs, as long as the pack itself
+// is. Tags, retention and legal holds are not kept in sidecars and cannot be
+// recovered, and neither can the deletion of a packed file whose pack was not
+// compacted yet.
+func (mr *MetadataRecovery) Rebuild(ctx context.Context, dryRun bool) (*RebuildReport, error) {
+	report := &RebuildReport{
+		StartedAt:  time.Now().UTC(),
+		DryRun:     dryRun,
+		Rebuilt:    []RebuiltFile{},
+		Incomplete: []string{},
+	}
+
+	workerIDs := make([]string, 0)
+	for id := range mr.workerManager.GetWorkers() {
+		workerIDs = append(workerIDs, id)
+	}
+	sort.Strings(workerIDs)
+
+	// Group the replicas found on the workers by file, upload and chunk index.
+	// Every upload of a file has its own chunk IDs, which only differ in the
+	// suffix of the chunk index. Sanitized filenames may contain the separator
+	// themselves, so the chunk ID is cut at its last one.
+	replicas := make(map[string]map[string]map[int][]ChunkRecord)
+	modTimes := make(map[string]map[string]time.Time)
+	// The places each small file was packed into, from the sidecars of the packs
+	packed := make(map[string]map[PackRef]time.Time)
+	for _, workerID := range workerIDs {
+		chunks, err := mr.chunkManager.listChunksOnWorker(workerID, true)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("worker %s: %v", workerID, err))
+			continue
+		}
+		report.WorkersScanned++
+
+		for _, chunk := range chunks {
+			if chunk.Sidecar == nil || chunk.Sidecar.Filename == "" {
+				report.Unidentified++
+				continue
+			}
+			sidecar := chunk.Sidecar
+			upload := chunk.ChunkID
+			if i := strings.LastIndex(upload, "_chunk_"); i >= 0 {
+				upload = upload[:i]
+			}
+			if replicas[sidecar.Filename] == nil {
+				replicas[sidecar.Filename] = make(map[string]map[int][]ChunkRecord)
+				modTimes[sidecar.Filename] = make(map[string]time.Time)
+			}
+			if replicas[sidecar.Filename][upload] == nil {
+				replicas[sidecar.Filename][upload] = make(map[int][]ChunkRecord)
+			}
+			byIndex := replicas[sidecar.Filename][upload]
+			byIndex[sidecar.Index] = append(byIndex[sidecar.Index], ChunkRecord{
+				ChunkID:  chunk.ChunkID,
+				WorkerID: workerID,
+				Index:    sidecar.Index,
+				Size:     sidecar.Size,
+				Checksum: sidecar.Checksum,
+			})
+			if chunk.ModTime.After(modTimes[sidecar.Filename][upload]) {
+				modTimes[sidecar.Filename][upload] = chunk.ModTime
+			}
+
+			if !isPackFile(sidecar.Filename) {
+				continue
+			}
+			packID := strings.TrimPrefix(sidecar.Filename, PackFilePrefix)
+			for _, member := range sidecar.Members {
+				if member.Offset+member.Length > sidecar.Size {
+					continue
+				}
+				if packed[member.Filename] == nil {
+					packed[member.Filename] = make(map[PackRef]time.Time)
+				}
+				packed[member.Filename][PackRef{PackID: packID, Offset: member.Offset, Length: member.Length}] = member.PackedAt
+			}
+		}
+	}
+
+	filenames := make([]string, 0, len(replicas)+len(packed))
+	for filename := range replicas {
+		filenames = append(filenames, filename)
+	}
+	for filename := range packed {
+		if replicas[filename] == nil {
+			filenames = append(filenames, filename)
+		}
+	}
+	// Packs go first, so the files packed into them know whether they were recovered
+	sort.Slice(filenames, func(i, j int) bool {
+		if isPackFile(filenames[i]) != isPackFile(filenames[j]) {
+			return isPackFile(filenames[i])
+		}
+		return filenames[i] < filenames[j]
+	})
+	recoveredPacks := make(map[string]bool)
+
+	for _, filename := range filenames {
+		_, err := metadata.GetFileDocument(ctx, filename)
+		if err == nil {
+			report.Existing++
+			recoveredPacks[filename] = true
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", filename, err))
+			continue
+		}
+
+		// The most recent complete upload wins
+		uploads := make([]string, 0, len(replicas[filename]))
+		for upload := range replicas[filename] {
+			uploads = append(uploads, upload)
+		}
+		sort.Slice(uploads, func(i, j int) bool {
+			return modTimes[filename][uploads[i]].After(modTimes[filename][uploads[j]])
+		})
+		var doc FileDocument
+		var upload string
+		complete := false
+		for _, upload = range uploads {
+			if doc, complete = rebuildFileDocument(filename, replicas[filename][upload]); complete {
+				doc.UploadedAt = modTimes[filename][upload].UTC()
+				break
+			}
+		}
+		chunks := len(replicas[filename][upload])
+
+		// A file packed after its last complete upload was small the last time
+		for ref, packedAt := range packed[filename] {
+			if !recoveredPacks[packFilename(ref.PackID)] || (complete && !packedAt.After(doc.UploadedAt)) {
+				continue
+			}
+			doc = FileDocument{
+				FileInfo: FileInfo{Filename: filename, Size: ref.Length, UploadedAt: packedAt.UTC()},
+				Chunks:   []ChunkRecord{},
+				Pack:     &ref,
+			}
+			chunks = 0
+			complete = true
+		}
+		if !complete {
+			report.Incomplete = append(report.Incomplete, filename)
+			continue
+		}
+
+		if !dryRun {
+			if err := metadata.PutFileDocument(ctx, doc); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", filename, err))
+				continue
+			}
+		}
+		if isPackFile(filename) {
+			recoveredPacks[filename] = true
+		}
+		rebuilt := RebuiltFile{Filename: filename, Size: doc.Size, Chunks: chunks, Replicas: len(doc.Chunks)}
+		if doc.Pack != nil {
+			rebuilt.Pack = doc.Pack.PackID
+		}
+		report.Rebuilt = append(report.Rebuilt, rebuilt)
+	}
+
+	slog.InfoContext(ctx, "Metadata rebuild finished", "workers", report.WorkersScanned, "rebuilt", len(report.Rebuilt),
+		"incomplete", len(report.Incomplete), "existing", report.Existing, "dryRun", dryRun)
+	return report, nil
+}
+
+// rebuildFileDocument assembles a file document from its chunk replicas. The
+// file is complete if the indices have no gap and every chunk but the last is as
+// large as the first. The chunk size in effect at upload time is not recorded, so
+// the first chunk stands in for it. Replicas that disagree with the first replica
+// of their index are dropped.
+func rebuildFileDocument(filename string, byIndex map[int][]ChunkRecord) (FileDocument, bool) {
+	doc := FileDocument{FileInfo: FileInfo{Filename: filename}, Chunks: []ChunkRecord{}}
+	var chunkSize int64
+	for index := 0; index < len(byIndex); index++ {
+		records, ok := byIndex[index]
+		if !ok {
+			return doc, false
+		}
+		if index == 0 {
+			chunkSize = records[0].Size
+		}
+		if records[0].Size > chunkSize || (index < len(byIndex)-1 && records[0].Size != chunkSize) {
+			return doc, false
+		}
+
+		for _, record := range records {
+			if record.Checksum == records[0].Checksum && record.Size == records[0].Size {
+				doc.Chunks = append(doc.Chunks, record)
+			}
+		}
+		doc.Size += records[0].Size
+	}
+	return doc, true
+}
+
+func (mr *MetadataRecovery) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	report, err := mr.Rebuild(ctx, dryRun)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeJSONResponse(w, report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode rebuild report", "error", err)
+	}
+}
+
+// handleExport streams a metadata snapshot to the client
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	filename := fmt.Sprintf("frostbyte-metadata-%s.jsonl.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	counts, err := ExportMetadata(ctx, w)
+	if err != nil {
+		// The headers are already sent, so the client sees a truncated snapshot
+		slog.ErrorContext(r.Context(), "Metadata export failed", "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Exported metadata snapshot", "files", counts.Files, "policies", counts.Policies,
+		"auditEvents", counts.AuditEvents, "workers", counts.Workers)
+}
+
+// handleRestore loads a metadata snapshot from the request body
+func (mr *MetadataRecovery) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	bypass, err := bypassFromRequest(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	counts, err := RestoreMetadata(ctx, r.Body, bypass)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Restored workers take effect right away
+	if err := mr.workerManager.LoadRegistry(ctx); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to reload worker registry after restore", "error", err)
+	}
+	if err := writeJSONResponse(w, counts); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode restore result", "error", err)
+	}
+}
+
+// openCommandStore opens the metadata store for a subcommand. A Raft group member
+// cannot be opened next to the running master, so commands need MongoDB.
+func openCommandStore(command string) error {
+	if MetadataBackend != MetadataBackendMongo {
+		return fmt.Errorf("%s needs the %s metadata backend, use the admin API on the leader instead", command, MetadataBackendMongo)
+	}
+	store, err := openMetadataStore()
+	if err != nil {
+		return err
+	}
+	metadata = store
+	return nil
+}
+
+// runExportCommand implements the "export" subcommand
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "snapshot file to write (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := openCommandStore("export"); err != nil {
+		slog.Error("Export failed", "error", err)
+		return 1
+	}
+	defer metadata.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			slog.Error("Export failed", "error", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	counts, err := ExportMetadata(ctx, w)
+	if err != nil {
+		slog.Error("Export failed", "error", err)
+		return 1
+	}
+	slog.Info("Exported metadata snapshot", "files", counts.Files, "policies", counts.Policies,
+		"auditEvents", counts.AuditEvents, "workers", counts.Workers)
+	return 0
+}
+
+// runRestoreCommand implements the "restore" subcommand
+func runRestoreCommand(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := flags.String("i", "", "snapshot file to read (default stdin)")
+	bypassGovernance := flags.Bool("bypass-governance", false, "replace files under governance retention, recorded in the audit log")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := openCommandStore("restore"); err != nil {
+		slog.Error("Restore failed", "error", err)
+		return 1
+	}
+	defer metadata.Close()
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			slog.Error("Restore failed", "error", err)
+			return 1
+		}
+		defer file.Close()
+		r = file
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	var bypass *governanceBypass
+	if *bypassGovernance {
+		hostname, _ := os.Hostname()
+		bypass = &governanceBypass{Actor: "restore-command@" + hostname}
+	}
+	if _, err := RestoreMetadata(ctx, r, bypass); err != nil {
+		slog.Error("Restore failed", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// snapshotEntries exports the metadata and returns the entries of the snapshot, sorted
+func snapshotEntries(t *testing.T) []string {
+	t.Helper()
+	var snapshot bytes.Buffer
+	_, err := ExportMetadata(testContext(t), &snapshot)
+	must(t, err)
+	compressed, err := gzip.NewReader(&snapshot)
+	must(t, err)
+
+	var entries []string
+	lines := bufio.NewScanner(compressed)
+	lines.Scan() // The header holds the time of the export
+	for lines.Scan() {
+		entries = append(entries, lines.Text())
+	}
+	must(t, lines.Err())
+	slices.Sort(entries)
+	return entries
+}
+
+func TestMetadataSnapshotRoundTrip(t *testing.T) {
+	store := useTestMetadata(t)
+	ctx := testContext(t)
+	must(t, store.StoreFileMetadata(ctx, FileInfo{Filename: "a", Size: 3, Tags: []string{"logs"}, UploadedAt: time.Now().UTC()}))
+	must(t, store.AddChunkRecord(ctx, "a", ChunkRecord{ChunkID: "a_chunk_00000000", WorkerID: "w1", Size: 3, Checksum: chunkChecksum([]byte("abc"))}))
+	must(t, UpdateFileRetention(ctx, "a", RetentionCompliance, time.Now().Add(time.Hour).UTC()))
+	must(t, UpdateFileLegalHold(ctx, "a", true))
+	must(t, StoreLifecyclePolicy(ctx, LifecyclePolicy{ID: "logs", Tag: "logs", ExpireAfterDays: 30}))
+	must(t, StoreAuditEvent(ctx, AuditEvent{Time: time.Now().UTC(), Action: "delete", Filename: "b", Actor: "admin@192.0.2.1:4000"}))
+	must(t, StoreWorkerRecord(ctx, Worker{ID: "w1", Address: "192.0.2.1:8081", State: WorkerStateDraining, Topology: Topology{Zone: "a"}}))
+	want := snapshotEntries(t)
+
+	var snapshot bytes.Buffer
+	exported, err := ExportMetadata(ctx, &snapshot)
+	must(t, err)
+	if exported != (SnapshotCounts{Files: 1, Policies: 1, AuditEvents: 1, Workers: 1}) {
+		t.Fatalf("exported %+v", exported)
+	}
+
+	// Restore into an empty store, twice
+	useTestMetadata(t)
+	for range 2 {
+		_, err := RestoreMetadata(testContext(t), bytes.NewReader(snapshot.Bytes()), nil)
+		must(t, err)
+	}
+	if got := snapshotEntries(t); !slices.Equal(got, want) {
+		t.Fatalf("restored metadata differs:\n got %q\nwant %q", got, want)
+	}
+
+	if _, err := RestoreMetadata(testContext(t), bytes.NewReader([]byte("not a snapshot")), nil); err == nil {
+		t.Fatal("restoring garbage succeeded")
+	}
+}
+
+func TestRestoreKeepsRetainedFiles(t *testing.T) {
+	store := useTestMetadata(t)
+	ctx := testContext(t)
+	for _, filename := range []string{"governed", "complied", "free"} {
+		must(t, store.StoreFileMetadata(ctx, FileInfo{Filename: filename, Size: 1}))
+	}
+	var snapshot bytes.Buffer
+	_, err := ExportMetadata(ctx, &snapshot)
+	must(t, err)
+
+	// The files were replaced after the snapshot, and two of them are retained
+	store = useTestMetadata(t)
+	ctx = testContext(t)
+	for _, filename := range []string{"governed", "complied", "free"} {
+		must(t, store.StoreFileMetadata(ctx, FileInfo{Filename: filename, Size: 2}))
+	}
+	retainUntil := time.Now().Add(time.Hour).UTC()
+	must(t, UpdateFileRetention(ctx, "governed", RetentionGovernance, retainUntil))
+	must(t, UpdateFileRetention(ctx, "complied", RetentionCompliance, retainUntil))
+
+	sizes := func() map[string]int64 {
+		result := make(map[string]int64)
+		for _, filename := range []string{"governed", "complied", "free"} {
+			file, err := GetFileInfo(ctx, filename)
+			must(t, err)
+			result[filename] = file.Size
+		}
+		return result
+	}
+
+	counts, err := RestoreMetadata(ctx, bytes.NewReader(snapshot.Bytes()), nil)
+	must(t, err)
+	if counts.Files != 1 || counts.Retained != 2 {
+		t.Fatalf("restore without bypass: %+v", counts)
+	}
+	if got := sizes(); got["governed"] != 2 || got["complied"] != 2 || got["free"] != 1 {
+		t.Fatalf("restore without bypass replaced retained files: %v", got)
+	}
+
+	counts, err = RestoreMetadata(ctx, bytes.NewReader(snapshot.Bytes()), &governanceBypass{Actor: "admin@192.0.2.1:4000"})
+	must(t, err)
+	if counts.Files != 2 || counts.Retained != 1 {
+		t.Fatalf("restore with bypass: %+v", counts)
+	}
+	if got := sizes(); got["governed"] != 1 || got["complied"] != 2 {
+		t.Fatalf("restore with bypass: %v", got)
+	}
+	events, err := GetAuditEvents(ctx, 10)
+	must(t, err)
+	if len(events) != 1 || events[0].Action != "restore" || events[0].Filename != "governed" {
+		t.Fatalf("audit log after bypass: %+v", events)
+	}
+}
+
+func TestRebuildMetadataFromSidecars(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 2)
+	previousChunkSize, previousReplication := ChunkSize, ReplicationFactor
+	ChunkSize, ReplicationFactor = 4, 2
+	t.Cleanup(func() { ChunkSize, ReplicationFactor = previousChunkSize, previousReplication })
+	fo := NewFileOperations(wm)
+	ctx := testContext(t)
+
+	upload := func(filename, data string) {
+		params := url.Values{"filename": {filename}, "size": {strconv.Itoa(len(data))}}
+		w := httptest.NewRecorder()
+		fo.uploadFile(w, httptest.NewRequest(http.MethodPost, "/upload?"+params.Encode(), bytes.NewReader([]byte(data))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload of %s returned %d: %s", filename, w.Code, w.Body)
+		}
+	}
+	upload("kept", "0123456789")
+	upload("lost", "abcdefgh")
+	upload("untouched", "xyz")
+	// The chunk ID separator in a filename does not mix up the uploads of the file
+	upload("x_chunk_y", "abcdefghij")
+	upload("x_chunk_y", "0123456")
+
+	// The metadata of two files is lost, and one of them also lost its first chunk on every worker
+	for _, filename := range []string{"kept", "lost", "x_chunk_y"} {
+		doc, err := GetFileDocument(ctx, filename)
+		must(t, err)
+		if filename == "lost" {
+			for _, record := range doc.Chunks {
+				if record.Index == 0 {
+					workers[0].drop(record.ChunkID)
+					workers[1].drop(record.ChunkID)
+				}
+			}
+		}
+		must(t, DeleteFileMetadata(ctx, filename))
+	}
+
+	// Files written before a change of the chunk size can still be rebuilt
+	ChunkSize = 3
+	mr := NewMetadataRecovery(wm, cm)
+	report, err := mr.Rebuild(ctx, true)
+	must(t, err)
+	if len(report.Rebuilt) != 2 || report.Rebuilt[0] != (RebuiltFile{Filename: "kept", Size: 10, Chunks: 3, Replicas: 6}) ||
+		report.Rebuilt[1] != (RebuiltFile{Filename: "x_chunk_y", Size: 7, Chunks: 2, Replicas: 4}) ||
+		!slices.Equal(report.Incomplete, []string{"lost"}) || report.Existing != 1 {
+		t.Fatalf("dry run report: %+v", report)
+	}
+	if _, err := GetFileDocument(ctx, "kept"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("dry run wrote metadata: %v", err)
+	}
+
+	_, err = mr.Rebuild(ctx, false)
+	must(t, err)
+	w := httptest.NewRecorder()
+	fo.downloadFile(w, httptest.NewRequest(http.MethodGet, "/download/kept", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("download of the rebuilt file returned %d: %q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	fo.downloadFile(w, httptest.NewRequest(http.MethodGet, "/download/x_chunk_y", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "0123456" {
+		t.Fatalf("download of the rebuilt file with a separator in its name returned %d: %q", w.Code, w.Body)
+	}
+}
+
+func TestRebuildPackedFilesFromPackSidecars(t *testing.T) {
+	wm, cm, _ := newTestCluster(t, 2)
+	previousThreshold, previousSize, previousReplication := PackThreshold, PackSize, ReplicationFactor
+	PackThreshold, PackSize, ReplicationFactor = 100, 30, 2
+	t.Cleanup(func() {
+		PackThreshold, PackSize, ReplicationFactor = previousThreshold, previousSize, previousReplication
+	})
+	fo := NewFileOperations(wm)
+	ctx := testContext(t)
+
+	upload := func(filename, data string) string {
+		params := url.Values{"filename": {filename}, "size": {strconv.Itoa(len(data))}}
+		w := httptest.NewRecorder()
+		fo.uploadFile(w, httptest.NewRequest(http.MethodPost, "/upload?"+params.Encode(), bytes.NewReader([]byte(data))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload of %s returned %d: %s", filename, w.Code, w.Body)
+		}
+		doc, err := GetFileDocument(ctx, filename)
+		must(t, err)
+		return doc.Pack.PackID
+	}
+	pack := upload("a", "first-a..\n")
+	upload("b", "only-b...\n")
+	if upload("a", "second-a.\n") != pack {
+		t.Fatal("the files were not packed together")
+	}
+
+	// All metadata is lost, including that of the pack
+	for _, filename := range []string{"a", "b", packFilename(pack)} {
+		must(t, DeleteFileMetadata(ctx, filename))
+	}
+
+	report, err := NewMetadataRecovery(wm, cm).Rebuild(ctx, false)
+	must(t, err)
+	want := []RebuiltFile{
+		{Filename: packFilename(pack), Size: 30, Chunks: 1, Replicas: 2},
+		{Filename: "a", Size: 10, Pack: pack},
+		{Filename: "b", Size: 10, Pack: pack},
+	}
+	if !slices.Equal(report.Rebuilt, want) || len(report.Incomplete) != 0 {
+		t.Fatalf("rebuild report: %+v", report)
+	}
+
+	for filename, content := range map[string]string{"a": "second-a.\n", "b": "only-b...\n"} {
+		w := httptest.NewRecorder()
+		fo.downloadFile(w, httptest.NewRequest(http.MethodGet, "/download/"+filename, nil))
+		if w.Code != http.StatusOK || w.Body.String() != content {
+			t.Fatalf("download of rebuilt packed file %s returned %d: %q", filename, w.Code, w.Body)
+		}
+	}
+}
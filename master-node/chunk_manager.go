@@ -2,25 +2,33 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 // HTTP client with connection pooling for better performance
 var httpClient = &http.Client{
-	Timeout: NetworkTimeout,
-	Transport: &http.Transport{
+	Timeout: DefaultNetworkTimeout,
+	Transport: tracedTransport(propagateRequestID{&http.Transport{
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
 		IdleConnTimeout:     30 * time.Second,
-	},
+	}}),
 }
 
+// downloadClient streams chunks from workers to clients. It shares the connection
+// pool of httpClient but has no overall timeout, since a slow client keeps the
+// worker response open for as long as it takes to read it.
+var downloadClient = &http.Client{Transport: httpClient.Transport}
+
 // ChunkManager handles all chunk-related operations
 type ChunkManager struct {
 	workerManager *WorkerManager
@@ -34,12 +42,26 @@ func NewChunkManager(wm *WorkerManager, maxConcurrent int) *ChunkManager {
 	}
 }
 
+// Workers reject chunk IDs longer than 200 bytes. Sanitizing keeps the length of
+// a filename, so longer filenames would fail once their first chunk is stored.
+const (
+	maxChunkIDLength  = 200
+	MaxFilenameLength = maxChunkIDLength - len("_0123456789abcdef_chunk_00000000")
+)
+
 // Chunk ID generation with improved sanitization
 func (cm *ChunkManager) generateChunkID(filename string, chunkIndex int) string {
 	safeFilename := cm.sanitizeFilename(filename)
 	return fmt.Sprintf("%s_chunk_%08d", safeFilename, chunkIndex) // 8 digits for better sorting
 }
 
+// generateVersionChunkID names a chunk of one upload of a file. Every upload has
+// its own chunk IDs, so a re-upload never overwrites the chunks of the version
+// it replaces.
+func (cm *ChunkManager) generateVersionChunkID(filename, version string, chunkIndex int) string {
+	return cm.generateChunkID(filename+"_"+version, chunkIndex)
+}
+
 func (cm *ChunkManager) sanitizeFilename(filename string) string {
 	replacements := map[string]string{
 		".": "_", " ": "_", "/": "_", "\\": "_", ":": "_",
@@ -53,122 +75,336 @@ func (cm *ChunkManager) sanitizeFilename(filename string) string {
 	return result
 }
 
-// Upload chunks in parallel with improved error handling
-func (cm *ChunkManager) UploadChunks(filename string, chunks [][]byte) error {
-	var wg sync.WaitGroup
-	errors := make(chan error, len(chunks))
-	semaphore := make(chan struct{}, cm.maxConcurrent)
+// storeChunkOnWorker uploads chunk data to a worker without touching metadata
+func (cm *ChunkManager) storeChunkOnWorker(ctx context.Context, workerID, filename, chunkID string, chunkIndex int, chunkData []byte) (record ChunkRecord, err error) {
+	defer cm.workerManager.beginTransfer(workerID)()
+	ctx, span := startSpan(ctx, "store chunk", chunkAttributes(workerID, chunkID)...)
+	defer func(start time.Time) {
+		observeChunkTransfer(chunkStoreDuration, errorChunkStore, workerID, start, err)
+		endSpan(span, err)
+	}(time.Now())
 
-	for i, chunk := range chunks {
-		wg.Add(1)
-		go func(chunkData []byte, chunkIndex int) {
-			defer wg.Done()
+	resp, err := tracedPost(ctx, httpClient,
+		chunkStoreURL(cm.workerManager.workerAddress(workerID), "/store", filename, chunkID, chunkIndex),
+		ContentTypeOctetStream,
+		bytes.NewReader(chunkData),
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send chunk to worker", "chunk", chunkID, "worker", workerID, "error", err)
+		return ChunkRecord{}, fmt.Errorf("failed to send chunk to worker %s: %v", workerID, err)
+	}
+	defer resp.Body.Close()
 
-			// Acquire semaphore
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+	if resp.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "Worker failed to store chunk", "chunk", chunkID, "worker", workerID, "status", resp.Status)
+		return ChunkRecord{}, fmt.Errorf("worker %s returned error: %s", workerID, resp.Status)
+	}
 
-			workerID := cm.workerManager.SelectWorker()
-			if workerID == "" {
-				errors <- fmt.Errorf("no available workers")
-				return
-			}
+	return chunkRecordFromResponse(resp, chunkID, workerID, chunkIndex), nil
+}
 
-			err := cm.sendChunkToWorker(filename, workerID, chunkData, chunkIndex)
-			if err != nil {
-				errors <- fmt.Errorf("failed to send chunk to worker %s: %v", workerID, err)
-				return
-			}
-		}(chunk, i)
+// appendChunkOnWorker appends the data of the member file to a pack chunk on a
+// worker that holds offset bytes of it, or creates the chunk when offset is 0.
+// The returned record describes the whole chunk after the append.
+func (cm *ChunkManager) appendChunkOnWorker(ctx context.Context, workerID, filename, chunkID string, offset int64, data []byte, member string) (record ChunkRecord, err error) {
+	defer cm.workerManager.beginTransfer(workerID)()
+	ctx, span := startSpan(ctx, "append chunk", chunkAttributes(workerID, chunkID)...)
+	defer func(start time.Time) {
+		observeChunkTransfer(chunkStoreDuration, errorChunkStore, workerID, start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	// The member is the file being appended, which the worker lists in the sidecar of the pack
+	appendURL := chunkStoreURL(cm.workerManager.workerAddress(workerID), "/append", filename, chunkID, 0)
+	appendURL += "&offset=" + strconv.FormatInt(offset, 10) + "&member=" + url.QueryEscape(member)
+	resp, err := tracedPost(ctx, httpClient, appendURL, ContentTypeOctetStream, bytes.NewReader(data))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to append to chunk on worker", "chunk", chunkID, "worker", workerID, "error", err)
+		return ChunkRecord{}, fmt.Errorf("failed to append to chunk on worker %s: %v", workerID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "Worker failed to append to chunk", "chunk", chunkID, "worker", workerID, "offset", offset, "status", resp.Status)
+		return ChunkRecord{}, fmt.Errorf("worker %s returned error: %s", workerID, resp.Status)
 	}
 
-	wg.Wait()
-	close(errors)
+	return chunkRecordFromResponse(resp, chunkID, workerID, 0), nil
+}
 
-	// Collect and return errors
-	var uploadErrors []string
-	for err := range errors {
-		uploadErrors = append(uploadErrors, err.Error())
+// moveChunk copies one chunk replica to another worker, points its metadata
+// record at the new worker and then removes the old copy. If the file changed
+// while the chunk was being copied, the copy is discarded and errChunkMoveStale is returned.
+func (cm *ChunkManager) moveChunk(ctx context.Context, filename string, record ChunkRecord, targetWorkerID string) error {
+	if err := cm.replaceReplica(ctx, filename, record, record.WorkerID, targetWorkerID); err != nil {
+		return err
 	}
 
-	if len(uploadErrors) > 0 {
-		return fmt.Errorf("upload failed: %v", uploadErrors)
+	if err := cm.deleteChunkFromWorker(ctx, record.WorkerID, record.ChunkID); err != nil {
+		// The metadata no longer references the old copy, so GC will collect it
+		slog.WarnContext(ctx, "Moved chunk but failed to remove the old copy", "chunk", record.ChunkID, "worker", record.WorkerID, "error", err)
 	}
 
+	slog.InfoContext(ctx, "Moved chunk", "chunk", record.ChunkID, "filename", filename, "from", record.WorkerID, "to", targetWorkerID)
 	return nil
 }
 
-func (cm *ChunkManager) sendChunkToWorker(filename string, workerID string, chunkData []byte, chunkIndex int) error {
-	chunkID := cm.generateChunkID(filename, chunkIndex)
-	resp, err := httpClient.Post(
-		fmt.Sprintf("http://%s:%s/store?chunkID=%s", workerID, DefaultWorkerPort, chunkID),
-		ContentTypeOctetStream,
-		bytes.NewReader(chunkData),
-	)
+// replaceReplica copies a chunk from sourceWorkerID to targetWorkerID and points
+// record at the copy. The source may be the worker of record or another replica.
+// If the file changed while the chunk was being copied, the copy is discarded and
+// errChunkMoveStale is returned.
+func (cm *ChunkManager) replaceReplica(ctx context.Context, filename string, record ChunkRecord, sourceWorkerID, targetWorkerID string) error {
+	data, err := cm.fetchChunkFromWorker(ctx, sourceWorkerID, record.ChunkID)
 	if err != nil {
-		log.Printf("Failed to send chunk to worker %s: %v", workerID, err)
-		return fmt.Errorf("failed to send chunk to worker %s: %v", workerID, err)
+		return fmt.Errorf("failed to read chunk %s from worker %s: %v", record.ChunkID, sourceWorkerID, err)
+	}
+
+	copied, err := cm.storeChunkOnWorker(ctx, targetWorkerID, filename, record.ChunkID, record.Index, data)
+	if err != nil {
+		return err
+	}
+	if record.Checksum != "" && copied.Checksum != record.Checksum {
+		cm.deleteChunkFromWorker(ctx, targetWorkerID, record.ChunkID)
+		return fmt.Errorf("checksum mismatch after copying chunk %s to worker %s", record.ChunkID, targetWorkerID)
+	}
+
+	err = ReplaceChunkRecord(ctx, filename, record, copied)
+	if err != nil {
+		cm.deleteChunkFromWorker(ctx, targetWorkerID, record.ChunkID)
+		return err
+	}
+	return nil
+}
+
+// chunkStoreURL builds the URL of a worker's store endpoint. The filename and
+// index let the worker write a sidecar, from which metadata can be rebuilt.
+func chunkStoreURL(address, endpoint, filename, chunkID string, chunkIndex int) string {
+	params := url.Values{}
+	params.Set("chunkID", chunkID)
+	params.Set("filename", filename)
+	params.Set("index", strconv.Itoa(chunkIndex))
+	return fmt.Sprintf("http://%s%s?%s", address, endpoint, params.Encode())
+}
+
+// chunkRecordFromResponse builds the metadata record of a chunk from the
+// checksum and size the worker reported after storing it
+func chunkRecordFromResponse(resp *http.Response, chunkID, workerID string, chunkIndex int) ChunkRecord {
+	size, _ := strconv.ParseInt(resp.Header.Get(ChunkSizeHeader), 10, 64)
+	return ChunkRecord{
+		ChunkID:  chunkID,
+		WorkerID: workerID,
+		Index:    chunkIndex,
+		Size:     size,
+		Checksum: resp.Header.Get(ChunkChecksumHeader),
+	}
+}
+
+// fetchChunkFromWorker reads a whole chunk from a worker into memory
+func (cm *ChunkManager) fetchChunkFromWorker(ctx context.Context, workerID, chunkID string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, NetworkTimeout)
+	defer cancel()
+
+	var data bytes.Buffer
+	if _, err := cm.streamChunkFromWorker(ctx, &data, workerID, chunkID, 0, -1); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// copyChunk streams a chunk to w from the first replica that serves it. When a
+// worker fails midway, the next replica continues from the bytes already written.
+// Once every replica has failed, up to retries more rounds are made after a pause.
+// Errors writing to w are returned right away, since no replica can fix them.
+func (cm *ChunkManager) copyChunk(ctx context.Context, w io.Writer, chunkID string, workerIDs []string, retries int) (int64, error) {
+	return cm.copyChunkRange(ctx, w, chunkID, workerIDs, 0, -1, retries)
+}
+
+// copyChunkRange is copyChunk for length bytes of a chunk starting at offset, or
+// for the rest of the chunk if length is negative
+func (cm *ChunkManager) copyChunkRange(ctx context.Context, w io.Writer, chunkID string, workerIDs []string, offset, length int64, retries int) (int64, error) {
+	dst := &recordingWriter{writer: w}
+	var copied int64
+	err := fmt.Errorf("chunk %s has no replicas", chunkID)
+	for round := 0; round <= retries && len(workerIDs) > 0; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+				return copied, ctx.Err()
+			case <-time.After(time.Duration(round) * chunkRetryBackoff):
+			}
+		}
+		for _, workerID := range workerIDs {
+			remaining := int64(-1)
+			if length >= 0 {
+				remaining = length - copied
+			}
+			var n int64
+			n, err = cm.streamChunkFromWorker(ctx, dst, workerID, chunkID, offset+copied, remaining)
+			copied += n
+			if dst.err != nil {
+				return copied, dst.err
+			}
+			if err == nil {
+				return copied, nil
+			}
+			slog.WarnContext(ctx, "Failed to stream chunk, trying next replica", "chunk", chunkID, "worker", workerID, "offset", offset+copied, "round", round, "error", err)
+		}
+	}
+	return copied, err
+}
+
+// chunkRetryBackoff is the pause before the first retry of a chunk whose replicas
+// all failed; later retries wait proportionally longer
+const chunkRetryBackoff = 200 * time.Millisecond
+
+// streamChunkFromWorker copies a chunk from a worker to w, starting at offset. It
+// copies length bytes, or the rest of the chunk if length is negative.
+func (cm *ChunkManager) streamChunkFromWorker(ctx context.Context, w io.Writer, workerID, chunkID string, offset, length int64) (written int64, err error) {
+	ctx, span := startSpan(ctx, "fetch chunk", chunkAttributes(workerID, chunkID)...)
+	defer func(start time.Time) {
+		observeChunkTransfer(chunkFetchDuration, errorChunkFetch, workerID, start, err)
+		endSpan(span, err)
+	}(time.Now())
+
+	params := url.Values{}
+	params.Set("chunkID", chunkID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/get?%s", cm.workerManager.workerAddress(workerID), params.Encode()), nil)
+	if err != nil {
+		return 0, err
+	}
+	ranged := offset > 0 || length >= 0
+	switch {
+	case length == 0:
+		return 0, nil
+	case length > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to fetch chunk from worker", "chunk", chunkID, "worker", workerID, "error", err)
+		return 0, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Worker %s returned error: %s", workerID, resp.Status)
-		return fmt.Errorf("worker %s returned error: %s", workerID, resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && ranged:
+	case resp.StatusCode == http.StatusOK:
+		// The worker ignored the range, so skip what was already written
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return 0, fmt.Errorf("failed to skip to offset %d: %v", offset, err)
+		}
+	default:
+		slog.WarnContext(ctx, "Worker failed to return chunk", "chunk", chunkID, "worker", workerID, "status", resp.Status)
+		return 0, fmt.Errorf("failed to fetch chunk: %s", resp.Status)
 	}
 
-	// Store the chunk information in the database
-	err = storeChunkInDB(filename, chunkID, workerID)
+	if length < 0 {
+		written, err = io.Copy(w, resp.Body)
+	} else {
+		written, err = io.CopyN(w, resp.Body, length)
+	}
 	if err != nil {
-		log.Printf("Failed to store chunk in database: %v", err)
-		return fmt.Errorf("failed to store chunk in database: %v", err)
+		return written, err
 	}
 
-	log.Printf("Chunk %s sent to worker %s", chunkID, workerID)
-	return nil
+	slog.DebugContext(ctx, "Chunk fetched from worker", "chunk", chunkID, "worker", workerID, "bytes", written)
+	return written, nil
+}
+
+// recordingWriter remembers the first error of the writer it wraps, so copy
+// errors can be told apart from read errors
+type recordingWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	n, err := r.writer.Write(p)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
 }
 
-func (cm *ChunkManager) fetchChunkFromWorker(workerID, chunkID string) ([]byte, error) {
-	resp, err := httpClient.Get(fmt.Sprintf("http://%s:%s/get?chunkID=%s", workerID, DefaultWorkerPort, chunkID))
+// statChunkOnWorker asks a worker whether it holds a chunk, optionally computing its checksum
+func (cm *ChunkManager) statChunkOnWorker(workerID, chunkID string, withChecksum bool) (*ChunkStat, error) {
+	params := url.Values{}
+	params.Set("chunkID", chunkID)
+	params.Set("checksum", strconv.FormatBool(withChecksum))
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/stat?%s", cm.workerManager.workerAddress(workerID), params.Encode()))
 	if err != nil {
-		log.Printf("Failed to fetch chunk %s from worker %s: %v", chunkID, workerID, err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Worker %s returned error for chunk %s: %s", workerID, chunkID, resp.Status)
-		return nil, fmt.Errorf("failed to fetch chunk: %s", resp.Status)
+		return nil, fmt.Errorf("failed to stat chunk: %s", resp.Status)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	var stat ChunkStat
+	if err := json.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		return nil, fmt.Errorf("failed to decode chunk stat from worker %s: %v", workerID, err)
+	}
+	return &stat, nil
+}
+
+// listChunksOnWorker returns every chunk stored on a worker, optionally with the sidecar of each chunk
+func (cm *ChunkManager) listChunksOnWorker(workerID string, withSidecars bool) ([]WorkerChunk, error) {
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/chunks?sidecars=%t", cm.workerManager.workerAddress(workerID), withSidecars))
 	if err != nil {
-		log.Printf("Failed to read chunk data from worker %s: %v", workerID, err)
+		slog.Warn("Failed to list chunks on worker", "worker", workerID, "error", err)
 		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Worker failed to list chunks", "worker", workerID, "status", resp.Status)
+		return nil, fmt.Errorf("failed to list chunks: %s", resp.Status)
+	}
 
-	log.Printf("Chunk %s fetched from worker %s", chunkID, workerID)
-	return data, nil
+	var chunks []WorkerChunk
+	if err := json.NewDecoder(resp.Body).Decode(&chunks); err != nil {
+		return nil, fmt.Errorf("failed to decode chunk list from worker %s: %v", workerID, err)
+	}
+	return chunks, nil
 }
 
-func (cm *ChunkManager) deleteChunkFromWorker(workerID, chunkID string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:%s/delete?chunkID=%s", workerID, DefaultWorkerPort, chunkID), nil)
+func (cm *ChunkManager) deleteChunkFromWorker(ctx context.Context, workerID, chunkID string) (err error) {
+	ctx, span := startSpan(ctx, "delete chunk", chunkAttributes(workerID, chunkID)...)
+	defer func() {
+		if err != nil {
+			errorsTotal.WithLabelValues(errorChunkDelete).Inc()
+		}
+		endSpan(span, err)
+	}()
+
+	params := url.Values{}
+	params.Set("chunkID", chunkID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("http://%s/delete?%s", cm.workerManager.workerAddress(workerID), params.Encode()), nil)
 	if err != nil {
-		log.Printf("Failed to create DELETE request for chunk %s: %v", chunkID, err)
+		slog.ErrorContext(ctx, "Failed to create chunk delete request", "chunk", chunkID, "error", err)
 		return err
 	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Printf("Failed to send DELETE request for chunk %s to worker %s: %v", chunkID, workerID, err)
+		slog.WarnContext(ctx, "Failed to delete chunk on worker", "chunk", chunkID, "worker", workerID, "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 
+	// A replica that is already gone needs no deleting
+	if resp.StatusCode == http.StatusNotFound {
+		slog.DebugContext(ctx, "Chunk already missing on worker", "chunk", chunkID, "worker", workerID)
+		return nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Worker %s returned error for DELETE chunk %s: %s", workerID, chunkID, resp.Status)
+		slog.WarnContext(ctx, "Worker failed to delete chunk", "chunk", chunkID, "worker", workerID, "status", resp.Status)
 		return fmt.Errorf("failed to delete chunk: %s", resp.Status)
 	}
 
-	log.Printf("Chunk %s deleted from worker %s", chunkID, workerID)
+	slog.DebugContext(ctx, "Chunk deleted from worker", "chunk", chunkID, "worker", workerID)
 	return nil
 }
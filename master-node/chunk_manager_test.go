@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWorker serves the chunk API of a worker from memory
+type fakeWorker struct {
+	id     string
+	server *httptest.Server
+
+	mu       sync.Mutex
+	chunks   map[string][]byte
+	sidecars map[string]ChunkSidecar
+	modTimes map[string]time.Time
+	failing  bool // Every request fails with 503
+}
+
+// startFakeWorker starts a worker and registers it with wm
+func startFakeWorker(t *testing.T, wm *WorkerManager, id string, topology Topology) *fakeWorker {
+	t.Helper()
+	fw := &fakeWorker{
+		id:       id,
+		chunks:   make(map[string][]byte),
+		sidecars: make(map[string]ChunkSidecar),
+		modTimes: make(map[string]time.Time),
+	}
+	fw.server = httptest.NewServer(fw)
+	t.Cleanup(fw.server.Close)
+	wm.AddWorker(id, Worker{ID: id, Address: strings.TrimPrefix(fw.server.URL, "http://"), Topology: topology, LastHeartbeat: time.Now()})
+	return fw
+}
+
+func (fw *fakeWorker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.failing {
+		writeErrorResponse(w, "worker is failing", http.StatusServiceUnavailable)
+		return
+	}
+	chunkID := r.URL.Query().Get("chunkID")
+	switch r.URL.Path {
+	case "/store", "/append":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data := body
+		if r.URL.Path == "/append" {
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			existing := fw.chunks[chunkID]
+			if offset > len(existing) {
+				writeErrorResponse(w, "append offset beyond the end of the chunk", http.StatusConflict)
+				return
+			}
+			data = append(append([]byte(nil), existing[:offset]...), body...)
+		}
+		fw.chunks[chunkID] = data
+		fw.modTimes[chunkID] = time.Now()
+		checksum := chunkChecksum(data)
+		if filename := r.URL.Query().Get("filename"); filename != "" {
+			index, _ := strconv.Atoi(r.URL.Query().Get("index"))
+			sidecar := ChunkSidecar{Filename: filename, Index: index, Size: int64(len(data)), Checksum: checksum}
+			if member := r.URL.Query().Get("member"); member != "" {
+				offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+				for _, existing := range fw.sidecars[chunkID].Members {
+					if existing.Offset+existing.Length <= offset {
+						sidecar.Members = append(sidecar.Members, existing)
+					}
+				}
+				sidecar.Members = append(sidecar.Members, PackMember{Filename: member, Offset: offset, Length: int64(len(body)), PackedAt: time.Now().UTC()})
+			}
+			fw.sidecars[chunkID] = sidecar
+		}
+		w.Header().Set(ChunkChecksumHeader, checksum)
+		w.Header().Set(ChunkSizeHeader, strconv.Itoa(len(data)))
+		writeSuccessResponse(w, "stored")
+	case "/get":
+		data, exists := fw.chunks[chunkID]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, chunkID, fw.modTimes[chunkID], bytes.NewReader(data))
+	case "/stat":
+		stat := ChunkStat{ChunkID: chunkID}
+		if data, exists := fw.chunks[chunkID]; exists {
+			stat.Exists = true
+			stat.Size = int64(len(data))
+			if r.URL.Query().Get("checksum") == "true" {
+				stat.Checksum = chunkChecksum(data)
+			}
+		}
+		writeJSONResponse(w, stat)
+	case "/chunks":
+		chunks := []WorkerChunk{}
+		for id, data := range fw.chunks {
+			chunk := WorkerChunk{ChunkID: id, Size: int64(len(data)), ModTime: fw.modTimes[id]}
+			if sidecar, exists := fw.sidecars[id]; exists && r.URL.Query().Get("sidecars") == "true" {
+				chunk.Sidecar = &sidecar
+			}
+			chunks = append(chunks, chunk)
+		}
+		writeJSONResponse(w, chunks)
+	case "/delete":
+		if _, exists := fw.chunks[chunkID]; !exists {
+			writeErrorResponse(w, "Chunk not found", http.StatusNotFound)
+			return
+		}
+		delete(fw.chunks, chunkID)
+		delete(fw.sidecars, chunkID)
+		writeSuccessResponse(w, "deleted")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func chunkChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// put stores a chunk on the worker directly, as if it had been uploaded earlier
+func (fw *fakeWorker) put(chunkID string, data []byte, modTime time.Time) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.chunks[chunkID] = data
+	fw.modTimes[chunkID] = modTime
+}
+
+// drop loses a chunk, as a failed disk would
+func (fw *fakeWorker) drop(chunkID string) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	delete(fw.chunks, chunkID)
+	delete(fw.sidecars, chunkID)
+}
+
+func (fw *fakeWorker) chunk(chunkID string) ([]byte, bool) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	data, exists := fw.chunks[chunkID]
+	return data, exists
+}
+
+func (fw *fakeWorker) chunkCount() int {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return len(fw.chunks)
+}
+
+func (fw *fakeWorker) setFailing(failing bool) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.failing = failing
+}
+
+// newTestCluster starts a metadata store and n fake workers named w1 to wn, each on its own host
+func newTestCluster(t *testing.T, n int) (*WorkerManager, *ChunkManager, []*fakeWorker) {
+	t.Helper()
+	useTestMetadata(t)
+	wm := NewWorkerManager(&roundRobinPlacement{})
+	workers := make([]*fakeWorker, n)
+	for i := range workers {
+		id := fmt.Sprintf("w%d", i+1)
+		workers[i] = startFakeWorker(t, wm, id, Topology{Host: id})
+	}
+	return wm, NewChunkManager(wm, 4), workers
+}
+
+// storeTestFile records a file whose chunks are stored on the given workers, one replica per worker
+func storeTestFile(t *testing.T, filename string, chunks [][]byte, replicas ...*fakeWorker) {
+	t.Helper()
+	ctx := testContext(t)
+	var size int64
+	var records []ChunkRecord
+	for i, data := range chunks {
+		size += int64(len(data))
+		chunkID := fmt.Sprintf("%s_chunk_%08d", filename, i)
+		for _, worker := range replicas {
+			worker.put(chunkID, data, time.Now())
+			records = append(records, ChunkRecord{ChunkID: chunkID, WorkerID: worker.id, Index: i, Size: int64(len(data)), Checksum: chunkChecksum(data)})
+		}
+	}
+	must(t, storeFileVersion(ctx, filename, size, nil, records))
+}
+
+func TestFakeWorkerChunkAPI(t *testing.T) {
+	_, cm, workers := newTestCluster(t, 1)
+	ctx := testContext(t)
+
+	record, err := cm.storeChunkOnWorker(ctx, "w1", "f", "f_chunk_00000000", 0, []byte("hello"))
+	must(t, err)
+	if record.Size != 5 || record.Checksum != chunkChecksum([]byte("hello")) {
+		t.Fatalf("stored record %+v", record)
+	}
+	data, err := cm.fetchChunkFromWorker(ctx, "w1", "f_chunk_00000000")
+	must(t, err)
+	if string(data) != "hello" {
+		t.Fatalf("fetched %q", data)
+	}
+	must(t, cm.deleteChunkFromWorker(ctx, "w1", "f_chunk_00000000"))
+	if workers[0].chunkCount() != 0 {
+		t.Fatalf("chunk not deleted")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// forwardToLeader sends every request a follower receives to the Raft leader, so
+// clients and workers may talk to any master. Health, cluster status, metrics
+// and configuration are always answered locally.
+func forwardToLeader(store *RaftStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = trustForward(store, r)
+		if store.IsLeader() || r.URL.Path == "/health" || r.URL.Path == "/cluster" || r.URL.Path == "/metrics" || r.URL.Path == "/config" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A forwarded request must not bounce between masters during an election
+		leader := store.LeaderHTTPAddr()
+		if leader == "" || r.Header.Get(ForwardedHeader) != "" {
+			w.Header().Set("Retry-After", "1")
+			writeErrorResponse(w, "No leader available, retry shortly", http.StatusServiceUnavailable)
+			return
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leader})
+		proxy.FlushInterval = -1 // Stream downloads through as they arrive
+		proxy.Transport = tracedTransport(http.DefaultTransport)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			writeErrorResponse(w, fmt.Sprintf("Failed to reach the leader %s: %v", leader, err), http.StatusBadGateway)
+		}
+		r.Header.Set(ForwardedHeader, store.config.NodeID)
+		r.Header.Set(ClientAddrHeader, r.RemoteAddr)
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// trustForward takes the client address of a forwarded request from its headers
+// if another master of the group sent it, and strips the forwarding headers from
+// any other request. Otherwise a client could pose as a worker or put any address
+// in the audit log.
+func trustForward(store *RaftStore, r *http.Request) *http.Request {
+	forwardedBy, addr := r.Header.Get(ForwardedHeader), r.Header.Get(ClientAddrHeader)
+	if forwardedBy == "" && addr == "" {
+		return r
+	}
+	if err := store.verifyPeer(r); err != nil {
+		slog.WarnContext(r.Context(), "Ignoring forwarding headers from a client that is not a master",
+			"remote", r.RemoteAddr, "forwardedBy", forwardedBy, "clientAddr", addr, "error", err)
+		r.Header.Del(ForwardedHeader)
+		r.Header.Del(ClientAddrHeader)
+		return r
+	}
+	if forwardedBy != "" && addr != "" {
+		r = r.WithContext(withClientAddr(r.Context(), addr))
+	}
+	return r
+}
+
+// verifyPeer checks that a request comes from the host of another master of the group
+func (s *RaftStore) verifyPeer(r *http.Request) error {
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	for _, peer := range s.config.Peers {
+		if peer.ID == s.config.NodeID {
+			continue
+		}
+		for _, addr := range []string{peer.HTTPAddr, peer.RaftAddr} {
+			if host, _, err := net.SplitHostPort(addr); err == nil && verifyHostAddr(r.Context(), host, remoteHost) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not a master of the group", remoteHost)
+}
+
+// handleClusterStatus reports this master's view of the Raft group
+func handleClusterStatus(store *RaftStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validateHTTPMethod(w, r, http.MethodGet) {
+			return
+		}
+		if err := writeJSONResponse(w, store.Status()); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode cluster status", "error", err)
+		}
+	}
+}
+
+// onLeadershipChange hands the background work of the cluster to the new leader.
+// Followers only forward requests, so a new leader reloads the worker registry
+// that the previous leader kept up to date.
+func (s *MasterServer) onLeadershipChange(isLeader bool) {
+	if !isLeader {
+		s.drainManager.StopDrains()
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+		defer cancel()
+		if err := s.workerManager.LoadRegistry(ctx); err != nil {
+			slog.Error("Failed to reload worker registry after becoming leader", "error", err)
+			return
+		}
+		if metadata.IsLeader() {
+			s.drainManager.ResumeDrains()
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// forwardTarget records what the handler behind forwardToLeader sees of a request
+type forwardTarget struct {
+	clientAddr  string
+	forwardedBy string
+}
+
+func (f *forwardTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.clientAddr = clientAddr(r)
+	f.forwardedBy = r.Header.Get(ForwardedHeader) + r.Header.Get(ClientAddrHeader)
+}
+
+func TestForwardingHeadersAreTrustedOnlyFromMasters(t *testing.T) {
+	stores := newInmemRaftCluster(t, 2, "192.0.2.1:8080", "192.0.2.2:8080")
+	leader := waitForLeader(t, stores)
+	peerIP := "192.0.2.1"
+	if leader.config.NodeID == stores[0].config.NodeID {
+		peerIP = "192.0.2.2"
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    bool
+		wantClient string
+		wantHeader bool
+	}{
+		{"client", "203.0.113.7:4000", false, "203.0.113.7:4000", false},
+		{"forged by client", "203.0.113.7:4000", true, "203.0.113.7:4000", false},
+		{"forwarded by master", peerIP + ":4000", true, "198.51.100.9:5000", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := &forwardTarget{}
+			r := httptest.NewRequest(http.MethodPost, "/chunks/lost", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.headers {
+				r.Header.Set(ForwardedHeader, "master9")
+				r.Header.Set(ClientAddrHeader, "198.51.100.9:5000")
+			}
+			forwardToLeader(leader, target).ServeHTTP(httptest.NewRecorder(), r)
+
+			if target.clientAddr != test.wantClient {
+				t.Errorf("client address %q, want %q", target.clientAddr, test.wantClient)
+			}
+			if (target.forwardedBy != "") != test.wantHeader {
+				t.Errorf("forwarding headers %q reached the handler: %t, want %t", target.forwardedBy, target.forwardedBy != "", test.wantHeader)
+			}
+		})
+	}
+}
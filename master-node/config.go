@@ -1,47 +1,366 @@
 package main
 
 import (
-	"io"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 )
 
 // Worker represents a worker node in the cluster
 type Worker struct {
-	ID               string
-	CurrentChunkSize int64             // Track current chunk being written
-	StreamConn       *StreamConnection // Active connection for streaming
+	ID               string         // Stable worker ID referenced by chunk metadata
+	Address          string         // host:port the worker advertises for chunk traffic
+	CurrentChunkSize int64          // Track current chunk being written
+	State            string         // active, draining or drained
+	Drain            *DrainProgress // Progress of the current or last drain
+	Status           WorkerStatus   // Capacity and load reported with the last heartbeat
+	LastHeartbeat    time.Time
+	Offline          bool // Deregistered while shutting down or timed out, until it registers again
+	Pending          int  // Transfers the master currently has in flight to this worker
+	Topology         Topology
+
+	persistedHeartbeat time.Time // LastHeartbeat as last written to the registry
+}
+
+// Topology places a worker in the failure domains of the cluster
+type Topology struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+// WorkerStatus is the capacity and load report a worker sends with each
+// heartbeat. The totals only count the worker's healthy disks.
+type WorkerStatus struct {
+	ID            string       `json:"id"`
+	Address       string       `json:"address"`
+	CapacityBytes uint64       `json:"capacityBytes"`
+	FreeBytes     uint64       `json:"freeBytes"`
+	UsedBytes     int64        `json:"usedBytes"`
+	ChunkCount    int          `json:"chunkCount"`
+	InFlight      int64        `json:"inFlight"`
+	Disks         []DiskStatus `json:"disks,omitempty"`
+}
+
+// DiskStatus is the capacity and health of one data directory of a worker
+type DiskStatus struct {
+	Path          string `json:"path"`
+	State         string `json:"state"` // healthy or failed
+	Error         string `json:"error,omitempty"`
+	CapacityBytes uint64 `json:"capacityBytes"`
+	FreeBytes     uint64 `json:"freeBytes"`
+	UsedBytes     int64  `json:"usedBytes"`
+	ChunkCount    int    `json:"chunkCount"`
 }
 
+// Worker states
+const (
+	WorkerStateActive   = "active"
+	WorkerStateDraining = "draining"
+	WorkerStateDrained  = "drained"
+)
+
 const (
 	// Server configuration
 	DefaultMasterPort = "8080"
 	DefaultWorkerPort = "8081"
+	DefaultPprofAddr  = "localhost:6060"
+
+	// Time in-flight requests get to finish on shutdown
+	DefaultShutdownTimeout = 30 * time.Second
 
 	// File processing configuration
-	DefaultChunkSize     = 10 * 1024 * 1024 // 10MB
-	MaxConcurrentUploads = 5
-	StreamBufferSize     = 32 * 1024 // 32KB buffer for streaming
+	DefaultChunkSize            = 10 * 1024 * 1024 // 10MB
+	DefaultMaxConcurrentUploads = 5
+	DefaultStreamBufferSize     = 32 * 1024         // 32KB buffer for streaming
+	DefaultUploadMemoryBudget   = 256 * 1024 * 1024 // 256MB
+
+	// Download configuration
+	DefaultDownloadPrefetch     = 4
+	DefaultDownloadMemoryBudget = 256 * 1024 * 1024 // 256MB
+	DefaultDownloadRetries      = 2
+
+	// Small file packing configuration
+	DefaultPackThreshold           = 0               // Packing is off unless a threshold is set
+	DefaultPackSize                = 4 * 1024 * 1024 // 4MB
+	DefaultPackCompactionThreshold = 50
+	DefaultPackCompactionInterval  = 1 * time.Hour
 
 	// Network configuration
-	NetworkTimeout  = 30 * time.Second
-	DatabaseTimeout = 30 * time.Second
+	DefaultNetworkTimeout  = 30 * time.Second
+	DefaultDatabaseTimeout = 30 * time.Second
 
 	// HTTP configuration
 	ContentTypeJSON        = "application/json"
 	ContentTypeOctetStream = "application/octet-stream"
 
+	// Headers workers use to report what they stored
+	ChunkChecksumHeader = "X-Chunk-Checksum"
+	ChunkSizeHeader     = "X-Chunk-Size"
+
 	// Database configuration
-	DatabaseName     = "frostbyte"
-	FilesCollection  = "files"
-	ChunksCollection = "chunks"
-)
-
-// StreamConnection manages active streaming to a worker
-type StreamConnection struct {
-	WorkerID     string
-	ChunkID      string
-	ChunkIndex   int
-	BytesWritten int64
-	Stream       io.WriteCloser
-	ResultChan   chan error // Channel to track upload completion
+	DatabaseName       = "frostbyte"
+	FilesCollection    = "files"
+	ChunksCollection   = "chunks"
+	PoliciesCollection = "lifecycle_policies"
+	AuditCollection    = "audit_log"
+	WorkersCollection  = "workers"
+
+	// Placement configuration
+	DefaultPlacementPolicy   = PlacementRoundRobin
+	DefaultReplicationFactor = 1
+
+	// Worker liveness configuration. Workers send a heartbeat every 10 seconds by default.
+	DefaultWorkerTimeout = 1 * time.Minute
+
+	// Lifecycle configuration
+	DefaultLifecycleInterval = 1 * time.Hour
+
+	// Garbage collection configuration
+	DefaultGCGracePeriod = 24 * time.Hour
+	DefaultGCTimeout     = 30 * time.Minute
+
+	// Rebalancer configuration
+	DefaultRebalanceInterval         = 10 * time.Minute
+	DefaultRebalanceThresholdPercent = 10
+	DefaultRebalanceBandwidthMB      = 50
+
+	// Consistency check configuration
+	DefaultFsckTimeout = 1 * time.Hour
+
+	// Metadata configuration
+	DefaultMetadataBackend       = MetadataBackendMongo
+	DefaultMongoURI              = "mongodb://mongodb:27017"
+	DefaultRaftDataDir           = "raft-data"
+	DefaultRaftSnapshotThreshold = 8192
+
+	// Header marking a request a follower forwarded to the leader
+	ForwardedHeader = "X-Frostbyte-Forwarded"
+	// Header carrying the address of the client whose request was forwarded
+	ClientAddrHeader = "X-Frostbyte-Client-Addr"
+
+	// Tracing configuration
+	DefaultTraceExporter = TraceExporterNone
+	DefaultTraceFile     = "traces.jsonl"
+
+	// Logging configuration
+	DefaultLogFormat = LogFormatText
+	DefaultLogLevel  = "info"
+
+	// Header carrying the ID of a request from the master to the workers
+	RequestIDHeader = "X-Request-ID"
+
+	// Header carrying the cluster token on requests from workers
+	ClusterTokenHeader = "X-Frostbyte-Cluster-Token"
+)
+
+// Server settings: the port the master listens on, the port workers listen on
+// unless they advertise an address, and the address of the pprof server
+var (
+	MasterPort = DefaultMasterPort
+	WorkerPort = DefaultWorkerPort
+	PprofAddr  = DefaultPprofAddr
+)
+
+// File processing settings
+var (
+	ChunkSize            int64 = DefaultChunkSize
+	MaxConcurrentUploads       = DefaultMaxConcurrentUploads
+	StreamBufferSize           = DefaultStreamBufferSize
+	UploadMemoryBudget   int64 = DefaultUploadMemoryBudget
+)
+
+// Download settings: chunks prefetched ahead of the one being sent (0 disables
+// prefetching), memory all downloads may hold in prefetched chunks, and extra
+// rounds over the replicas of a chunk once all of them failed
+var (
+	DownloadPrefetch           = DefaultDownloadPrefetch
+	DownloadMemoryBudget int64 = DefaultDownloadMemoryBudget
+	DownloadRetries            = DefaultDownloadRetries
+)
+
+// Small file packing settings: files below PackThreshold bytes are appended to
+// shared packs of up to PackSize bytes (0 disables packing), and a pack is
+// compacted once PackCompactionThreshold percent of it belongs to deleted files
+var (
+	PackThreshold           int64 = DefaultPackThreshold
+	PackSize                int64 = DefaultPackSize
+	PackCompactionThreshold       = DefaultPackCompactionThreshold
+	PackCompactionInterval        = DefaultPackCompactionInterval
+)
+
+// Timeouts of requests to workers and to the metadata store, and of the shutdown
+var (
+	NetworkTimeout  = DefaultNetworkTimeout
+	DatabaseTimeout = DefaultDatabaseTimeout
+	ShutdownTimeout = DefaultShutdownTimeout
+)
+
+// Background job settings
+var (
+	LifecycleInterval = DefaultLifecycleInterval
+	GCGracePeriod     = DefaultGCGracePeriod
+	GCTimeout         = DefaultGCTimeout
+	RebalanceInterval = DefaultRebalanceInterval
+	FsckTimeout       = DefaultFsckTimeout
+)
+
+// AdminToken grants admin permissions to requests presenting it as a bearer token.
+// Admin operations are disabled when it is empty.
+var AdminToken string
+
+// ClusterToken is shared by the master and its workers. When it is set, workers
+// must present it to register, send heartbeats and report lost chunks. Without
+// it, a worker can only change its address from the host of its current address.
+var ClusterToken string
+
+// PlacementPolicyName selects how chunks are placed on workers
+var PlacementPolicyName = DefaultPlacementPolicy
+
+// WorkerTimeout is how long a worker may go without a heartbeat before it is taken out of rotation
+var WorkerTimeout = DefaultWorkerTimeout
+
+// ReplicationFactor is the number of workers each chunk is stored on
+var ReplicationFactor = DefaultReplicationFactor
+
+// Rebalancer settings: allowed deviation from the mean utilization in percentage
+// points, and the bandwidth the rebalancer may use for moving chunks
+var (
+	RebalanceThresholdPercent = DefaultRebalanceThresholdPercent
+	RebalanceBandwidthMB      = DefaultRebalanceBandwidthMB
+)
+
+// Metadata store settings. The raft backend runs several masters as one Raft group;
+// RaftPeers lists every master as id=raftHost:port=httpHost:port, comma separated.
+var (
+	MetadataBackend       = DefaultMetadataBackend
+	MongoURI              = DefaultMongoURI
+	RaftNodeID            string
+	RaftPeers             string
+	RaftDataDir           = DefaultRaftDataDir
+	RaftSnapshotThreshold = DefaultRaftSnapshotThreshold
+)
+
+// Tracing settings: the exporter spans are sent to, and the file used by the file exporter
+var (
+	TraceExporter = DefaultTraceExporter
+	TraceFile     = DefaultTraceFile
+)
+
+// Logging settings: text or json output, and the minimum level (debug, info, warn or error)
+var (
+	LogFormat = DefaultLogFormat
+	LogLevel  = DefaultLogLevel
+)
+
+// loadConfig fills the settings above from the configuration file, the environment
+// and the command line, validates them, and returns the remaining arguments
+func loadConfig(args []string) (*configLoader, []string, error) {
+	c := newConfigLoader("dfs-master")
+	c.String(&MasterPort, "port", "FROSTBYTE_PORT", "port the master listens on")
+	c.String(&WorkerPort, "worker-port", "FROSTBYTE_WORKER_PORT", "port of workers that do not advertise an address")
+	c.String(&PprofAddr, "pprof-addr", "FROSTBYTE_PPROF_ADDR", "address of the pprof server")
+	c.Int64(&ChunkSize, "chunk-size", "FROSTBYTE_CHUNK_SIZE", "size of file chunks in bytes")
+	c.Int(&MaxConcurrentUploads, "max-concurrent-uploads", "FROSTBYTE_MAX_CONCURRENT_UPLOADS", "chunk transfers run in parallel per request")
+	c.Int(&StreamBufferSize, "stream-buffer-size", "FROSTBYTE_STREAM_BUFFER_SIZE", "buffer size for streaming uploads in bytes")
+	c.Int64(&UploadMemoryBudget, "upload-memory-budget", "FROSTBYTE_UPLOAD_MEMORY_BUDGET", "memory all uploads may use for chunks in flight in bytes")
+	c.Int(&DownloadPrefetch, "download-prefetch", "FROSTBYTE_DOWNLOAD_PREFETCH", "chunks fetched ahead of the one being downloaded, 0 disables prefetching")
+	c.Int64(&DownloadMemoryBudget, "download-memory-budget", "FROSTBYTE_DOWNLOAD_MEMORY_BUDGET", "memory all downloads may use for prefetched chunks in bytes")
+	c.Int(&DownloadRetries, "download-retries", "FROSTBYTE_DOWNLOAD_RETRIES", "extra rounds over the replicas of a chunk before a download fails")
+	c.Int64(&PackThreshold, "pack-threshold", "FROSTBYTE_PACK_THRESHOLD", "files smaller than this many bytes are packed into shared chunks, 0 disables packing")
+	c.Int64(&PackSize, "pack-size", "FROSTBYTE_PACK_SIZE", "size at which a pack is closed in bytes")
+	c.Int(&PackCompactionThreshold, "pack-compaction-threshold", "FROSTBYTE_PACK_COMPACTION_THRESHOLD", "percentage of deleted data at which a pack is compacted")
+	c.Duration(&PackCompactionInterval, "pack-compaction-interval", "FROSTBYTE_PACK_COMPACTION_INTERVAL", "interval between pack compaction runs")
+	c.Duration(&NetworkTimeout, "network-timeout", "FROSTBYTE_NETWORK_TIMEOUT", "timeout of requests to workers")
+	c.Duration(&DatabaseTimeout, "database-timeout", "FROSTBYTE_DATABASE_TIMEOUT", "timeout of metadata operations")
+	c.Duration(&ShutdownTimeout, "shutdown-timeout", "FROSTBYTE_SHUTDOWN_TIMEOUT", "time in-flight requests get to finish on shutdown")
+	c.Duration(&LifecycleInterval, "lifecycle-interval", "FROSTBYTE_LIFECYCLE_INTERVAL", "interval between lifecycle runs")
+	c.Duration(&GCGracePeriod, "gc-grace-period", "FROSTBYTE_GC_GRACE_PERIOD", "age below which orphaned chunks are kept")
+	c.Duration(&GCTimeout, "gc-timeout", "FROSTBYTE_GC_TIMEOUT", "timeout of a garbage collection run")
+	c.Duration(&RebalanceInterval, "rebalance-interval", "FROSTBYTE_REBALANCE_INTERVAL", "interval between rebalancer runs")
+	c.Duration(&FsckTimeout, "fsck-timeout", "FROSTBYTE_FSCK_TIMEOUT", "timeout of consistency checks and metadata recovery")
+	c.Secret(&AdminToken, "admin-token", "FROSTBYTE_ADMIN_TOKEN", "bearer token granting admin permissions (prefer the environment)")
+	c.Secret(&ClusterToken, "cluster-token", "FROSTBYTE_CLUSTER_TOKEN", "token workers present to the master (prefer the environment)")
+	c.String(&PlacementPolicyName, "placement-policy", "FROSTBYTE_PLACEMENT_POLICY", "chunk placement policy")
+	c.Duration(&WorkerTimeout, "worker-timeout", "FROSTBYTE_WORKER_TIMEOUT", "time without a heartbeat after which a worker is taken out of rotation")
+	c.Int(&ReplicationFactor, "replication-factor", "FROSTBYTE_REPLICATION_FACTOR", "number of workers each chunk is stored on")
+	c.Int(&RebalanceThresholdPercent, "rebalance-threshold", "FROSTBYTE_REBALANCE_THRESHOLD", "allowed deviation from the mean utilization in percentage points")
+	c.Int(&RebalanceBandwidthMB, "rebalance-bandwidth-mb", "FROSTBYTE_REBALANCE_BANDWIDTH_MB", "bandwidth the rebalancer may use in MB/s")
+	c.String(&MetadataBackend, "metadata-backend", "FROSTBYTE_METADATA_BACKEND", "metadata store: mongo or raft")
+	c.URL(&MongoURI, "mongo-uri", "FROSTBYTE_MONGO_URI", "MongoDB connection string")
+	c.String(&RaftNodeID, "raft-id", "FROSTBYTE_RAFT_ID", "ID of this master in the Raft group")
+	c.String(&RaftPeers, "raft-peers", "FROSTBYTE_RAFT_PEERS", "masters of the Raft group as id=raftHost:port=httpHost:port, comma separated")
+	c.String(&RaftDataDir, "raft-dir", "FROSTBYTE_RAFT_DIR", "directory of the Raft log and snapshots")
+	c.Int(&RaftSnapshotThreshold, "raft-snapshot-threshold", "FROSTBYTE_RAFT_SNAPSHOT_THRESHOLD", "Raft log entries between snapshots")
+	c.String(&TraceExporter, "trace-exporter", "FROSTBYTE_TRACE_EXPORTER", "span exporter: none, stdout, file or otlp")
+	c.String(&TraceFile, "trace-file", "FROSTBYTE_TRACE_FILE", "file written by the file span exporter")
+	c.String(&LogFormat, "log-format", "FROSTBYTE_LOG_FORMAT", "log format: text or json")
+	c.String(&LogLevel, "log-level", "FROSTBYTE_LOG_LEVEL", "minimum log level: debug, info, warn or error")
+
+	rest, err := c.Load(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateConfig(); err != nil {
+		return nil, nil, err
+	}
+	return c, rest, nil
+}
+
+// validateConfig reports every invalid setting at once
+func validateConfig() error {
+	var level slog.Level
+	errs := []error{
+		checkPort("port", MasterPort),
+		checkPort("worker-port", WorkerPort),
+		checkPositive("chunk-size", ChunkSize),
+		checkPositive("max-concurrent-uploads", MaxConcurrentUploads),
+		checkPositive("stream-buffer-size", StreamBufferSize),
+		checkPositive("download-memory-budget", DownloadMemoryBudget),
+		checkPositive("pack-size", PackSize),
+		checkPositive("pack-compaction-interval", PackCompactionInterval),
+		checkPositive("network-timeout", NetworkTimeout),
+		checkPositive("database-timeout", DatabaseTimeout),
+		checkPositive("shutdown-timeout", ShutdownTimeout),
+		checkPositive("lifecycle-interval", LifecycleInterval),
+		checkPositive("gc-timeout", GCTimeout),
+		checkPositive("rebalance-interval", RebalanceInterval),
+		checkPositive("fsck-timeout", FsckTimeout),
+		checkPositive("worker-timeout", WorkerTimeout),
+		checkPositive("replication-factor", ReplicationFactor),
+		checkPositive("rebalance-bandwidth-mb", RebalanceBandwidthMB),
+		checkPositive("raft-snapshot-threshold", RaftSnapshotThreshold),
+		checkOneOf("metadata-backend", MetadataBackend, MetadataBackendMongo, MetadataBackendRaft),
+		checkOneOf("trace-exporter", TraceExporter, TraceExporterNone, TraceExporterStdout, TraceExporterFile, TraceExporterOTLP),
+		checkOneOf("log-format", LogFormat, LogFormatText, LogFormatJSON),
+	}
+	if GCGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("gc-grace-period must not be negative, got %v", GCGracePeriod))
+	}
+	if UploadMemoryBudget < ChunkSize {
+		errs = append(errs, fmt.Errorf("upload-memory-budget must hold at least one chunk of %d bytes, got %d", ChunkSize, UploadMemoryBudget))
+	}
+	if PackThreshold < 0 || PackThreshold > PackSize {
+		errs = append(errs, fmt.Errorf("pack-threshold must be between 0 and pack-size %d, got %d", PackSize, PackThreshold))
+	}
+	if PackCompactionThreshold < 1 || PackCompactionThreshold > 100 {
+		errs = append(errs, fmt.Errorf("pack-compaction-threshold must be between 1 and 100, got %d", PackCompactionThreshold))
+	}
+	if DownloadPrefetch < 0 {
+		errs = append(errs, fmt.Errorf("download-prefetch must not be negative, got %d", DownloadPrefetch))
+	}
+	if DownloadRetries < 0 {
+		errs = append(errs, fmt.Errorf("download-retries must not be negative, got %d", DownloadRetries))
+	}
+	if RebalanceThresholdPercent < 0 || RebalanceThresholdPercent > 100 {
+		errs = append(errs, fmt.Errorf("rebalance-threshold must be between 0 and 100, got %d", RebalanceThresholdPercent))
+	}
+	if _, err := newPlacementPolicy(PlacementPolicyName); err != nil {
+		errs = append(errs, fmt.Errorf("placement-policy: %v", err))
+	}
+	if err := level.UnmarshalText([]byte(LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log-level must be debug, info, warn or error, got %q", LogLevel))
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources a setting can take its value from, in increasing order of precedence
+const (
+	ConfigSourceDefault = "default"
+	ConfigSourceFile    = "file"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFlag    = "flag"
+)
+
+// ConfigFileEnv names the environment variable pointing at the configuration file
+const ConfigFileEnv = "FROSTBYTE_CONFIG"
+
+// configLoader fills settings from defaults, a YAML configuration file, environment
+// variables and command line flags, each overriding the ones before it. Every setting
+// is a command line flag and a key of the configuration file with the same name.
+type configLoader struct {
+	flags   *flag.FlagSet
+	file    string
+	env     map[string]string              // Environment variable of each setting
+	redact  map[string]func(string) string // Hides secrets in the effective configuration
+	sources map[string]string
+}
+
+func newConfigLoader(name string) *configLoader {
+	c := &configLoader{
+		flags:   flag.NewFlagSet(name, flag.ExitOnError),
+		env:     make(map[string]string),
+		redact:  make(map[string]func(string) string),
+		sources: make(map[string]string),
+	}
+	c.flags.StringVar(&c.file, "config", "", "YAML configuration file (env "+ConfigFileEnv+")")
+	return c
+}
+
+func (c *configLoader) register(name, env string) {
+	c.env[name] = env
+	c.sources[name] = ConfigSourceDefault
+}
+
+// String registers a string setting whose default is the current value of p
+func (c *configLoader) String(p *string, name, env, usage string) {
+	c.flags.StringVar(p, name, *p, usage)
+	c.register(name, env)
+}
+
+// Secret registers a string setting that is hidden from the effective configuration
+func (c *configLoader) Secret(p *string, name, env, usage string) {
+	c.String(p, name, env, usage)
+	c.redact[name] = redactSecret
+}
+
+// URL registers a string setting holding a URL whose password is hidden from the
+// effective configuration
+func (c *configLoader) URL(p *string, name, env, usage string) {
+	c.String(p, name, env, usage)
+	c.redact[name] = redactURL
+}
+
+// Int registers an integer setting whose default is the current value of p
+func (c *configLoader) Int(p *int, name, env, usage string) {
+	c.flags.IntVar(p, name, *p, usage)
+	c.register(name, env)
+}
+
+// Int64 registers a 64-bit integer setting whose default is the current value of p
+func (c *configLoader) Int64(p *int64, name, env, usage string) {
+	c.flags.Int64Var(p, name, *p, usage)
+	c.register(name, env)
+}
+
+// Bool registers a boolean setting whose default is the current value of p
+func (c *configLoader) Bool(p *bool, name, env, usage string) {
+	c.flags.BoolVar(p, name, *p, usage)
+	c.register(name, env)
+}
+
+// Duration registers a duration setting whose default is the current value of p
+func (c *configLoader) Duration(p *time.Duration, name, env, usage string) {
+	c.flags.DurationVar(p, name, *p, usage)
+	c.register(name, env)
+}
+
+// Load applies the configuration file, the environment and the command line flags
+// in args, and returns the arguments left after the flags
+func (c *configLoader) Load(args []string) ([]string, error) {
+	c.flags.Parse(args)
+
+	// Flags win over everything else, so they are applied again at the end
+	explicit := make(map[string]string)
+	c.flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if c.file == "" {
+		c.file = os.Getenv(ConfigFileEnv)
+	}
+	if c.file != "" {
+		if err := c.loadFile(c.file); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, env := range c.env {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := c.flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", value, env, err)
+		}
+		c.sources[name] = ConfigSourceEnv
+	}
+
+	for name, value := range explicit {
+		c.flags.Set(name, value)
+		if name != "config" {
+			c.sources[name] = ConfigSourceFlag
+		}
+	}
+	return c.flags.Args(), nil
+}
+
+// loadFile applies the settings of a YAML configuration file
+func (c *configLoader) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for name, value := range values {
+		if _, ok := c.env[name]; !ok {
+			return fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		switch value.(type) {
+		case map[string]any, []any, nil:
+			return fmt.Errorf("config file %s: %s must be a single value", path, name)
+		}
+		if err := c.flags.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("config file %s: invalid value for %s: %v", path, name, err)
+		}
+		c.sources[name] = ConfigSourceFile
+	}
+	return nil
+}
+
+// EffectiveSetting is the value a setting ended up with and where it came from
+type EffectiveSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	Env    string `json:"env"`
+}
+
+// Effective returns the value of every setting, with secrets redacted
+func (c *configLoader) Effective() map[string]EffectiveSetting {
+	effective := make(map[string]EffectiveSetting, len(c.env))
+	for name, env := range c.env {
+		value := c.flags.Lookup(name).Value.String()
+		if redact, ok := c.redact[name]; ok {
+			value = redact(value)
+		}
+		effective[name] = EffectiveSetting{Value: value, Source: c.sources[name], Env: env}
+	}
+	return effective
+}
+
+// handleConfig serves the effective configuration
+func (c *configLoader) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSONResponse(w, map[string]any{
+		"file":     c.file,
+		"settings": c.Effective(),
+	})
+}
+
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return redactSecret(value)
+	}
+	return parsed.Redacted()
+}
+
+// checkPort validates a TCP port setting
+func checkPort(name, port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("%s must be a port number between 1 and 65535, got %q", name, port)
+	}
+	return nil
+}
+
+// checkPositive validates a setting that must be greater than zero
+func checkPositive[T int | int64 | time.Duration](name string, value T) error {
+	if value <= 0 {
+		return fmt.Errorf("%s must be positive, got %v", name, value)
+	}
+	return nil
+}
+
+// checkOneOf validates a setting that must be one of a fixed set of values
+func checkOneOf(name, value string, allowed ...string) error {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %v, got %q", name, allowed, value)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	must(t, os.WriteFile(path, []byte("file-only: from-file\nfile-env: from-file\nall: from-file\ntimeout: 5s\n"), 0644))
+	t.Setenv("TEST_FILE_ENV", "from-env")
+	t.Setenv("TEST_ALL", "from-env")
+	t.Setenv("TEST_TOKEN", "hunter2")
+
+	defaulted, fileOnly, fileEnv, all, token := "default", "default", "default", "default", ""
+	timeout := time.Second
+	c := newConfigLoader("test")
+	c.String(&defaulted, "defaulted", "TEST_DEFAULTED", "")
+	c.String(&fileOnly, "file-only", "TEST_FILE_ONLY", "")
+	c.String(&fileEnv, "file-env", "TEST_FILE_ENV", "")
+	c.String(&all, "all", "TEST_ALL", "")
+	c.Secret(&token, "token", "TEST_TOKEN", "")
+	c.Duration(&timeout, "timeout", "TEST_TIMEOUT", "")
+
+	args, err := c.Load([]string{"-config", path, "-all", "from-flag", "serve"})
+	must(t, err)
+	if len(args) != 1 || args[0] != "serve" {
+		t.Fatalf("remaining arguments %v", args)
+	}
+
+	effective := c.Effective()
+	for _, want := range []struct {
+		name, value, source string
+		got                 string
+	}{
+		{"defaulted", "default", ConfigSourceDefault, defaulted},
+		{"file-only", "from-file", ConfigSourceFile, fileOnly},
+		{"file-env", "from-env", ConfigSourceEnv, fileEnv},
+		{"all", "from-flag", ConfigSourceFlag, all},
+		{"timeout", "5s", ConfigSourceFile, timeout.String()},
+	} {
+		if want.got != want.value || effective[want.name].Value != want.value || effective[want.name].Source != want.source {
+			t.Errorf("%s is %q, effective %+v; want %q from %s", want.name, want.got, effective[want.name], want.value, want.source)
+		}
+	}
+	if token != "hunter2" || effective["token"].Value != "[REDACTED]" {
+		t.Errorf("token is %q, shown as %q", token, effective["token"].Value)
+	}
+}
+
+func TestConfigRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		want string
+	}{
+		{"unknown key", "retries: 3\n", "", `unknown setting "retries"`},
+		{"nested value", "timeout:\n  read: 3s\n", "", "must be a single value"},
+		{"invalid file value", "timeout: soon\n", "", "invalid value for timeout"},
+		{"invalid env value", "", "soon", "invalid value \"soon\" for TEST_TIMEOUT"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			must(t, os.WriteFile(path, []byte(test.file), 0644))
+			if test.env != "" {
+				t.Setenv("TEST_TIMEOUT", test.env)
+			}
+
+			timeout := time.Second
+			c := newConfigLoader("test")
+			c.Duration(&timeout, "timeout", "TEST_TIMEOUT", "")
+			if _, err := c.Load([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("loading returned %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
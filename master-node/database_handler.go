@@ -2,172 +2,237 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
-var client *mongo.Client
-var filesCollection *mongo.Collection
+// MongoStore keeps the metadata of a single master in MongoDB
+type MongoStore struct {
+	client   *mongo.Client
+	files    *mongo.Collection
+	policies *mongo.Collection
+	audit    *mongo.Collection
+	workers  *mongo.Collection
+}
 
-func init() {
+// NewMongoStore connects to MongoDB, retrying while the database starts up
+func NewMongoStore(uri string) (*MongoStore, error) {
 	// Set client options with connection pooling
 	clientOptions := options.Client().
-		ApplyURI("mongodb://mongodb:27017").
+		ApplyURI(uri).
 		SetMaxPoolSize(50).                   // Maximum number of connections in pool
 		SetMinPoolSize(5).                    // Minimum number of connections in pool
 		SetMaxConnIdleTime(30 * time.Minute). // Close connections after 30 minutes of inactivity
 		SetServerSelectionTimeout(10 * time.Second).
 		SetSocketTimeout(30 * time.Second).
-		SetConnectTimeout(10 * time.Second)
+		SetConnectTimeout(10 * time.Second).
+		SetMonitor(otelmongo.NewMonitor()) // Trace every command as a child of the caller's span
 
 	// Connect to MongoDB with retry logic
 	maxRetries := 10
 	retryDelay := 2 * time.Second
 
+	var client *mongo.Client
 	var err error
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Printf("Attempting to connect to MongoDB (attempt %d/%d)...", attempt, maxRetries)
+		slog.Info("Connecting to MongoDB", "attempt", attempt, "maxAttempts", maxRetries)
 
 		client, err = mongo.Connect(context.TODO(), clientOptions)
 		if err != nil {
-			log.Printf("Failed to connect to MongoDB (attempt %d): %v", attempt, err)
+			slog.Warn("Failed to connect to MongoDB", "attempt", attempt, "error", err)
 			if attempt < maxRetries {
 				time.Sleep(retryDelay)
 				continue
 			}
-			log.Fatalf("Failed to connect to MongoDB after %d attempts: %v", maxRetries, err)
+			return nil, fmt.Errorf("failed to connect to MongoDB after %d attempts: %v", maxRetries, err)
 		}
 
 		// Check the connection
 		err = client.Ping(context.TODO(), nil)
 		if err != nil {
-			log.Printf("Failed to ping MongoDB (attempt %d): %v", attempt, err)
+			slog.Warn("Failed to ping MongoDB", "attempt", attempt, "error", err)
 			if attempt < maxRetries {
 				time.Sleep(retryDelay)
 				continue
 			}
-			log.Fatalf("Failed to ping MongoDB after %d attempts: %v", maxRetries, err)
+			return nil, fmt.Errorf("failed to ping MongoDB after %d attempts: %v", maxRetries, err)
 		}
 
-		log.Println("Successfully connected to MongoDB!")
+		slog.Info("Connected to MongoDB")
 		break
 	}
 
-	// Get a handle for the files collection
-	filesCollection = client.Database("frostbyte").Collection("files")
+	database := client.Database(DatabaseName)
+	return &MongoStore{
+		client:   client,
+		files:    database.Collection(FilesCollection),
+		policies: database.Collection(PoliciesCollection),
+		audit:    database.Collection(AuditCollection),
+		workers:  database.Collection(WorkersCollection),
+	}, nil
 }
 
-func storeChunkInDB(filename, chunkID, workerID string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second) // Increase timeout
-	defer cancel()
+// IsLeader is always true, a MongoDB-backed master runs alone
+func (s *MongoStore) IsLeader() bool {
+	return true
+}
 
-	filter := bson.M{"filename": filename}
+func (s *MongoStore) Close() error {
+	return s.client.Disconnect(context.Background())
+}
 
-	// Use array-based storage instead of object keys to avoid field name limitations
-	chunkInfo := bson.M{
-		"chunkId":  chunkID,
-		"workerId": workerID,
+// notFound translates the driver's missing-document error
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
 	}
+	return err
+}
 
+func (s *MongoStore) AddChunkRecord(ctx context.Context, filename string, record ChunkRecord) error {
+	filter := bson.M{"filename": filename}
+
+	// Use array-based storage instead of object keys to avoid field name limitations
 	update := bson.M{
 		"$addToSet": bson.M{
-			"chunks": chunkInfo,
+			"chunks": record,
 		},
 	}
 
 	opts := options.Update().SetUpsert(true)
-	result, err := filesCollection.UpdateOne(ctx, filter, update, opts)
+	result, err := s.files.UpdateOne(ctx, filter, update, opts)
 	if err != nil {
 		return fmt.Errorf("failed to store chunk in database: %v", err)
 	}
 
 	// Verify the update was successful
 	if result.ModifiedCount == 0 && result.UpsertedCount == 0 && result.MatchedCount == 0 {
-		log.Printf("Warning: No documents were modified when storing chunk %s", chunkID)
+		slog.WarnContext(ctx, "No documents were modified when storing chunk", "chunk", record.ChunkID)
 	}
 
-	log.Printf("Stored chunk %s for file %s with worker %s", chunkID, filename, workerID)
+	slog.DebugContext(ctx, "Stored chunk record", "chunk", record.ChunkID, "filename", filename, "worker", record.WorkerID)
 	return nil
 }
 
-func storeFileMetadata(filename string, fileSize int64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	filter := bson.M{"filename": filename}
+func (s *MongoStore) StoreFileMetadata(ctx context.Context, file FileInfo) error {
+	filter := bson.M{"filename": file.Filename}
 	update := bson.M{
 		"$set": bson.M{
-			"filename": filename,
-			"size":     fileSize,
-		},
-		"$setOnInsert": bson.M{
-			"chunks": []bson.M{},
+			"filename":   file.Filename,
+			"size":       file.Size,
+			"tags":       file.Tags,
+			"uploadedAt": file.UploadedAt,
+			"chunks":     []bson.M{},
 		},
+		"$unset": bson.M{"pack": ""},
 	}
 
 	opts := options.Update().SetUpsert(true)
-	_, err := filesCollection.UpdateOne(ctx, filter, update, opts)
+	_, err := s.files.UpdateOne(ctx, filter, update, opts)
 	if err != nil {
 		return fmt.Errorf("failed to store file metadata: %v", err)
 	}
 
-	log.Printf("Stored metadata for file %s with size %d", filename, fileSize)
+	slog.DebugContext(ctx, "Stored file metadata", "filename", file.Filename, "size", file.Size)
 	return nil
 }
 
-// Retrieve file metadata from the database
-func GetFileMetadata(ctx context.Context, filename string) (map[string][]string, error) {
-	var fileMetadata struct {
-		Chunks []struct {
-			ChunkID  string `bson:"chunkId"`
-			WorkerID string `bson:"workerId"`
-		} `bson:"chunks"`
+// StoreFileVersion replaces the contents of a file with a complete new version,
+// keeping its retention and legal hold
+func (s *MongoStore) StoreFileVersion(ctx context.Context, doc FileDocument) error {
+	if doc.Chunks == nil {
+		doc.Chunks = []ChunkRecord{}
+	}
+	set := bson.M{
+		"filename":   doc.Filename,
+		"size":       doc.Size,
+		"tags":       doc.Tags,
+		"uploadedAt": doc.UploadedAt,
+		"chunks":     doc.Chunks,
+	}
+	update := bson.M{"$set": set}
+	if doc.Pack != nil {
+		set["pack"] = doc.Pack
+	} else {
+		update["$unset"] = bson.M{"pack": ""}
 	}
 
-	err := filesCollection.FindOne(ctx, bson.M{"filename": filename}).Decode(&fileMetadata)
-	if err != nil {
-		return nil, err
+	opts := options.Update().SetUpsert(true)
+	if _, err := s.files.UpdateOne(ctx, bson.M{"filename": doc.Filename}, update, opts); err != nil {
+		return fmt.Errorf("failed to store file version %s: %v", doc.Filename, err)
 	}
+	slog.DebugContext(ctx, "Stored file version", "filename", doc.Filename, "size", doc.Size, "chunks", len(doc.Chunks))
+	return nil
+}
 
-	// Convert array format back to map format for compatibility
-	result := make(map[string][]string)
-	for _, chunk := range fileMetadata.Chunks {
-		if _, exists := result[chunk.ChunkID]; !exists {
-			result[chunk.ChunkID] = []string{}
-		}
-		result[chunk.ChunkID] = append(result[chunk.ChunkID], chunk.WorkerID)
+// PutFileDocument creates or replaces a complete file document, as when restoring a backup
+func (s *MongoStore) PutFileDocument(ctx context.Context, doc FileDocument) error {
+	if doc.Chunks == nil {
+		doc.Chunks = []ChunkRecord{}
 	}
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.files.ReplaceOne(ctx, bson.M{"filename": doc.Filename}, doc, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store file document %s: %v", doc.Filename, err)
+	}
+	return nil
+}
 
-	return result, nil
+func (s *MongoStore) GetFileDocument(ctx context.Context, filename string) (FileDocument, error) {
+	var doc FileDocument
+	err := s.files.FindOne(ctx, bson.M{"filename": filename}).Decode(&doc)
+	return doc, notFound(err)
 }
 
-// Delete file metadata from the database
-func DeleteFileMetadata(ctx context.Context, filename string) error {
-	_, err := filesCollection.DeleteOne(ctx, bson.M{"filename": filename})
+func (s *MongoStore) DeleteFileMetadata(ctx context.Context, filename string) error {
+	_, err := s.files.DeleteOne(ctx, bson.M{"filename": filename})
 	if err != nil {
 		return err
 	}
-	log.Printf("File metadata deleted for file: %s", filename)
+	slog.DebugContext(ctx, "Deleted file metadata", "filename", filename)
+	return nil
+}
+
+func (s *MongoStore) UpdateFileRetention(ctx context.Context, filename, mode string, retainUntil time.Time) error {
+	update := bson.M{"$set": bson.M{"retentionMode": mode, "retainUntil": retainUntil}}
+	if mode == "" {
+		update = bson.M{"$unset": bson.M{"retentionMode": "", "retainUntil": ""}}
+	}
+	result, err := s.files.UpdateOne(ctx, bson.M{"filename": filename}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update retention: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	slog.InfoContext(ctx, "Retention set", "filename", filename, "mode", mode, "retainUntil", retainUntil.Format(time.RFC3339))
 	return nil
 }
 
-// FileInfo represents a file with its metadata
-type FileInfo struct {
-	Filename string `json:"filename" bson:"filename"`
-	Size     int64  `json:"size" bson:"size"`
+func (s *MongoStore) UpdateFileLegalHold(ctx context.Context, filename string, hold bool) error {
+	result, err := s.files.UpdateOne(ctx, bson.M{"filename": filename}, bson.M{"$set": bson.M{"legalHold": hold}})
+	if err != nil {
+		return fmt.Errorf("failed to update legal hold: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	slog.InfoContext(ctx, "Legal hold set", "filename", filename, "hold", hold)
+	return nil
 }
 
-// GetAllFilenames retrieves a list of all files with their metadata
-func GetAllFilenames(ctx context.Context) ([]FileInfo, error) {
+func (s *MongoStore) ListFiles(ctx context.Context) ([]FileInfo, error) {
 	var files []FileInfo
 
 	// Find all documents in the collection
-	cursor, err := filesCollection.Find(ctx, bson.M{})
+	cursor, err := s.files.Find(ctx, bson.M{})
 	if err != nil {
 		return nil, err
 	}
@@ -189,3 +254,241 @@ func GetAllFilenames(ctx context.Context) ([]FileInfo, error) {
 
 	return files, nil
 }
+
+func (s *MongoStore) GetLifecyclePolicies(ctx context.Context) ([]LifecyclePolicy, error) {
+	cursor, err := s.policies.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	policies := []LifecyclePolicy{}
+	if err := cursor.All(ctx, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+func (s *MongoStore) StoreLifecyclePolicy(ctx context.Context, policy LifecyclePolicy) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.policies.ReplaceOne(ctx, bson.M{"_id": policy.ID}, policy, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store lifecycle policy: %v", err)
+	}
+	slog.InfoContext(ctx, "Stored lifecycle policy", "policy", policy.ID)
+	return nil
+}
+
+func (s *MongoStore) DeleteLifecyclePolicy(ctx context.Context, id string) error {
+	result, err := s.policies.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	slog.InfoContext(ctx, "Deleted lifecycle policy", "policy", id)
+	return nil
+}
+
+func (s *MongoStore) StoreAuditEvent(ctx context.Context, event AuditEvent) error {
+	_, err := s.audit.InsertOne(ctx, event)
+	if err != nil {
+		return fmt.Errorf("failed to store audit event: %v", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) GetAuditEvents(ctx context.Context, limit int64) ([]AuditEvent, error) {
+	opts := options.Find().SetSort(bson.M{"time": -1}).SetLimit(limit)
+	cursor, err := s.audit.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *MongoStore) GetChunkReferences(ctx context.Context) (map[string]map[string]bool, error) {
+	opts := options.Find().SetProjection(bson.M{"chunks": 1})
+	cursor, err := s.files.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	references := make(map[string]map[string]bool)
+	for cursor.Next(ctx) {
+		var doc struct {
+			Chunks []struct {
+				ChunkID  string `bson:"chunkId"`
+				WorkerID string `bson:"workerId"`
+			} `bson:"chunks"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		for _, chunk := range doc.Chunks {
+			if references[chunk.WorkerID] == nil {
+				references[chunk.WorkerID] = make(map[string]bool)
+			}
+			references[chunk.WorkerID][chunk.ChunkID] = true
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return references, nil
+}
+
+func (s *MongoStore) ForEachFileDocument(ctx context.Context, fn func(FileDocument) error) error {
+	cursor, err := s.files.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc FileDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStore) ReplaceChunkRecord(ctx context.Context, filename string, old ChunkRecord, replacement ChunkRecord) error {
+	filter := bson.M{
+		"filename": filename,
+		"chunks": bson.M{"$elemMatch": bson.M{
+			"chunkId":  old.ChunkID,
+			"workerId": old.WorkerID,
+			"size":     old.Size,
+		}},
+	}
+	update := bson.M{"$set": bson.M{"chunks.$": replacement}}
+
+	result, err := s.files.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to replace chunk record: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return errChunkMoveStale
+	}
+	return nil
+}
+
+func (s *MongoStore) ReplaceFilePack(ctx context.Context, filename string, old PackRef, replacement PackRef) error {
+	filter := bson.M{
+		"filename":    filename,
+		"pack.packId": old.PackID,
+		"pack.offset": old.Offset,
+		"pack.length": old.Length,
+	}
+	result, err := s.files.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"pack": replacement}})
+	if err != nil {
+		return fmt.Errorf("failed to replace pack reference: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return errPackRefStale
+	}
+	return nil
+}
+
+func (s *MongoStore) GetChunkRecordsForWorker(ctx context.Context, workerID string) ([]WorkerChunkRef, error) {
+	cursor, err := s.files.Find(ctx, bson.M{"chunks.workerId": workerID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	refs := []WorkerChunkRef{}
+	for cursor.Next(ctx) {
+		var doc FileDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		for _, record := range doc.Chunks {
+			if record.WorkerID == workerID {
+				refs = append(refs, WorkerChunkRef{Filename: doc.Filename, Record: record})
+			}
+		}
+	}
+	return refs, cursor.Err()
+}
+
+func (s *MongoStore) GetWorkerUsage(ctx context.Context) (map[string]int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$unwind", Value: "$chunks"}},
+		{{Key: "$group", Value: bson.M{"_id": "$chunks.workerId", "bytes": bson.M{"$sum": "$chunks.size"}}}},
+	}
+	cursor, err := s.files.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	usage := make(map[string]int64)
+	for cursor.Next(ctx) {
+		var row struct {
+			WorkerID string `bson:"_id"`
+			Bytes    int64  `bson:"bytes"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		usage[row.WorkerID] = row.Bytes
+	}
+	return usage, cursor.Err()
+}
+
+func (s *MongoStore) StoreWorkerRecord(ctx context.Context, record WorkerRecord) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.workers.ReplaceOne(ctx, bson.M{"_id": record.ID}, record, opts)
+	if err != nil {
+		return fmt.Errorf("failed to store worker %s: %v", record.ID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) LoadWorkerRecords(ctx context.Context) ([]WorkerRecord, error) {
+	cursor, err := s.workers.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	records := []WorkerRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *MongoStore) DeleteWorkerRecord(ctx context.Context, id string) error {
+	_, err := s.workers.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *MongoStore) RenameWorkerInChunks(ctx context.Context, oldID, newID string) (int64, error) {
+	filter := bson.M{"chunks.workerId": oldID}
+	update := bson.M{"$set": bson.M{"chunks.$[chunk].workerId": newID}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"chunk.workerId": oldID}},
+	})
+
+	result, err := s.files.UpdateMany(ctx, filter, update, opts)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
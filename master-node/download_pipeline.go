@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// downloadChunk is one chunk of a file being downloaded
+type downloadChunk struct {
+	ChunkID   string
+	Index     int
+	WorkerIDs []string // Workers holding a replica, in the order they are tried
+	Size      int64    // Largest size recorded for a replica, 0 if unknown
+}
+
+// downloadChunks orders the chunk records of a file for a download. The replicas
+// of consecutive chunks are tried starting with different workers, so prefetches
+// spread over the cluster.
+func downloadChunks(records []ChunkRecord) []downloadChunk {
+	byID := make(map[string]*downloadChunk)
+	var chunks []*downloadChunk
+	for _, record := range records {
+		chunk, exists := byID[record.ChunkID]
+		if !exists {
+			chunk = &downloadChunk{ChunkID: record.ChunkID, Index: record.Index}
+			byID[record.ChunkID] = chunk
+			chunks = append(chunks, chunk)
+		}
+		chunk.WorkerIDs = append(chunk.WorkerIDs, record.WorkerID)
+		chunk.Size = max(chunk.Size, record.Size)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Index < chunks[j].Index
+	})
+
+	ordered := make([]downloadChunk, len(chunks))
+	for i, chunk := range chunks {
+		shift := i % len(chunk.WorkerIDs)
+		chunk.WorkerIDs = append(chunk.WorkerIDs[shift:], chunk.WorkerIDs[:shift]...)
+		ordered[i] = *chunk
+	}
+	return ordered
+}
+
+// prefetchedChunk is a chunk fetched into memory ahead of its turn
+type prefetchedChunk struct {
+	done     chan struct{} // Closed once data or err is set
+	data     []byte
+	err      error
+	reserved int64 // Bytes taken from the memory budget
+}
+
+// errPrefetchTooLarge stops a prefetch that outgrows the memory it reserved
+var errPrefetchTooLarge = errors.New("chunk is larger than the memory reserved for it")
+
+// downloadPipeline sends the chunks of a file to a client in order. While one
+// chunk is streamed straight from its worker, up to window of the following
+// chunks are fetched concurrently into memory. Prefetched chunks draw on a
+// memory budget shared by all downloads; a chunk that does not fit is streamed
+// when its turn comes, as is one whose prefetch failed.
+type downloadPipeline struct {
+	chunkManager *ChunkManager
+	budget       *semaphore.Weighted
+	window       int
+	retries      int
+}
+
+// Run writes every chunk to w and returns the number of bytes written
+func (p *downloadPipeline) Run(ctx context.Context, w io.Writer, chunks []downloadChunk) (written int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	prefetched := make([]*prefetchedChunk, len(chunks))
+	defer func() {
+		// Give back the memory of prefetches that were never sent
+		cancel()
+		for _, chunk := range prefetched {
+			if chunk != nil {
+				<-chunk.done
+				p.budget.Release(chunk.reserved)
+			}
+		}
+	}()
+
+	for i, chunk := range chunks {
+		for j := i + 1; j < len(chunks) && j <= i+p.window; j++ {
+			if prefetched[j] == nil {
+				prefetched[j] = p.prefetch(ctx, chunks[j])
+			}
+		}
+
+		if ahead := prefetched[i]; ahead != nil {
+			prefetched[i] = nil
+			<-ahead.done
+			if ahead.err == nil {
+				n, err := w.Write(ahead.data)
+				p.budget.Release(ahead.reserved)
+				written += int64(n)
+				if err != nil {
+					return written, err
+				}
+				continue
+			}
+			p.budget.Release(ahead.reserved)
+			slog.WarnContext(ctx, "Prefetching chunk failed, streaming it instead", "chunk", chunk.ChunkID, "error", ahead.err)
+		}
+
+		n, err := p.chunkManager.copyChunk(ctx, w, chunk.ChunkID, chunk.WorkerIDs, p.retries)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// prefetch starts fetching a chunk in the background. It returns nil if the
+// memory budget cannot hold the chunk right now.
+func (p *downloadPipeline) prefetch(ctx context.Context, chunk downloadChunk) *prefetchedChunk {
+	reserved := chunk.Size
+	if reserved <= 0 {
+		reserved = ChunkSize
+	}
+	if !p.budget.TryAcquire(reserved) {
+		return nil
+	}
+
+	prefetched := &prefetchedChunk{done: make(chan struct{}), reserved: reserved}
+	go func() {
+		defer close(prefetched.done)
+		buffer := &boundedBuffer{limit: reserved}
+		buffer.Grow(int(reserved))
+		if _, err := p.chunkManager.copyChunk(ctx, buffer, chunk.ChunkID, chunk.WorkerIDs, p.retries); err != nil {
+			prefetched.err = err
+			return
+		}
+		prefetched.data = buffer.Bytes()
+	}()
+	return prefetched
+}
+
+// boundedBuffer is a buffer that refuses to grow beyond limit bytes
+type boundedBuffer struct {
+	bytes.Buffer
+	limit int64
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.limit {
+		return 0, errPrefetchTooLarge
+	}
+	return b.Buffer.Write(p)
+}
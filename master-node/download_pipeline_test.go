@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDownloadChunksFollowRecordedIndex(t *testing.T) {
+	// Chunk IDs of a filename containing the separator do not sort by index
+	records := []ChunkRecord{
+		{ChunkID: "a_chunk_b_chunk_00000002", WorkerID: "w1", Index: 2},
+		{ChunkID: "a_chunk_b_chunk_00000000", WorkerID: "w2", Index: 0},
+		{ChunkID: "a_chunk_b_chunk_00000001", WorkerID: "w1", Index: 1},
+		{ChunkID: "a_chunk_b_chunk_00000000", WorkerID: "w1", Index: 0},
+	}
+	chunks := downloadChunks(records)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.Index != i || chunk.ChunkID != fmt.Sprintf("a_chunk_b_chunk_%08d", i) {
+			t.Fatalf("chunk %d is %+v", i, chunk)
+		}
+	}
+	if len(chunks[0].WorkerIDs) != 2 {
+		t.Fatalf("chunk 0 has replicas %v", chunks[0].WorkerIDs)
+	}
+}
+
+func TestConcurrentUploadsAndDownloadsKeepChunkOrder(t *testing.T) {
+	wm, _, _ := newTestCluster(t, 3)
+	previousChunkSize := ChunkSize
+	ChunkSize = 7
+	t.Cleanup(func() { ChunkSize = previousChunkSize })
+	fo := NewFileOperations(wm)
+
+	// Every file has many small chunks, each with distinct content
+	files := make(map[string][]byte)
+	for i := range 6 {
+		var data bytes.Buffer
+		for j := range 50 {
+			fmt.Fprintf(&data, "%d:%d;", i, j)
+		}
+		files[fmt.Sprintf("file_chunk_%d", i)] = data.Bytes()
+	}
+
+	var wg sync.WaitGroup
+	for filename, data := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := url.Values{"filename": {filename}, "size": {strconv.Itoa(len(data))}}
+			w := httptest.NewRecorder()
+			fo.uploadFile(w, httptest.NewRequest(http.MethodPost, "/upload?"+params.Encode(), bytes.NewReader(data)))
+			if w.Code != http.StatusOK {
+				t.Errorf("upload of %s returned %d: %s", filename, w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for filename, data := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			fo.downloadFile(w, httptest.NewRequest(http.MethodGet, "/download/"+filename, nil))
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+				t.Errorf("download of %s returned %d with %d bytes, want %d bytes in upload order", filename, w.Code, w.Body.Len(), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+}
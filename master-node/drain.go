@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DrainProgress tracks how many chunks have been moved off a draining worker
+type DrainProgress struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Total      int
+	Moved      int
+	Failed     int
+	Remaining  int
+	LastError  string
+}
+
+// DrainManager moves chunks off workers that are being decommissioned
+type DrainManager struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+	mu            sync.Mutex
+	running       map[string]context.CancelFunc
+}
+
+func NewDrainManager(wm *WorkerManager, cm *ChunkManager) *DrainManager {
+	return &DrainManager{
+		workerManager: wm,
+		chunkManager:  cm,
+		running:       make(map[string]context.CancelFunc),
+	}
+}
+
+// StartDrain puts a worker into draining state and starts moving its chunks in the background
+func (dm *DrainManager) StartDrain(workerID string) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if _, running := dm.running[workerID]; running {
+		return fmt.Errorf("worker %s is already being drained", workerID)
+	}
+
+	exists := dm.workerManager.updateWorker(workerID, func(worker *Worker) {
+		worker.State = WorkerStateDraining
+		worker.Drain = &DrainProgress{StartedAt: time.Now().UTC()}
+	})
+	if !exists {
+		return errWorkerNotFound
+	}
+	dm.workerManager.persistWorker(workerID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dm.running[workerID] = cancel
+	go dm.drain(ctx, workerID)
+
+	slog.Info("Started draining worker", "worker", workerID)
+	return nil
+}
+
+// CancelDrain stops a running drain and puts the worker back into rotation
+func (dm *DrainManager) CancelDrain(workerID string) error {
+	dm.mu.Lock()
+	if cancel, running := dm.running[workerID]; running {
+		cancel()
+		delete(dm.running, workerID)
+	}
+	dm.mu.Unlock()
+
+	exists := dm.workerManager.updateWorker(workerID, func(worker *Worker) {
+		worker.State = WorkerStateActive
+	})
+	if !exists {
+		return errWorkerNotFound
+	}
+	dm.workerManager.persistWorker(workerID)
+
+	slog.Info("Worker returned to active state", "worker", workerID)
+	return nil
+}
+
+func (dm *DrainManager) drain(ctx context.Context, workerID string) {
+	defer func() {
+		dm.mu.Lock()
+		delete(dm.running, workerID)
+		dm.mu.Unlock()
+	}()
+
+	refs, err := GetChunkRecordsForWorker(ctx, workerID)
+	if err != nil {
+		dm.recordError(workerID, fmt.Sprintf("failed to load chunk records: %v", err))
+		return
+	}
+	dm.workerManager.updateWorker(workerID, func(worker *Worker) {
+		worker.Drain.Total = len(refs)
+		worker.Drain.Remaining = len(refs)
+	})
+
+	for _, ref := range refs {
+		if ctx.Err() != nil {
+			slog.Info("Drain cancelled", "worker", workerID)
+			return
+		}
+
+		err := dm.moveOffWorker(ctx, ref)
+		dm.workerManager.updateWorker(workerID, func(worker *Worker) {
+			switch {
+			case err == nil, errors.Is(err, errChunkMoveStale):
+				worker.Drain.Moved++
+			default:
+				worker.Drain.Failed++
+				worker.Drain.LastError = err.Error()
+			}
+		})
+		if err != nil && !errors.Is(err, errChunkMoveStale) {
+			slog.Warn("Failed to move chunk off draining worker", "chunk", ref.Record.ChunkID, "worker", workerID, "error", err)
+		}
+	}
+
+	// Only declare the worker drained once nothing references it anymore
+	remaining, err := GetChunkRecordsForWorker(ctx, workerID)
+	if err != nil {
+		dm.recordError(workerID, fmt.Sprintf("failed to verify drain: %v", err))
+		return
+	}
+	dm.workerManager.updateWorker(workerID, func(worker *Worker) {
+		worker.Drain.Remaining = len(remaining)
+		worker.Drain.FinishedAt = time.Now().UTC()
+		if len(remaining) == 0 && worker.State == WorkerStateDraining {
+			worker.State = WorkerStateDrained
+		}
+	})
+	dm.workerManager.persistWorker(workerID)
+	slog.Info("Drain finished", "worker", workerID, "remaining", len(remaining))
+}
+
+// StopDrains stops every running drain without changing worker state, so
+// another master can resume them
+func (dm *DrainManager) StopDrains() {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for workerID, cancel := range dm.running {
+		cancel()
+		delete(dm.running, workerID)
+		slog.Info("Stopped draining worker", "worker", workerID)
+	}
+}
+
+// ResumeDrains restarts the drains that were in progress when the master stopped
+func (dm *DrainManager) ResumeDrains() {
+	for id, worker := range dm.workerManager.GetWorkers() {
+		if worker.State != WorkerStateDraining {
+			continue
+		}
+		if err := dm.StartDrain(id); err != nil {
+			slog.Error("Failed to resume drain", "worker", id, "error", err)
+		}
+	}
+}
+
+// moveOffWorker moves one chunk to an active worker that does not already hold a replica of it
+func (dm *DrainManager) moveOffWorker(ctx context.Context, ref WorkerChunkRef) error {
+	holders, err := GetChunkHolders(ctx, ref.Filename, ref.Record.ChunkID)
+	if err != nil {
+		return err
+	}
+
+	// The new replica is spread away from the replicas that stay where they are
+	var remaining []string
+	for workerID := range holders {
+		if workerID != ref.Record.WorkerID {
+			remaining = append(remaining, workerID)
+		}
+	}
+
+	targets := dm.workerManager.SelectWorkers(1, remaining, holders)
+	if len(targets) == 0 {
+		return fmt.Errorf("no active worker available for chunk %s", ref.Record.ChunkID)
+	}
+
+	// The draining worker is copied from first, but if it is unreachable or lost
+	// the chunk, any other replica will do, as in replica repair
+	sources := append([]string{ref.Record.WorkerID}, remaining...)
+	for _, source := range sources {
+		err = dm.chunkManager.replaceReplica(ctx, ref.Filename, ref.Record, source, targets[0])
+		if err == nil || errors.Is(err, errChunkMoveStale) {
+			break
+		}
+		slog.WarnContext(ctx, "Failed to copy chunk off draining worker", "chunk", ref.Record.ChunkID,
+			"worker", ref.Record.WorkerID, "source", source, "error", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := dm.chunkManager.deleteChunkFromWorker(ctx, ref.Record.WorkerID, ref.Record.ChunkID); err != nil {
+		// The metadata no longer references the old copy, so GC will collect it
+		slog.WarnContext(ctx, "Moved chunk but failed to remove the old copy", "chunk", ref.Record.ChunkID, "worker", ref.Record.WorkerID, "error", err)
+	}
+	slog.InfoContext(ctx, "Moved chunk", "chunk", ref.Record.ChunkID, "filename", ref.Filename, "from", ref.Record.WorkerID, "to", targets[0])
+	return nil
+}
+
+func (dm *DrainManager) recordError(workerID, message string) {
+	slog.Error("Drain failed", "worker", workerID, "error", message)
+	dm.workerManager.updateWorker(workerID, func(worker *Worker) {
+		worker.Drain.LastError = message
+	})
+}
+
+// RemoveWorker forgets a drained worker. Workers still referenced by metadata cannot be removed.
+func (dm *DrainManager) RemoveWorker(ctx context.Context, workerID string) error {
+	if _, exists := dm.workerManager.GetWorker(workerID); !exists {
+		return errWorkerNotFound
+	}
+
+	refs, err := GetChunkRecordsForWorker(ctx, workerID)
+	if err != nil {
+		return fmt.Errorf("failed to load chunk records: %v", err)
+	}
+	if len(refs) > 0 {
+		return fmt.Errorf("worker %s still holds %d referenced chunks", workerID, len(refs))
+	}
+
+	return dm.workerManager.RemoveWorker(ctx, workerID)
+}
+
+func (dm *DrainManager) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	id, err := getRequiredParam(r, "id")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = dm.StartDrain(id)
+	if errors.Is(err, errWorkerNotFound) {
+		writeErrorResponse(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Draining worker %s", id))
+}
+
+func (dm *DrainManager) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	id, err := getRequiredParam(r, "id")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := dm.CancelDrain(id); err != nil {
+		writeErrorResponse(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Worker %s is active again", id))
+}
+
+func (dm *DrainManager) handleRemove(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	id, err := getRequiredParam(r, "id")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	err = dm.RemoveWorker(ctx, id)
+	if errors.Is(err, errWorkerNotFound) {
+		writeErrorResponse(w, "Worker not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Worker %s removed", id))
+}
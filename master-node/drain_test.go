@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForDrain waits until the drain of a worker has finished
+func waitForDrain(t *testing.T, dm *DrainManager, workerID string) Worker {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		dm.mu.Lock()
+		_, running := dm.running[workerID]
+		dm.mu.Unlock()
+		if worker, _ := dm.workerManager.GetWorker(workerID); !running && worker.Drain != nil && !worker.Drain.FinishedAt.IsZero() {
+			return worker
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("drain of %s did not finish", workerID)
+	return Worker{}
+}
+
+func TestDrainMovesEveryChunk(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 3)
+	dm := NewDrainManager(wm, cm)
+	chunks := [][]byte{[]byte("one"), []byte("two"), []byte("three"), []byte("four")}
+	storeTestFile(t, "a", chunks, workers[0], workers[1])
+	storeTestFile(t, "b", chunks[:2], workers[0])
+
+	// Listing and persisting the workers while the drain updates its progress must not race
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			w := httptest.NewRecorder()
+			wm.listWorkers(w, httptest.NewRequest(http.MethodGet, "/workers", nil))
+			var listed map[string]Worker
+			if err := json.NewDecoder(w.Body).Decode(&listed); err != nil {
+				t.Errorf("failed to decode workers: %v", err)
+				return
+			}
+			wm.persistWorker("w1")
+		}
+	}()
+
+	defer wg.Wait()
+	defer close(stop)
+
+	must(t, dm.StartDrain("w1"))
+	worker := waitForDrain(t, dm, "w1")
+
+	if worker.State != WorkerStateDrained {
+		t.Errorf("worker state %s after drain, want %s", worker.State, WorkerStateDrained)
+	}
+	if worker.Drain.Total != 6 || worker.Drain.Moved != 6 || worker.Drain.Failed != 0 || worker.Drain.Remaining != 0 {
+		t.Errorf("drain progress %+v", *worker.Drain)
+	}
+	if n := workers[0].chunkCount(); n != 0 {
+		t.Errorf("drained worker still holds %d chunks", n)
+	}
+
+	// Every chunk keeps its replicas, and no two replicas share a worker
+	ctx := testContext(t)
+	refs, err := GetChunkRecordsForWorker(ctx, "w1")
+	must(t, err)
+	if len(refs) != 0 {
+		t.Errorf("metadata still references the drained worker: %+v", refs)
+	}
+	for filename, want := range map[string]int{"a": 2, "b": 1} {
+		doc, err := GetFileDocument(ctx, filename)
+		must(t, err)
+		holders := make(map[string]map[string]bool)
+		for _, record := range doc.Chunks {
+			if holders[record.ChunkID] == nil {
+				holders[record.ChunkID] = make(map[string]bool)
+			}
+			holders[record.ChunkID][record.WorkerID] = true
+		}
+		for chunkID, workerIDs := range holders {
+			if len(workerIDs) != want {
+				t.Errorf("chunk %s is held by %v, want %d distinct workers", chunkID, workerIDs, want)
+			}
+		}
+	}
+
+	// A drained worker can be removed, which is refused while it holds chunks
+	if err := dm.RemoveWorker(ctx, "w2"); err == nil {
+		t.Errorf("removed a worker that still holds chunks")
+	}
+	must(t, dm.RemoveWorker(ctx, "w1"))
+}
+
+func TestDrainCopiesFromOtherReplicasWhenTheWorkerIsUnreachable(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 3)
+	dm := NewDrainManager(wm, cm)
+	chunks := [][]byte{[]byte("one"), []byte("two")}
+	storeTestFile(t, "a", chunks, workers[0], workers[1])
+	workers[0].setFailing(true)
+
+	must(t, dm.StartDrain("w1"))
+	worker := waitForDrain(t, dm, "w1")
+
+	if worker.State != WorkerStateDrained || worker.Drain.Moved != 2 || worker.Drain.Failed != 0 {
+		t.Fatalf("drain of an unreachable worker ended %s with progress %+v", worker.State, *worker.Drain)
+	}
+	for i, data := range chunks {
+		if got, exists := workers[2].chunk(fmt.Sprintf("a_chunk_%08d", i)); !exists || string(got) != string(data) {
+			t.Errorf("chunk %d was not copied from the other replica: %q", i, got)
+		}
+	}
+}
@@ -4,38 +4,35 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/sync/semaphore"
 )
 
 type FileOperations struct {
-	workerManager *WorkerManager
-	chunkManager  *ChunkManager
-}
-
-// extractChunkIndex extracts the chunk index from chunk ID for proper sorting
-func extractChunkIndex(chunkID string) int {
-	// ChunkID format: filename_chunk_########
-	parts := strings.Split(chunkID, "_chunk_")
-	if len(parts) != 2 {
-		return 0 // fallback for malformed chunk IDs
-	}
-
-	index, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return 0 // fallback for invalid index
-	}
-	return index
+	workerManager  *WorkerManager
+	chunkManager   *ChunkManager
+	packer         *Packer             // Packs small files, nil when packing is off
+	uploadBudget   *semaphore.Weighted // Memory all uploads may use for chunks in flight
+	downloadBudget *semaphore.Weighted // Memory all downloads may use for prefetched chunks
 }
 
 func NewFileOperations(wm *WorkerManager) *FileOperations {
 	cm := NewChunkManager(wm, MaxConcurrentUploads)
+	var packer *Packer
+	if PackThreshold > 0 {
+		packer = NewPacker(wm, cm, PackSize)
+	}
 	return &FileOperations{
-		workerManager: wm,
-		chunkManager:  cm,
+		workerManager:  wm,
+		chunkManager:   cm,
+		packer:         packer,
+		uploadBudget:   semaphore.NewWeighted(UploadMemoryBudget),
+		downloadBudget: semaphore.NewWeighted(DownloadMemoryBudget),
 	}
 }
 
@@ -68,6 +65,14 @@ func (fo *FileOperations) uploadFile(w http.ResponseWriter, r *http.Request) {
 		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if isPackFile(filename) {
+		writeErrorResponse(w, fmt.Sprintf("Files starting with %s are internal", PackFilePrefix), http.StatusBadRequest)
+		return
+	}
+	if len(filename) > MaxFilenameLength {
+		writeErrorResponse(w, fmt.Sprintf("Filename is longer than %d bytes", MaxFilenameLength), http.StatusBadRequest)
+		return
+	}
 
 	// Get file size parameter
 	sizeParam, err := getRequiredParam(r, "size")
@@ -82,8 +87,28 @@ func (fo *FileOperations) uploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Request Header: %s", r.Header)
-	log.Printf("Uploading file %s with size %d bytes", filename, fileSize)
+	tags := parseTags(r.URL.Query().Get("tags"))
+
+	bypass, err := bypassFromRequest(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Overwriting an existing file is subject to its retention settings
+	ctx, cancel := context.WithTimeout(r.Context(), DatabaseTimeout)
+	err = enforceRetention(ctx, filename, "overwrite", bypass)
+	cancel()
+	if isRetentionError(err) {
+		writeErrorResponse(w, fmt.Sprintf("Cannot overwrite file %s: %v", filename, err), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Uploading file", "filename", filename, "size", fileSize)
 
 	// Check Content-Type to determine if it's multipart form data or raw file
 	contentType := r.Header.Get("Content-Type")
@@ -110,14 +135,19 @@ func (fo *FileOperations) uploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Use streaming coordinator
-	streamCoordinator := NewStreamCoordinator(fo.workerManager, fo.chunkManager)
-	err = streamCoordinator.StreamUpload(filename, fileReader, fileSize)
+	start := time.Now()
+	streamCoordinator := NewStreamCoordinator(fo.workerManager, fo.chunkManager, fo.uploadBudget, fo.packer)
+	err = streamCoordinator.StreamUpload(r.Context(), filename, meteredReader{fileReader, uploadBytesTotal}, fileSize, tags)
+	uploadDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		uploadsTotal.WithLabelValues(resultError).Inc()
+		errorsTotal.WithLabelValues(errorUpload).Inc()
 		writeErrorResponse(w, fmt.Sprintf("Streaming upload failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("File %s uploaded successfully via streaming", filename)
+	uploadsTotal.WithLabelValues(resultSuccess).Inc()
+	slog.InfoContext(r.Context(), "File uploaded", "filename", filename)
 	writeSuccessResponse(w, fmt.Sprintf("File %s uploaded successfully via streaming", filename))
 }
 
@@ -132,57 +162,72 @@ func (fo *FileOperations) downloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	ctx, cancel := context.WithTimeout(r.Context(), DatabaseTimeout)
 	defer cancel()
 
-	fileChunks, err := GetFileMetadata(ctx, filename)
+	// Every return below is a failed download until the last chunk is written
+	start := time.Now()
+	result := resultError
+	defer func() {
+		downloadDuration.Observe(time.Since(start).Seconds())
+		downloadsTotal.WithLabelValues(result).Inc()
+		if result == resultError {
+			errorsTotal.WithLabelValues(errorDownload).Inc()
+		}
+	}()
+
+	// A packed file is read from the chunk of its pack
+	doc, err := GetFileDocument(ctx, filename)
+	if err == nil && doc.Pack != nil {
+		doc.Chunks, err = GetFileChunkRecords(ctx, packFilename(doc.Pack.PackID))
+	}
 	if err != nil {
-		log.Printf("Failed to retrieve file metadata for %s: %v", filename, err)
+		slog.ErrorContext(ctx, "Failed to retrieve file metadata", "filename", filename, "error", err)
 		writeErrorResponse(w, "Failed to retrieve file metadata", http.StatusInternalServerError)
 		return
 	}
-
-	// Sort chunk IDs to ensure correct order
-	var chunkIDs []string
-	for chunkID := range fileChunks {
-		chunkIDs = append(chunkIDs, chunkID)
-	}
-
-	// Sort by extracting chunk index for proper numerical ordering
-	sort.Slice(chunkIDs, func(i, j int) bool {
-		// Extract chunk indices from chunk IDs (format: filename_chunk_########)
-		iIndex := extractChunkIndex(chunkIDs[i])
-		jIndex := extractChunkIndex(chunkIDs[j])
-		return iIndex < jIndex
-	})
+	chunks := downloadChunks(doc.Chunks)
 
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 	w.Header().Set("Content-Type", ContentTypeOctetStream)
 
-	for _, chunkID := range chunkIDs {
-		workerIDs := fileChunks[chunkID]
-		var chunkData []byte
-		for _, workerID := range workerIDs {
-			chunkData, err = fo.chunkManager.fetchChunkFromWorker(workerID, chunkID)
-			if err == nil {
-				break
-			}
-			log.Printf("Failed to fetch chunk %s from worker %s: %v", chunkID, workerID, err)
-		}
-
-		if err != nil {
-			log.Printf("Failed to fetch chunk %s from all workers: %v", chunkID, err)
-			writeErrorResponse(w, fmt.Sprintf("Failed to fetch chunk %s from all workers", chunkID), http.StatusInternalServerError)
-			return
-		}
+	// The chunk in turn is piped from its worker to the client while the next
+	// ones are prefetched from other workers
+	pipeline := &downloadPipeline{
+		chunkManager: fo.chunkManager,
+		budget:       fo.downloadBudget,
+		window:       DownloadPrefetch,
+		retries:      DownloadRetries,
+	}
+	out := &recordingWriter{writer: w}
+	var written int64
+	if doc.Pack != nil {
+		written, err = fo.copyPackedFile(r.Context(), out, *doc.Pack, chunks)
+	} else {
+		written, err = pipeline.Run(r.Context(), out, chunks)
+	}
+	downloadBytesTotal.Add(float64(written))
+	if err != nil && written == 0 && out.err == nil {
+		slog.ErrorContext(r.Context(), "Failed to fetch file from all workers", "filename", filename, "error", err)
+		writeErrorResponse(w, fmt.Sprintf("Failed to fetch file %s from all workers", filename), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		// The status went out with the first bytes, so the connection is cut
+		// instead, which the client cannot mistake for a complete file
+		slog.ErrorContext(r.Context(), "Download aborted", "filename", filename, "bytes", written, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	slog.DebugContext(r.Context(), "File written to response", "filename", filename, "chunks", len(chunks), "bytes", written)
+	result = resultSuccess
+}
 
-		_, err = w.Write(chunkData)
-		if err != nil {
-			log.Printf("Failed to write chunk %s to response: %v", chunkID, err)
-			return
-		}
-		log.Printf("Chunk %s written to response", chunkID)
+// copyPackedFile writes the range of a pack chunk holding a packed file
+func (fo *FileOperations) copyPackedFile(ctx context.Context, w io.Writer, ref PackRef, chunks []downloadChunk) (int64, error) {
+	if len(chunks) != 1 {
+		return 0, fmt.Errorf("pack %s has %d chunks, expected 1", ref.PackID, len(chunks))
 	}
+	return fo.chunkManager.copyChunkRange(ctx, w, chunks[0].ChunkID, chunks[0].WorkerIDs, ref.Offset, ref.Length, DownloadRetries)
 }
 
 func (fo *FileOperations) deleteFile(w http.ResponseWriter, r *http.Request) {
@@ -191,42 +236,68 @@ func (fo *FileOperations) deleteFile(w http.ResponseWriter, r *http.Request) {
 		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if isPackFile(filename) {
+		writeErrorResponse(w, fmt.Sprintf("Files starting with %s are internal", PackFilePrefix), http.StatusBadRequest)
+		return
+	}
+
+	bypass, err := bypassFromRequest(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	// A delete that has started finishes even if the client goes away
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), DatabaseTimeout)
 	defer cancel()
 
-	fileChunks, err := GetFileMetadata(ctx, filename)
+	err = fo.DeleteFile(ctx, filename, bypass)
+	if isRetentionError(err) {
+		writeErrorResponse(w, fmt.Sprintf("Cannot delete file %s: %v", filename, err), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to retrieve file metadata for %s: %v", filename, err)
-		writeErrorResponse(w, "Failed to retrieve file metadata", http.StatusInternalServerError)
+		errorsTotal.WithLabelValues(errorDelete).Inc()
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	writeSuccessResponse(w, fmt.Sprintf("File %s deleted successfully", filename))
+}
 
-	for chunkID, workerIDs := range fileChunks {
-		for _, workerID := range workerIDs {
-			err = fo.chunkManager.deleteChunkFromWorker(workerID, chunkID)
-			if err == nil {
-				break
-			}
-			log.Printf("Failed to delete chunk %s from worker %s: %v", chunkID, workerID, err)
-		}
+// DeleteFile removes the metadata of a file and then its chunks from the workers.
+// It is the single delete path shared by the HTTP handler and background jobs,
+// and refuses to delete files under retention unless governance is bypassed.
+// Replicas that cannot be deleted are no longer referenced once the metadata is
+// gone, so garbage collection removes them later.
+func (fo *FileOperations) DeleteFile(ctx context.Context, filename string, bypass *governanceBypass) error {
+	if err := enforceRetention(ctx, filename, "delete", bypass); err != nil {
+		return err
+	}
 
-		if err != nil {
-			log.Printf("Failed to delete chunk %s from all workers: %v", chunkID, err)
-			writeErrorResponse(w, fmt.Sprintf("Failed to delete chunk %s from all workers", chunkID), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Deleted chunk %s for file %s", chunkID, filename)
+	fileChunks, err := GetFileMetadata(ctx, filename)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve file metadata", "filename", filename, "error", err)
+		return fmt.Errorf("failed to retrieve file metadata")
 	}
 
 	err = DeleteFileMetadata(ctx, filename)
 	if err != nil {
-		log.Printf("Failed to delete file metadata for %s: %v", filename, err)
-		writeErrorResponse(w, "Failed to delete file metadata", http.StatusInternalServerError)
-		return
+		slog.ErrorContext(ctx, "Failed to delete file metadata", "filename", filename, "error", err)
+		return fmt.Errorf("failed to delete file metadata")
 	}
-	log.Printf("Deleted file metadata for %s", filename)
-	writeSuccessResponse(w, fmt.Sprintf("File %s deleted successfully", filename))
+
+	leftover := 0
+	for chunkID, workerIDs := range fileChunks {
+		for _, workerID := range workerIDs {
+			if err := fo.chunkManager.deleteChunkFromWorker(ctx, workerID, chunkID); err != nil {
+				slog.WarnContext(ctx, "Failed to delete chunk replica, leaving it for garbage collection", "chunk", chunkID, "worker", workerID, "error", err)
+				leftover++
+			}
+		}
+		slog.DebugContext(ctx, "Deleted chunk", "chunk", chunkID, "filename", filename)
+	}
+	slog.InfoContext(ctx, "Deleted file", "filename", filename, "leftoverReplicas", leftover)
+	return nil
 }
 
 func (fo *FileOperations) listFiles(w http.ResponseWriter, r *http.Request) {
@@ -234,20 +305,20 @@ func (fo *FileOperations) listFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	ctx, cancel := context.WithTimeout(r.Context(), DatabaseTimeout)
 	defer cancel()
 
 	files, err := GetAllFilenames(ctx)
 	if err != nil {
-		log.Printf("Failed to retrieve file metadata from database: %v", err)
+		slog.ErrorContext(ctx, "Failed to list files", "error", err)
 		writeErrorResponse(w, "Failed to retrieve file metadata", http.StatusInternalServerError)
 		return
 	}
 
 	if err := writeJSONResponse(w, files); err != nil {
-		log.Printf("Failed to encode file metadata: %v", err)
+		slog.ErrorContext(ctx, "Failed to encode file list", "error", err)
 		writeErrorResponse(w, "Failed to encode file metadata", http.StatusInternalServerError)
 		return
 	}
-	log.Println("File list with metadata successfully retrieved")
+	slog.DebugContext(ctx, "File list retrieved", "files", len(files))
 }
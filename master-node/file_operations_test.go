@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeleteFileWithLostAndUnreachableReplicas(t *testing.T) {
+	wm, _, workers := newTestCluster(t, 2)
+	fo := NewFileOperations(wm)
+	ctx := testContext(t)
+	storeTestFile(t, "a", [][]byte{[]byte("one"), []byte("two")}, workers[0], workers[1])
+
+	// One replica is lost and the other worker is down
+	workers[1].drop("a_chunk_00000000")
+	workers[0].setFailing(true)
+	must(t, fo.DeleteFile(ctx, "a", nil))
+
+	if _, err := GetFileDocument(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("metadata of the deleted file: %v, want ErrNotFound", err)
+	}
+	if n := workers[1].chunkCount(); n != 0 {
+		t.Errorf("reachable worker still holds %d chunks", n)
+	}
+	// The unreachable worker's replicas are left for garbage collection
+	workers[0].setFailing(false)
+	if n := workers[0].chunkCount(); n != 2 {
+		t.Errorf("unreachable worker holds %d chunks, want its 2 leftovers", n)
+	}
+}
+
+func TestDeleteFileMissingReplicaCountsAsDeleted(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 1)
+	ctx := testContext(t)
+	storeTestFile(t, "a", [][]byte{[]byte("one")}, workers[0])
+	workers[0].drop("a_chunk_00000000")
+
+	if err := cm.deleteChunkFromWorker(ctx, "w1", "a_chunk_00000000"); err != nil {
+		t.Fatalf("deleting a missing chunk failed: %v", err)
+	}
+	must(t, NewFileOperations(wm).DeleteFile(ctx, "a", nil))
+	if _, err := GetFileDocument(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("metadata of the deleted file: %v, want ErrNotFound", err)
+	}
+}
+
+func TestFailedUploadKeepsPreviousVersion(t *testing.T) {
+	wm, _, workers := newTestCluster(t, 2)
+	previousChunkSize, previousReplication := ChunkSize, ReplicationFactor
+	ChunkSize, ReplicationFactor = 4, 2
+	t.Cleanup(func() { ChunkSize, ReplicationFactor = previousChunkSize, previousReplication })
+	fo := NewFileOperations(wm)
+
+	upload := func(data string) int {
+		w := httptest.NewRecorder()
+		fo.uploadFile(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/upload?filename=a&size=%d", len(data)), strings.NewReader(data)))
+		return w.Code
+	}
+	download := func() string {
+		w := httptest.NewRecorder()
+		fo.downloadFile(w, httptest.NewRequest(http.MethodGet, "/download/a", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("download returned %d: %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	if code := upload("version one"); code != http.StatusOK {
+		t.Fatalf("first upload returned %d", code)
+	}
+	first, err := GetFileChunkRecords(testContext(t), "a")
+	must(t, err)
+
+	// A replica fails, so the new version is dropped. Staged chunks a worker stored
+	// after the upload gave up on them are left for garbage collection.
+	workers[1].setFailing(true)
+	if code := upload("the second version"); code != http.StatusInternalServerError {
+		t.Fatalf("upload with a failing worker returned %d", code)
+	}
+	workers[1].setFailing(false)
+	if got := download(); got != "version one" {
+		t.Fatalf("file holds %q after the failed upload", got)
+	}
+	records, err := GetFileChunkRecords(testContext(t), "a")
+	must(t, err)
+	if fmt.Sprint(records) != fmt.Sprint(first) {
+		t.Fatalf("failed upload changed the chunk records to %v", records)
+	}
+
+	// A successful upload replaces the file and removes the chunks of the old version
+	if code := upload("the second version"); code != http.StatusOK {
+		t.Fatalf("second upload returned %d", code)
+	}
+	if got := download(); got != "the second version" {
+		t.Fatalf("file holds %q after the second upload", got)
+	}
+	for _, record := range first {
+		for _, fw := range workers {
+			if _, exists := fw.chunk(record.ChunkID); exists {
+				t.Fatalf("chunk %s of the old version is still stored on %s", record.ChunkID, fw.id)
+			}
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Problem types reported by the consistency checker
+const (
+	FsckZeroSize           = "zero-size"
+	FsckMissingChunkIndex  = "missing-chunk-index"
+	FsckDuplicateChunk     = "duplicate-chunk-record"
+	FsckFileSizeMismatch   = "file-size-mismatch"
+	FsckChunkMissing       = "chunk-missing"
+	FsckChunkUnreachable   = "chunk-unreachable"
+	FsckChunkSizeMismatch  = "chunk-size-mismatch"
+	FsckChecksumMismatch   = "checksum-mismatch"
+	FsckNoReadableReplicas = "no-readable-replica"
+	FsckSpreadViolation    = "replica-spread-violation"
+	FsckPackMissing        = "pack-missing"
+	FsckPackRange          = "pack-range"
+)
+
+// ChunkStat is a worker's answer about a single chunk
+type ChunkStat struct {
+	ChunkID  string `json:"chunkId"`
+	Exists   bool   `json:"exists"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// FsckProblem is a single inconsistency found by the checker
+type FsckProblem struct {
+	Filename string `json:"filename"`
+	Type     string `json:"type"`
+	ChunkID  string `json:"chunkId,omitempty"`
+	WorkerID string `json:"workerId,omitempty"`
+	Index    int    `json:"index"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// FsckReport is the machine-readable result of a consistency check
+type FsckReport struct {
+	StartedAt       time.Time     `json:"startedAt"`
+	FinishedAt      time.Time     `json:"finishedAt"`
+	VerifyChecksums bool          `json:"verifyChecksums"`
+	FilesChecked    int           `json:"filesChecked"`
+	ChunksChecked   int           `json:"chunksChecked"`
+	UnreadableFiles []string      `json:"unreadableFiles"`
+	Problems        []FsckProblem `json:"problems"`
+	Healthy         bool          `json:"healthy"`
+}
+
+// ConsistencyChecker verifies that every file in the metadata is fully readable
+type ConsistencyChecker struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+}
+
+func NewConsistencyChecker(wm *WorkerManager, cm *ChunkManager) *ConsistencyChecker {
+	return &ConsistencyChecker{
+		workerManager: wm,
+		chunkManager:  cm,
+	}
+}
+
+// Run walks every file document and checks its chunk records against the workers
+func (cc *ConsistencyChecker) Run(ctx context.Context, verifyChecksums bool) (*FsckReport, error) {
+	report := &FsckReport{
+		StartedAt:       time.Now().UTC(),
+		VerifyChecksums: verifyChecksums,
+		UnreadableFiles: []string{},
+		Problems:        []FsckProblem{},
+	}
+
+	workers := cc.workerManager.GetWorkers()
+	cluster := make([]Worker, 0, len(workers))
+	for _, worker := range workers {
+		cluster = append(cluster, worker)
+	}
+
+	packSizes := make(map[string]int64)
+	err := ForEachFileDocument(ctx, func(doc FileDocument) error {
+		report.FilesChecked++
+		var problems []FsckProblem
+		var readable bool
+		if doc.Pack != nil {
+			problems, readable = cc.checkPackedFile(ctx, doc, packSizes)
+		} else {
+			problems, readable = cc.checkFile(doc, verifyChecksums)
+		}
+		problems = append(problems, checkSpread(doc, workers, cluster)...)
+		report.ChunksChecked += len(doc.Chunks)
+		report.Problems = append(report.Problems, problems...)
+		if !readable {
+			report.UnreadableFiles = append(report.UnreadableFiles, doc.Filename)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk file metadata: %v", err)
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	report.Healthy = len(report.Problems) == 0
+	return report, nil
+}
+
+// checkFile checks the chunk records of one file. It reports whether every
+// chunk index has at least one readable replica.
+func (cc *ConsistencyChecker) checkFile(doc FileDocument, verifyChecksums bool) ([]FsckProblem, bool) {
+	var problems []FsckProblem
+	report := func(problem FsckProblem) {
+		problem.Filename = doc.Filename
+		problems = append(problems, problem)
+	}
+
+	// Packs start empty and grow with every packed file, so their size is not recorded
+	pack := isPackFile(doc.Filename)
+	if doc.Size == 0 && !pack {
+		report(FsckProblem{Type: FsckZeroSize, Detail: fmt.Sprintf("%d chunk records", len(doc.Chunks))})
+	}
+
+	// Group replicas by chunk index and detect duplicate records
+	replicas := make(map[int][]ChunkRecord)
+	chunkIDByIndex := make(map[int]string)
+	seen := make(map[string]bool)
+	for _, record := range doc.Chunks {
+		index := record.Index
+
+		key := record.ChunkID + "@" + record.WorkerID
+		if seen[key] {
+			report(FsckProblem{Type: FsckDuplicateChunk, ChunkID: record.ChunkID, WorkerID: record.WorkerID, Index: index,
+				Detail: "chunk recorded more than once on the same worker"})
+			continue
+		}
+		seen[key] = true
+
+		if existing, ok := chunkIDByIndex[index]; ok && existing != record.ChunkID {
+			report(FsckProblem{Type: FsckDuplicateChunk, ChunkID: record.ChunkID, WorkerID: record.WorkerID, Index: index,
+				Detail: fmt.Sprintf("index also used by chunk %s", existing)})
+			continue
+		}
+		chunkIDByIndex[index] = record.ChunkID
+		replicas[index] = append(replicas[index], record)
+	}
+
+	// Every index from 0 to the expected chunk count must be present
+	expectedChunks := int((doc.Size + ChunkSize - 1) / ChunkSize)
+	lastIndex := expectedChunks - 1
+	for index := range replicas {
+		if index > lastIndex {
+			lastIndex = index
+		}
+	}
+	for index := 0; index <= lastIndex; index++ {
+		if _, ok := replicas[index]; !ok {
+			report(FsckProblem{Type: FsckMissingChunkIndex, Index: index})
+		}
+	}
+
+	readable := len(replicas) == lastIndex+1
+	var totalSize int64
+	for index, records := range replicas {
+		indexReadable := false
+		var indexSize int64
+		for _, record := range records {
+			if cc.checkReplica(record, index, verifyChecksums, report) {
+				indexReadable = true
+				indexSize = record.Size
+			}
+		}
+		if !indexReadable {
+			readable = false
+			report(FsckProblem{Type: FsckNoReadableReplicas, ChunkID: chunkIDByIndex[index], Index: index})
+		}
+		totalSize += indexSize
+	}
+
+	if readable && totalSize != doc.Size && !hasUnknownSizes(doc.Chunks) && !pack {
+		report(FsckProblem{Type: FsckFileSizeMismatch, Detail: fmt.Sprintf("metadata size %d, chunks add up to %d", doc.Size, totalSize)})
+	}
+	return problems, readable
+}
+
+// checkPackedFile checks that the pack of a packed file exists and covers its data.
+// The pack chunk itself is checked along with the pack. packSizes caches the size
+// of every pack seen so far, or -1 for missing packs.
+func (cc *ConsistencyChecker) checkPackedFile(ctx context.Context, doc FileDocument, packSizes map[string]int64) ([]FsckProblem, bool) {
+	ref := *doc.Pack
+	size, known := packSizes[ref.PackID]
+	if !known {
+		size = -1
+		if pack, err := GetFileDocument(ctx, packFilename(ref.PackID)); err == nil {
+			size = 0
+			for _, record := range pack.Chunks {
+				size = max(size, record.Size)
+			}
+		}
+		packSizes[ref.PackID] = size
+	}
+
+	problem := FsckProblem{Filename: doc.Filename, Detail: fmt.Sprintf("pack %s, offset %d, length %d", ref.PackID, ref.Offset, ref.Length)}
+	switch {
+	case size < 0:
+		problem.Type = FsckPackMissing
+	case ref.Offset+ref.Length > size:
+		problem.Type = FsckPackRange
+		problem.Detail += fmt.Sprintf(", pack holds %d bytes", size)
+	default:
+		return nil, true
+	}
+	return []FsckProblem{problem}, false
+}
+
+// checkReplica checks a single chunk replica on its worker and reports whether it is readable
+func (cc *ConsistencyChecker) checkReplica(record ChunkRecord, index int, verifyChecksums bool, report func(FsckProblem)) bool {
+	problem := FsckProblem{ChunkID: record.ChunkID, WorkerID: record.WorkerID, Index: index}
+
+	stat, err := cc.chunkManager.statChunkOnWorker(record.WorkerID, record.ChunkID, verifyChecksums && record.Checksum != "")
+	if err != nil {
+		problem.Type = FsckChunkUnreachable
+		problem.Detail = err.Error()
+		report(problem)
+		return false
+	}
+	if !stat.Exists {
+		problem.Type = FsckChunkMissing
+		report(problem)
+		return false
+	}
+	if record.Size > 0 && stat.Size != record.Size {
+		problem.Type = FsckChunkSizeMismatch
+		problem.Detail = fmt.Sprintf("recorded %d bytes, worker has %d", record.Size, stat.Size)
+		report(problem)
+		return false
+	}
+	if stat.Checksum != "" && stat.Checksum != record.Checksum {
+		problem.Type = FsckChecksumMismatch
+		problem.Detail = fmt.Sprintf("recorded %s, worker has %s", record.Checksum, stat.Checksum)
+		report(problem)
+		return false
+	}
+	return true
+}
+
+// checkSpread reports chunks whose replicas share more failure domains than the
+// cluster topology requires. Chunks with replicas on unknown workers are skipped.
+func checkSpread(doc FileDocument, workers map[string]Worker, cluster []Worker) []FsckProblem {
+	var order []string
+	holders := make(map[string][]string)
+	indexes := make(map[string]int)
+	for _, record := range doc.Chunks {
+		if _, seen := holders[record.ChunkID]; !seen {
+			order = append(order, record.ChunkID)
+			indexes[record.ChunkID] = record.Index
+		}
+		holders[record.ChunkID] = append(holders[record.ChunkID], record.WorkerID)
+	}
+
+	var problems []FsckProblem
+	for _, chunkID := range order {
+		replicas := make([]Worker, 0, len(holders[chunkID]))
+		for _, workerID := range holders[chunkID] {
+			if worker, known := workers[workerID]; known {
+				replicas = append(replicas, worker)
+			}
+		}
+		if len(replicas) < 2 || len(replicas) != len(holders[chunkID]) {
+			continue
+		}
+
+		if level := spreadViolation(replicas, cluster); level != "" {
+			problems = append(problems, FsckProblem{
+				Filename: doc.Filename,
+				Type:     FsckSpreadViolation,
+				ChunkID:  chunkID,
+				Index:    indexes[chunkID],
+				Detail:   fmt.Sprintf("%d replicas share a %s", len(replicas), level),
+			})
+		}
+	}
+	return problems
+}
+
+// hasUnknownSizes reports whether any chunk record predates size tracking
+func hasUnknownSizes(records []ChunkRecord) bool {
+	for _, record := range records {
+		if record.Size == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (cc *ConsistencyChecker) handleFsck(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	verify := r.URL.Query().Get("verify") == "true"
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	report, err := cc.Run(ctx, verify)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeJSONResponse(w, report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode fsck report", "error", err)
+	}
+}
+
+// runFsckCommand implements the "fsck" subcommand. It prints the report as JSON
+// to stdout and returns a non-zero exit code if any problem was found.
+func runFsckCommand(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "verify chunk checksums (reads every chunk)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := openCommandStore("fsck"); err != nil {
+		slog.Error("fsck failed", "error", err)
+		return 2
+	}
+	defer metadata.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), FsckTimeout)
+	defer cancel()
+
+	// The persisted registry provides worker topology for the spread check
+	wm := NewWorkerManager(&roundRobinPlacement{})
+	if err := wm.LoadRegistry(ctx); err != nil {
+		slog.Error("fsck failed", "error", err)
+		return 2
+	}
+	checker := NewConsistencyChecker(wm, NewChunkManager(wm, MaxConcurrentUploads))
+	report, err := checker.Run(ctx, *verify)
+	if err != nil {
+		slog.Error("fsck failed", "error", err)
+		return 2
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		slog.Error("Failed to encode fsck report", "error", err)
+		return 2
+	}
+
+	if !report.Healthy {
+		return 1
+	}
+	return 0
+}
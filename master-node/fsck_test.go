@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// problemTypes lists the type and chunk index of every problem in a report
+func problemTypes(report *FsckReport) map[string]int {
+	types := make(map[string]int)
+	for _, problem := range report.Problems {
+		types[problem.Type] = problem.Index
+	}
+	return types
+}
+
+func TestFsckReportsProblemsByRecordedIndex(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 2)
+	cc := NewConsistencyChecker(wm, cm)
+	ctx := testContext(t)
+
+	// The filename contains the chunk ID separator, so the index cannot be parsed from chunk IDs
+	filename := "backup_chunk_2026.tar"
+	chunks := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	storeTestFile(t, filename, chunks, workers[0], workers[1])
+
+	report, err := cc.Run(ctx, true)
+	must(t, err)
+	if !report.Healthy || report.FilesChecked != 1 || report.ChunksChecked != 6 {
+		t.Fatalf("report of a healthy file: %+v", report)
+	}
+
+	// One lost replica leaves the file readable, losing both does not
+	chunkID := filename + "_chunk_00000001"
+	workers[0].drop(chunkID)
+	report, err = cc.Run(ctx, true)
+	must(t, err)
+	if types := problemTypes(report); len(types) != 1 || types[FsckChunkMissing] != 1 || len(report.UnreadableFiles) != 0 {
+		t.Fatalf("problems after losing one replica: %+v", report.Problems)
+	}
+
+	workers[1].put(chunkID, []byte("SECOND"), time.Now())
+	report, err = cc.Run(ctx, true)
+	must(t, err)
+	types := problemTypes(report)
+	if types[FsckChecksumMismatch] != 1 || types[FsckNoReadableReplicas] != 1 || len(report.UnreadableFiles) != 1 {
+		t.Fatalf("problems after corrupting the other replica: %+v", report.Problems)
+	}
+	if _, duplicate := types[FsckDuplicateChunk]; duplicate {
+		t.Fatalf("chunks reported as duplicates: %+v", report.Problems)
+	}
+}
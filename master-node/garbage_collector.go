@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// WorkerChunk describes a chunk as reported by a worker's chunk listing
+type WorkerChunk struct {
+	ChunkID string        `json:"chunkId"`
+	Size    int64         `json:"size"`
+	ModTime time.Time     `json:"modTime"`
+	Sidecar *ChunkSidecar `json:"sidecar,omitempty"`
+}
+
+// WorkerGCReport is the garbage collection outcome for one worker
+type WorkerGCReport struct {
+	WorkerID     string   `json:"workerId"`
+	StoredChunks int      `json:"storedChunks"`
+	Orphans      []string `json:"orphans"`
+	OrphanBytes  int64    `json:"orphanBytes"`
+	Deleted      int      `json:"deleted"`
+	TooRecent    int      `json:"tooRecent"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// GCReport is the outcome of one garbage collection run
+type GCReport struct {
+	StartedAt   time.Time        `json:"startedAt"`
+	DryRun      bool             `json:"dryRun"`
+	GracePeriod string           `json:"gracePeriod"`
+	Workers     []WorkerGCReport `json:"workers"`
+}
+
+// GarbageCollector removes chunks from workers that no file metadata references
+type GarbageCollector struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+}
+
+func NewGarbageCollector(wm *WorkerManager, cm *ChunkManager) *GarbageCollector {
+	return &GarbageCollector{
+		workerManager: wm,
+		chunkManager:  cm,
+	}
+}
+
+// Run marks every chunk referenced by metadata and sweeps unreferenced chunks
+// older than the grace period. Chunks younger than the grace period may belong
+// to uploads whose metadata has not been written yet, so they are left alone.
+func (gc *GarbageCollector) Run(ctx context.Context, dryRun bool, gracePeriod time.Duration) (*GCReport, error) {
+	report := &GCReport{
+		StartedAt:   time.Now().UTC(),
+		DryRun:      dryRun,
+		GracePeriod: gracePeriod.String(),
+		Workers:     []WorkerGCReport{},
+	}
+
+	// Mark: load references before listing workers, so chunks written after
+	// this point are protected by the grace period rather than by the snapshot
+	references, err := GetChunkReferences(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunk references: %v", err)
+	}
+	cutoff := time.Now().Add(-gracePeriod)
+
+	workerIDs := make([]string, 0)
+	for id := range gc.workerManager.GetWorkers() {
+		workerIDs = append(workerIDs, id)
+	}
+	sort.Strings(workerIDs)
+
+	// Sweep
+	for _, workerID := range workerIDs {
+		workerReport := WorkerGCReport{WorkerID: workerID, Orphans: []string{}}
+
+		chunks, err := gc.chunkManager.listChunksOnWorker(workerID, false)
+		if err != nil {
+			workerReport.Errors = append(workerReport.Errors, fmt.Sprintf("failed to list chunks: %v", err))
+			report.Workers = append(report.Workers, workerReport)
+			continue
+		}
+		workerReport.StoredChunks = len(chunks)
+
+		for _, chunk := range chunks {
+			if references[workerID][chunk.ChunkID] {
+				continue
+			}
+			if chunk.ModTime.After(cutoff) {
+				workerReport.TooRecent++
+				continue
+			}
+
+			workerReport.Orphans = append(workerReport.Orphans, chunk.ChunkID)
+			workerReport.OrphanBytes += chunk.Size
+			if dryRun {
+				continue
+			}
+
+			if err := gc.chunkManager.deleteChunkFromWorker(ctx, workerID, chunk.ChunkID); err != nil {
+				workerReport.Errors = append(workerReport.Errors, fmt.Sprintf("%s: %v", chunk.ChunkID, err))
+				continue
+			}
+			workerReport.Deleted++
+		}
+
+		slog.InfoContext(ctx, "Garbage collected worker", "worker", workerID, "orphans", len(workerReport.Orphans),
+			"orphanBytes", workerReport.OrphanBytes, "deleted", workerReport.Deleted, "dryRun", dryRun)
+		report.Workers = append(report.Workers, workerReport)
+	}
+
+	return report, nil
+}
+
+// handleGC runs garbage collection. It only reports orphans unless dryRun=false is passed.
+func (gc *GarbageCollector) handleGC(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+
+	gracePeriod := GCGracePeriod
+	if raw := r.URL.Query().Get("grace"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 {
+			writeErrorResponse(w, "grace must be a non-negative duration such as 24h", http.StatusBadRequest)
+			return
+		}
+		gracePeriod = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), GCTimeout)
+	defer cancel()
+
+	report, err := gc.Run(ctx, dryRun, gracePeriod)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeJSONResponse(w, report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode GC report", "error", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGarbageCollectorKeepsRecentAndReferencedChunks(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 2)
+	gc := NewGarbageCollector(wm, cm)
+	ctx := testContext(t)
+	storeTestFile(t, "a", [][]byte{[]byte("one"), []byte("two")}, workers[0], workers[1])
+
+	// An old orphan, and one of an upload whose metadata is not written yet
+	workers[0].put("old_chunk_00000000", []byte("old orphan"), time.Now().Add(-2*time.Hour))
+	workers[1].put("new_chunk_00000000", []byte("new"), time.Now())
+
+	report, err := gc.Run(ctx, true, time.Hour)
+	must(t, err)
+	w1, w2 := report.Workers[0], report.Workers[1]
+	if len(w1.Orphans) != 1 || w1.Orphans[0] != "old_chunk_00000000" || w1.OrphanBytes != 10 || w1.Deleted != 0 {
+		t.Fatalf("dry run on w1: %+v", w1)
+	}
+	if len(w2.Orphans) != 0 || w2.TooRecent != 1 {
+		t.Fatalf("dry run on w2: %+v", w2)
+	}
+	if workers[0].chunkCount() != 3 {
+		t.Fatalf("dry run deleted chunks, %d left on w1", workers[0].chunkCount())
+	}
+
+	report, err = gc.Run(ctx, false, time.Hour)
+	must(t, err)
+	if report.Workers[0].Deleted != 1 || report.Workers[1].Deleted != 0 {
+		t.Fatalf("collection deleted %d and %d chunks, want 1 and 0", report.Workers[0].Deleted, report.Workers[1].Deleted)
+	}
+	if _, exists := workers[0].chunk("old_chunk_00000000"); exists {
+		t.Fatal("old orphan was not deleted")
+	}
+	if _, exists := workers[1].chunk("new_chunk_00000000"); !exists {
+		t.Fatal("orphan within the grace period was deleted")
+	}
+	for _, fw := range workers {
+		for _, chunkID := range []string{"a_chunk_00000000", "a_chunk_00000001"} {
+			if _, exists := fw.chunk(chunkID); !exists {
+				t.Fatalf("referenced chunk %s was deleted from %s", chunkID, fw.id)
+			}
+		}
+	}
+
+	// Once the grace period has passed the other orphan goes too
+	report, err = gc.Run(ctx, false, 0)
+	must(t, err)
+	if report.Workers[1].Deleted != 1 || workers[1].chunkCount() != 2 {
+		t.Fatalf("collection without grace period: %+v", report.Workers[1])
+	}
+}
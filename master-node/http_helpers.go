@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -14,9 +17,14 @@ func writeJSONResponse(w http.ResponseWriter, data interface{}) error {
 	return json.NewEncoder(w).Encode(data)
 }
 
-// writeErrorResponse writes an error response with logging
+// writeErrorResponse writes an error response. The message is logged with the
+// access log line of the request.
 func writeErrorResponse(w http.ResponseWriter, message string, statusCode int) {
-	log.Printf("Error: %s", message)
+	if recorder := responseRecorder(w); recorder != nil {
+		recorder.errorMessage = message
+	} else {
+		slog.Warn("Request failed", "status", statusCode, "error", message)
+	}
 	http.Error(w, message, statusCode)
 }
 
@@ -34,9 +42,20 @@ func getRequiredParam(r *http.Request, param string) (string, error) {
 	return value, nil
 }
 
+// parseTags splits a comma-separated tag list, dropping empty entries
+func parseTags(raw string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
 func getDownloadPathParameter(r *http.Request) (string, error) {
 	fileName := strings.TrimPrefix(r.URL.Path, "/download/")
-	fmt.Printf("filename searched for %s", fileName)
 	if fileName == "" {
 		return "", fmt.Errorf("no file was specified")
 	}
@@ -51,3 +70,84 @@ func validateHTTPMethod(w http.ResponseWriter, r *http.Request, expectedMethod s
 	}
 	return true
 }
+
+// isAdmin reports whether the request carries the configured admin token
+func isAdmin(r *http.Request) bool {
+	if AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr returns a context carrying the address of the client a master
+// forwarded the request for
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// clientAddr returns the address of the client that sent the request, looking
+// through a forward from another master of the group
+func clientAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// verifyClientHost checks that a request comes from one of the addresses host resolves to
+func verifyClientHost(r *http.Request, host string) error {
+	clientHost, _, err := net.SplitHostPort(clientAddr(r))
+	if err != nil {
+		return err
+	}
+	return verifyHostAddr(r.Context(), host, clientHost)
+}
+
+// verifyHostAddr checks that host resolves to the IP address ip
+func verifyHostAddr(ctx context.Context, host, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, DatabaseTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not resolve to %s", host, ip)
+}
+
+// requireClusterToken rejects requests from workers that do not carry the
+// cluster token, if one is configured
+func requireClusterToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(ClusterTokenHeader)
+		if ClusterToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ClusterToken)) != 1 {
+			writeErrorResponse(w, "Cluster token required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminActor identifies an admin request in the audit log. Admins share a single
+// token, so the client address is the only thing telling them apart.
+func adminActor(r *http.Request) string {
+	return "admin@" + clientAddr(r)
+}
+
+// requireAdmin rejects requests that do not carry admin permissions
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			writeErrorResponse(w, "Admin permission required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
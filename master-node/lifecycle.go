@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LifecyclePolicy describes when matching files should be expired.
+// A file matches when it starts with Prefix and carries Tag (empty fields match everything).
+// Files have no versions, so KeepNewest keeps the newest files of that scope, not
+// the newest versions of each file.
+type LifecyclePolicy struct {
+	ID              string `json:"id" bson:"_id"`
+	Prefix          string `json:"prefix,omitempty" bson:"prefix,omitempty"`
+	Tag             string `json:"tag,omitempty" bson:"tag,omitempty"`
+	ExpireAfterDays int    `json:"expireAfterDays,omitempty" bson:"expireAfterDays,omitempty"`
+	KeepNewest      int    `json:"keepNewest,omitempty" bson:"keepNewest,omitempty"`
+}
+
+// LifecycleAction is a single expiration decided by a policy
+type LifecycleAction struct {
+	Filename string `json:"filename"`
+	PolicyID string `json:"policyId"`
+	Reason   string `json:"reason"`
+}
+
+// LifecycleReport is the outcome of one policy evaluation run
+type LifecycleReport struct {
+	EvaluatedAt time.Time         `json:"evaluatedAt"`
+	DryRun      bool              `json:"dryRun"`
+	Actions     []LifecycleAction `json:"actions"`
+	Retained    []LifecycleAction `json:"retained,omitempty"`
+	Errors      []string          `json:"errors,omitempty"`
+}
+
+// LifecycleManager periodically evaluates lifecycle policies and expires files
+type LifecycleManager struct {
+	fileOperations *FileOperations
+}
+
+func NewLifecycleManager(fo *FileOperations) *LifecycleManager {
+	return &LifecycleManager{
+		fileOperations: fo,
+	}
+}
+
+func (p LifecyclePolicy) validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("policy id is required")
+	}
+	if p.ExpireAfterDays < 0 || p.KeepNewest < 0 {
+		return fmt.Errorf("expireAfterDays and keepNewest must not be negative")
+	}
+	if p.ExpireAfterDays == 0 && p.KeepNewest == 0 {
+		return fmt.Errorf("policy must set expireAfterDays or keepNewest")
+	}
+	// Without a scope, keepNewest would delete all but a few files of the cluster
+	if p.KeepNewest > 0 && p.Prefix == "" && p.Tag == "" {
+		return fmt.Errorf("keepNewest requires a prefix or tag")
+	}
+	return nil
+}
+
+func (p LifecyclePolicy) matches(file FileInfo) bool {
+	if !strings.HasPrefix(file.Filename, p.Prefix) {
+		return false
+	}
+	if p.Tag == "" {
+		return true
+	}
+	for _, tag := range file.Tags {
+		if tag == p.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluatePolicies decides which files are expired by the given policies.
+// A file expired by several policies is only reported once, for the first policy.
+func evaluatePolicies(policies []LifecyclePolicy, files []FileInfo, now time.Time) []LifecycleAction {
+	actions := []LifecycleAction{}
+	expired := make(map[string]bool)
+
+	addAction := func(filename, policyID, reason string) {
+		if expired[filename] {
+			return
+		}
+		expired[filename] = true
+		actions = append(actions, LifecycleAction{Filename: filename, PolicyID: policyID, Reason: reason})
+	}
+
+	for _, policy := range policies {
+		var matched []FileInfo
+		for _, file := range files {
+			if policy.matches(file) {
+				matched = append(matched, file)
+			}
+		}
+
+		if policy.ExpireAfterDays > 0 {
+			cutoff := now.AddDate(0, 0, -policy.ExpireAfterDays)
+			for _, file := range matched {
+				// Files uploaded before upload times were recorded have no known age
+				if !file.UploadedAt.IsZero() && file.UploadedAt.Before(cutoff) {
+					addAction(file.Filename, policy.ID, fmt.Sprintf("older than %d days", policy.ExpireAfterDays))
+				}
+			}
+		}
+
+		// Files without an upload time cannot be ranked, so they are neither kept nor expired
+		var dated []FileInfo
+		for _, file := range matched {
+			if !file.UploadedAt.IsZero() {
+				dated = append(dated, file)
+			}
+		}
+		if policy.KeepNewest > 0 && len(dated) > policy.KeepNewest {
+			sort.SliceStable(dated, func(i, j int) bool {
+				return dated[i].UploadedAt.After(dated[j].UploadedAt)
+			})
+			for _, file := range dated[policy.KeepNewest:] {
+				addAction(file.Filename, policy.ID, fmt.Sprintf("not among the newest %d files of the scope", policy.KeepNewest))
+			}
+		}
+	}
+	return actions
+}
+
+// Run evaluates all policies and, unless dryRun is set, deletes the expired files
+func (lm *LifecycleManager) Run(ctx context.Context, dryRun bool) (*LifecycleReport, error) {
+	policies, err := GetLifecyclePolicies(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lifecycle policies: %v", err)
+	}
+
+	files, err := GetAllFilenames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file metadata: %v", err)
+	}
+
+	now := time.Now()
+	report := &LifecycleReport{
+		EvaluatedAt: now.UTC(),
+		DryRun:      dryRun,
+		Actions:     []LifecycleAction{},
+	}
+
+	// Files under retention or legal hold are reported but never expired
+	filesByName := make(map[string]FileInfo, len(files))
+	for _, file := range files {
+		filesByName[file.Filename] = file
+	}
+	for _, action := range evaluatePolicies(policies, files, now) {
+		if _, err := checkRetention(filesByName[action.Filename], now, false); err != nil {
+			action.Reason = err.Error()
+			report.Retained = append(report.Retained, action)
+			continue
+		}
+		report.Actions = append(report.Actions, action)
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	for _, action := range report.Actions {
+		if err := lm.fileOperations.DeleteFile(ctx, action.Filename, nil); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", action.Filename, err))
+			continue
+		}
+		slog.InfoContext(ctx, "Lifecycle policy expired file", "policy", action.PolicyID, "filename", action.Filename, "reason", action.Reason)
+	}
+	return report, nil
+}
+
+// Start runs the lifecycle job in the background at the given interval until ctx is done
+func (lm *LifecycleManager) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			// Only the leader expires files, followers would just forward the writes
+			if !metadata.IsLeader() {
+				continue
+			}
+			runCtx, cancel := context.WithTimeout(ctx, interval)
+			report, err := lm.Run(runCtx, false)
+			cancel()
+			if err != nil {
+				slog.Error("Lifecycle run failed", "error", err)
+				continue
+			}
+			slog.Info("Lifecycle run finished", "expired", len(report.Actions)-len(report.Errors), "errors", len(report.Errors))
+		}
+	}()
+}
+
+func (lm *LifecycleManager) handlePolicies(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		policies, err := GetLifecyclePolicies(ctx)
+		if err != nil {
+			writeErrorResponse(w, "Failed to retrieve lifecycle policies", http.StatusInternalServerError)
+			return
+		}
+		if err := writeJSONResponse(w, policies); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode lifecycle policies", "error", err)
+		}
+
+	case http.MethodPost:
+		var policy LifecyclePolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeErrorResponse(w, fmt.Sprintf("Invalid policy: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := policy.validate(); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := StoreLifecyclePolicy(ctx, policy); err != nil {
+			writeErrorResponse(w, "Failed to store lifecycle policy", http.StatusInternalServerError)
+			return
+		}
+		writeSuccessResponse(w, fmt.Sprintf("Lifecycle policy %s stored", policy.ID))
+
+	case http.MethodDelete:
+		id, err := getRequiredParam(r, "id")
+		if err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = DeleteLifecyclePolicy(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			writeErrorResponse(w, "Lifecycle policy not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeErrorResponse(w, "Failed to delete lifecycle policy", http.StatusInternalServerError)
+			return
+		}
+		writeSuccessResponse(w, fmt.Sprintf("Lifecycle policy %s deleted", id))
+
+	default:
+		writeErrorResponse(w, "Only GET, POST and DELETE requests are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReport evaluates all policies without deleting anything
+func (lm *LifecycleManager) handleReport(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	report, err := lm.Run(ctx, true)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeJSONResponse(w, report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode lifecycle report", "error", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+// storeAgedFile records a one-chunk file on fw that was uploaded the given time ago
+func storeAgedFile(t *testing.T, filename string, age time.Duration, tags []string, fw *fakeWorker) {
+	t.Helper()
+	ctx := testContext(t)
+	storeTestFile(t, filename, [][]byte{[]byte(filename)}, fw)
+	doc, err := GetFileDocument(ctx, filename)
+	must(t, err)
+	doc.UploadedAt = time.Now().Add(-age).UTC()
+	doc.Tags = tags
+	must(t, metadata.PutFileDocument(ctx, doc))
+}
+
+// actionFiles lists the files of lifecycle actions sorted by name
+func actionFiles(actions []LifecycleAction) []string {
+	files := []string{}
+	for _, action := range actions {
+		files = append(files, action.Filename)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestLifecycleExpiresFilesAfterDryRun(t *testing.T) {
+	wm, _, workers := newTestCluster(t, 1)
+	lm := NewLifecycleManager(NewFileOperations(wm))
+	ctx := testContext(t)
+	day := 24 * time.Hour
+
+	storeAgedFile(t, "logs/old", 40*day, nil, workers[0])
+	storeAgedFile(t, "logs/new", day, nil, workers[0])
+	storeAgedFile(t, "logs/held", 40*day, nil, workers[0])
+	storeAgedFile(t, "data/old", 40*day, nil, workers[0])
+	storeAgedFile(t, "builds/1", 3*day, []string{"ci"}, workers[0])
+	storeAgedFile(t, "builds/2", 2*day, []string{"ci"}, workers[0])
+	storeAgedFile(t, "builds/3", day, []string{"ci"}, workers[0])
+	must(t, UpdateFileLegalHold(ctx, "logs/held", true))
+	must(t, StoreLifecyclePolicy(ctx, LifecyclePolicy{ID: "logs", Prefix: "logs/", ExpireAfterDays: 30}))
+	must(t, StoreLifecyclePolicy(ctx, LifecyclePolicy{ID: "ci", Tag: "ci", KeepNewest: 2}))
+	want := []string{"builds/1", "logs/old"}
+
+	// A dry run reports what would expire without deleting anything
+	report, err := lm.Run(ctx, true)
+	must(t, err)
+	if got := actionFiles(report.Actions); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("dry run expires %v, want %v", got, want)
+	}
+	if got := actionFiles(report.Retained); len(got) != 1 || got[0] != "logs/held" {
+		t.Fatalf("dry run retains %v, want [logs/held]", got)
+	}
+	if workers[0].chunkCount() != 7 {
+		t.Fatalf("dry run deleted chunks, %d left", workers[0].chunkCount())
+	}
+
+	report, err = lm.Run(ctx, false)
+	must(t, err)
+	if len(report.Errors) != 0 {
+		t.Fatalf("lifecycle run failed: %v", report.Errors)
+	}
+	for _, filename := range want {
+		if _, err := GetFileDocument(ctx, filename); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expired file %s still has metadata: %v", filename, err)
+		}
+	}
+	if workers[0].chunkCount() != 5 {
+		t.Fatalf("%d chunks left after expiring 2 of 7 files", workers[0].chunkCount())
+	}
+
+	// Nothing is left to expire
+	report, err = lm.Run(ctx, true)
+	must(t, err)
+	if len(report.Actions) != 0 {
+		t.Fatalf("second run expires %v", actionFiles(report.Actions))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// sensitiveHeaders are never written to the log
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	ClusterTokenHeader:    true,
+}
+
+// setupLogging installs the default logger in the configured format and level.
+// Lines written through the standard log package end up there as well, at info level.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case LogFormatText:
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case LogFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns a context carrying the ID of the request it belongs to
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx, or an empty string
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the request ID of the context to every log line
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validRequestID accepts IDs of a sane length made of URL-safe characters, so
+// a client cannot inject arbitrary text into the log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// redactHeaders returns the headers of a request with sensitive values replaced
+func redactHeaders(header http.Header) map[string]string {
+	redacted := make(map[string]string, len(header))
+	for name, values := range header {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			redacted[name] = "[REDACTED]"
+			continue
+		}
+		redacted[name] = strings.Join(values, ", ")
+	}
+	return redacted
+}
+
+// loggingResponseWriter remembers the status and error message of a response for the access log
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	errorMessage string
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streamed responses streaming
+func (w *loggingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseRecorder finds the access log recorder beneath any writers wrapping it
+func responseRecorder(w http.ResponseWriter) *loggingResponseWriter {
+	for {
+		switch writer := w.(type) {
+		case *loggingResponseWriter:
+			return writer
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// logRequests assigns every request an ID, passes it on in RequestIDHeader and
+// writes one access log line per request. A valid ID sent by the caller, such as
+// a follower master forwarding the request, is kept.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		ctx := withRequestID(r.Context(), id)
+
+		slog.DebugContext(ctx, "Request received", "method", r.Method, "path", r.URL.Path,
+			"remote", r.RemoteAddr, "headers", redactHeaders(r.Header))
+
+		start := time.Now()
+		recorder := &loggingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		case r.URL.Path == "/health" || r.URL.Path == "/metrics" || r.URL.Path == "/heartbeat":
+			level = slog.LevelDebug // Polled constantly
+		}
+
+		args := []any{"method", r.Method, "path", r.URL.Path, "status", status,
+			"bytes", recorder.bytes, "duration", time.Since(start)}
+		if recorder.errorMessage != "" {
+			args = append(args, "error", recorder.errorMessage)
+		}
+		slog.Log(ctx, level, "Request completed", args...)
+	})
+}
+
+// propagateRequestID passes the request ID of the outgoing request's context on to the worker
+type propagateRequestID struct {
+	base http.RoundTripper
+}
+
+func (t propagateRequestID) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := requestIDFrom(req.Context())
+	if id == "" || req.Header.Get(RequestIDHeader) != "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(RequestIDHeader, id)
+	return t.base.RoundTrip(req)
+}
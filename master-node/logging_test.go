@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		redacted bool
+	}{
+		{"Authorization", true},
+		{"Proxy-Authorization", true},
+		{"Cookie", true},
+		{"Set-Cookie", true},
+		{"X-Api-Key", true},
+		{ClusterTokenHeader, true},
+		{"x-frostbyte-cluster-token", true},
+		{RequestIDHeader, false},
+		{"Content-Type", false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set(test.name, "secret-value")
+		got := redactHeaders(header)[http.CanonicalHeaderKey(test.name)]
+		if redacted := got == "[REDACTED]"; redacted != test.redacted {
+			t.Errorf("header %s logged as %q, redacted %t, want %t", test.name, got, redacted, test.redacted)
+		}
+	}
+}
+
+// captureLogs sends the log to a buffer at debug level until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestLogRequestsRedactsSensitiveHeaders(t *testing.T) {
+	logs := captureLogs(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/files", nil)
+	for name := range sensitiveHeaders {
+		r.Header.Set(name, "secret-"+name)
+	}
+	r.Header.Set("Content-Type", "visible-value")
+	logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), r)
+
+	for name := range sensitiveHeaders {
+		if strings.Contains(logs.String(), "secret-"+name) {
+			t.Errorf("value of %s written to the log", name)
+		}
+	}
+	if !strings.Contains(logs.String(), "[REDACTED]") || !strings.Contains(logs.String(), "visible-value") {
+		t.Fatalf("request headers missing from the log: %s", logs)
+	}
+}
+
+func TestRequestIDReachesWorkers(t *testing.T) {
+	logs := captureLogs(t)
+	received := make(chan string, 1)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(RequestIDHeader)
+	}))
+	defer worker.Close()
+
+	client := &http.Client{Transport: propagateRequestID{http.DefaultTransport}}
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, worker.URL, nil)
+		must(t, err)
+		resp, err := client.Do(req)
+		must(t, err)
+		resp.Body.Close()
+	}))
+
+	tests := []struct {
+		name, sent string
+		kept       bool
+	}{
+		{"valid ID", "forwarded-by-follower_1", true},
+		{"no ID", "", false},
+		{"ID that would inject into the log", "bad id\nlevel=ERROR", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/download", nil)
+		if test.sent != "" {
+			r.Header.Set(RequestIDHeader, test.sent)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(RequestIDHeader)
+		if got := <-received; got != id || !validRequestID(id) {
+			t.Errorf("%s: worker got request ID %q, response carries %q", test.name, got, id)
+		}
+		if kept := id == test.sent; kept != test.kept {
+			t.Errorf("%s: request ID %q kept: %t, want %t", test.name, test.sent, kept, test.kept)
+		}
+		if !strings.Contains(logs.String(), `"request_id":"`+id+`"`) {
+			t.Errorf("%s: request ID %s missing from the log", test.name, id)
+		}
+	}
+}
@@ -1,18 +1,94 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
-	_ "net/http/pprof" // Add this import
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
+	config, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := setupLogging(LogFormat, LogLevel); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	// The client is created before the configuration is loaded
+	httpClient.Timeout = NetworkTimeout
+
+	// Subcommands run once against the metadata store and exit
+	if len(args) > 0 {
+		switch args[0] {
+		case "fsck":
+			os.Exit(runFsckCommand(args[1:]))
+		case "export":
+			os.Exit(runExportCommand(args[1:]))
+		case "restore":
+			os.Exit(runRestoreCommand(args[1:]))
+		default:
+			fatal("Unknown command", "command", args[0])
+		}
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	store, err := openMetadataStore()
+	if err != nil {
+		fatal("Failed to open metadata store", "error", err)
+	}
+	metadata = store
+
+	go servePprof(PprofAddr)
+	server, err := NewMasterServer(config)
+	if err != nil {
+		fatal("Failed to create master server", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
 	go func() {
-		log.Println("pprof listening on :6060")
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
+		served <- server.Start(MasterPort)
 	}()
-	server := NewMasterServer()
-	if err := server.Start(DefaultMasterPort); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+
+	select {
+	case err := <-served:
+		fatal("Failed to start server", "error", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", "timeout", ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown was not graceful", "error", err)
 	}
+	if err := metadata.Close(); err != nil {
+		slog.Error("Failed to close metadata store", "error", err)
+	}
+	slog.Info("Master node stopped")
+}
+
+// servePprof serves the profiling endpoints on a mux of their own, so the pprof
+// address exposes nothing but profiles
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	slog.Info("pprof listening", "addr", addr)
+	slog.Error("pprof server stopped", "error", http.ListenAndServe(addr, mux))
 }
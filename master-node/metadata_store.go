@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Metadata backends
+const (
+	MetadataBackendMongo = "mongo"
+	MetadataBackendRaft  = "raft"
+)
+
+// ErrNotFound reports that a file, policy or worker does not exist in the metadata store
+var ErrNotFound = errors.New("not found")
+
+// errChunkMoveStale reports that a chunk record changed while it was being moved
+var errChunkMoveStale = errors.New("chunk record changed during move")
+
+// errPackRefStale reports that a packed file changed while its data was being moved
+var errPackRefStale = errors.New("packed file changed during move")
+
+// MetadataStore persists file and chunk metadata, lifecycle policies, the audit
+// log and the worker registry. Writes must go to the leader; a single master
+// backed by MongoDB is always the leader.
+type MetadataStore interface {
+	StoreFileMetadata(ctx context.Context, file FileInfo) error
+	StoreFileVersion(ctx context.Context, doc FileDocument) error
+	PutFileDocument(ctx context.Context, doc FileDocument) error
+	AddChunkRecord(ctx context.Context, filename string, record ChunkRecord) error
+	GetFileDocument(ctx context.Context, filename string) (FileDocument, error)
+	DeleteFileMetadata(ctx context.Context, filename string) error
+	ListFiles(ctx context.Context) ([]FileInfo, error)
+	ForEachFileDocument(ctx context.Context, fn func(FileDocument) error) error
+	UpdateFileRetention(ctx context.Context, filename, mode string, retainUntil time.Time) error
+	UpdateFileLegalHold(ctx context.Context, filename string, hold bool) error
+
+	GetChunkReferences(ctx context.Context) (map[string]map[string]bool, error)
+	GetChunkRecordsForWorker(ctx context.Context, workerID string) ([]WorkerChunkRef, error)
+	GetWorkerUsage(ctx context.Context) (map[string]int64, error)
+	ReplaceChunkRecord(ctx context.Context, filename string, old ChunkRecord, replacement ChunkRecord) error
+	ReplaceFilePack(ctx context.Context, filename string, old PackRef, replacement PackRef) error
+	RenameWorkerInChunks(ctx context.Context, oldID, newID string) (int64, error)
+
+	GetLifecyclePolicies(ctx context.Context) ([]LifecyclePolicy, error)
+	StoreLifecyclePolicy(ctx context.Context, policy LifecyclePolicy) error
+	DeleteLifecyclePolicy(ctx context.Context, id string) error
+
+	StoreAuditEvent(ctx context.Context, event AuditEvent) error
+	GetAuditEvents(ctx context.Context, limit int64) ([]AuditEvent, error)
+
+	StoreWorkerRecord(ctx context.Context, record WorkerRecord) error
+	LoadWorkerRecords(ctx context.Context) ([]WorkerRecord, error)
+	DeleteWorkerRecord(ctx context.Context, id string) error
+
+	IsLeader() bool
+	Close() error
+}
+
+// metadata is the metadata store of this master, opened in main
+var metadata MetadataStore
+
+// openMetadataStore opens the configured metadata backend
+func openMetadataStore() (MetadataStore, error) {
+	switch MetadataBackend {
+	case MetadataBackendMongo:
+		return NewMongoStore(MongoURI)
+	case MetadataBackendRaft:
+		config, err := raftConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewRaftStore(config)
+	default:
+		return nil, fmt.Errorf("unknown metadata backend %q", MetadataBackend)
+	}
+}
+
+// ChunkRecord is the metadata of one chunk replica stored on a worker
+type ChunkRecord struct {
+	ChunkID  string `json:"chunkId" bson:"chunkId"`
+	WorkerID string `json:"workerId" bson:"workerId"`
+	Index    int    `json:"index" bson:"index"`
+	Size     int64  `json:"size" bson:"size"`
+	Checksum string `json:"checksum,omitempty" bson:"checksum,omitempty"`
+}
+
+// FileInfo represents a file with its metadata
+type FileInfo struct {
+	Filename      string    `json:"filename" bson:"filename"`
+	Size          int64     `json:"size" bson:"size"`
+	Tags          []string  `json:"tags,omitempty" bson:"tags,omitempty"`
+	UploadedAt    time.Time `json:"uploadedAt" bson:"uploadedAt,omitempty"`
+	RetentionMode string    `json:"retentionMode,omitempty" bson:"retentionMode,omitempty"`
+	RetainUntil   time.Time `json:"retainUntil,omitzero" bson:"retainUntil,omitempty"`
+	LegalHold     bool      `json:"legalHold,omitempty" bson:"legalHold,omitempty"`
+}
+
+// FileDocument is the full metadata document of a file including its chunk records.
+// A small file packed into a shared pack chunk has no chunks of its own but a Pack.
+type FileDocument struct {
+	FileInfo `bson:",inline"`
+	Chunks   []ChunkRecord `json:"chunks" bson:"chunks"`
+	Pack     *PackRef      `json:"pack,omitempty" bson:"pack,omitempty"`
+}
+
+// PackRef locates the data of a packed file within its pack
+type PackRef struct {
+	PackID string `json:"packId" bson:"packId"`
+	Offset int64  `json:"offset" bson:"offset"`
+	Length int64  `json:"length" bson:"length"`
+}
+
+// WorkerChunkRef is a chunk record together with the file that references it
+type WorkerChunkRef struct {
+	Filename string
+	Record   ChunkRecord
+}
+
+// WorkerRecord is the persisted part of a worker's registry entry
+type WorkerRecord struct {
+	ID            string         `json:"id" bson:"_id"`
+	Address       string         `json:"address" bson:"address"`
+	State         string         `json:"state" bson:"state"`
+	Drain         *DrainProgress `json:"drain,omitempty" bson:"drain,omitempty"`
+	Topology      Topology       `json:"topology" bson:"topology"`
+	Status        WorkerStatus   `json:"status" bson:"status"`
+	LastHeartbeat time.Time      `json:"lastHeartbeat" bson:"lastHeartbeat"`
+	Offline       bool           `json:"offline,omitempty" bson:"offline,omitempty"`
+}
+
+func storeChunkInDB(ctx context.Context, filename string, record ChunkRecord) error {
+	defer timeMetadata("add_chunk")()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return countMetadataError(metadata.AddChunkRecord(ctx, filename, record))
+}
+
+// storeFileMetadata creates or replaces the metadata of a file whose chunks are
+// recorded one at a time, such as a pack. The chunk list starts empty again.
+func storeFileMetadata(ctx context.Context, filename string, fileSize int64, tags []string) error {
+	defer timeMetadata("store_file")()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return countMetadataError(metadata.StoreFileMetadata(ctx, FileInfo{
+		Filename:   filename,
+		Size:       fileSize,
+		Tags:       tags,
+		UploadedAt: time.Now().UTC(),
+	}))
+}
+
+// storeFileVersion replaces the contents of a file with a fully uploaded version
+func storeFileVersion(ctx context.Context, filename string, fileSize int64, tags []string, records []ChunkRecord) error {
+	defer timeMetadata("store_file")()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return countMetadataError(metadata.StoreFileVersion(ctx, FileDocument{
+		FileInfo: FileInfo{
+			Filename:   filename,
+			Size:       fileSize,
+			Tags:       tags,
+			UploadedAt: time.Now().UTC(),
+		},
+		Chunks: records,
+	}))
+}
+
+// storePackedFileMetadata records a file whose data was appended to a pack.
+// Like any re-upload, it keeps the retention and legal hold of the file.
+func storePackedFileMetadata(ctx context.Context, filename string, tags []string, ref PackRef) error {
+	defer timeMetadata("store_file")()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return countMetadataError(metadata.StoreFileVersion(ctx, FileDocument{
+		FileInfo: FileInfo{
+			Filename:   filename,
+			Size:       ref.Length,
+			Tags:       tags,
+			UploadedAt: time.Now().UTC(),
+		},
+		Pack: &ref,
+	}))
+}
+
+// Retrieve file metadata from the database
+func GetFileMetadata(ctx context.Context, filename string) (map[string][]string, error) {
+	defer timeMetadata("get_file")()
+	doc, err := metadata.GetFileDocument(ctx, filename)
+	if countMetadataError(err) != nil {
+		return nil, err
+	}
+
+	// Convert array format back to map format for compatibility
+	result := make(map[string][]string)
+	for _, chunk := range doc.Chunks {
+		result[chunk.ChunkID] = append(result[chunk.ChunkID], chunk.WorkerID)
+	}
+	return result, nil
+}
+
+// GetFileDocument returns the full metadata document of a file
+func GetFileDocument(ctx context.Context, filename string) (FileDocument, error) {
+	defer timeMetadata("get_file")()
+	doc, err := metadata.GetFileDocument(ctx, filename)
+	return doc, countMetadataError(err)
+}
+
+// GetFileChunkRecords returns the record of every chunk replica of a file
+func GetFileChunkRecords(ctx context.Context, filename string) ([]ChunkRecord, error) {
+	defer timeMetadata("get_file")()
+	doc, err := metadata.GetFileDocument(ctx, filename)
+	if countMetadataError(err) != nil {
+		return nil, err
+	}
+	return doc.Chunks, nil
+}
+
+// Delete file metadata from the database
+func DeleteFileMetadata(ctx context.Context, filename string) error {
+	defer timeMetadata("delete_file")()
+	return countMetadataError(metadata.DeleteFileMetadata(ctx, filename))
+}
+
+// GetFileInfo retrieves the metadata of a single file without its chunk list
+func GetFileInfo(ctx context.Context, filename string) (FileInfo, error) {
+	defer timeMetadata("get_file")()
+	doc, err := metadata.GetFileDocument(ctx, filename)
+	return doc.FileInfo, countMetadataError(err)
+}
+
+// UpdateFileRetention sets the retention mode and date of a file
+func UpdateFileRetention(ctx context.Context, filename, mode string, retainUntil time.Time) error {
+	defer timeMetadata("update_retention")()
+	return countMetadataError(metadata.UpdateFileRetention(ctx, filename, mode, retainUntil))
+}
+
+// UpdateFileLegalHold places or releases a legal hold on a file
+func UpdateFileLegalHold(ctx context.Context, filename string, hold bool) error {
+	defer timeMetadata("update_legal_hold")()
+	return countMetadataError(metadata.UpdateFileLegalHold(ctx, filename, hold))
+}
+
+// GetAllFilenames retrieves a list of all files with their metadata. Packs are
+// internal and left out.
+func GetAllFilenames(ctx context.Context) ([]FileInfo, error) {
+	defer timeMetadata("list_files")()
+	files, err := countMetadataResult(metadata.ListFiles(ctx))
+	if err != nil {
+		return nil, err
+	}
+	visible := files[:0]
+	for _, file := range files {
+		if !isPackFile(file.Filename) {
+			visible = append(visible, file)
+		}
+	}
+	return visible, nil
+}
+
+// GetLifecyclePolicies retrieves all stored lifecycle policies
+func GetLifecyclePolicies(ctx context.Context) ([]LifecyclePolicy, error) {
+	defer timeMetadata("get_policies")()
+	return countMetadataResult(metadata.GetLifecyclePolicies(ctx))
+}
+
+// StoreLifecyclePolicy creates or replaces a lifecycle policy by its ID
+func StoreLifecyclePolicy(ctx context.Context, policy LifecyclePolicy) error {
+	defer timeMetadata("store_policy")()
+	return countMetadataError(metadata.StoreLifecyclePolicy(ctx, policy))
+}
+
+// DeleteLifecyclePolicy removes a lifecycle policy by its ID
+func DeleteLifecyclePolicy(ctx context.Context, id string) error {
+	defer timeMetadata("delete_policy")()
+	return countMetadataError(metadata.DeleteLifecyclePolicy(ctx, id))
+}
+
+// StoreAuditEvent appends an event to the audit log
+func StoreAuditEvent(ctx context.Context, event AuditEvent) error {
+	defer timeMetadata("store_audit_event")()
+	return countMetadataError(metadata.StoreAuditEvent(ctx, event))
+}
+
+// GetAuditEvents retrieves the most recent audit events, newest first
+func GetAuditEvents(ctx context.Context, limit int64) ([]AuditEvent, error) {
+	defer timeMetadata("get_audit_events")()
+	return countMetadataResult(metadata.GetAuditEvents(ctx, limit))
+}
+
+// GetChunkReferences returns, per worker, the set of chunk IDs referenced by any file
+func GetChunkReferences(ctx context.Context) (map[string]map[string]bool, error) {
+	defer timeMetadata("get_chunk_references")()
+	return countMetadataResult(metadata.GetChunkReferences(ctx))
+}
+
+// ForEachFileDocument calls fn for every file document, stopping at the first error
+func ForEachFileDocument(ctx context.Context, fn func(FileDocument) error) error {
+	defer timeMetadata("walk_files")()
+	return countMetadataError(metadata.ForEachFileDocument(ctx, fn))
+}
+
+// ReplaceChunkRecord swaps a chunk record for a new one, as long as the old record
+// is still present with the same size. It returns errChunkMoveStale if the file was
+// deleted or re-uploaded, or if the chunk is a pack that grew in the meantime.
+func ReplaceChunkRecord(ctx context.Context, filename string, old ChunkRecord, replacement ChunkRecord) error {
+	defer timeMetadata("replace_chunk")()
+	return countMetadataError(metadata.ReplaceChunkRecord(ctx, filename, old, replacement))
+}
+
+// ReplaceFilePack points a packed file at a new location, as long as it still has
+// the old one. It returns errPackRefStale if the file was deleted or re-uploaded.
+func ReplaceFilePack(ctx context.Context, filename string, old PackRef, replacement PackRef) error {
+	defer timeMetadata("replace_pack")()
+	return countMetadataError(metadata.ReplaceFilePack(ctx, filename, old, replacement))
+}
+
+// GetChunkRecordsForWorker returns every chunk record that references the given worker
+func GetChunkRecordsForWorker(ctx context.Context, workerID string) ([]WorkerChunkRef, error) {
+	defer timeMetadata("get_worker_chunks")()
+	return countMetadataResult(metadata.GetChunkRecordsForWorker(ctx, workerID))
+}
+
+// GetChunkHolders returns the set of workers holding a replica of a chunk
+func GetChunkHolders(ctx context.Context, filename, chunkID string) (map[string]bool, error) {
+	defer timeMetadata("get_file")()
+	doc, err := metadata.GetFileDocument(ctx, filename)
+	if countMetadataError(err) != nil {
+		return nil, err
+	}
+
+	holders := make(map[string]bool)
+	for _, record := range doc.Chunks {
+		if record.ChunkID == chunkID {
+			holders[record.WorkerID] = true
+		}
+	}
+	return holders, nil
+}
+
+// GetWorkerUsage returns the number of chunk bytes each worker holds according to the metadata
+func GetWorkerUsage(ctx context.Context) (map[string]int64, error) {
+	defer timeMetadata("get_worker_usage")()
+	return countMetadataResult(metadata.GetWorkerUsage(ctx))
+}
+
+// StoreWorkerRecord creates or replaces the registry entry of a worker
+func StoreWorkerRecord(ctx context.Context, worker Worker) error {
+	defer timeMetadata("store_worker")()
+	return countMetadataError(metadata.StoreWorkerRecord(ctx, WorkerRecord{
+		ID:            worker.ID,
+		Address:       worker.Address,
+		State:         worker.State,
+		Drain:         worker.Drain,
+		Topology:      worker.Topology,
+		Status:        worker.Status,
+		LastHeartbeat: worker.LastHeartbeat,
+		Offline:       worker.Offline,
+	}))
+}
+
+// LoadWorkerRecords returns every worker in the persisted registry
+func LoadWorkerRecords(ctx context.Context) ([]Worker, error) {
+	defer timeMetadata("load_workers")()
+	records, err := metadata.LoadWorkerRecords(ctx)
+	if countMetadataError(err) != nil {
+		return nil, err
+	}
+
+	workers := make([]Worker, 0, len(records))
+	for _, record := range records {
+		workers = append(workers, Worker{
+			ID:            record.ID,
+			Address:       record.Address,
+			State:         record.State,
+			Drain:         record.Drain,
+			Topology:      record.Topology,
+			Status:        record.Status,
+			LastHeartbeat: record.LastHeartbeat,
+			Offline:       record.Offline,
+		})
+	}
+	return workers, nil
+}
+
+// DeleteWorkerRecord removes a worker from the persisted registry
+func DeleteWorkerRecord(ctx context.Context, id string) error {
+	defer timeMetadata("delete_worker")()
+	return countMetadataError(metadata.DeleteWorkerRecord(ctx, id))
+}
+
+// RenameWorkerInChunks points every chunk record of a worker at a new worker ID.
+// It returns the number of files that were updated.
+func RenameWorkerInChunks(ctx context.Context, oldID, newID string) (int64, error) {
+	defer timeMetadata("rename_worker")()
+	return countMetadataResult(metadata.RenameWorkerInChunks(ctx, oldID, newID))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Error types counted by the errors metric
+const (
+	errorUpload      = "upload"
+	errorDownload    = "download"
+	errorDelete      = "delete"
+	errorChunkStore  = "chunk_store"
+	errorChunkFetch  = "chunk_fetch"
+	errorChunkDelete = "chunk_delete"
+	errorMetadata    = "metadata"
+)
+
+// Results of uploads and downloads
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+// Transfers take from milliseconds for small chunks to minutes for large files
+var transferBuckets = prometheus.ExponentialBuckets(0.005, 2, 16)
+
+var (
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frostbyte",
+		Name:      "uploads_total",
+		Help:      "File uploads by result.",
+	}, []string{"result"})
+
+	downloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frostbyte",
+		Name:      "downloads_total",
+		Help:      "File downloads by result.",
+	}, []string{"result"})
+
+	uploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "frostbyte",
+		Name:      "upload_bytes_total",
+		Help:      "Bytes received from clients uploading files.",
+	})
+
+	downloadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "frostbyte",
+		Name:      "download_bytes_total",
+		Help:      "Bytes sent to clients downloading files.",
+	})
+
+	uploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "frostbyte",
+		Name:      "upload_duration_seconds",
+		Help:      "Duration of file uploads.",
+		Buckets:   transferBuckets,
+	})
+
+	downloadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "frostbyte",
+		Name:      "download_duration_seconds",
+		Help:      "Duration of file downloads.",
+		Buckets:   transferBuckets,
+	})
+
+	chunkStoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frostbyte",
+		Name:      "chunk_store_duration_seconds",
+		Help:      "Duration of storing a chunk on a worker.",
+		Buckets:   transferBuckets,
+	}, []string{"worker"})
+
+	chunkFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frostbyte",
+		Name:      "chunk_fetch_duration_seconds",
+		Help:      "Duration of fetching a chunk from a worker.",
+		Buckets:   transferBuckets,
+	}, []string{"worker"})
+
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frostbyte",
+		Name:      "errors_total",
+		Help:      "Errors by type.",
+	}, []string{"type"})
+
+	lostReplicasTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frostbyte",
+		Name:      "lost_replicas_total",
+		Help:      "Chunk replicas workers reported lost with a failed disk, by repair result.",
+	}, []string{"result"})
+
+	activeStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "frostbyte",
+		Name:      "active_streams",
+		Help:      "Chunk replica streams currently open to workers.",
+	})
+
+	metadataDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frostbyte",
+		Name:      "metadata_operation_duration_seconds",
+		Help:      "Duration of metadata store operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+)
+
+// timeMetadata starts timing a metadata operation; call the result when it is done
+func timeMetadata(operation string) func() {
+	start := time.Now()
+	return func() {
+		metadataDuration.WithLabelValues(MetadataBackend, operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// countMetadataError counts a failed metadata operation and passes the error through.
+// Missing records and stale chunk moves are expected outcomes, not errors.
+func countMetadataError(err error) error {
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, errChunkMoveStale) {
+		errorsTotal.WithLabelValues(errorMetadata).Inc()
+	}
+	return err
+}
+
+// countMetadataResult is countMetadataError for operations that also return a value
+func countMetadataResult[T any](value T, err error) (T, error) {
+	return value, countMetadataError(err)
+}
+
+// observeChunkTransfer records how long a chunk transfer with a worker took and
+// counts it as an error if it failed
+func observeChunkTransfer(duration *prometheus.HistogramVec, errorType, workerID string, start time.Time, err error) {
+	duration.WithLabelValues(workerID).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errorsTotal.WithLabelValues(errorType).Inc()
+	}
+}
+
+// meteredReader counts the bytes read through it into a counter
+type meteredReader struct {
+	reader  io.Reader
+	counter prometheus.Counter
+}
+
+func (m meteredReader) Read(p []byte) (int, error) {
+	n, err := m.reader.Read(p)
+	m.counter.Add(float64(n))
+	return n, err
+}
+
+// workerCollector reports the number of registered workers by state at scrape time
+type workerCollector struct {
+	workerManager *WorkerManager
+	desc          *prometheus.Desc
+}
+
+func newWorkerCollector(wm *WorkerManager) *workerCollector {
+	return &workerCollector{
+		workerManager: wm,
+		desc: prometheus.NewDesc("frostbyte_workers", "Registered workers by state.",
+			[]string{"state"}, nil),
+	}
+}
+
+func (c *workerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *workerCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[string]int{
+		WorkerStateActive:   0,
+		WorkerStateDraining: 0,
+		WorkerStateDrained:  0,
+	}
+	for _, worker := range c.workerManager.GetWorkers() {
+		counts[worker.State]++
+	}
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), state)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsEndpointReportsWorkers(t *testing.T) {
+	useTestMetadata(t)
+	wm := NewWorkerManager(nil)
+	wm.AddWorker("w1", Worker{ID: "w1", Address: "192.0.2.1:8081", LastHeartbeat: time.Now()})
+	wm.AddWorker("w2", Worker{ID: "w2", Address: "192.0.2.2:8081", LastHeartbeat: time.Now()})
+	wm.AddWorker("w3", Worker{ID: "w3", Address: "192.0.2.3:8081", LastHeartbeat: time.Now(), State: WorkerStateDraining})
+	collector := newWorkerCollector(wm)
+	must(t, prometheus.Register(collector))
+	t.Cleanup(func() { prometheus.Unregister(collector) })
+
+	s := &MasterServer{mux: http.NewServeMux()}
+	s.setupRoutes()
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d", w.Code)
+	}
+	for _, line := range []string{
+		`frostbyte_workers{state="active"} 2`,
+		`frostbyte_workers{state="draining"} 1`,
+		`frostbyte_workers{state="drained"} 0`,
+		"frostbyte_upload_bytes_total",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics are missing %s", line)
+		}
+	}
+}
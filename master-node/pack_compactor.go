@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pack compaction actions
+const (
+	PackActionDelete  = "delete"
+	PackActionCompact = "compact"
+)
+
+// PackStatus describes one pack in a compaction report
+type PackStatus struct {
+	PackID     string   `json:"packId"`
+	Size       int64    `json:"size"`
+	LiveFiles  int      `json:"liveFiles"`
+	LiveBytes  int64    `json:"liveBytes"`
+	Action     string   `json:"action,omitempty"`
+	MovedFiles int      `json:"movedFiles,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// PackReport is the outcome of one pack compaction run
+type PackReport struct {
+	StartedAt time.Time    `json:"startedAt"`
+	DryRun    bool         `json:"dryRun"`
+	Packs     []PackStatus `json:"packs"`
+}
+
+// PackCompactor reclaims the space of deleted packed files. Packs without live
+// files are deleted; packs whose share of deleted data reaches the threshold have
+// their live files appended to the current pack and are deleted afterwards.
+type PackCompactor struct {
+	fileOperations *FileOperations
+	threshold      float64 // Share of deleted data at which a pack is compacted
+
+	mu sync.Mutex // Serializes runs
+}
+
+func NewPackCompactor(fo *FileOperations, thresholdPercent int) *PackCompactor {
+	return &PackCompactor{
+		fileOperations: fo,
+		threshold:      float64(thresholdPercent) / 100,
+	}
+}
+
+// Run reports every pack and, unless dryRun is set, deletes or compacts the
+// packs that qualify. Packs in use by the packer are left alone.
+func (pc *PackCompactor) Run(ctx context.Context, dryRun bool) (*PackReport, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	report := &PackReport{StartedAt: time.Now().UTC(), DryRun: dryRun, Packs: []PackStatus{}}
+	packer := pc.fileOperations.packer
+
+	packs := make(map[string]*PackStatus)
+	status := func(packID string) *PackStatus {
+		if packs[packID] == nil {
+			packs[packID] = &PackStatus{PackID: packID}
+		}
+		return packs[packID]
+	}
+	members := make(map[string][]FileDocument)
+	err := ForEachFileDocument(ctx, func(doc FileDocument) error {
+		switch {
+		case isPackFile(doc.Filename):
+			pack := status(strings.TrimPrefix(doc.Filename, PackFilePrefix))
+			for _, record := range doc.Chunks {
+				pack.Size = max(pack.Size, record.Size)
+			}
+		case doc.Pack != nil:
+			pack := status(doc.Pack.PackID)
+			pack.LiveFiles++
+			pack.LiveBytes += doc.Pack.Length
+			members[doc.Pack.PackID] = append(members[doc.Pack.PackID], doc)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk file metadata: %v", err)
+	}
+
+	ids := make([]string, 0, len(packs))
+	for id := range packs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		pack := packs[id]
+		switch {
+		case packer != nil && packer.usedSince(id, report.StartedAt):
+		case pack.LiveFiles == 0:
+			pack.Action = PackActionDelete
+		case pack.Size > 0 && float64(pack.Size-pack.LiveBytes)/float64(pack.Size) >= pc.threshold:
+			pack.Action = PackActionCompact
+		}
+
+		if !dryRun && pack.Action != "" {
+			pc.apply(ctx, pack, members[id])
+		}
+		report.Packs = append(report.Packs, *pack)
+	}
+	return report, nil
+}
+
+// apply compacts or deletes one pack and records the outcome in its status
+func (pc *PackCompactor) apply(ctx context.Context, pack *PackStatus, files []FileDocument) {
+	if pack.Action == PackActionCompact {
+		if pc.fileOperations.packer == nil {
+			pack.Errors = append(pack.Errors, "packing is disabled, so live files cannot be moved")
+			return
+		}
+		for _, doc := range files {
+			if err := pc.moveFile(ctx, doc); err != nil {
+				pack.Errors = append(pack.Errors, fmt.Sprintf("%s: %v", doc.Filename, err))
+				continue
+			}
+			pack.MovedFiles++
+		}
+		// The pack still holds files that could not be moved
+		if len(pack.Errors) > 0 {
+			return
+		}
+	}
+
+	if err := pc.fileOperations.DeleteFile(ctx, packFilename(pack.PackID), nil); err != nil {
+		pack.Errors = append(pack.Errors, err.Error())
+		return
+	}
+	slog.InfoContext(ctx, "Reclaimed pack", "pack", pack.PackID, "action", pack.Action, "size", pack.Size,
+		"liveBytes", pack.LiveBytes, "movedFiles", pack.MovedFiles)
+}
+
+// moveFile copies a packed file to the current pack and points its metadata there.
+// A file that was deleted or re-uploaded in the meantime counts as moved.
+func (pc *PackCompactor) moveFile(ctx context.Context, doc FileDocument) error {
+	fo := pc.fileOperations
+	records, err := GetFileChunkRecords(ctx, packFilename(doc.Pack.PackID))
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	if _, err := fo.copyPackedFile(ctx, &data, *doc.Pack, downloadChunks(records)); err != nil {
+		return fmt.Errorf("failed to read packed file: %v", err)
+	}
+
+	ref, err := fo.packer.Add(ctx, doc.Filename, data.Bytes())
+	if err != nil {
+		return err
+	}
+	defer fo.packer.Done(ref)
+
+	err = ReplaceFilePack(ctx, doc.Filename, *doc.Pack, ref)
+	if errors.Is(err, errPackRefStale) {
+		return nil
+	}
+	return err
+}
+
+// Start runs compaction in the background at the given interval until ctx is done
+func (pc *PackCompactor) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if !metadata.IsLeader() {
+				continue
+			}
+			runCtx, cancel := context.WithTimeout(ctx, GCTimeout)
+			report, err := pc.Run(runCtx, false)
+			cancel()
+			if err != nil {
+				slog.Error("Pack compaction failed", "error", err)
+				continue
+			}
+			reclaimed := 0
+			for _, pack := range report.Packs {
+				if pack.Action != "" && len(pack.Errors) == 0 {
+					reclaimed++
+				}
+			}
+			slog.Info("Pack compaction finished", "packs", len(report.Packs), "reclaimed", reclaimed)
+		}
+	}()
+}
+
+// handleCompact runs pack compaction. With dryRun=true it only reports the packs.
+func (pc *PackCompactor) handleCompact(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), GCTimeout)
+	defer cancel()
+
+	report, err := pc.Run(ctx, r.URL.Query().Get("dryRun") == "true")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := writeJSONResponse(w, report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode pack report", "error", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPackCompaction(t *testing.T) {
+	wm, _, workers := newTestCluster(t, 2)
+	previousThreshold, previousSize, previousReplication := PackThreshold, PackSize, ReplicationFactor
+	PackThreshold, PackSize, ReplicationFactor = 100, 30, 2
+	t.Cleanup(func() {
+		PackThreshold, PackSize, ReplicationFactor = previousThreshold, previousSize, previousReplication
+	})
+	fo := NewFileOperations(wm)
+	pc := NewPackCompactor(fo, 50)
+	ctx := testContext(t)
+
+	// Every pack holds three files of 10 bytes
+	content := func(i int) string { return fmt.Sprintf("file-%04d", i) + "\n" }
+	packOf := make(map[int]string)
+	for i := 1; i <= 7; i++ {
+		w := httptest.NewRecorder()
+		fo.uploadFile(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/upload?filename=f%d&size=10", i), strings.NewReader(content(i))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload of f%d returned %d: %s", i, w.Code, w.Body)
+		}
+		doc, err := GetFileDocument(ctx, fmt.Sprintf("f%d", i))
+		must(t, err)
+		packOf[i] = doc.Pack.PackID
+	}
+	mostlyDeleted, deleted, open := packOf[1], packOf[4], packOf[7]
+	if packOf[3] != mostlyDeleted || packOf[6] != deleted || len(map[string]bool{mostlyDeleted: true, deleted: true, open: true}) != 3 {
+		t.Fatalf("files were packed as %v", packOf)
+	}
+	for _, i := range []int{1, 2, 4, 5, 6} {
+		must(t, fo.DeleteFile(ctx, fmt.Sprintf("f%d", i), nil))
+	}
+
+	actions := func(report *PackReport) map[string]string {
+		result := make(map[string]string)
+		for _, pack := range report.Packs {
+			if len(pack.Errors) > 0 {
+				t.Fatalf("pack %s failed: %v", pack.PackID, pack.Errors)
+			}
+			result[pack.PackID] = pack.Action
+		}
+		return result
+	}
+
+	// The open pack is left alone, however much of it is deleted
+	report, err := pc.Run(ctx, true)
+	must(t, err)
+	want := map[string]string{mostlyDeleted: PackActionCompact, deleted: PackActionDelete, open: ""}
+	if got := actions(report); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("dry run plans %v, want %v", got, want)
+	}
+	if workers[0].chunkCount() != 3 || workers[1].chunkCount() != 3 {
+		t.Fatalf("dry run changed the pack chunks")
+	}
+
+	report, err = pc.Run(ctx, false)
+	must(t, err)
+	if got := actions(report); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("compaction did %v, want %v", got, want)
+	}
+	for _, packID := range []string{mostlyDeleted, deleted} {
+		if _, err := GetFileDocument(ctx, packFilename(packID)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("reclaimed pack %s still has metadata: %v", packID, err)
+		}
+	}
+	for _, fw := range workers {
+		if fw.chunkCount() != 1 {
+			t.Fatalf("%s holds %d pack chunks after compaction, want 1", fw.id, fw.chunkCount())
+		}
+	}
+
+	// The live file of the compacted pack moved to the open pack, and both files still read back
+	for _, i := range []int{3, 7} {
+		doc, err := GetFileDocument(ctx, fmt.Sprintf("f%d", i))
+		must(t, err)
+		if doc.Pack.PackID != open {
+			t.Fatalf("f%d is in pack %s, want %s", i, doc.Pack.PackID, open)
+		}
+		w := httptest.NewRecorder()
+		fo.downloadFile(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/download/f%d", i), nil))
+		if w.Code != http.StatusOK || w.Body.String() != content(i) {
+			t.Fatalf("download of f%d returned %d: %q", i, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PackFilePrefix starts the names of the internal files that own pack chunks.
+// Clients cannot upload or delete files with this prefix.
+const PackFilePrefix = ".packs/"
+
+func isPackFile(filename string) bool {
+	return strings.HasPrefix(filename, PackFilePrefix)
+}
+
+func packFilename(packID string) string {
+	return PackFilePrefix + packID
+}
+
+// openPack is the pack the packer currently appends to
+type openPack struct {
+	id        string
+	chunkID   string
+	workerIDs []string
+	records   []ChunkRecord // Metadata record of each replica, once it holds data
+	size      int64
+}
+
+// Packer appends small files to shared pack chunks. Each pack is an internal file
+// with a single chunk, so replication, moves, garbage collection and consistency
+// checks treat it like any other file. Appends are serialized, so a pack has one
+// writer; a pack whose append failed is left behind and a new one is opened.
+type Packer struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+	packSize      int64
+
+	mu       sync.Mutex
+	open     *openPack
+	pending  map[string]int       // Packed files whose metadata is not written yet, per pack
+	lastUsed map[string]time.Time // When each pack last received or committed a file
+}
+
+func NewPacker(wm *WorkerManager, cm *ChunkManager, packSize int64) *Packer {
+	return &Packer{
+		workerManager: wm,
+		chunkManager:  cm,
+		packSize:      packSize,
+		pending:       make(map[string]int),
+		lastUsed:      make(map[string]time.Time),
+	}
+}
+
+// Add stores the data of a file in a pack and returns where. The caller must call
+// Done with the reference once the metadata of the packed file is written.
+func (p *Packer) Add(ctx context.Context, filename string, data []byte) (PackRef, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if p.open == nil || p.open.size+int64(len(data)) > p.packSize {
+			if err = p.openNew(ctx); err != nil {
+				return PackRef{}, err
+			}
+		}
+
+		var ref PackRef
+		ref, err = p.append(ctx, filename, data)
+		if err == nil {
+			p.pending[ref.PackID]++
+			p.lastUsed[ref.PackID] = time.Now()
+			return ref, nil
+		}
+		slog.WarnContext(ctx, "Failed to append to pack, opening a new one", "pack", p.open.id, "error", err)
+		p.open = nil
+	}
+	return PackRef{}, err
+}
+
+// Done marks the packed file at ref as recorded in the metadata, or abandoned
+func (p *Packer) Done(ref PackRef) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastUsed[ref.PackID] = time.Now()
+	if p.pending[ref.PackID]--; p.pending[ref.PackID] <= 0 {
+		delete(p.pending, ref.PackID)
+	}
+}
+
+// usedSince reports whether a pack is open, has files whose metadata is not
+// written yet, or was used after t. The compactor leaves such packs alone.
+func (p *Packer) usedSince(packID string, t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open != nil && p.open.id == packID {
+		return true
+	}
+	return p.pending[packID] > 0 || p.lastUsed[packID].After(t)
+}
+
+// openNew starts a new pack on workers chosen by the placement policy
+func (p *Packer) openNew(ctx context.Context) error {
+	workerIDs := p.workerManager.SelectWorkers(ReplicationFactor, nil, nil)
+	if len(workerIDs) == 0 {
+		return fmt.Errorf("no available workers")
+	}
+	if len(workerIDs) < ReplicationFactor {
+		return fmt.Errorf("replication factor %d needs more workers, only %d available", ReplicationFactor, len(workerIDs))
+	}
+
+	id := time.Now().UTC().Format("20060102-150405") + "-" + newRequestID()
+	filename := packFilename(id)
+	if err := storeFileMetadata(ctx, filename, 0, nil); err != nil {
+		return fmt.Errorf("failed to store pack metadata: %v", err)
+	}
+
+	p.open = &openPack{
+		id:        id,
+		chunkID:   p.chunkManager.generateChunkID(filename, 0),
+		workerIDs: workerIDs,
+		records:   make([]ChunkRecord, len(workerIDs)),
+	}
+	slog.InfoContext(ctx, "Opened pack", "pack", id, "workers", workerIDs)
+	return nil
+}
+
+// append writes the data of a file to every replica of the open pack and records
+// the grown chunk. The workers list the file in the sidecar of the pack.
+func (p *Packer) append(ctx context.Context, member string, data []byte) (PackRef, error) {
+	pack := p.open
+	filename := packFilename(pack.id)
+	size := pack.size + int64(len(data))
+
+	records := make([]ChunkRecord, len(pack.workerIDs))
+	errs := make([]error, len(pack.workerIDs))
+	var wg sync.WaitGroup
+	for i, workerID := range pack.workerIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			records[i], errs[i] = p.chunkManager.appendChunkOnWorker(ctx, workerID, filename, pack.chunkID, pack.size, data, member)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return PackRef{}, err
+	}
+
+	for i, record := range records {
+		if record.Size != size {
+			return PackRef{}, fmt.Errorf("worker %s holds %d bytes of pack %s, expected %d", record.WorkerID, record.Size, pack.id, size)
+		}
+		// A replica that was moved in the meantime no longer matches, and fails the append
+		var err error
+		if pack.size == 0 {
+			err = storeChunkInDB(ctx, filename, record)
+		} else {
+			err = ReplaceChunkRecord(ctx, filename, pack.records[i], record)
+		}
+		if err != nil {
+			return PackRef{}, fmt.Errorf("failed to record pack %s on worker %s: %v", pack.id, record.WorkerID, err)
+		}
+		pack.records[i] = record
+	}
+
+	ref := PackRef{PackID: pack.id, Offset: pack.size, Length: int64(len(data))}
+	pack.size = size
+	return ref, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Placement policy names
+const (
+	PlacementRoundRobin  = "round-robin"
+	PlacementRandom      = "random"
+	PlacementFreeSpace   = "weighted-free-space"
+	PlacementLeastLoaded = "least-loaded"
+	PlacementPowerOfTwo  = "power-of-two"
+)
+
+// PlacementPolicy chooses a worker for a new chunk. Select is called with the
+// worker manager's lock held and a non-empty candidate list sorted by ID.
+type PlacementPolicy interface {
+	Select(candidates []Worker) string
+}
+
+// newPlacementPolicy creates the placement policy with the given name
+func newPlacementPolicy(name string) (PlacementPolicy, error) {
+	switch name {
+	case PlacementRoundRobin:
+		return &roundRobinPlacement{}, nil
+	case PlacementRandom:
+		return randomPlacement{}, nil
+	case PlacementFreeSpace:
+		return freeSpacePlacement{}, nil
+	case PlacementLeastLoaded:
+		return leastLoadedPlacement{}, nil
+	case PlacementPowerOfTwo:
+		return powerOfTwoPlacement{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement policy %q", name)
+	}
+}
+
+// workerLoad combines the load a worker reported with the transfers the master has in flight to it
+func workerLoad(worker Worker) int64 {
+	return worker.Status.InFlight + int64(worker.Pending)
+}
+
+// roundRobinPlacement cycles through the workers in ID order
+type roundRobinPlacement struct {
+	lastSelected int
+}
+
+func (p *roundRobinPlacement) Select(candidates []Worker) string {
+	selected := candidates[p.lastSelected%len(candidates)]
+	p.lastSelected++
+	return selected.ID
+}
+
+// randomPlacement picks a worker uniformly at random
+type randomPlacement struct{}
+
+func (randomPlacement) Select(candidates []Worker) string {
+	return candidates[rand.Intn(len(candidates))].ID
+}
+
+// freeSpacePlacement picks a worker at random, weighted by its free disk space.
+// Workers that have not reported capacity yet weigh as much as the mean worker
+// that has, so they get chunks from the start.
+type freeSpacePlacement struct{}
+
+func (freeSpacePlacement) Select(candidates []Worker) string {
+	var reportedFree, reported uint64
+	for _, worker := range candidates {
+		if worker.Status.CapacityBytes > 0 {
+			reportedFree += worker.Status.FreeBytes
+			reported++
+		}
+	}
+	if reportedFree == 0 {
+		return randomPlacement{}.Select(candidates)
+	}
+
+	mean := reportedFree / reported
+	weight := func(worker Worker) uint64 {
+		if worker.Status.CapacityBytes == 0 {
+			return mean
+		}
+		return worker.Status.FreeBytes
+	}
+	total := reportedFree + mean*(uint64(len(candidates))-reported)
+
+	target := rand.Uint64() % total
+	for _, worker := range candidates {
+		if target < weight(worker) {
+			return worker.ID
+		}
+		target -= weight(worker)
+	}
+	return candidates[len(candidates)-1].ID
+}
+
+// leastLoadedPlacement picks the worker with the fewest in-flight requests
+type leastLoadedPlacement struct{}
+
+func (leastLoadedPlacement) Select(candidates []Worker) string {
+	best := candidates[0]
+	for _, worker := range candidates[1:] {
+		if lessLoaded(worker, best) {
+			best = worker
+		}
+	}
+	return best.ID
+}
+
+// powerOfTwoPlacement samples two workers at random and keeps the less loaded one
+type powerOfTwoPlacement struct{}
+
+func (powerOfTwoPlacement) Select(candidates []Worker) string {
+	if len(candidates) == 1 {
+		return candidates[0].ID
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(candidates[j], candidates[i]) {
+		return candidates[j].ID
+	}
+	return candidates[i].ID
+}
+
+// lessLoaded reports whether a is less loaded than b, preferring more free space on ties
+func lessLoaded(a, b Worker) bool {
+	loadA, loadB := workerLoad(a), workerLoad(b)
+	if loadA != loadB {
+		return loadA < loadB
+	}
+	return a.Status.FreeBytes > b.Status.FreeBytes
+}
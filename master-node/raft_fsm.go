@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Operations of the replicated metadata log
+const (
+	opStoreFile    = "store-file"
+	opStoreVersion = "store-version"
+	opPutFile      = "put-file"
+	opAddChunk     = "add-chunk"
+	opDeleteFile   = "delete-file"
+	opSetRetention = "set-retention"
+	opSetLegalHold = "set-legal-hold"
+	opReplaceChunk = "replace-chunk"
+	opReplacePack  = "replace-pack"
+	opRenameWorker = "rename-worker"
+	opStorePolicy  = "store-policy"
+	opDeletePolicy = "delete-policy"
+	opAppendAudit  = "append-audit"
+	opStoreWorker  = "store-worker"
+	opDeleteWorker = "delete-worker"
+)
+
+// raftCommand is one entry of the replicated metadata log. Everything that is
+// not deterministic, such as timestamps, is decided by the leader beforehand.
+type raftCommand struct {
+	Op          string           `json:"op"`
+	Filename    string           `json:"filename,omitempty"`
+	File        *FileInfo        `json:"file,omitempty"`
+	Document    *FileDocument    `json:"document,omitempty"`
+	Record      *ChunkRecord     `json:"record,omitempty"`
+	Old         *ChunkRecord     `json:"old,omitempty"`
+	Pack        *PackRef         `json:"pack,omitempty"`
+	OldPack     *PackRef         `json:"oldPack,omitempty"`
+	Policy      *LifecyclePolicy `json:"policy,omitempty"`
+	Audit       *AuditEvent      `json:"audit,omitempty"`
+	Worker      *WorkerRecord    `json:"worker,omitempty"`
+	ID          string           `json:"id,omitempty"`
+	NewID       string           `json:"newId,omitempty"`
+	Mode        string           `json:"mode,omitempty"`
+	RetainUntil time.Time        `json:"retainUntil,omitzero"`
+	LegalHold   bool             `json:"legalHold,omitempty"`
+}
+
+// metadataState is the complete replicated metadata, and the format of snapshots
+type metadataState struct {
+	Files    map[string]*FileDocument   `json:"files"`
+	Policies map[string]LifecyclePolicy `json:"policies"`
+	Audit    []AuditEvent               `json:"audit"`
+	Workers  map[string]WorkerRecord    `json:"workers"`
+}
+
+func newMetadataState() metadataState {
+	return metadataState{
+		Files:    make(map[string]*FileDocument),
+		Policies: make(map[string]LifecyclePolicy),
+		Audit:    []AuditEvent{},
+		Workers:  make(map[string]WorkerRecord),
+	}
+}
+
+// metadataFSM applies the metadata log to an in-memory state
+type metadataFSM struct {
+	mu    sync.RWMutex
+	state metadataState
+}
+
+func newMetadataFSM() *metadataFSM {
+	return &metadataFSM{state: newMetadataState()}
+}
+
+// Apply applies one committed log entry. The result is an error, an int64 for
+// rename-worker, or nil.
+func (f *metadataFSM) Apply(entry *raft.Log) interface{} {
+	var command raftCommand
+	if err := json.Unmarshal(entry.Data, &command); err != nil {
+		slog.Error("Skipping undecodable raft log entry", "index", entry.Index, "error", err)
+		return fmt.Errorf("failed to decode raft command: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := &f.state
+
+	switch command.Op {
+	case opStoreFile:
+		// A re-upload replaces the object but keeps its retention and legal hold
+		doc := &FileDocument{FileInfo: *command.File, Chunks: []ChunkRecord{}}
+		if existing, exists := state.Files[command.File.Filename]; exists {
+			doc.RetentionMode = existing.RetentionMode
+			doc.RetainUntil = existing.RetainUntil
+			doc.LegalHold = existing.LegalHold
+		}
+		state.Files[command.File.Filename] = doc
+	case opStoreVersion:
+		doc := copyFileDocument(command.Document)
+		doc.RetentionMode, doc.RetainUntil, doc.LegalHold = "", time.Time{}, false
+		if existing, exists := state.Files[doc.Filename]; exists {
+			doc.RetentionMode = existing.RetentionMode
+			doc.RetainUntil = existing.RetainUntil
+			doc.LegalHold = existing.LegalHold
+		}
+		state.Files[doc.Filename] = &doc
+	case opPutFile:
+		doc := copyFileDocument(command.Document)
+		state.Files[doc.Filename] = &doc
+	case opAddChunk:
+		doc, exists := state.Files[command.Filename]
+		if !exists {
+			doc = &FileDocument{FileInfo: FileInfo{Filename: command.Filename}, Chunks: []ChunkRecord{}}
+			state.Files[command.Filename] = doc
+		}
+		for _, record := range doc.Chunks {
+			if record == *command.Record {
+				return nil
+			}
+		}
+		doc.Chunks = append(doc.Chunks, *command.Record)
+	case opDeleteFile:
+		delete(state.Files, command.Filename)
+	case opSetRetention:
+		doc, exists := state.Files[command.Filename]
+		if !exists {
+			return ErrNotFound
+		}
+		doc.RetentionMode = command.Mode
+		doc.RetainUntil = command.RetainUntil
+		if command.Mode == "" {
+			doc.RetainUntil = time.Time{}
+		}
+	case opSetLegalHold:
+		doc, exists := state.Files[command.Filename]
+		if !exists {
+			return ErrNotFound
+		}
+		doc.LegalHold = command.LegalHold
+	case opReplaceChunk:
+		doc, exists := state.Files[command.Filename]
+		if !exists {
+			return errChunkMoveStale
+		}
+		for i, record := range doc.Chunks {
+			if record.ChunkID == command.Old.ChunkID && record.WorkerID == command.Old.WorkerID && record.Size == command.Old.Size {
+				doc.Chunks[i] = *command.Record
+				return nil
+			}
+		}
+		return errChunkMoveStale
+	case opReplacePack:
+		doc, exists := state.Files[command.Filename]
+		if !exists || doc.Pack == nil || *doc.Pack != *command.OldPack {
+			return errPackRefStale
+		}
+		pack := *command.Pack
+		doc.Pack = &pack
+	case opRenameWorker:
+		var renamed int64
+		for _, doc := range state.Files {
+			changed := false
+			for i := range doc.Chunks {
+				if doc.Chunks[i].WorkerID == command.ID {
+					doc.Chunks[i].WorkerID = command.NewID
+					changed = true
+				}
+			}
+			if changed {
+				renamed++
+			}
+		}
+		return renamed
+	case opStorePolicy:
+		state.Policies[command.Policy.ID] = *command.Policy
+	case opDeletePolicy:
+		if _, exists := state.Policies[command.ID]; !exists {
+			return ErrNotFound
+		}
+		delete(state.Policies, command.ID)
+	case opAppendAudit:
+		state.Audit = append(state.Audit, *command.Audit)
+	case opStoreWorker:
+		state.Workers[command.Worker.ID] = *command.Worker
+	case opDeleteWorker:
+		delete(state.Workers, command.ID)
+	default:
+		return fmt.Errorf("unknown raft command %q", command.Op)
+	}
+	return nil
+}
+
+// fileDocuments returns copies of all file documents sorted by filename
+func (f *metadataFSM) fileDocuments() []FileDocument {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	docs := make([]FileDocument, 0, len(f.state.Files))
+	for _, doc := range f.state.Files {
+		docs = append(docs, copyFileDocument(doc))
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].Filename < docs[j].Filename
+	})
+	return docs
+}
+
+func copyFileDocument(doc *FileDocument) FileDocument {
+	copied := *doc
+	copied.Tags = append([]string(nil), doc.Tags...)
+	copied.Chunks = append([]ChunkRecord{}, doc.Chunks...)
+	if doc.Pack != nil {
+		pack := *doc.Pack
+		copied.Pack = &pack
+	}
+	return copied
+}
+
+// Snapshot serializes the state while holding the read lock, so the log can be
+// compacted up to the snapshot
+func (f *metadataFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metadata snapshot: %v", err)
+	}
+	return &metadataSnapshot{data: data}, nil
+}
+
+// Restore replaces the state with a snapshot
+func (f *metadataFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	state := newMetadataState()
+	if err := json.NewDecoder(snapshot).Decode(&state); err != nil {
+		return fmt.Errorf("failed to decode metadata snapshot: %v", err)
+	}
+
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	slog.Info("Restored raft snapshot", "files", len(state.Files), "workers", len(state.Workers))
+	return nil
+}
+
+// metadataSnapshot is an encoded point-in-time copy of the metadata
+type metadataSnapshot struct {
+	data []byte
+}
+
+func (s *metadataSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write metadata snapshot: %v", err)
+	}
+	return sink.Close()
+}
+
+func (s *metadataSnapshot) Release() {}
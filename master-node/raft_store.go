@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// errNotLeader reports a metadata write on a master that is not the Raft leader
+var errNotLeader = errors.New("this master is not the leader")
+
+// RaftPeer is one master of the Raft group
+type RaftPeer struct {
+	ID       string // Raft server ID
+	RaftAddr string // host:port of the Raft transport
+	HTTPAddr string // host:port of the master API, requests are forwarded there
+}
+
+// RaftConfig configures a master in multi-master mode
+type RaftConfig struct {
+	NodeID            string
+	DataDir           string
+	Peers             []RaftPeer
+	SnapshotThreshold uint64
+}
+
+// raftConfigFromEnv builds the Raft configuration from the settings. Peers are
+// given as a comma separated list of id=raftHost:port=httpHost:port entries.
+func raftConfigFromEnv() (RaftConfig, error) {
+	config := RaftConfig{
+		NodeID:            RaftNodeID,
+		DataDir:           RaftDataDir,
+		SnapshotThreshold: uint64(RaftSnapshotThreshold),
+	}
+	if config.NodeID == "" {
+		return config, errors.New("raft-id (FROSTBYTE_RAFT_ID) is required with the raft metadata backend")
+	}
+
+	for _, entry := range strings.Split(RaftPeers, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "=")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return config, fmt.Errorf("invalid raft peer %q, expected id=raftHost:port=httpHost:port", entry)
+		}
+		config.Peers = append(config.Peers, RaftPeer{ID: parts[0], RaftAddr: parts[1], HTTPAddr: parts[2]})
+	}
+	if config.peer(config.NodeID) == nil {
+		return config, fmt.Errorf("raft node %s is not in raft-peers (FROSTBYTE_RAFT_PEERS)", config.NodeID)
+	}
+	return config, nil
+}
+
+func (c RaftConfig) peer(id string) *RaftPeer {
+	for i := range c.Peers {
+		if c.Peers[i].ID == id {
+			return &c.Peers[i]
+		}
+	}
+	return nil
+}
+
+// RaftStore replicates the metadata across a group of masters. Every master
+// applies the same log to an in-memory state; only the leader accepts writes
+// and reads are served from the leader's state.
+type RaftStore struct {
+	raft    *raft.Raft
+	fsm     *metadataFSM
+	config  RaftConfig
+	closers []io.Closer
+
+	mu       sync.Mutex
+	onLeader func(isLeader bool)
+}
+
+// NewRaftStore starts a master's Raft node with durable log, stable and snapshot
+// stores in the data directory, and bootstraps the group on first start
+func NewRaftStore(config RaftConfig) (*RaftStore, error) {
+	self := config.peer(config.NodeID)
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft data directory: %v", err)
+	}
+
+	advertise, err := net.ResolveTCPAddr("tcp", self.RaftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve raft address %s: %v", self.RaftAddr, err)
+	}
+	transport, err := raft.NewTCPTransport(fmt.Sprintf(":%d", advertise.Port), advertise, 3, NetworkTimeout, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft transport: %v", err)
+	}
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(config.DataDir, "raft.db"))
+	if err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("failed to open raft log: %v", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(config.DataDir, 2, os.Stderr)
+	if err != nil {
+		transport.Close()
+		boltStore.Close()
+		return nil, fmt.Errorf("failed to open raft snapshots: %v", err)
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:       "raft",
+		Level:      hclog.LevelFromString(LogLevel),
+		JSONFormat: LogFormat == LogFormatJSON,
+	})
+	if config.SnapshotThreshold > 0 {
+		raftConfig.SnapshotThreshold = config.SnapshotThreshold
+	}
+	store, err := newRaftStore(config, raftConfig, boltStore, boltStore, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		boltStore.Close()
+		return nil, err
+	}
+	store.closers = append(store.closers, transport, boltStore)
+	return store, nil
+}
+
+// newRaftStore starts a Raft node on the given stores and transport, bootstrapping
+// the configured peers unless the node already has state
+func newRaftStore(config RaftConfig, raftConfig *raft.Config, logs raft.LogStore, stable raft.StableStore,
+	snapshots raft.SnapshotStore, transport raft.Transport) (*RaftStore, error) {
+	store := &RaftStore{
+		fsm:    newMetadataFSM(),
+		config: config,
+	}
+	leaders := make(chan bool, 1)
+	raftConfig.LocalID = raft.ServerID(config.NodeID)
+	raftConfig.NotifyCh = leaders
+
+	existing, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect raft state: %v", err)
+	}
+
+	node, err := raft.NewRaft(raftConfig, store.fsm, logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft: %v", err)
+	}
+	store.raft = node
+	go store.watchLeadership(leaders)
+
+	// Every peer bootstraps with the same configuration, so it does not matter
+	// which master starts first
+	if !existing {
+		servers := make([]raft.Server, 0, len(config.Peers))
+		for _, peer := range config.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(peer.ID), Address: raft.ServerAddress(peer.RaftAddr)})
+		}
+		if err := node.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil &&
+			!errors.Is(err, raft.ErrCantBootstrap) {
+			node.Shutdown()
+			return nil, fmt.Errorf("failed to bootstrap raft group: %v", err)
+		}
+	}
+
+	slog.Info("Raft node started", "node", config.NodeID, "peers", len(config.Peers))
+	return store, nil
+}
+
+func (s *RaftStore) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// LeaderHTTPAddr returns the API address of the current leader, or "" if there is none
+func (s *RaftStore) LeaderHTTPAddr() string {
+	_, id := s.raft.LeaderWithID()
+	if peer := s.config.peer(string(id)); peer != nil {
+		return peer.HTTPAddr
+	}
+	return ""
+}
+
+// OnLeadershipChange registers fn to be called with true when this master becomes
+// leader and with false when it steps down. fn must return quickly.
+func (s *RaftStore) OnLeadershipChange(fn func(isLeader bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onLeader = fn
+}
+
+// watchLeadership consumes Raft's leadership notifications, which must never block
+func (s *RaftStore) watchLeadership(leaders <-chan bool) {
+	for isLeader := range leaders {
+		if isLeader {
+			slog.Info("Raft node became leader", "node", s.config.NodeID)
+		} else {
+			slog.Info("Raft node stepped down", "node", s.config.NodeID)
+		}
+
+		s.mu.Lock()
+		fn := s.onLeader
+		s.mu.Unlock()
+		if fn != nil {
+			fn(isLeader)
+		}
+	}
+}
+
+// ClusterStatus describes the Raft group as seen by one master
+type ClusterStatus struct {
+	NodeID      string     `json:"nodeId"`
+	State       string     `json:"state"`
+	Leader      string     `json:"leader"`
+	LastIndex   uint64     `json:"lastIndex"`
+	AppliedTo   uint64     `json:"appliedIndex"`
+	Peers       []RaftPeer `json:"peers"`
+	LastContact time.Time  `json:"lastContact,omitzero"`
+}
+
+func (s *RaftStore) Status() ClusterStatus {
+	_, leader := s.raft.LeaderWithID()
+	return ClusterStatus{
+		NodeID:      s.config.NodeID,
+		State:       s.raft.State().String(),
+		Leader:      string(leader),
+		LastIndex:   s.raft.LastIndex(),
+		AppliedTo:   s.raft.AppliedIndex(),
+		Peers:       s.config.Peers,
+		LastContact: s.raft.LastContact(),
+	}
+}
+
+func (s *RaftStore) Close() error {
+	// Hand leadership over first, so the group does not wait for an election timeout
+	if s.IsLeader() && len(s.config.Peers) > 1 {
+		if err := s.raft.LeadershipTransfer().Error(); err != nil {
+			slog.Warn("Failed to transfer Raft leadership", "error", err)
+		}
+	}
+	err := s.raft.Shutdown().Error()
+	for _, closer := range s.closers {
+		closer.Close()
+	}
+	return err
+}
+
+// apply replicates a command through the log and returns the state machine's result
+func (s *RaftStore) apply(ctx context.Context, command raftCommand) (interface{}, error) {
+	if !s.IsLeader() {
+		return nil, errNotLeader
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s command: %v", command.Op, err)
+	}
+
+	timeout := DatabaseTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	future := s.raft.Apply(data, timeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return nil, errNotLeader
+		}
+		return nil, fmt.Errorf("failed to replicate %s command: %v", command.Op, err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+func (s *RaftStore) applyErr(ctx context.Context, command raftCommand) error {
+	_, err := s.apply(ctx, command)
+	return err
+}
+
+func (s *RaftStore) StoreFileMetadata(ctx context.Context, file FileInfo) error {
+	return s.applyErr(ctx, raftCommand{Op: opStoreFile, File: &file})
+}
+
+func (s *RaftStore) StoreFileVersion(ctx context.Context, doc FileDocument) error {
+	return s.applyErr(ctx, raftCommand{Op: opStoreVersion, Document: &doc})
+}
+
+func (s *RaftStore) PutFileDocument(ctx context.Context, doc FileDocument) error {
+	return s.applyErr(ctx, raftCommand{Op: opPutFile, Document: &doc})
+}
+
+func (s *RaftStore) AddChunkRecord(ctx context.Context, filename string, record ChunkRecord) error {
+	return s.applyErr(ctx, raftCommand{Op: opAddChunk, Filename: filename, Record: &record})
+}
+
+func (s *RaftStore) DeleteFileMetadata(ctx context.Context, filename string) error {
+	return s.applyErr(ctx, raftCommand{Op: opDeleteFile, Filename: filename})
+}
+
+func (s *RaftStore) UpdateFileRetention(ctx context.Context, filename, mode string, retainUntil time.Time) error {
+	return s.applyErr(ctx, raftCommand{Op: opSetRetention, Filename: filename, Mode: mode, RetainUntil: retainUntil})
+}
+
+func (s *RaftStore) UpdateFileLegalHold(ctx context.Context, filename string, hold bool) error {
+	return s.applyErr(ctx, raftCommand{Op: opSetLegalHold, Filename: filename, LegalHold: hold})
+}
+
+func (s *RaftStore) ReplaceChunkRecord(ctx context.Context, filename string, old ChunkRecord, replacement ChunkRecord) error {
+	return s.applyErr(ctx, raftCommand{Op: opReplaceChunk, Filename: filename, Old: &old, Record: &replacement})
+}
+
+func (s *RaftStore) ReplaceFilePack(ctx context.Context, filename string, old PackRef, replacement PackRef) error {
+	return s.applyErr(ctx, raftCommand{Op: opReplacePack, Filename: filename, OldPack: &old, Pack: &replacement})
+}
+
+func (s *RaftStore) RenameWorkerInChunks(ctx context.Context, oldID, newID string) (int64, error) {
+	result, err := s.apply(ctx, raftCommand{Op: opRenameWorker, ID: oldID, NewID: newID})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+func (s *RaftStore) StoreLifecyclePolicy(ctx context.Context, policy LifecyclePolicy) error {
+	return s.applyErr(ctx, raftCommand{Op: opStorePolicy, Policy: &policy})
+}
+
+func (s *RaftStore) DeleteLifecyclePolicy(ctx context.Context, id string) error {
+	return s.applyErr(ctx, raftCommand{Op: opDeletePolicy, ID: id})
+}
+
+func (s *RaftStore) StoreAuditEvent(ctx context.Context, event AuditEvent) error {
+	return s.applyErr(ctx, raftCommand{Op: opAppendAudit, Audit: &event})
+}
+
+func (s *RaftStore) StoreWorkerRecord(ctx context.Context, record WorkerRecord) error {
+	return s.applyErr(ctx, raftCommand{Op: opStoreWorker, Worker: &record})
+}
+
+func (s *RaftStore) DeleteWorkerRecord(ctx context.Context, id string) error {
+	return s.applyErr(ctx, raftCommand{Op: opDeleteWorker, ID: id})
+}
+
+func (s *RaftStore) GetFileDocument(ctx context.Context, filename string) (FileDocument, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+	doc, exists := s.fsm.state.Files[filename]
+	if !exists {
+		return FileDocument{}, ErrNotFound
+	}
+	return copyFileDocument(doc), nil
+}
+
+func (s *RaftStore) ListFiles(ctx context.Context) ([]FileInfo, error) {
+	docs := s.fsm.fileDocuments()
+	files := make([]FileInfo, 0, len(docs))
+	for _, doc := range docs {
+		files = append(files, doc.FileInfo)
+	}
+	return files, nil
+}
+
+// ForEachFileDocument walks a copy of the documents, so fn may take its time
+func (s *RaftStore) ForEachFileDocument(ctx context.Context, fn func(FileDocument) error) error {
+	for _, doc := range s.fsm.fileDocuments() {
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RaftStore) GetChunkReferences(ctx context.Context) (map[string]map[string]bool, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	references := make(map[string]map[string]bool)
+	for _, doc := range s.fsm.state.Files {
+		for _, chunk := range doc.Chunks {
+			if references[chunk.WorkerID] == nil {
+				references[chunk.WorkerID] = make(map[string]bool)
+			}
+			references[chunk.WorkerID][chunk.ChunkID] = true
+		}
+	}
+	return references, nil
+}
+
+func (s *RaftStore) GetChunkRecordsForWorker(ctx context.Context, workerID string) ([]WorkerChunkRef, error) {
+	refs := []WorkerChunkRef{}
+	for _, doc := range s.fsm.fileDocuments() {
+		for _, record := range doc.Chunks {
+			if record.WorkerID == workerID {
+				refs = append(refs, WorkerChunkRef{Filename: doc.Filename, Record: record})
+			}
+		}
+	}
+	return refs, nil
+}
+
+func (s *RaftStore) GetWorkerUsage(ctx context.Context) (map[string]int64, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	usage := make(map[string]int64)
+	for _, doc := range s.fsm.state.Files {
+		for _, chunk := range doc.Chunks {
+			usage[chunk.WorkerID] += chunk.Size
+		}
+	}
+	return usage, nil
+}
+
+func (s *RaftStore) GetLifecyclePolicies(ctx context.Context) ([]LifecyclePolicy, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	policies := make([]LifecyclePolicy, 0, len(s.fsm.state.Policies))
+	for _, policy := range s.fsm.state.Policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].ID < policies[j].ID
+	})
+	return policies, nil
+}
+
+func (s *RaftStore) GetAuditEvents(ctx context.Context, limit int64) ([]AuditEvent, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	events := []AuditEvent{}
+	for i := len(s.fsm.state.Audit) - 1; i >= 0 && int64(len(events)) < limit; i-- {
+		events = append(events, s.fsm.state.Audit[i])
+	}
+	return events, nil
+}
+
+func (s *RaftStore) LoadWorkerRecords(ctx context.Context) ([]WorkerRecord, error) {
+	s.fsm.mu.RLock()
+	defer s.fsm.mu.RUnlock()
+
+	records := make([]WorkerRecord, 0, len(s.fsm.state.Workers))
+	for _, record := range s.fsm.state.Workers {
+		// The drain progress is updated in place by the worker manager
+		if record.Drain != nil {
+			drain := *record.Drain
+			record.Drain = &drain
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
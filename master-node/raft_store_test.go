@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// newInmemRaftCluster starts a group of n Raft stores in this process, connected
+// through in-memory transports. httpAddrs optionally sets the API address of each
+// master, which followers forward requests to.
+func newInmemRaftCluster(t *testing.T, n int, httpAddrs ...string) []*RaftStore {
+	t.Helper()
+
+	config := RaftConfig{}
+	transports := make([]*raft.InmemTransport, n)
+	for i := range transports {
+		id := fmt.Sprintf("master%d", i+1)
+		addr, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+		transports[i] = transport
+		peer := RaftPeer{ID: id, RaftAddr: string(addr)}
+		if i < len(httpAddrs) {
+			peer.HTTPAddr = httpAddrs[i]
+		}
+		config.Peers = append(config.Peers, peer)
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			if a != b {
+				a.Connect(b.LocalAddr(), b)
+			}
+		}
+	}
+
+	stores := make([]*RaftStore, 0, n)
+	for i, transport := range transports {
+		nodeConfig := config
+		nodeConfig.NodeID = config.Peers[i].ID
+
+		raftConfig := raft.DefaultConfig()
+		raftConfig.Logger = hclog.NewNullLogger()
+		raftConfig.HeartbeatTimeout = 50 * time.Millisecond
+		raftConfig.ElectionTimeout = 50 * time.Millisecond
+		raftConfig.LeaderLeaseTimeout = 50 * time.Millisecond
+		raftConfig.CommitTimeout = 5 * time.Millisecond
+
+		logs := raft.NewInmemStore()
+		store, err := newRaftStore(nodeConfig, raftConfig, logs, logs, raft.NewInmemSnapshotStore(), transport)
+		if err != nil {
+			t.Fatalf("failed to start raft store %s: %v", nodeConfig.NodeID, err)
+		}
+		t.Cleanup(func() { store.raft.Shutdown() })
+		stores = append(stores, store)
+	}
+	return stores
+}
+
+// waitForLeader waits until the running stores agree on a leader and returns it
+func waitForLeader(t *testing.T, stores []*RaftStore) *RaftStore {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *RaftStore
+		agreed := true
+		for _, store := range stores {
+			if store.raft.State() == raft.Shutdown {
+				continue
+			}
+			if store.IsLeader() {
+				leader = store
+			}
+			if _, id := store.raft.LeaderWithID(); leader != nil && string(id) != leader.config.NodeID {
+				agreed = false
+			}
+		}
+		if leader != nil && agreed {
+			return leader
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for a raft leader")
+	return nil
+}
+
+// waitForApplied waits until every running store has applied the leader's log
+func waitForApplied(t *testing.T, stores []*RaftStore, leader *RaftStore) {
+	t.Helper()
+
+	if err := leader.raft.Barrier(5 * time.Second).Error(); err != nil {
+		t.Fatalf("barrier failed: %v", err)
+	}
+	index := leader.raft.AppliedIndex()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, store := range stores {
+		for store.raft.State() != raft.Shutdown && store.raft.AppliedIndex() < index {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s did not apply index %d", store.config.NodeID, index)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// useTestMetadata makes a single in-process Raft store the metadata store of the
+// master for the duration of the test
+func useTestMetadata(t *testing.T) *RaftStore {
+	t.Helper()
+	store := waitForLeader(t, newInmemRaftCluster(t, 1))
+	previous := metadata
+	metadata = store
+	t.Cleanup(func() { metadata = previous })
+	return store
+}
+
+func followers(stores []*RaftStore, leader *RaftStore) []*RaftStore {
+	var result []*RaftStore
+	for _, store := range stores {
+		if store != leader {
+			result = append(result, store)
+		}
+	}
+	return result
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestRaftLeaderElection(t *testing.T) {
+	stores := newInmemRaftCluster(t, 3)
+	leader := waitForLeader(t, stores)
+
+	leaders := 0
+	for _, store := range stores {
+		if store.IsLeader() {
+			leaders++
+		}
+		if status := store.Status(); status.Leader != leader.config.NodeID {
+			t.Errorf("%s sees leader %q, want %q", store.config.NodeID, status.Leader, leader.config.NodeID)
+		}
+	}
+	if leaders != 1 {
+		t.Errorf("got %d leaders, want 1", leaders)
+	}
+}
+
+func TestRaftFollowerWritesAreForwarded(t *testing.T) {
+	// The handler of each master writes through its own store, as the API does
+	stores := make([]*RaftStore, 3)
+	servers := make([]*httptest.Server, len(stores))
+	addrs := make([]string, len(stores))
+	for i := range servers {
+		store := &stores[i]
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			file := FileInfo{Filename: r.URL.Query().Get("filename"), Size: 1}
+			if err := (*store).StoreFileMetadata(r.Context(), file); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeSuccessResponse(w, "stored by "+(*store).config.NodeID)
+		})
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwardToLeader(*store, handler).ServeHTTP(w, r)
+		}))
+		t.Cleanup(servers[i].Close)
+		addrs[i] = strings.TrimPrefix(servers[i].URL, "http://")
+	}
+	copy(stores, newInmemRaftCluster(t, len(stores), addrs...))
+	leader := waitForLeader(t, stores)
+
+	ctx := testContext(t)
+	for i, follower := range stores {
+		if follower == leader {
+			continue
+		}
+		filename := fmt.Sprintf("file-%d", i)
+		if err := follower.StoreFileMetadata(ctx, FileInfo{Filename: filename}); !errors.Is(err, errNotLeader) {
+			t.Fatalf("write on follower %s returned %v, want errNotLeader", follower.config.NodeID, err)
+		}
+
+		resp, err := http.Post(servers[i].URL+"/upload?filename="+filename, "text/plain", nil)
+		if err != nil {
+			t.Fatalf("request to follower failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request to follower %s returned %s", follower.config.NodeID, resp.Status)
+		}
+
+		waitForApplied(t, stores, leader)
+		for _, store := range stores {
+			if _, err := store.GetFileDocument(ctx, filename); err != nil {
+				t.Errorf("%s does not have %s: %v", store.config.NodeID, filename, err)
+			}
+		}
+	}
+}
+
+func TestRaftSnapshotRestore(t *testing.T) {
+	stores := newInmemRaftCluster(t, 3)
+	leader := waitForLeader(t, stores)
+	ctx := testContext(t)
+
+	retainUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	must(t, leader.StoreFileMetadata(ctx, FileInfo{Filename: "a", Size: 3, Tags: []string{"x"}}))
+	must(t, leader.AddChunkRecord(ctx, "a", ChunkRecord{ChunkID: "a_0", WorkerID: "w1", Size: 3}))
+	must(t, leader.UpdateFileRetention(ctx, "a", RetentionGovernance, retainUntil))
+	must(t, leader.StoreLifecyclePolicy(ctx, LifecyclePolicy{ID: "p1", Prefix: "logs/", ExpireAfterDays: 30}))
+	must(t, leader.StoreWorkerRecord(ctx, WorkerRecord{ID: "w1", Address: "w1:8081", State: WorkerStateActive}))
+
+	future := leader.raft.Snapshot()
+	must(t, future.Error())
+	_, snapshot, err := future.Open()
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+
+	restored := newMetadataFSM()
+	must(t, restored.Restore(snapshot))
+
+	docs := restored.fileDocuments()
+	if len(docs) != 1 || docs[0].Filename != "a" || len(docs[0].Chunks) != 1 || docs[0].Chunks[0].ChunkID != "a_0" {
+		t.Fatalf("restored files %+v", docs)
+	}
+	if docs[0].RetentionMode != RetentionGovernance || !docs[0].RetainUntil.Equal(retainUntil) {
+		t.Errorf("restored retention %s until %s", docs[0].RetentionMode, docs[0].RetainUntil)
+	}
+	if _, exists := restored.state.Policies["p1"]; !exists {
+		t.Errorf("restored policies %+v", restored.state.Policies)
+	}
+	if worker := restored.state.Workers["w1"]; worker.Address != "w1:8081" {
+		t.Errorf("restored workers %+v", restored.state.Workers)
+	}
+}
+
+func TestRaftFailoverKeepsCommittedMetadata(t *testing.T) {
+	stores := newInmemRaftCluster(t, 3)
+	leader := waitForLeader(t, stores)
+	ctx := testContext(t)
+
+	must(t, leader.StoreFileMetadata(ctx, FileInfo{Filename: "kept", Size: 5}))
+	must(t, leader.AddChunkRecord(ctx, "kept", ChunkRecord{ChunkID: "kept_0", WorkerID: "w1", Size: 5}))
+	must(t, leader.UpdateFileLegalHold(ctx, "kept", true))
+	waitForApplied(t, stores, leader)
+
+	// Stop the leader without handing leadership over, as in a crash
+	must(t, leader.raft.Shutdown().Error())
+	survivors := followers(stores, leader)
+	newLeader := waitForLeader(t, survivors)
+
+	doc, err := newLeader.GetFileDocument(ctx, "kept")
+	if err != nil {
+		t.Fatalf("new leader lost the file: %v", err)
+	}
+	if len(doc.Chunks) != 1 || doc.Chunks[0].ChunkID != "kept_0" || !doc.LegalHold {
+		t.Fatalf("new leader has %+v", doc)
+	}
+
+	// The new leader accepts writes, which reach the remaining follower
+	must(t, newLeader.StoreFileMetadata(ctx, FileInfo{Filename: "after", Size: 1}))
+	waitForApplied(t, survivors, newLeader)
+	for _, store := range survivors {
+		if _, err := store.GetFileDocument(ctx, "after"); err != nil {
+			t.Errorf("%s does not have the file written after failover: %v", store.config.NodeID, err)
+		}
+	}
+}
+
+func TestRaftStoreFileKeepsRetention(t *testing.T) {
+	stores := newInmemRaftCluster(t, 1)
+	leader := waitForLeader(t, stores)
+	ctx := testContext(t)
+
+	retainUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	must(t, leader.StoreFileMetadata(ctx, FileInfo{Filename: "f", Size: 1}))
+	must(t, leader.AddChunkRecord(ctx, "f", ChunkRecord{ChunkID: "f_0", WorkerID: "w1", Size: 1}))
+	must(t, leader.UpdateFileRetention(ctx, "f", RetentionGovernance, retainUntil))
+	must(t, leader.UpdateFileLegalHold(ctx, "f", true))
+
+	// A re-upload replaces size and chunks but not retention or legal hold
+	must(t, leader.StoreFileMetadata(ctx, FileInfo{Filename: "f", Size: 2}))
+	doc, err := leader.GetFileDocument(ctx, "f")
+	must(t, err)
+	if doc.Size != 2 || len(doc.Chunks) != 0 {
+		t.Errorf("re-upload left size %d and %d chunks", doc.Size, len(doc.Chunks))
+	}
+	if doc.RetentionMode != RetentionGovernance || !doc.RetainUntil.Equal(retainUntil) || !doc.LegalHold {
+		t.Errorf("re-upload cleared retention: %s until %s, legal hold %t", doc.RetentionMode, doc.RetainUntil, doc.LegalHold)
+	}
+}
+
+func TestRaftStoreVersionKeepsRetention(t *testing.T) {
+	stores := newInmemRaftCluster(t, 1)
+	leader := waitForLeader(t, stores)
+	ctx := testContext(t)
+
+	must(t, leader.StoreFileMetadata(ctx, FileInfo{Filename: "f", Size: 1}))
+	must(t, leader.UpdateFileLegalHold(ctx, "f", true))
+
+	ref := PackRef{PackID: "p", Offset: 10, Length: 2}
+	must(t, leader.StoreFileVersion(ctx, FileDocument{FileInfo: FileInfo{Filename: "f", Size: 2}, Pack: &ref}))
+	doc, err := leader.GetFileDocument(ctx, "f")
+	must(t, err)
+	if doc.Size != 2 || doc.Pack == nil || *doc.Pack != ref || !doc.LegalHold {
+		t.Errorf("packed re-upload stored %+v", doc)
+	}
+
+	// A new file starts without retention, whatever the version carries
+	must(t, leader.StoreFileVersion(ctx, FileDocument{FileInfo: FileInfo{Filename: "g", Size: 1, LegalHold: true}}))
+	doc, err = leader.GetFileDocument(ctx, "g")
+	must(t, err)
+	if doc.LegalHold {
+		t.Errorf("new file stored with a legal hold")
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WorkerUtilization is the share of a worker's capacity used by referenced chunks
+type WorkerUtilization struct {
+	WorkerID          string  `json:"workerId"`
+	UsedBytes         int64   `json:"usedBytes"`
+	CapacityBytes     uint64  `json:"capacityBytes"`
+	EstimatedCapacity bool    `json:"estimatedCapacity,omitempty"` // The worker has not reported its capacity, which is taken to be the mean
+	Utilization       float64 `json:"utilization"`
+}
+
+// RebalanceStatus describes the rebalancer for the admin API
+type RebalanceStatus struct {
+	Paused           bool                `json:"paused"`
+	Running          bool                `json:"running"`
+	ThresholdPercent int                 `json:"thresholdPercent"`
+	BandwidthBytes   int64               `json:"bandwidthBytesPerSecond"`
+	LastRunAt        time.Time           `json:"lastRunAt,omitzero"`
+	LastError        string              `json:"lastError,omitempty"`
+	MovedChunks      int                 `json:"movedChunks"`
+	MovedBytes       int64               `json:"movedBytes"`
+	Workers          []WorkerUtilization `json:"workers"`
+}
+
+// Rebalancer moves chunks from over-full workers to under-full workers in the background
+type Rebalancer struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+	threshold     float64 // Allowed deviation from the mean utilization, as a fraction
+	bandwidth     int64   // Bytes per second
+
+	mu     sync.Mutex
+	status RebalanceStatus
+	wake   chan struct{}
+}
+
+func NewRebalancer(wm *WorkerManager, cm *ChunkManager, thresholdPercent int, bandwidth int64) *Rebalancer {
+	return &Rebalancer{
+		workerManager: wm,
+		chunkManager:  cm,
+		threshold:     float64(thresholdPercent) / 100,
+		bandwidth:     bandwidth,
+		status: RebalanceStatus{
+			ThresholdPercent: thresholdPercent,
+			BandwidthBytes:   bandwidth,
+			Workers:          []WorkerUtilization{},
+		},
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Start runs rebalancing passes in the background at the given interval until ctx is done
+func (rb *Rebalancer) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-rb.wake:
+			case <-ctx.Done():
+				return
+			}
+			if rb.isPaused() || !metadata.IsLeader() {
+				continue
+			}
+
+			err := rb.Run(ctx)
+			rb.mu.Lock()
+			rb.status.LastRunAt = time.Now().UTC()
+			rb.status.LastError = ""
+			if err != nil {
+				rb.status.LastError = err.Error()
+			}
+			rb.mu.Unlock()
+			if err != nil {
+				slog.Error("Rebalance pass failed", "error", err)
+			}
+		}
+	}()
+}
+
+// Pause stops the rebalancer after the chunk currently being moved
+func (rb *Rebalancer) Pause() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.status.Paused = true
+	slog.Info("Rebalancer paused")
+}
+
+// Resume lets the rebalancer continue and starts a pass right away
+func (rb *Rebalancer) Resume() {
+	rb.mu.Lock()
+	rb.status.Paused = false
+	rb.mu.Unlock()
+
+	select {
+	case rb.wake <- struct{}{}:
+	default:
+	}
+	slog.Info("Rebalancer resumed")
+}
+
+func (rb *Rebalancer) isPaused() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.status.Paused
+}
+
+// Status returns a snapshot of the rebalancer state
+func (rb *Rebalancer) Status() RebalanceStatus {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	status := rb.status
+	status.Workers = append([]WorkerUtilization(nil), rb.status.Workers...)
+	return status
+}
+
+// utilization computes the utilization of every active worker. Workers that have
+// not reported their capacity yet are taken to have the mean capacity of those
+// that have, so new workers receive chunks before their first heartbeat.
+func (rb *Rebalancer) utilization(ctx context.Context) (map[string]*WorkerUtilization, error) {
+	usage, err := GetWorkerUsage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute worker usage: %v", err)
+	}
+
+	var totalCapacity, reported uint64
+	utilization := make(map[string]*WorkerUtilization)
+	for id, worker := range rb.workerManager.GetWorkers() {
+		if worker.State != WorkerStateActive || worker.Offline {
+			continue
+		}
+		utilization[id] = &WorkerUtilization{
+			WorkerID:      id,
+			UsedBytes:     usage[id],
+			CapacityBytes: worker.Status.CapacityBytes,
+		}
+		if worker.Status.CapacityBytes > 0 {
+			totalCapacity += worker.Status.CapacityBytes
+			reported++
+		}
+	}
+
+	for id, u := range utilization {
+		if u.CapacityBytes == 0 {
+			if reported == 0 {
+				delete(utilization, id)
+				continue
+			}
+			u.CapacityBytes = totalCapacity / reported
+			u.EstimatedCapacity = true
+		}
+		u.update(0)
+	}
+	return utilization, nil
+}
+
+func (u *WorkerUtilization) update(delta int64) {
+	u.UsedBytes += delta
+	u.Utilization = float64(u.UsedBytes) / float64(u.CapacityBytes)
+}
+
+// Run performs one rebalancing pass. It moves chunks off the most utilized worker
+// until every worker is within the threshold of the mean, or no move is possible.
+func (rb *Rebalancer) Run(ctx context.Context) error {
+	rb.mu.Lock()
+	if rb.status.Running {
+		rb.mu.Unlock()
+		return errors.New("a rebalance pass is already running")
+	}
+	rb.status.Running = true
+	rb.mu.Unlock()
+	defer func() {
+		rb.mu.Lock()
+		rb.status.Running = false
+		rb.mu.Unlock()
+	}()
+
+	utilization, err := rb.utilization(ctx)
+	if err != nil {
+		return err
+	}
+	rb.publish(utilization)
+	if len(utilization) < 2 {
+		return nil
+	}
+
+	// The chunks of each source are loaded once per pass, and every chunk is tried
+	// at most once. Sources that have nothing left to move are skipped.
+	candidates := make(map[string][]WorkerChunkRef)
+	exhausted := make(map[string]bool)
+	for !rb.isPaused() && ctx.Err() == nil {
+		source, targets, ceiling := rb.plan(utilization, exhausted)
+		if source == "" {
+			return nil
+		}
+
+		refs, loaded := candidates[source]
+		if !loaded {
+			refs, err = GetChunkRecordsForWorker(ctx, source)
+			if err != nil {
+				return fmt.Errorf("failed to load chunk records of worker %s: %v", source, err)
+			}
+			// Moving the largest chunks first needs the fewest moves
+			sort.Slice(refs, func(i, j int) bool {
+				return refs[i].Record.Size > refs[j].Record.Size
+			})
+		}
+
+		moved, rest := rb.moveOneChunk(ctx, source, refs, targets, utilization, ceiling)
+		candidates[source] = rest
+		if moved == nil {
+			exhausted[source] = true
+			continue
+		}
+
+		utilization[source].update(-moved.Size)
+		utilization[moved.WorkerID].update(moved.Size)
+		rb.mu.Lock()
+		rb.status.MovedChunks++
+		rb.status.MovedBytes += moved.Size
+		rb.mu.Unlock()
+		rb.publish(utilization)
+	}
+	return nil
+}
+
+// plan picks the most utilized worker above the threshold, and the workers below
+// the mean that may receive its chunks. Targets must stay at or below the returned
+// ceiling, or they would become sources themselves and chunks would bounce back.
+func (rb *Rebalancer) plan(utilization map[string]*WorkerUtilization, exhausted map[string]bool) (string, map[string]bool, float64) {
+	var mean float64
+	for _, u := range utilization {
+		mean += u.Utilization
+	}
+	mean /= float64(len(utilization))
+
+	source := ""
+	targets := make(map[string]bool)
+	for id, u := range utilization {
+		if u.Utilization > mean+rb.threshold && !exhausted[id] &&
+			(source == "" || u.Utilization > utilization[source].Utilization) {
+			source = id
+		}
+		if u.Utilization < mean {
+			targets[id] = true
+		}
+	}
+	if len(targets) == 0 {
+		return "", nil, 0
+	}
+	return source, targets, mean + rb.threshold
+}
+
+// moveOneChunk moves the first of the source's chunks that fits on a target without
+// pushing it above the ceiling, honouring the bandwidth limit. It returns the new chunk
+// record, or nil if no chunk could be moved, and the chunks that were not tried yet.
+func (rb *Rebalancer) moveOneChunk(ctx context.Context, source string, refs []WorkerChunkRef, targets map[string]bool,
+	utilization map[string]*WorkerUtilization, ceiling float64) (*ChunkRecord, []WorkerChunkRef) {
+	for i, ref := range refs {
+		if ref.Record.Size == 0 || ctx.Err() != nil {
+			continue
+		}
+
+		holders, err := GetChunkHolders(ctx, ref.Filename, ref.Record.ChunkID)
+		if err != nil {
+			continue
+		}
+
+		// Only under-full workers without a replica of this chunk are eligible
+		exclude := make(map[string]bool)
+		var remaining []string
+		for id := range rb.workerManager.GetWorkers() {
+			if !targets[id] || holders[id] {
+				exclude[id] = true
+				continue
+			}
+			if target := utilization[id]; float64(target.UsedBytes+ref.Record.Size)/float64(target.CapacityBytes) > ceiling {
+				exclude[id] = true
+			}
+		}
+		for id := range holders {
+			if id != source {
+				remaining = append(remaining, id)
+			}
+		}
+
+		selected := rb.workerManager.SelectWorkers(1, remaining, exclude)
+		if len(selected) == 0 {
+			continue
+		}
+
+		started := time.Now()
+		err = rb.chunkManager.moveChunk(ctx, ref.Filename, ref.Record, selected[0])
+		if errors.Is(err, errChunkMoveStale) {
+			continue
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Rebalancer failed to move chunk", "chunk", ref.Record.ChunkID, "worker", source, "error", err)
+			continue
+		}
+		rb.throttle(ctx, ref.Record.Size, time.Since(started))
+
+		moved := ref.Record
+		moved.WorkerID = selected[0]
+		return &moved, refs[i+1:]
+	}
+	return nil, nil
+}
+
+// throttle waits long enough for the moved bytes to stay within the bandwidth limit,
+// or until ctx is done
+func (rb *Rebalancer) throttle(ctx context.Context, size int64, elapsed time.Duration) {
+	if rb.bandwidth <= 0 {
+		return
+	}
+	budget := time.Duration(float64(size) / float64(rb.bandwidth) * float64(time.Second))
+	if budget <= elapsed {
+		return
+	}
+	timer := time.NewTimer(budget - elapsed)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// publish stores the current utilization for the status endpoint
+func (rb *Rebalancer) publish(utilization map[string]*WorkerUtilization) {
+	workers := make([]WorkerUtilization, 0, len(utilization))
+	for _, u := range utilization {
+		workers = append(workers, *u)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].WorkerID < workers[j].WorkerID
+	})
+
+	rb.mu.Lock()
+	rb.status.Workers = workers
+	rb.mu.Unlock()
+}
+
+func (rb *Rebalancer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+	if err := writeJSONResponse(w, rb.Status()); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode rebalancer status", "error", err)
+	}
+}
+
+func (rb *Rebalancer) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+	rb.Pause()
+	writeSuccessResponse(w, "Rebalancer paused")
+}
+
+func (rb *Rebalancer) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+	rb.Resume()
+	writeSuccessResponse(w, "Rebalancer resumed")
+}
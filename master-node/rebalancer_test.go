@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// setCapacity sets the capacity a worker reported with its last heartbeat
+func setCapacity(wm *WorkerManager, capacity uint64, workers ...*fakeWorker) {
+	for _, fw := range workers {
+		wm.updateWorker(fw.id, func(worker *Worker) {
+			worker.Status.CapacityBytes = capacity
+		})
+	}
+}
+
+func TestRebalanceMovesChunksToEmptyWorkers(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 3)
+	setCapacity(wm, 1000, workers...)
+	chunk := bytes.Repeat([]byte("x"), 100)
+	storeTestFile(t, "a", [][]byte{chunk, chunk, chunk, chunk}, workers[0])
+
+	// The mean is 400/3000, so with a 10% threshold a worker may hold up to 233 bytes
+	rb := NewRebalancer(wm, cm, 10, 0)
+	must(t, rb.Run(testContext(t)))
+
+	if got := [3]int{workers[0].chunkCount(), workers[1].chunkCount(), workers[2].chunkCount()}; got != [3]int{2, 1, 1} {
+		t.Fatalf("chunks per worker after rebalancing are %v, want [2 1 1]", got)
+	}
+	usage, err := GetWorkerUsage(testContext(t))
+	must(t, err)
+	if usage["w1"] != 200 || usage["w2"] != 100 || usage["w3"] != 100 {
+		t.Fatalf("usage after rebalancing is %v", usage)
+	}
+	if status := rb.Status(); status.MovedChunks != 2 || status.MovedBytes != 200 {
+		t.Fatalf("status reports %d chunks and %d bytes moved", status.MovedChunks, status.MovedBytes)
+	}
+}
+
+func TestRebalanceMovesChunksToWorkersWithoutCapacity(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 3)
+	setCapacity(wm, 1000, workers[0], workers[1])
+	chunk := bytes.Repeat([]byte("x"), 100)
+	storeTestFile(t, "a", [][]byte{chunk, chunk, chunk, chunk}, workers[0])
+
+	// w3 has not reported its capacity yet and counts with the mean of 1000
+	rb := NewRebalancer(wm, cm, 10, 0)
+	must(t, rb.Run(testContext(t)))
+
+	if got := [3]int{workers[0].chunkCount(), workers[1].chunkCount(), workers[2].chunkCount()}; got != [3]int{2, 1, 1} {
+		t.Fatalf("chunks per worker after rebalancing are %v, want [2 1 1]", got)
+	}
+}
+
+func TestRebalanceDoesNotOvershootTheTarget(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 2)
+	setCapacity(wm, 1000, workers...)
+	storeTestFile(t, "a", [][]byte{bytes.Repeat([]byte("x"), 500)}, workers[0])
+
+	// Moving the chunk would leave the other worker just as far above the mean, and it would move back
+	rb := NewRebalancer(wm, cm, 10, 0)
+	must(t, rb.Run(testContext(t)))
+
+	if workers[0].chunkCount() != 1 || workers[1].chunkCount() != 0 {
+		t.Fatalf("chunk moved from w1 to w2")
+	}
+	if status := rb.Status(); status.MovedChunks != 0 {
+		t.Fatalf("status reports %d chunks moved", status.MovedChunks)
+	}
+}
+
+func TestRebalanceThrottleStopsWithContext(t *testing.T) {
+	rb := NewRebalancer(nil, nil, 10, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	started := time.Now()
+	rb.throttle(ctx, 1<<20, 0)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Fatalf("throttle waited %v after the context was cancelled", elapsed)
+	}
+}
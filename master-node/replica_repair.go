@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// Results of repairing a lost replica
+const (
+	RepairRepaired      = "repaired"
+	RepairStale         = "stale"
+	RepairUnrecoverable = "unrecoverable"
+	RepairFailed        = "failed"
+)
+
+// lostReportQueueSize is the number of lost chunk reports waiting for repair
+// before workers are asked to send theirs again later
+const lostReportQueueSize = 64
+
+// errNoReplicaLeft is returned for lost chunks without another replica to copy
+var errNoReplicaLeft = errors.New("no other replica left")
+
+// LostChunkReport lists the chunks a worker lost with a failed disk
+type LostChunkReport struct {
+	WorkerID string   `json:"workerId"`
+	ChunkIDs []string `json:"chunkIds"`
+}
+
+// ReplicaRepairer replaces the replicas workers report as lost with copies of
+// their surviving replicas on other workers. Reports are repaired one at a time
+// in the background. A worker only knows what it lost while it runs, so whenever
+// a worker registers, the chunks recorded for it are compared with the chunks it
+// holds, and those it is missing are repaired as if it had reported them. This
+// covers disks that were dead when the worker started and reports lost in a restart.
+type ReplicaRepairer struct {
+	workerManager *WorkerManager
+	chunkManager  *ChunkManager
+	reports       chan LostChunkReport
+	checks        chan string // Workers whose chunks are compared with the metadata
+}
+
+func NewReplicaRepairer(wm *WorkerManager, cm *ChunkManager) *ReplicaRepairer {
+	return &ReplicaRepairer{
+		workerManager: wm,
+		chunkManager:  cm,
+		reports:       make(chan LostChunkReport, lostReportQueueSize),
+		checks:        make(chan string, lostReportQueueSize),
+	}
+}
+
+// Start repairs queued reports in the background until ctx is done
+func (rr *ReplicaRepairer) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case report := <-rr.reports:
+				rr.repair(ctx, report)
+			case workerID := <-rr.checks:
+				if report, err := rr.missingChunks(ctx, workerID); err != nil {
+					slog.Warn("Failed to compare the chunks of a registered worker with the metadata", "worker", workerID, "error", err)
+				} else if len(report.ChunkIDs) > 0 {
+					slog.Warn("Registered worker is missing chunks", "worker", workerID, "chunks", len(report.ChunkIDs))
+					rr.repair(ctx, report)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// repair replaces every lost replica of a report that the metadata still references
+func (rr *ReplicaRepairer) repair(ctx context.Context, report LostChunkReport) {
+	lost := make(map[string]bool, len(report.ChunkIDs))
+	for _, chunkID := range report.ChunkIDs {
+		lost[chunkID] = true
+	}
+
+	refs, err := GetChunkRecordsForWorker(ctx, report.WorkerID)
+	if err != nil {
+		slog.Error("Failed to load chunk records for lost replicas", "worker", report.WorkerID, "error", err)
+		return
+	}
+
+	results := make(map[string]int)
+	for _, ref := range refs {
+		if !lost[ref.Record.ChunkID] {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		result := RepairRepaired
+		err := rr.repairReplica(ctx, ref)
+		switch {
+		case errors.Is(err, errChunkMoveStale):
+			result = RepairStale
+		case errors.Is(err, errNoReplicaLeft):
+			result = RepairUnrecoverable
+			slog.Error("Lost the last replica of a chunk", "chunk", ref.Record.ChunkID, "filename", ref.Filename, "worker", report.WorkerID)
+		case err != nil:
+			result = RepairFailed
+			slog.Warn("Failed to repair lost replica", "chunk", ref.Record.ChunkID, "worker", report.WorkerID, "error", err)
+		}
+		results[result]++
+		lostReplicasTotal.WithLabelValues(result).Inc()
+	}
+
+	slog.Info("Repaired lost replicas", "worker", report.WorkerID, "reported", len(report.ChunkIDs),
+		"repaired", results[RepairRepaired], "stale", results[RepairStale],
+		"unrecoverable", results[RepairUnrecoverable], "failed", results[RepairFailed])
+}
+
+// checkWorker queues the comparison of a worker's chunks with the metadata. If the
+// queue is full the check is skipped; fsck still finds the missing chunks.
+func (rr *ReplicaRepairer) checkWorker(workerID string) {
+	select {
+	case rr.checks <- workerID:
+	default:
+		slog.Warn("Too many registered workers waiting for a chunk check, skipping it", "worker", workerID)
+	}
+}
+
+// missingChunks lists the chunks the metadata records on a worker that the worker does not hold
+func (rr *ReplicaRepairer) missingChunks(ctx context.Context, workerID string) (LostChunkReport, error) {
+	report := LostChunkReport{WorkerID: workerID}
+	refs, err := GetChunkRecordsForWorker(ctx, workerID)
+	if err != nil || len(refs) == 0 {
+		return report, err
+	}
+	// Chunks are stored before they are recorded and deleted after they are no longer
+	// recorded, so listing the worker after loading the records finds every chunk in them
+	chunks, err := rr.chunkManager.listChunksOnWorker(workerID, false)
+	if err != nil {
+		return report, err
+	}
+
+	held := make(map[string]bool, len(chunks))
+	for _, chunk := range chunks {
+		held[chunk.ChunkID] = true
+	}
+	for _, ref := range refs {
+		if !held[ref.Record.ChunkID] {
+			report.ChunkIDs = append(report.ChunkIDs, ref.Record.ChunkID)
+		}
+	}
+	return report, nil
+}
+
+// repairReplica copies a surviving replica of a lost chunk to a worker that holds
+// none, spread away from the remaining replicas, and points the lost record at it
+func (rr *ReplicaRepairer) repairReplica(ctx context.Context, ref WorkerChunkRef) error {
+	holders, err := GetChunkHolders(ctx, ref.Filename, ref.Record.ChunkID)
+	if err != nil {
+		return err
+	}
+
+	var sources []string
+	for workerID := range holders {
+		if workerID != ref.Record.WorkerID {
+			sources = append(sources, workerID)
+		}
+	}
+	if len(sources) == 0 {
+		return errNoReplicaLeft
+	}
+
+	targets := rr.workerManager.SelectWorkers(1, sources, holders)
+	if len(targets) == 0 {
+		return fmt.Errorf("no active worker available for chunk %s", ref.Record.ChunkID)
+	}
+	for _, source := range sources {
+		err = rr.chunkManager.replaceReplica(ctx, ref.Filename, ref.Record, source, targets[0])
+		if err == nil || errors.Is(err, errChunkMoveStale) {
+			break
+		}
+	}
+	if err == nil {
+		slog.InfoContext(ctx, "Repaired lost replica", "chunk", ref.Record.ChunkID, "filename", ref.Filename,
+			"lostOn", ref.Record.WorkerID, "to", targets[0])
+	}
+	return err
+}
+
+// handleLostChunks queues the repair of the chunks a worker lost with a failed disk
+func (rr *ReplicaRepairer) handleLostChunks(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var report LostChunkReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeErrorResponse(w, fmt.Sprintf("Invalid lost chunk report: %v", err), http.StatusBadRequest)
+		return
+	}
+	worker, known := rr.workerManager.GetWorker(report.WorkerID)
+	if !known {
+		writeErrorResponse(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+	// Only the worker itself may report its chunks lost, or anyone could have replicas copied around
+	host, _, err := net.SplitHostPort(worker.Address)
+	if err == nil {
+		err = verifyClientHost(r, host)
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Refused lost chunk report", "worker", report.WorkerID,
+			"remote", clientAddr(r), "error", err)
+		writeErrorResponse(w, fmt.Sprintf("Report does not come from worker %s: %v", report.WorkerID, err), http.StatusForbidden)
+		return
+	}
+
+	select {
+	case rr.reports <- report:
+	default:
+		writeErrorResponse(w, "Too many lost chunk reports waiting for repair", http.StatusServiceUnavailable)
+		return
+	}
+	slog.WarnContext(r.Context(), "Worker reported lost chunks", "worker", report.WorkerID, "chunks", len(report.ChunkIDs))
+	w.WriteHeader(http.StatusAccepted)
+	writeSuccessResponse(w, fmt.Sprintf("Repair of %d chunks queued\n", len(report.ChunkIDs)))
+}
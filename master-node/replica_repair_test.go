@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForHolders waits until the metadata records a chunk on exactly the given workers
+func waitForHolders(t *testing.T, filename, chunkID string, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var holders map[string]bool
+	for time.Now().Before(deadline) {
+		var err error
+		holders, err = GetChunkHolders(testContext(t), filename, chunkID)
+		must(t, err)
+		matches := len(holders) == len(want)
+		for _, id := range want {
+			matches = matches && holders[id]
+		}
+		if matches {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("chunk %s is recorded on %v, want %v", chunkID, holders, want)
+}
+
+func TestRegisteredWorkerIsCheckedForMissingChunks(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 3)
+	rr := NewReplicaRepairer(wm, cm)
+	wm.onRegister = rr.checkWorker
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rr.Start(ctx)
+
+	chunks := [][]byte{[]byte("one"), []byte("two")}
+	storeTestFile(t, "a", chunks, workers[0], workers[1])
+
+	// w1 restarted with the disk holding chunk 1 dead, so it never reported the chunk lost
+	lostID := "a_chunk_00000001"
+	workers[0].drop(lostID)
+	params := url.Values{"id": {"w1"}, "addr": {strings.TrimPrefix(workers[0].server.URL, "http://")}, "host": {"w1"}}
+	w := httptest.NewRecorder()
+	wm.registerWorker(w, httptest.NewRequest(http.MethodPost, "/register?"+params.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("registration returned %d: %s", w.Code, w.Body)
+	}
+
+	waitForHolders(t, "a", lostID, "w2", "w3")
+	if data, exists := workers[2].chunk(lostID); !exists || string(data) != "two" {
+		t.Fatalf("w3 holds %q for the repaired chunk", data)
+	}
+	waitForHolders(t, "a", "a_chunk_00000000", "w1", "w2")
+	if workers[2].chunkCount() != 1 {
+		t.Fatalf("w3 holds %d chunks, want only the repaired one", workers[2].chunkCount())
+	}
+}
+
+func TestLostChunkReportIsRepaired(t *testing.T) {
+	wm, cm, workers := newTestCluster(t, 3)
+	rr := NewReplicaRepairer(wm, cm)
+	storeTestFile(t, "a", [][]byte{[]byte("one"), []byte("two")}, workers[0], workers[1])
+	storeTestFile(t, "b", [][]byte{[]byte("only")}, workers[0])
+
+	for _, chunkID := range []string{"a_chunk_00000000", "b_chunk_00000000"} {
+		workers[0].drop(chunkID)
+	}
+	rr.repair(testContext(t), LostChunkReport{WorkerID: "w1", ChunkIDs: []string{"a_chunk_00000000", "b_chunk_00000000"}})
+
+	// The chunk with a surviving replica is copied, the last replica cannot be
+	waitForHolders(t, "a", "a_chunk_00000000", "w2", "w3")
+	waitForHolders(t, "a", "a_chunk_00000001", "w1", "w2")
+	waitForHolders(t, "b", "b_chunk_00000000", "w1")
+	if data, exists := workers[2].chunk("a_chunk_00000000"); !exists || string(data) != "one" {
+		t.Fatalf("w3 holds %q for the repaired chunk", data)
+	}
+}
+
+func TestLostChunkReportsMustComeFromTheWorker(t *testing.T) {
+	store := useTestMetadata(t)
+	wm := NewWorkerManager(nil)
+	wm.AddWorker("w1", Worker{ID: "w1", Address: "192.0.2.60:8081"})
+	rr := NewReplicaRepairer(wm, nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forged     bool
+		worker     string
+		want       int
+	}{
+		{"from the worker", "192.0.2.60:40000", false, "w1", http.StatusAccepted},
+		{"from another host", "203.0.113.7:40000", false, "w1", http.StatusForbidden},
+		{"with a forged client address", "203.0.113.7:40000", true, "w1", http.StatusForbidden},
+		{"for an unknown worker", "192.0.2.60:40000", false, "w2", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"workerId":"` + test.worker + `","chunkIds":["f_chunk_0"]}`
+			r := httptest.NewRequest(http.MethodPost, "/chunks/lost", strings.NewReader(body))
+			r.RemoteAddr = test.remoteAddr
+			if test.forged {
+				r.Header.Set(ForwardedHeader, "master9")
+				r.Header.Set(ClientAddrHeader, "192.0.2.60:40000")
+			}
+			w := httptest.NewRecorder()
+			forwardToLeader(store, http.HandlerFunc(rr.handleLostChunks)).ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("report returned %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+		})
+	}
+}
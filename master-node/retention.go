@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// RetentionGovernance blocks changes unless an admin explicitly bypasses it
+	RetentionGovernance = "governance"
+	// RetentionCompliance blocks changes for everyone until the retention date
+	RetentionCompliance = "compliance"
+)
+
+var (
+	ErrFileRetained      = errors.New("file is under retention")
+	ErrLegalHold         = errors.New("file is under legal hold")
+	ErrBypassNotAllowed  = errors.New("governance bypass requires admin permission")
+	ErrRetentionWeakened = errors.New("retention can only be extended")
+)
+
+// AuditEvent records a privileged action such as a retention bypass
+type AuditEvent struct {
+	Time     time.Time `json:"time" bson:"time"`
+	Action   string    `json:"action" bson:"action"`
+	Filename string    `json:"filename" bson:"filename"`
+	Actor    string    `json:"actor" bson:"actor"`
+	Detail   string    `json:"detail,omitempty" bson:"detail,omitempty"`
+}
+
+// governanceBypass identifies an admin request to bypass governance retention
+type governanceBypass struct {
+	Actor string
+}
+
+// bypassFromRequest returns the requested governance bypass, or nil if none was requested
+func bypassFromRequest(r *http.Request) (*governanceBypass, error) {
+	if r.URL.Query().Get("bypassGovernance") != "true" {
+		return nil, nil
+	}
+	if !isAdmin(r) {
+		return nil, ErrBypassNotAllowed
+	}
+	return &governanceBypass{Actor: adminActor(r)}, nil
+}
+
+// isRetentionError reports whether err was caused by retention or legal hold rules
+func isRetentionError(err error) bool {
+	return errors.Is(err, ErrFileRetained) || errors.Is(err, ErrLegalHold) ||
+		errors.Is(err, ErrBypassNotAllowed) || errors.Is(err, ErrRetentionWeakened)
+}
+
+// checkRetention reports whether a file may be deleted or overwritten at the given time.
+// The returned bool is true when the change is only allowed because governance was bypassed.
+func checkRetention(file FileInfo, now time.Time, bypassGovernance bool) (bool, error) {
+	if file.LegalHold {
+		return false, ErrLegalHold
+	}
+	if file.RetentionMode == "" || !now.Before(file.RetainUntil) {
+		return false, nil
+	}
+	if file.RetentionMode == RetentionGovernance && bypassGovernance {
+		return true, nil
+	}
+	return false, fmt.Errorf("%w in %s mode until %s", ErrFileRetained, file.RetentionMode, file.RetainUntil.Format(time.RFC3339))
+}
+
+// auditBypass records a governance bypass. The bypass must not proceed if this fails.
+func auditBypass(ctx context.Context, bypass *governanceBypass, action, filename, detail string) error {
+	err := StoreAuditEvent(ctx, AuditEvent{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		Filename: filename,
+		Actor:    bypass.Actor,
+		Detail:   detail,
+	})
+	if err != nil {
+		return fmt.Errorf("refusing governance bypass, audit failed: %v", err)
+	}
+	slog.WarnContext(ctx, "Governance retention bypassed", "audit", true, "actor", bypass.Actor, "filename", filename, "action", action)
+	return nil
+}
+
+// enforceRetention checks that an existing file may be deleted or overwritten.
+// Missing files are not protected by anything.
+func enforceRetention(ctx context.Context, filename, action string, bypass *governanceBypass) error {
+	file, err := GetFileInfo(ctx, filename)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve file metadata: %v", err)
+	}
+
+	bypassed, err := checkRetention(file, time.Now(), bypass != nil)
+	if err != nil {
+		return err
+	}
+	if bypassed {
+		detail := fmt.Sprintf("governance retention until %s", file.RetainUntil.Format(time.RFC3339))
+		return auditBypass(ctx, bypass, action, filename, detail)
+	}
+	return nil
+}
+
+// retentionWeakened reports whether replacing the current retention with the new one relaxes it
+func retentionWeakened(current FileInfo, mode string, retainUntil time.Time, now time.Time) bool {
+	if current.RetentionMode == "" || !now.Before(current.RetainUntil) {
+		return false
+	}
+	if mode == "" || retainUntil.Before(current.RetainUntil) {
+		return true
+	}
+	return current.RetentionMode == RetentionCompliance && mode != RetentionCompliance
+}
+
+// handleSetRetention sets or clears the retention of a file.
+// Active retention can only be extended, unless governance retention is bypassed by an admin.
+func (fo *FileOperations) handleSetRetention(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	filename, err := getRequiredParam(r, "filename")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	var retainUntil time.Time
+	switch mode {
+	case RetentionGovernance, RetentionCompliance:
+		retainUntil, err = time.Parse(time.RFC3339, r.URL.Query().Get("retainUntil"))
+		if err != nil {
+			writeErrorResponse(w, "retainUntil must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	case "":
+	default:
+		writeErrorResponse(w, "mode must be governance, compliance or empty", http.StatusBadRequest)
+		return
+	}
+
+	bypass, err := bypassFromRequest(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	current, err := GetFileInfo(ctx, filename)
+	if errors.Is(err, ErrNotFound) {
+		writeErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, "Failed to retrieve file metadata", http.StatusInternalServerError)
+		return
+	}
+
+	if retentionWeakened(current, mode, retainUntil, time.Now()) {
+		if current.RetentionMode != RetentionGovernance || bypass == nil {
+			writeErrorResponse(w, ErrRetentionWeakened.Error(), http.StatusForbidden)
+			return
+		}
+		detail := fmt.Sprintf("retention changed from %s until %s to %q until %s", current.RetentionMode,
+			current.RetainUntil.Format(time.RFC3339), mode, retainUntil.Format(time.RFC3339))
+		if err := auditBypass(ctx, bypass, "retention-change", filename, detail); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := UpdateFileRetention(ctx, filename, mode, retainUntil); err != nil {
+		writeErrorResponse(w, "Failed to update retention", http.StatusInternalServerError)
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Retention for file %s updated", filename))
+}
+
+// handleSetLegalHold places or releases a legal hold. Releasing a hold is audited.
+func (fo *FileOperations) handleSetLegalHold(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	filename, err := getRequiredParam(r, "filename")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hold, err := strconv.ParseBool(r.URL.Query().Get("hold"))
+	if err != nil {
+		writeErrorResponse(w, "hold must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	// The release is audited before the hold is lifted, so only for a file that
+	// holds one
+	if !hold {
+		info, err := GetFileInfo(ctx, filename)
+		if errors.Is(err, ErrNotFound) {
+			writeErrorResponse(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeErrorResponse(w, "Failed to update legal hold", http.StatusInternalServerError)
+			return
+		}
+		if info.LegalHold {
+			bypass := &governanceBypass{Actor: adminActor(r)}
+			if err := auditBypass(ctx, bypass, "legal-hold-release", filename, ""); err != nil {
+				writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	err = UpdateFileLegalHold(ctx, filename, hold)
+	if errors.Is(err, ErrNotFound) {
+		writeErrorResponse(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, "Failed to update legal hold", http.StatusInternalServerError)
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Legal hold for file %s set to %t", filename, hold))
+}
+
+// handleAuditLog returns the most recent audit events
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	limit := int64(100)
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed <= 0 {
+			writeErrorResponse(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	events, err := GetAuditEvents(ctx, limit)
+	if err != nil {
+		writeErrorResponse(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+	if err := writeJSONResponse(w, events); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode audit log", "error", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForgedClientAddrDoesNotReachAuditLog(t *testing.T) {
+	store := useTestMetadata(t)
+	previousToken := AdminToken
+	AdminToken = "secret"
+	t.Cleanup(func() { AdminToken = previousToken })
+
+	ctx := testContext(t)
+	must(t, store.StoreFileMetadata(ctx, FileInfo{Filename: "held", Size: 1}))
+	must(t, store.UpdateFileLegalHold(ctx, "held", true))
+
+	fo := &FileOperations{}
+	r := httptest.NewRequest(http.MethodPost, "/legal-hold?filename=held&hold=false", nil)
+	r.RemoteAddr = "203.0.113.7:4000"
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(ForwardedHeader, "master9")
+	r.Header.Set(ClientAddrHeader, "198.51.100.9:5000")
+	w := httptest.NewRecorder()
+	forwardToLeader(store, requireAdmin(fo.handleSetLegalHold)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("legal hold release returned %d: %s", w.Code, w.Body)
+	}
+
+	events, err := store.GetAuditEvents(ctx, 10)
+	must(t, err)
+	if len(events) != 1 || events[0].Actor != "admin@203.0.113.7:4000" {
+		t.Fatalf("audit log %+v, want one event by admin@203.0.113.7:4000", events)
+	}
+}
+
+func TestLegalHoldReleaseIsOnlyAuditedForHeldFiles(t *testing.T) {
+	store := useTestMetadata(t)
+	ctx := testContext(t)
+	must(t, store.StoreFileMetadata(ctx, FileInfo{Filename: "free", Size: 1}))
+
+	fo := &FileOperations{}
+	release := func(filename string) int {
+		w := httptest.NewRecorder()
+		fo.handleSetLegalHold(w, httptest.NewRequest(http.MethodPost, "/legal-hold?filename="+filename+"&hold=false", nil))
+		return w.Code
+	}
+	if code := release("missing"); code != http.StatusNotFound {
+		t.Fatalf("releasing the hold of a missing file returned %d, want %d", code, http.StatusNotFound)
+	}
+	if code := release("free"); code != http.StatusOK {
+		t.Fatalf("releasing a file without a hold returned %d", code)
+	}
+	events, err := store.GetAuditEvents(ctx, 10)
+	must(t, err)
+	if len(events) != 0 {
+		t.Fatalf("audit log %+v, want no releases of holds that were never placed", events)
+	}
+}
+
+func TestRetentionBlocksDeletes(t *testing.T) {
+	wm, _, workers := newTestCluster(t, 1)
+	fo := NewFileOperations(wm)
+	previousToken := AdminToken
+	AdminToken = "secret"
+	t.Cleanup(func() { AdminToken = previousToken })
+	ctx := testContext(t)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		protect func(filename string) error
+		query   string
+		admin   bool
+		want    int
+	}{
+		{"compliance", func(f string) error { return UpdateFileRetention(ctx, f, RetentionCompliance, future) }, "", false, http.StatusForbidden},
+		{"compliance bypassed by admin", func(f string) error { return UpdateFileRetention(ctx, f, RetentionCompliance, future) }, "&bypassGovernance=true", true, http.StatusForbidden},
+		{"governance", func(f string) error { return UpdateFileRetention(ctx, f, RetentionGovernance, future) }, "", false, http.StatusForbidden},
+		{"governance bypassed without admin", func(f string) error { return UpdateFileRetention(ctx, f, RetentionGovernance, future) }, "&bypassGovernance=true", false, http.StatusForbidden},
+		{"governance bypassed by admin", func(f string) error { return UpdateFileRetention(ctx, f, RetentionGovernance, future) }, "&bypassGovernance=true", true, http.StatusOK},
+		{"legal hold bypassed by admin", func(f string) error { return UpdateFileLegalHold(ctx, f, true) }, "&bypassGovernance=true", true, http.StatusForbidden},
+		{"expired retention", func(f string) error {
+			return UpdateFileRetention(ctx, f, RetentionCompliance, time.Now().Add(-time.Hour))
+		}, "", false, http.StatusOK},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := fmt.Sprintf("file%d", i)
+			storeTestFile(t, filename, [][]byte{[]byte(filename)}, workers[0])
+			must(t, test.protect(filename))
+
+			r := httptest.NewRequest(http.MethodDelete, "/delete?filename="+filename+test.query, nil)
+			if test.admin {
+				r.Header.Set("Authorization", "Bearer secret")
+			}
+			w := httptest.NewRecorder()
+			fo.deleteFile(w, r)
+			if w.Code != test.want {
+				t.Fatalf("delete returned %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+
+			_, err := GetFileDocument(ctx, filename)
+			_, stored := workers[0].chunk(filename + "_chunk_00000000")
+			if deleted := errors.Is(err, ErrNotFound) && !stored; deleted != (test.want == http.StatusOK) {
+				t.Fatalf("file deleted is %v after delete returned %d (metadata error %v)", deleted, w.Code, err)
+			}
+		})
+	}
+
+	// Only the bypass is audited
+	events, err := GetAuditEvents(ctx, 10)
+	must(t, err)
+	if len(events) != 1 || events[0].Action != "delete" || events[0].Filename != "file4" {
+		t.Fatalf("audit log %+v, want the governance bypass of file4", events)
+	}
+}
+
+func TestRetentionBlocksOverwrites(t *testing.T) {
+	wm, _, workers := newTestCluster(t, 1)
+	fo := NewFileOperations(wm)
+	ctx := testContext(t)
+	storeTestFile(t, "kept", [][]byte{[]byte("original")}, workers[0])
+	must(t, UpdateFileRetention(ctx, "kept", RetentionCompliance, time.Now().Add(time.Hour)))
+
+	w := httptest.NewRecorder()
+	fo.uploadFile(w, httptest.NewRequest(http.MethodPost, "/upload?filename=kept&size=3", strings.NewReader("new")))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("overwrite returned %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+	doc, err := GetFileDocument(ctx, "kept")
+	must(t, err)
+	if doc.Size != int64(len("original")) || len(doc.Chunks) != 1 {
+		t.Fatalf("retained file changed to %+v", doc)
+	}
+}
@@ -1,32 +1,81 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type MasterServer struct {
-	workerManager  *WorkerManager
-	fileOperations *FileOperations
+	workerManager    *WorkerManager
+	fileOperations   *FileOperations
+	lifecycleManager *LifecycleManager
+	garbageCollector *GarbageCollector
+	checker          *ConsistencyChecker
+	drainManager     *DrainManager
+	rebalancer       *Rebalancer
+	packCompactor    *PackCompactor
+	repairer         *ReplicaRepairer
+	recovery         *MetadataRecovery
+	config           *configLoader
+	mux              *http.ServeMux
+	httpServer       *http.Server
+	stopJobs         context.CancelFunc // Stops the lifecycle job, the rebalancer, pack compaction, replica repair and the liveness check
 }
 
-func NewMasterServer() *MasterServer {
-	wm := NewWorkerManager()
+func NewMasterServer(config *configLoader) (*MasterServer, error) {
+	placement, err := newPlacementPolicy(PlacementPolicyName)
+	if err != nil {
+		return nil, err
+	}
+
+	wm := NewWorkerManager(placement)
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+	if err := wm.LoadRegistry(ctx); err != nil {
+		return nil, err
+	}
+
 	fo := NewFileOperations(wm)
+	lm := NewLifecycleManager(fo)
+	gc := NewGarbageCollector(wm, fo.chunkManager)
+	cc := NewConsistencyChecker(wm, fo.chunkManager)
+	dm := NewDrainManager(wm, fo.chunkManager)
+	rb := NewRebalancer(wm, fo.chunkManager, RebalanceThresholdPercent, int64(RebalanceBandwidthMB)*1024*1024)
+	pc := NewPackCompactor(fo, PackCompactionThreshold)
+	rr := NewReplicaRepairer(wm, fo.chunkManager)
+	wm.onRegister = rr.checkWorker
+	mr := NewMetadataRecovery(wm, fo.chunkManager)
+	prometheus.MustRegister(newWorkerCollector(wm))
 
 	return &MasterServer{
-		workerManager:  wm,
-		fileOperations: fo,
-	}
+		workerManager:    wm,
+		fileOperations:   fo,
+		lifecycleManager: lm,
+		garbageCollector: gc,
+		checker:          cc,
+		drainManager:     dm,
+		rebalancer:       rb,
+		packCompactor:    pc,
+		repairer:         rr,
+		recovery:         mr,
+		config:           config,
+		mux:              http.NewServeMux(),
+		httpServer:       &http.Server{ReadHeaderTimeout: NetworkTimeout},
+	}, nil
 }
 
 func (s *MasterServer) setupRoutes() {
 	// Serve static files (HTML, CSS, JS)
 	fs := http.FileServer(http.Dir("./static/"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	s.mux.Handle("/static/", http.StripPrefix("/static/", fs))
 
 	// Serve the main HTML page at root
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			http.ServeFile(w, r, "./static/index.html")
 		} else {
@@ -34,20 +83,80 @@ func (s *MasterServer) setupRoutes() {
 		}
 	})
 
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	s.mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "OK")
 	})
-	http.HandleFunc("/register", s.workerManager.registerWorker)
-	http.HandleFunc("/workers", s.workerManager.listWorkers)
-	http.HandleFunc("/test", s.workerManager.testWorker)
-	http.HandleFunc("/upload", s.fileOperations.uploadFile)
-	http.HandleFunc("/download/", s.fileOperations.downloadFile)
-	http.HandleFunc("/delete", s.fileOperations.deleteFile)
-	http.HandleFunc("/files", s.fileOperations.listFiles)
+	s.mux.Handle("/metrics", promhttp.Handler())
+	s.mux.HandleFunc("/config", s.config.handleConfig)
+	s.mux.HandleFunc("/register", requireClusterToken(s.workerManager.registerWorker))
+	s.mux.HandleFunc("/deregister", requireClusterToken(s.workerManager.deregisterWorker))
+	s.mux.HandleFunc("/heartbeat", requireClusterToken(s.workerManager.handleHeartbeat))
+	s.mux.HandleFunc("/chunks/lost", requireClusterToken(s.repairer.handleLostChunks))
+	s.mux.HandleFunc("/workers", s.workerManager.listWorkers)
+	s.mux.HandleFunc("/test", s.workerManager.testWorker)
+	s.mux.HandleFunc("/upload", s.fileOperations.uploadFile)
+	s.mux.HandleFunc("/download/", s.fileOperations.downloadFile)
+	s.mux.HandleFunc("/delete", s.fileOperations.deleteFile)
+	s.mux.HandleFunc("/files", s.fileOperations.listFiles)
+	s.mux.HandleFunc("/lifecycle/policies", requireAdmin(s.lifecycleManager.handlePolicies))
+	s.mux.HandleFunc("/lifecycle/report", requireAdmin(s.lifecycleManager.handleReport))
+	s.mux.HandleFunc("/retention", requireAdmin(s.fileOperations.handleSetRetention))
+	s.mux.HandleFunc("/legal-hold", requireAdmin(s.fileOperations.handleSetLegalHold))
+	s.mux.HandleFunc("/admin/audit", requireAdmin(handleAuditLog))
+	s.mux.HandleFunc("/admin/gc", requireAdmin(s.garbageCollector.handleGC))
+	s.mux.HandleFunc("/admin/fsck", requireAdmin(s.checker.handleFsck))
+	s.mux.HandleFunc("/admin/workers/drain", requireAdmin(s.drainManager.handleDrain))
+	s.mux.HandleFunc("/admin/workers/undrain", requireAdmin(s.drainManager.handleUndrain))
+	s.mux.HandleFunc("/admin/workers/remove", requireAdmin(s.drainManager.handleRemove))
+	s.mux.HandleFunc("/admin/rebalance", requireAdmin(s.rebalancer.handleStatus))
+	s.mux.HandleFunc("/admin/rebalance/pause", requireAdmin(s.rebalancer.handlePause))
+	s.mux.HandleFunc("/admin/rebalance/resume", requireAdmin(s.rebalancer.handleResume))
+	s.mux.HandleFunc("/admin/packs/compact", requireAdmin(s.packCompactor.handleCompact))
+	s.mux.HandleFunc("/admin/metadata/export", requireAdmin(handleExport))
+	s.mux.HandleFunc("/admin/metadata/restore", requireAdmin(s.recovery.handleRestore))
+	s.mux.HandleFunc("/admin/metadata/rebuild", requireAdmin(s.recovery.handleRebuild))
 }
 
+// Start serves requests until Shutdown is called, after which it returns http.ErrServerClosed
 func (s *MasterServer) Start(port string) error {
 	s.setupRoutes()
-	fmt.Printf("Master node listening on :%s\n", port)
-	return http.ListenAndServe(":"+port, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopJobs = cancel
+	s.lifecycleManager.Start(ctx, LifecycleInterval)
+	s.rebalancer.Start(ctx, RebalanceInterval)
+	s.packCompactor.Start(ctx, PackCompactionInterval)
+	s.repairer.Start(ctx)
+	s.workerManager.StartLivenessCheck(ctx, WorkerTimeout/2)
+
+	var handler http.Handler = s.mux
+	if store, ok := metadata.(*RaftStore); ok {
+		// In multi-master mode the leader does the work, and followers forward to it
+		s.mux.HandleFunc("/cluster", handleClusterStatus(store))
+		store.OnLeadershipChange(s.onLeadershipChange)
+		handler = forwardToLeader(store, handler)
+	} else {
+		s.drainManager.ResumeDrains()
+	}
+	handler = traceRequests(s.mux, logRequests(handler))
+
+	s.httpServer.Addr = ":" + port
+	s.httpServer.Handler = handler
+	slog.Info("Master node listening", "port", port)
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown stops the background jobs and drains, which resume on the next start,
+// stops accepting connections and waits for in-flight requests such as uploads to
+// finish. Requests still running when ctx expires are cut off.
+func (s *MasterServer) Shutdown(ctx context.Context) error {
+	if s.stopJobs != nil {
+		s.stopJobs()
+	}
+	s.drainManager.StopDrains()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.httpServer.Close()
+		return fmt.Errorf("in-flight requests did not finish: %v", err)
+	}
+	return nil
 }
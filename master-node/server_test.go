@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+	previousToken := AdminToken
+	AdminToken = "secret"
+	t.Cleanup(func() { AdminToken = previousToken })
+
+	s := &MasterServer{mux: http.NewServeMux()}
+	s.setupRoutes()
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/lifecycle/policies"},
+		{http.MethodPost, "/lifecycle/policies"},
+		{http.MethodDelete, "/lifecycle/policies?id=p1"},
+		{http.MethodGet, "/lifecycle/report"},
+		{http.MethodPost, "/retention?filename=f"},
+		{http.MethodPost, "/legal-hold?filename=f&hold=false"},
+		{http.MethodGet, "/admin/audit"},
+		{http.MethodPost, "/admin/gc"},
+		{http.MethodPost, "/admin/workers/drain?id=w1"},
+		{http.MethodPost, "/admin/metadata/restore"},
+	}
+	for _, route := range routes {
+		for _, token := range []string{"", "wrong"} {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			s.mux.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized && w.Code != http.StatusForbidden {
+				t.Errorf("%s %s with token %q returned %d, want 401 or 403", route.method, route.path, token, w.Code)
+			}
+		}
+	}
+}
+
+// TestShutdownWaitsForUploads starts a shutdown while a file is being uploaded,
+// and checks that it only returns once the upload is stored
+func TestShutdownWaitsForUploads(t *testing.T) {
+	wm, cm, _ := newTestCluster(t, 2)
+	previousChunkSize := ChunkSize
+	ChunkSize = 4
+	t.Cleanup(func() { ChunkSize = previousChunkSize })
+
+	active := make(chan struct{}, 1)
+	s := &MasterServer{
+		mux:            http.NewServeMux(),
+		fileOperations: NewFileOperations(wm),
+		drainManager:   NewDrainManager(wm, cm),
+		httpServer: &http.Server{ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateActive {
+				select {
+				case active <- struct{}{}:
+				default:
+				}
+			}
+		}},
+	}
+	s.setupRoutes()
+	s.httpServer.Handler = s.mux
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	must(t, err)
+	go s.httpServer.Serve(listener)
+
+	// The upload sends half of the file and waits
+	data := strings.Repeat("shutdown", 8)
+	body, upload := io.Pipe()
+	uploaded := make(chan int, 1)
+	go func() {
+		url := fmt.Sprintf("http://%s/upload?filename=slow&size=%d", listener.Addr(), len(data))
+		resp, err := http.Post(url, "text/plain", body)
+		if err != nil {
+			uploaded <- 0
+			return
+		}
+		resp.Body.Close()
+		uploaded <- resp.StatusCode
+	}()
+	io.WriteString(upload, data[:len(data)/2])
+	<-active
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown returned during an upload: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	io.WriteString(upload, data[len(data)/2:])
+	upload.Close()
+	if code := <-uploaded; code != http.StatusOK {
+		t.Fatalf("upload during shutdown returned %d", code)
+	}
+	must(t, <-stopped)
+	info, err := GetFileInfo(testContext(t), "slow")
+	if err != nil || info.Size != int64(len(data)) {
+		t.Fatalf("uploaded file after shutdown: %+v, %v", info, err)
+	}
+}
@@ -1,216 +1,228 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"time"
+	"log/slog"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/semaphore"
 )
 
+// StreamCoordinator splits an upload into chunks and stores them on workers.
+// Each chunk is read into memory and uploaded in the background while the next
+// one is read, so up to maxConcurrent chunks of a request are in flight to
+// different workers at once. The chunk buffers draw on a memory budget shared
+// by all uploads. Files below PackThreshold are appended to a shared pack instead
+// when a packer is given.
+//
+// An upload is staged under chunk IDs of its own and only replaces the metadata
+// of an existing file once every chunk is stored, so a failed re-upload leaves
+// the previous version in place.
 type StreamCoordinator struct {
 	workerManager *WorkerManager
 	chunkManager  *ChunkManager
+	budget        *semaphore.Weighted
+	packer        *Packer
 }
 
-func NewStreamCoordinator(wm *WorkerManager, cm *ChunkManager) *StreamCoordinator {
+func NewStreamCoordinator(wm *WorkerManager, cm *ChunkManager, budget *semaphore.Weighted, packer *Packer) *StreamCoordinator {
 	return &StreamCoordinator{
 		workerManager: wm,
 		chunkManager:  cm,
+		budget:        budget,
+		packer:        packer,
 	}
 }
 
-func (sc *StreamCoordinator) StreamUpload(filename string, reader io.Reader, fileSize int64) error {
-	// Store file metadata first
-	err := storeFileMetadata(filename, fileSize)
-	if err != nil {
-		return fmt.Errorf("failed to store file metadata: %v", err)
+func (sc *StreamCoordinator) StreamUpload(ctx context.Context, filename string, reader io.Reader, fileSize int64, tags []string) (err error) {
+	ctx, span := startSpan(ctx, "stream upload",
+		attribute.String("frostbyte.filename", filename), attribute.Int64("frostbyte.size", fileSize))
+	defer func() { endSpan(span, err) }()
+
+	if sc.packer != nil && fileSize > 0 && fileSize < PackThreshold {
+		// Read one byte short of the threshold; getting less means the file ended
+		data, err := io.ReadAll(io.LimitReader(reader, PackThreshold))
+		if err != nil {
+			return fmt.Errorf("error reading from client stream: %v", err)
+		}
+		if len(data) > 0 && int64(len(data)) < PackThreshold {
+			return sc.packUpload(ctx, filename, data, tags)
+		}
+		// The file is larger than announced, so it gets chunks of its own
+		reader = io.MultiReader(bytes.NewReader(data), reader)
 	}
 
-	buffer := make([]byte, StreamBufferSize)
-	chunkIndex := 0
-	var currentStream *StreamConnection
+	// The first failed chunk cancels the others and stops reading
+	uploadCtx := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var inFlight sync.WaitGroup
+	slots := make(chan struct{}, sc.chunkManager.maxConcurrent)
 
-	for {
-		bytesRead, err := reader.Read(buffer)
-
-		// Handle EOF - process any remaining data first
-		if err == io.EOF {
-			// Process any remaining data in the buffer
-			if bytesRead > 0 {
-				data := buffer[:bytesRead]
-				// Process the remaining data in chunks
-				for len(data) > 0 {
-					// Start new chunk if needed
-					if currentStream == nil || currentStream.BytesWritten >= DefaultChunkSize {
-						if currentStream != nil {
-							closeErr := sc.closeCurrentStream(filename, currentStream)
-							if closeErr != nil {
-								return closeErr
-							}
-						}
-
-						currentStream, err = sc.startNewChunk(filename, chunkIndex)
-						if err != nil {
-							return err
-						}
-						chunkIndex++
-					}
-
-					// Write as much as possible to current chunk
-					remainingInChunk := DefaultChunkSize - currentStream.BytesWritten
-					writeSize := int64(len(data))
-					if writeSize > remainingInChunk {
-						writeSize = remainingInChunk
-					}
-
-					written, err := currentStream.Stream.Write(data[:writeSize])
-					if err != nil {
-						currentStream.Stream.Close()
-						return fmt.Errorf("error writing to worker stream: %v", err)
-					}
-
-					currentStream.BytesWritten += int64(written)
-					data = data[written:]
-				}
-			}
+	version := newRequestID()
+	var recordsMu sync.Mutex
+	var records []ChunkRecord
 
-			// Close the current stream if any
-			if currentStream != nil {
-				err := sc.closeCurrentStream(filename, currentStream)
-				if err != nil {
-					return err
-				}
-			}
+	input := bufio.NewReaderSize(reader, StreamBufferSize)
+	chunkIndex := 0
+	var offset int64
+	for {
+		// Stop at the end of the file before reserving memory for another chunk
+		if _, err := input.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			cancel(fmt.Errorf("error reading from client stream: %v", err))
 			break
-		}
-		if err != nil {
-			if currentStream != nil {
-				currentStream.Stream.Close()
-			}
-			return fmt.Errorf("error reading from client stream: %v", err)
 		}
 
-		data := buffer[:bytesRead]
-
-		// Process the data in chunks
-		for len(data) > 0 {
-			// Start new chunk if needed
-			if currentStream == nil || currentStream.BytesWritten >= DefaultChunkSize {
-				if currentStream != nil {
-					err := sc.closeCurrentStream(filename, currentStream)
-					if err != nil {
-						return err
-					}
-				}
-
-				currentStream, err = sc.startNewChunk(filename, chunkIndex)
-				if err != nil {
-					return err
-				}
-				chunkIndex++
-			}
+		// Wait for a free slot and the memory of the next chunk
+		size := ChunkSize
+		if remaining := fileSize - offset; remaining > 0 && remaining < size {
+			size = remaining
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil || sc.budget.Acquire(ctx, size) != nil {
+			break
+		}
 
-			// Write as much as possible to current chunk
-			remainingInChunk := DefaultChunkSize - currentStream.BytesWritten
-			writeSize := int64(len(data))
-			if writeSize > remainingInChunk {
-				writeSize = remainingInChunk
-			}
+		buffer := make([]byte, size)
+		n, err := io.ReadFull(input, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			sc.budget.Release(size)
+			cancel(fmt.Errorf("error reading from client stream: %v", err))
+			break
+		}
 
-			written, err := currentStream.Stream.Write(data[:writeSize])
+		inFlight.Add(1)
+		go func(data []byte, chunkIndex int) {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			defer sc.budget.Release(size)
+			stored, err := sc.uploadChunk(ctx, filename, version, chunkIndex, data)
+			recordsMu.Lock()
+			records = append(records, stored...)
+			recordsMu.Unlock()
 			if err != nil {
-				currentStream.Stream.Close()
-				return fmt.Errorf("error writing to worker stream: %v", err)
+				cancel(err)
 			}
+		}(buffer[:n], chunkIndex)
 
-			currentStream.BytesWritten += int64(written)
-			data = data[written:]
-		}
+		chunkIndex++
+		offset += int64(n)
 	}
 
-	log.Printf("Successfully streamed file %s in %d chunks", filename, chunkIndex)
-	return nil
-}
-
-func (sc *StreamCoordinator) startNewChunk(filename string, chunkIndex int) (*StreamConnection, error) {
-	workerID := sc.workerManager.SelectWorker()
-	if workerID == "" {
-		return nil, fmt.Errorf("no available workers")
+	inFlight.Wait()
+	if err := context.Cause(ctx); err != nil {
+		sc.deleteReplicas(uploadCtx, filename, records)
+		return err
 	}
 
-	chunkID := sc.chunkManager.generateChunkID(filename, chunkIndex)
-
-	// Create streaming HTTP request to worker
-	url := fmt.Sprintf("http://%s:%s/stream-store?chunkID=%s", workerID, DefaultWorkerPort, chunkID)
-
-	// Use a pipe to create streaming connection
-	pr, pw := io.Pipe()
-
-	// Create a channel to track the upload result
-	resultChan := make(chan error, 1)
+	// Switch the file over to the new version, then drop the chunks of the old one
+	previous, err := metadata.GetFileDocument(uploadCtx, filename)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		sc.deleteReplicas(uploadCtx, filename, records)
+		return fmt.Errorf("failed to retrieve file metadata: %v", err)
+	}
+	if err := storeFileVersion(uploadCtx, filename, fileSize, tags, records); err != nil {
+		sc.deleteReplicas(uploadCtx, filename, records)
+		return fmt.Errorf("failed to store file metadata: %v", err)
+	}
+	sc.deleteReplicas(uploadCtx, filename, previous.Chunks)
 
-	// Start HTTP request in goroutine
-	go func() {
-		defer pr.Close()
-		resp, err := http.Post(url, ContentTypeOctetStream, pr)
-		if err != nil {
-			log.Printf("Failed to stream to worker %s: %v", workerID, err)
-			resultChan <- err
-			return
-		}
-		defer resp.Body.Close()
+	slog.InfoContext(uploadCtx, "Streamed file", "filename", filename, "chunks", chunkIndex, "version", version)
+	return nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			err := fmt.Errorf("worker %s returned error: %s", workerID, resp.Status)
-			log.Printf("%v", err)
-			resultChan <- err
-			return
+// deleteReplicas removes chunk replicas no version of a file references, such as
+// those of a failed upload. Replicas that cannot be deleted are left for garbage
+// collection, as are replicas a worker finished storing after the upload gave up on them.
+func (sc *StreamCoordinator) deleteReplicas(ctx context.Context, filename string, records []ChunkRecord) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DatabaseTimeout)
+	defer cancel()
+	for _, record := range records {
+		if err := sc.chunkManager.deleteChunkFromWorker(ctx, record.WorkerID, record.ChunkID); err != nil {
+			slog.WarnContext(ctx, "Failed to delete unreferenced chunk replica", "chunk", record.ChunkID,
+				"worker", record.WorkerID, "filename", filename, "error", err)
 		}
+	}
+}
 
-		// Store chunk metadata after successful upload
-		err = storeChunkInDB(filename, chunkID, workerID)
-		if err != nil {
-			log.Printf("Failed to store chunk metadata: %v", err)
-			resultChan <- err
-			return
-		}
+// packUpload appends a small file to a pack and records where it went
+func (sc *StreamCoordinator) packUpload(ctx context.Context, filename string, data []byte, tags []string) error {
+	ref, err := sc.packer.Add(ctx, filename, data)
+	if err != nil {
+		return fmt.Errorf("failed to pack file: %v", err)
+	}
+	defer sc.packer.Done(ref)
 
-		resultChan <- nil
-	}()
-
-	return &StreamConnection{
-		WorkerID:     workerID,
-		ChunkID:      chunkID,
-		ChunkIndex:   chunkIndex,
-		BytesWritten: 0,
-		Stream:       pw,
-		ResultChan:   resultChan,
-	}, nil
+	previous, err := metadata.GetFileDocument(ctx, filename)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to retrieve file metadata: %v", err)
+	}
+	if err := storePackedFileMetadata(ctx, filename, tags, ref); err != nil {
+		return fmt.Errorf("failed to store file metadata: %v", err)
+	}
+	sc.deleteReplicas(ctx, filename, previous.Chunks)
+	slog.InfoContext(ctx, "Packed file", "filename", filename, "pack", ref.PackID, "offset", ref.Offset, "bytes", ref.Length)
+	return nil
 }
 
-func (sc *StreamCoordinator) closeCurrentStream(filename string, stream *StreamConnection) error {
-	err := stream.Stream.Close()
-	if err != nil {
-		log.Printf("Error closing stream to worker %s: %v", stream.WorkerID, err)
-		return err
+// uploadChunk stores every replica of a chunk of an upload and returns their
+// records. It fails if any replica cannot be stored, still returning the records
+// of the replicas that were.
+func (sc *StreamCoordinator) uploadChunk(ctx context.Context, filename, version string, chunkIndex int, data []byte) ([]ChunkRecord, error) {
+	// Replicas are spread across failure domains by the placement engine
+	workerIDs := sc.workerManager.SelectWorkers(ReplicationFactor, nil, nil)
+	if len(workerIDs) == 0 {
+		return nil, fmt.Errorf("no available workers")
+	}
+	if len(workerIDs) < ReplicationFactor {
+		return nil, fmt.Errorf("replication factor %d needs more workers, only %d available", ReplicationFactor, len(workerIDs))
 	}
 
-	// Wait for the upload goroutine to complete and check for errors
-	if stream.ResultChan != nil {
-		select {
-		case uploadErr := <-stream.ResultChan:
-			if uploadErr != nil {
-				log.Printf("Upload failed for chunk %s to worker %s: %v",
-					stream.ChunkID, stream.WorkerID, uploadErr)
-				return uploadErr
+	type replicaResult struct {
+		record ChunkRecord
+		err    error
+	}
+	chunkID := sc.chunkManager.generateVersionChunkID(filename, version, chunkIndex)
+	results := make(chan replicaResult, len(workerIDs))
+	for _, workerID := range workerIDs {
+		go func(workerID string) {
+			activeStreams.Inc()
+			defer activeStreams.Dec()
+
+			record, err := sc.chunkManager.storeChunkOnWorker(ctx, workerID, filename, chunkID, chunkIndex, data)
+			results <- replicaResult{record, err}
+		}(workerID)
+	}
+
+	// Wait for every replica, so no upload outlives the request
+	var records []ChunkRecord
+	var err error
+	for range workerIDs {
+		result := <-results
+		if result.err != nil {
+			if err == nil {
+				err = result.err
 			}
-		case <-time.After(30 * time.Second): // Add timeout
-			return fmt.Errorf("timeout waiting for chunk %s upload to complete", stream.ChunkID)
+			continue
 		}
+		records = append(records, result.record)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Chunk upload failed", "chunk", chunkID, "workers", workerIDs, "error", err)
+		return records, err
 	}
 
-	log.Printf("Completed chunk %s to worker %s (%d bytes)",
-		stream.ChunkID, stream.WorkerID, stream.BytesWritten)
-	return nil
+	slog.DebugContext(ctx, "Completed chunk", "chunk", chunkID, "workers", workerIDs, "bytes", len(data))
+	return records, nil
 }
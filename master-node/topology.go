@@ -0,0 +1,89 @@
+package main
+
+// Failure domain levels, from the largest to the smallest
+const (
+	DomainZone = iota
+	DomainRack
+	DomainHost
+)
+
+var domainLevelNames = []string{"zone", "rack", "host"}
+
+// domain returns the failure domain of the worker at the given level. Domains are
+// hierarchical, so racks with the same name in different zones are distinct.
+func (t Topology) domain(level int) string {
+	switch level {
+	case DomainZone:
+		return t.Zone
+	case DomainRack:
+		return t.Zone + "/" + t.Rack
+	default:
+		return t.Zone + "/" + t.Rack + "/" + t.Host
+	}
+}
+
+// sharedDomains counts, per level, how many of the chosen workers share a failure domain with the worker
+func sharedDomains(worker Worker, chosen []Worker) [3]int {
+	var shared [3]int
+	for _, other := range chosen {
+		for level := DomainZone; level <= DomainHost; level++ {
+			if worker.Topology.domain(level) == other.Topology.domain(level) {
+				shared[level]++
+			}
+		}
+	}
+	return shared
+}
+
+// lessShared orders overlap counts, treating a shared zone as worse than any number of shared racks
+func lessShared(a, b [3]int) bool {
+	for level := DomainZone; level <= DomainHost; level++ {
+		if a[level] != b[level] {
+			return a[level] < b[level]
+		}
+	}
+	return false
+}
+
+// mostSpreadCandidates returns the candidates that share the fewest failure domains with the chosen workers
+func mostSpreadCandidates(candidates []Worker, chosen []Worker) []Worker {
+	if len(chosen) == 0 {
+		return candidates
+	}
+
+	var best []Worker
+	var bestShared [3]int
+	for _, worker := range candidates {
+		shared := sharedDomains(worker, chosen)
+		switch {
+		case best == nil || lessShared(shared, bestShared):
+			best = []Worker{worker}
+			bestShared = shared
+		case shared == bestShared:
+			best = append(best, worker)
+		}
+	}
+	return best
+}
+
+// spreadViolation checks the replicas of one chunk against the spread policy: at every
+// level, replicas must occupy as many distinct domains as the cluster allows. It returns
+// the name of the first violated level, or an empty string if the placement is fine.
+func spreadViolation(replicas []Worker, cluster []Worker) string {
+	for level := DomainZone; level <= DomainHost; level++ {
+		available := countDomains(cluster, level)
+		used := countDomains(replicas, level)
+		if used < min(len(replicas), available) {
+			return domainLevelNames[level]
+		}
+	}
+	return ""
+}
+
+func countDomains(workers []Worker, level int) int {
+	domains := make(map[string]bool)
+	for _, worker := range workers {
+		domains[worker.Topology.domain(level)] = true
+	}
+	return len(domains)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+)
+
+// topologyCluster registers workers in two zones: w1 and w2 share a host in rack
+// r1 of zone a, w3 is in rack r2 of zone a and w4 is alone in zone b
+func topologyCluster(t *testing.T, placement PlacementPolicy) *WorkerManager {
+	t.Helper()
+	useTestMetadata(t)
+	wm := NewWorkerManager(placement)
+	for id, topology := range map[string]Topology{
+		"w1": {Zone: "a", Rack: "r1", Host: "h1"},
+		"w2": {Zone: "a", Rack: "r1", Host: "h1"},
+		"w3": {Zone: "a", Rack: "r2", Host: "h3"},
+		"w4": {Zone: "b", Rack: "r1", Host: "h4"},
+	} {
+		wm.AddWorker(id, Worker{ID: id, Topology: topology, Status: WorkerStatus{CapacityBytes: 1 << 30, FreeBytes: 1 << 30}})
+	}
+	return wm
+}
+
+func TestPlacementSpreadsReplicasOverFailureDomains(t *testing.T) {
+	for _, name := range []string{PlacementRoundRobin, PlacementRandom, PlacementFreeSpace, PlacementLeastLoaded, PlacementPowerOfTwo} {
+		t.Run(name, func(t *testing.T) {
+			placement, err := newPlacementPolicy(name)
+			must(t, err)
+			wm := topologyCluster(t, placement)
+			workers := wm.GetWorkers()
+			cluster := make([]Worker, 0, len(workers))
+			for _, worker := range workers {
+				cluster = append(cluster, worker)
+			}
+
+			for range 20 {
+				selected := wm.SelectWorkers(3, nil, nil)
+				replicas := make([]Worker, len(selected))
+				for i, id := range selected {
+					replicas[i] = workers[id]
+				}
+				// Three replicas fit on both zones, both racks of zone a and three hosts
+				if len(selected) != 3 || spreadViolation(replicas, cluster) != "" {
+					t.Fatalf("selected %v, which violates the %q spread", selected, spreadViolation(replicas, cluster))
+				}
+			}
+
+			// A new replica goes to another zone than the existing one
+			for range 20 {
+				if selected := wm.SelectWorkers(1, []string{"w4"}, map[string]bool{"w4": true}); len(selected) != 1 || workers[selected[0]].Topology.Zone != "a" {
+					t.Fatalf("replica next to w4 placed on %v", selected)
+				}
+			}
+		})
+	}
+}
+
+func TestSpreadViolation(t *testing.T) {
+	wm := topologyCluster(t, &roundRobinPlacement{})
+	workers := wm.GetWorkers()
+	cluster := []Worker{workers["w1"], workers["w2"], workers["w3"], workers["w4"]}
+
+	tests := []struct {
+		replicas []string
+		want     string
+	}{
+		{[]string{"w1", "w4"}, ""},
+		{[]string{"w1", "w2"}, "zone"},
+		{[]string{"w1", "w3"}, "zone"},
+		{[]string{"w1", "w3", "w4"}, ""},
+		{[]string{"w1", "w2", "w4"}, "rack"},
+	}
+	for _, test := range tests {
+		replicas := make([]Worker, len(test.replicas))
+		for i, id := range test.replicas {
+			replicas[i] = workers[id]
+		}
+		if got := spreadViolation(replicas, cluster); got != test.want {
+			t.Errorf("spread violation of %v is %q, want %q", test.replicas, got, test.want)
+		}
+	}
+}
+
+func TestFreeSpacePlacementIncludesWorkersWithoutCapacity(t *testing.T) {
+	candidates := []Worker{
+		{ID: "full", Status: WorkerStatus{CapacityBytes: 1 << 30}},
+		{ID: "half", Status: WorkerStatus{CapacityBytes: 1 << 30, FreeBytes: 1 << 29}},
+		{ID: "new"},
+	}
+	selected := make(map[string]int)
+	for range 1000 {
+		selected[freeSpacePlacement{}.Select(candidates)]++
+	}
+	// The new worker weighs as much as the mean of the others, a third of the total
+	if selected["full"] != 0 || selected["new"] < 200 || selected["half"] < 500 {
+		t.Fatalf("selections %v", selected)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+	TraceExporterOTLP   = "otlp"
+)
+
+// TracingServiceName identifies the master in exported traces
+const TracingServiceName = "frostbyte-master"
+
+// tracer creates the spans of the master's own operations
+var tracer = otel.Tracer("frostbyte/master")
+
+// initTracing installs the global tracer provider and the W3C trace context
+// propagator. It returns a function that flushes and stops the exporter.
+// With the none exporter, spans are not recorded but trace context is still
+// passed on to the workers.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	exporter, err := newTraceExporter(ctx, TraceExporter)
+	if err != nil || exporter == nil {
+		return func(context.Context) error { return nil }, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(TracingServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+	res, err = resource.Merge(res, resource.Environment())
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	// The sampler can be chosen with OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newTraceExporter creates the exporter selected by name, or nil for none.
+// The OTLP exporter is configured with the standard OTEL_EXPORTER_OTLP_* variables.
+func newTraceExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case TraceExporterNone, "":
+		return nil, nil
+	case TraceExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterFile:
+		file, err := os.OpenFile(TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	case TraceExporterOTLP:
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", name)
+	}
+}
+
+// startSpan starts a span of the master as a child of the span in ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the outcome of an operation on its span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Span attributes of chunk operations
+func chunkAttributes(workerID, chunkID string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("frostbyte.worker_id", workerID),
+		attribute.String("frostbyte.chunk_id", chunkID),
+	}
+}
+
+// traceRequests starts a server span for every request, continuing the trace of
+// the caller if it sent one. Spans are named after the route that serves them.
+func traceRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "master",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, pattern := mux.Handler(r)
+			return r.Method + " " + pattern
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/health" && r.URL.Path != "/metrics"
+		}),
+	)
+}
+
+// tracedTransport injects the trace context into outgoing requests and records
+// a client span for each of them
+func tracedTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
+
+// tracedPost is http.Post with the trace context of ctx
+func tracedPost(ctx context.Context, client *http.Client, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return client.Do(req)
+}
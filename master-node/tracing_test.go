@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTraceContextReachesWorkers sends a traced request to the master and checks
+// that the chunk request it makes to a worker continues the same trace, also
+// when the master exports no spans
+func TestTraceContextReachesWorkers(t *testing.T) {
+	shutdown, err := initTracing(context.Background())
+	must(t, err)
+	t.Cleanup(func() { shutdown(context.Background()) })
+
+	received := make(chan string, 1)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+	}))
+	defer worker.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, worker.URL+"/get?chunkID=c", nil)
+		must(t, err)
+		resp, err := httpClient.Do(req)
+		must(t, err)
+		resp.Body.Close()
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest(http.MethodGet, "/download/f", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	traceRequests(mux, mux).ServeHTTP(httptest.NewRecorder(), r)
+
+	if got := <-received; !strings.HasPrefix(got, "00-"+traceID+"-") {
+		t.Fatalf("worker got trace context %q, want one continuing trace %s", got, traceID)
+	}
+}
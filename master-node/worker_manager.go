@@ -1,31 +1,193 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"log/slog"
+	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 )
 
+var (
+	errWorkerNotFound   = errors.New("worker not found")
+	errLegacyIDNotOwned = errors.New("registration does not come from the host of the legacy worker")
+	errNotFromWorker    = errors.New("request does not come from the host of the worker")
+)
+
 type WorkerManager struct {
-	workers      map[string]Worker
-	mu           sync.RWMutex
-	lastSelected int // For round-robin selection
+	workers    map[string]Worker
+	mu         sync.RWMutex
+	placement  PlacementPolicy
+	onRegister func(id string) // Called after a worker registered, if set
 }
 
-func NewWorkerManager() *WorkerManager {
+func NewWorkerManager(placement PlacementPolicy) *WorkerManager {
 	return &WorkerManager{
-		workers: make(map[string]Worker),
+		workers:   make(map[string]Worker),
+		placement: placement,
+	}
+}
+
+// LoadRegistry replaces the workers with the ones persisted in the metadata store,
+// so the cluster keeps its workers across master restarts and leader changes.
+// Workers that died while no master was watching are taken out of rotation.
+func (wm *WorkerManager) LoadRegistry(ctx context.Context) error {
+	workers, err := LoadWorkerRecords(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load worker registry: %v", err)
+	}
+
+	wm.mu.Lock()
+	loaded := make(map[string]Worker, len(workers))
+	for _, worker := range workers {
+		// Transfers in flight are only known to this master
+		if existing, exists := wm.workers[worker.ID]; exists {
+			worker.Pending = existing.Pending
+		}
+		worker.persistedHeartbeat = worker.LastHeartbeat
+		loaded[worker.ID] = worker
+	}
+	wm.workers = loaded
+	wm.mu.Unlock()
+
+	// Only the leader's liveness check writes timeouts to the registry, loading just finds them again
+	timedOut := wm.markTimedOutWorkers(time.Now(), WorkerTimeout)
+	slog.InfoContext(ctx, "Loaded worker registry", "workers", len(workers), "timedOut", len(timedOut))
+	return nil
+}
+
+// markTimedOutWorkers takes workers whose last heartbeat is older than timeout out
+// of rotation and returns them. Their next heartbeat is refused, so they register again.
+func (wm *WorkerManager) markTimedOutWorkers(now time.Time, timeout time.Duration) []Worker {
+	var timedOut []Worker
+	wm.mu.Lock()
+	for id, worker := range wm.workers {
+		if worker.Offline || now.Sub(worker.LastHeartbeat) <= timeout {
+			continue
+		}
+		worker.Offline = true
+		wm.workers[id] = worker
+		timedOut = append(timedOut, worker)
+	}
+	wm.mu.Unlock()
+
+	for _, worker := range timedOut {
+		slog.Warn("Worker timed out, taking it out of rotation", "worker", worker.ID, "lastHeartbeat", worker.LastHeartbeat)
+	}
+	return timedOut
+}
+
+// StartLivenessCheck takes workers that stop sending heartbeats out of rotation,
+// checking at the given interval until ctx is done
+func (wm *WorkerManager) StartLivenessCheck(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			wm.checkLiveness(time.Now())
+		}
+	}()
+}
+
+// checkLiveness takes workers whose last heartbeat is older than WorkerTimeout
+// at the given time out of rotation
+func (wm *WorkerManager) checkLiveness(now time.Time) {
+	// Followers do not receive heartbeats, the leader keeps the registry
+	if !metadata.IsLeader() {
+		return
+	}
+	for _, worker := range wm.markTimedOutWorkers(now, WorkerTimeout) {
+		wm.persistWorker(worker.ID)
+	}
+}
+
+// persistWorker writes the current registry entry of a worker to the metadata store
+func (wm *WorkerManager) persistWorker(id string) {
+	worker, exists := wm.GetWorker(id)
+	if !exists {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+	if err := StoreWorkerRecord(ctx, worker); err != nil {
+		slog.Error("Failed to persist worker", "worker", id, "error", err)
+		return
+	}
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if current, exists := wm.workers[id]; exists && worker.LastHeartbeat.After(current.persistedHeartbeat) {
+		current.persistedHeartbeat = worker.LastHeartbeat
+		wm.workers[id] = current
 	}
 }
 
 func (wm *WorkerManager) AddWorker(id string, worker Worker) {
+	defer wm.persistWorker(id)
+
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
+
+	// Re-registration must not bring a draining worker back into rotation,
+	// but the address and topology may change
+	if existing, exists := wm.workers[id]; exists {
+		worker.State = existing.State
+		worker.Drain = existing.Drain
+		worker.Status = existing.Status
+		if worker.LastHeartbeat.IsZero() {
+			worker.LastHeartbeat = existing.LastHeartbeat
+		}
+		worker.persistedHeartbeat = existing.persistedHeartbeat
+		worker.Pending = existing.Pending
+	}
+	if worker.State == "" {
+		worker.State = WorkerStateActive
+	}
 	wm.workers[id] = worker
-	log.Printf("Worker %s registered", id)
+	slog.Debug("Worker added", "worker", id)
+}
+
+// RemoveWorker forgets a worker, including its persisted registry entry
+func (wm *WorkerManager) RemoveWorker(ctx context.Context, id string) error {
+	if err := DeleteWorkerRecord(ctx, id); err != nil {
+		return fmt.Errorf("failed to remove worker %s from the registry: %v", id, err)
+	}
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	delete(wm.workers, id)
+	slog.InfoContext(ctx, "Worker removed", "worker", id)
+	return nil
+}
+
+// updateWorker applies fn to a worker under the lock. It reports whether the worker exists.
+func (wm *WorkerManager) updateWorker(id string, fn func(*Worker)) bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	worker, exists := wm.workers[id]
+	if !exists {
+		return false
+	}
+	// Copies returned by GetWorker share the drain progress, so it is replaced instead of changed in place
+	if worker.Drain != nil {
+		drain := *worker.Drain
+		worker.Drain = &drain
+	}
+	fn(&worker)
+	wm.workers[id] = worker
+	return true
 }
 
 func (wm *WorkerManager) GetWorkers() map[string]Worker {
@@ -47,48 +209,82 @@ func (wm *WorkerManager) GetWorker(id string) (Worker, bool) {
 	return worker, exists
 }
 
-// Improved worker selection with round-robin
+// workerAddress returns the host:port chunk traffic for a worker is sent to.
+// Workers registered before stable IDs were introduced are addressed by their ID.
+func (wm *WorkerManager) workerAddress(id string) string {
+	if worker, exists := wm.GetWorker(id); exists && worker.Address != "" {
+		return worker.Address
+	}
+	return id + ":" + WorkerPort
+}
+
+// SelectWorker selects an active worker using the configured placement policy
 func (wm *WorkerManager) SelectWorker() string {
-	wm.mu.Lock() // Use write lock since we're updating lastSelected
-	defer wm.mu.Unlock()
+	return wm.SelectWorkerExcluding(nil)
+}
 
-	if len(wm.workers) == 0 {
+// SelectWorkerExcluding selects an active worker that is not in the exclude set
+func (wm *WorkerManager) SelectWorkerExcluding(exclude map[string]bool) string {
+	selected := wm.SelectWorkers(1, nil, exclude)
+	if len(selected) == 0 {
 		return ""
 	}
+	return selected[0]
+}
 
-	// Convert to slice for round-robin selection
-	workerIDs := make([]string, 0, len(wm.workers))
-	for id := range wm.workers {
-		workerIDs = append(workerIDs, id)
-	}
+// SelectWorkers selects up to n active workers for the replicas of one chunk,
+// spreading them across zones, racks and hosts. Workers in existing already hold
+// a replica and count towards the spread; workers in exclude are never chosen.
+func (wm *WorkerManager) SelectWorkers(n int, existing []string, exclude map[string]bool) []string {
+	wm.mu.Lock() // Use write lock since policies may keep selection state
+	defer wm.mu.Unlock()
 
-	// Round-robin selection
-	selectedWorker := workerIDs[wm.lastSelected%len(workerIDs)]
-	wm.lastSelected++
+	// Skip workers that are being drained, and sort so policies see a stable order
+	candidates := make([]Worker, 0, len(wm.workers))
+	for id, worker := range wm.workers {
+		if worker.State == WorkerStateActive && !worker.Offline && !exclude[id] {
+			candidates = append(candidates, worker)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
 
-	return selectedWorker
-}
+	chosen := make([]Worker, 0, len(existing)+n)
+	for _, id := range existing {
+		if worker, exists := wm.workers[id]; exists {
+			chosen = append(chosen, worker)
+		}
+	}
 
-// SelectWorkerRandom provides random worker selection for load balancing
-func (wm *WorkerManager) SelectWorkerRandom() string {
-	wm.mu.RLock()
-	defer wm.mu.RUnlock()
+	selected := make([]string, 0, n)
+	for len(selected) < n && len(candidates) > 0 {
+		// Let the placement policy choose among the candidates that share the fewest failure domains
+		spread := mostSpreadCandidates(candidates, chosen)
+		id := wm.placement.Select(spread)
+		selected = append(selected, id)
 
-	if len(wm.workers) == 0 {
-		return ""
+		for i, worker := range candidates {
+			if worker.ID == id {
+				chosen = append(chosen, worker)
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
 	}
+	return selected
+}
 
-	// Convert to slice for random selection
-	workerIDs := make([]string, 0, len(wm.workers))
-	for id := range wm.workers {
-		workerIDs = append(workerIDs, id)
+// beginTransfer marks a transfer to a worker as in flight and returns a function that ends it
+func (wm *WorkerManager) beginTransfer(id string) func() {
+	wm.updateWorker(id, func(worker *Worker) { worker.Pending++ })
+	return func() {
+		wm.updateWorker(id, func(worker *Worker) { worker.Pending-- })
 	}
-	// Random selection with crypto/rand for better distribution
-	rand.Seed(time.Now().UnixNano())
-	return workerIDs[rand.Intn(len(workerIDs))]
 }
 
-// Register worker nodes
+// Register worker nodes. Workers identify themselves with a stable ID and
+// advertise the address the master should use to reach them.
 func (wm *WorkerManager) registerWorker(w http.ResponseWriter, r *http.Request) {
 	id, err := getRequiredParam(r, "id")
 	if err != nil {
@@ -96,18 +292,214 @@ func (wm *WorkerManager) registerWorker(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	address := r.URL.Query().Get("addr")
+	if address == "" {
+		address = id + ":" + WorkerPort
+	}
+	if existing, exists := wm.GetWorker(id); exists && existing.Address != address {
+		if err := verifyWorkerOrigin(r, existing); err != nil {
+			slog.WarnContext(r.Context(), "Refused worker address change", "worker", id, "address", address,
+				"remote", clientAddr(r), "error", err)
+			writeErrorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	// A worker that just created its stable ID takes over the chunks it stored under its hostname
+	if legacyID := r.URL.Query().Get("legacyId"); legacyID != "" && legacyID != id {
+		if err := wm.verifyLegacyHost(r, legacyID); err != nil {
+			slog.WarnContext(r.Context(), "Refused worker ID migration", "worker", id, "legacyId", legacyID,
+				"remote", clientAddr(r), "error", err)
+			writeErrorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := wm.migrateWorkerID(legacyID, id); err != nil {
+			writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	addr := r.RemoteAddr
-	worker := Worker{ID: id}
+	// Registering counts as a heartbeat, so the worker is not timed out before its first one
+	worker := Worker{
+		ID:            id,
+		Address:       address,
+		LastHeartbeat: time.Now().UTC(),
+		Topology: Topology{
+			Zone: r.URL.Query().Get("zone"),
+			Rack: r.URL.Query().Get("rack"),
+			Host: r.URL.Query().Get("host"),
+		},
+	}
 	wm.AddWorker(id, worker)
+	if wm.onRegister != nil {
+		wm.onRegister(id)
+	}
 
-	log.Printf("Worker %s registered from %s", id, addr)
+	slog.InfoContext(r.Context(), "Worker registered", "worker", id, "remote", addr, "address", address)
 	writeSuccessResponse(w, fmt.Sprintf("Worker %s registered from %s\n", id, addr))
 }
 
+// verifyLegacyHost checks that a registration claiming a legacy ID comes from the
+// host that ID stood for. Legacy IDs were hostnames, and legacy workers were
+// reached at their hostname unless they registered another address.
+func (wm *WorkerManager) verifyLegacyHost(r *http.Request, legacyID string) error {
+	legacyHost := legacyID
+	if legacy, exists := wm.GetWorker(legacyID); exists {
+		if host, _, err := net.SplitHostPort(legacy.Address); err == nil {
+			legacyHost = host
+		}
+	}
+	if err := verifyClientHost(r, legacyHost); err != nil {
+		return fmt.Errorf("%w: %v", errLegacyIDNotOwned, err)
+	}
+	return nil
+}
+
+// verifyWorkerOrigin checks that a request moving a registered worker to another
+// address, or taking it out of rotation, comes from that worker, so nobody else
+// can redirect its chunk traffic or stop placement on it. The cluster token
+// proves that if one is set; otherwise the request must come from the host of
+// the current address.
+func verifyWorkerOrigin(r *http.Request, worker Worker) error {
+	if ClusterToken != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(worker.Address)
+	if err == nil {
+		err = verifyClientHost(r, host)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNotFromWorker, err)
+	}
+	return nil
+}
+
+// migrateWorkerID rewrites the metadata and registry of a worker known by its legacy ID to its stable ID
+func (wm *WorkerManager) migrateWorkerID(legacyID, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DatabaseTimeout)
+	defer cancel()
+
+	migrated, err := RenameWorkerInChunks(ctx, legacyID, id)
+	if err != nil {
+		return fmt.Errorf("failed to migrate chunks of worker %s: %v", legacyID, err)
+	}
+
+	if legacy, exists := wm.GetWorker(legacyID); exists {
+		// Keep the drain state and status the worker had under its old ID
+		wm.mu.Lock()
+		legacy.ID = id
+		wm.workers[id] = legacy
+		wm.mu.Unlock()
+		if err := wm.RemoveWorker(ctx, legacyID); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Migrated worker to stable ID", "legacyId", legacyID, "worker", id, "files", migrated)
+	return nil
+}
+
+// deregisterWorker takes a shutting down worker out of rotation until it registers again.
+// Its drain state and chunks are kept.
+func (wm *WorkerManager) deregisterWorker(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+	id, err := getRequiredParam(r, "id")
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	worker, known := wm.GetWorker(id)
+	if known {
+		if err := verifyWorkerOrigin(r, worker); err != nil {
+			slog.WarnContext(r.Context(), "Refused worker deregistration", "worker", id, "remote", clientAddr(r), "error", err)
+			writeErrorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		known = wm.updateWorker(id, func(worker *Worker) {
+			worker.Offline = true
+		})
+	}
+	if !known {
+		writeErrorResponse(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+	wm.persistWorker(id)
+
+	slog.InfoContext(r.Context(), "Worker deregistered", "worker", id)
+	writeSuccessResponse(w, fmt.Sprintf("Worker %s deregistered\n", id))
+}
+
+// handleHeartbeat records the capacity and load reported by a worker.
+// Unknown workers get a 404 so they know to register again.
+func (wm *WorkerManager) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var status WorkerStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		writeErrorResponse(w, fmt.Sprintf("Invalid heartbeat: %v", err), http.StatusBadRequest)
+		return
+	}
+	if worker, exists := wm.GetWorker(status.ID); exists && status.Address != "" && status.Address != worker.Address {
+		if err := verifyWorkerOrigin(r, worker); err != nil {
+			slog.WarnContext(r.Context(), "Refused worker address change", "worker", status.ID, "address", status.Address,
+				"remote", clientAddr(r), "error", err)
+			writeErrorResponse(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	// Load figures change with every heartbeat and are only kept in memory.
+	// The registry is written when the address or the disks of the worker change,
+	// and often enough that a new leader does not take live workers for dead ones.
+	var changed, offline bool
+	now := time.Now().UTC()
+	known := wm.updateWorker(status.ID, func(worker *Worker) {
+		if worker.Offline {
+			offline = true
+			return
+		}
+		changed = worker.persistedHeartbeat.IsZero() || now.Sub(worker.persistedHeartbeat) > WorkerTimeout/2 ||
+			diskStatesChanged(worker.Status.Disks, status.Disks)
+		worker.Status = status
+		if status.Address != "" && status.Address != worker.Address {
+			worker.Address = status.Address
+			changed = true
+		}
+		worker.LastHeartbeat = now
+	})
+	// An offline worker registers again before it is put back into rotation
+	if !known || offline {
+		writeErrorResponse(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+	if changed {
+		wm.persistWorker(status.ID)
+	}
+	writeSuccessResponse(w, "OK")
+}
+
+// diskStatesChanged reports whether a worker gained, lost or failed a disk
+func diskStatesChanged(previous, current []DiskStatus) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for i := range current {
+		if previous[i].Path != current[i].Path || previous[i].State != current[i].State {
+			return true
+		}
+	}
+	return false
+}
+
 func (wm *WorkerManager) listWorkers(w http.ResponseWriter, r *http.Request) {
 	workers := wm.GetWorkers()
 	if err := writeJSONResponse(w, workers); err != nil {
-		log.Printf("Failed to encode workers list: %v", err)
 		writeErrorResponse(w, "Failed to encode workers list", http.StatusInternalServerError)
 	}
 }
@@ -121,19 +513,16 @@ func (wm *WorkerManager) testWorker(w http.ResponseWriter, r *http.Request) {
 
 	worker, exists := wm.GetWorker(id)
 	if !exists {
-		log.Printf("Worker %s not found", id)
 		writeErrorResponse(w, "Worker not found", http.StatusNotFound)
 		return
 	}
 
-	resp, err := http.Get(fmt.Sprintf("http://%s:%s/worker-test", worker.ID, DefaultWorkerPort))
+	resp, err := http.Get(fmt.Sprintf("http://%s/worker-test", wm.workerAddress(worker.ID)))
 	if err != nil {
-		log.Printf("Failed to reach worker %s: %v", id, err)
-		writeErrorResponse(w, "Failed to reach worker", http.StatusInternalServerError)
+		writeErrorResponse(w, fmt.Sprintf("Failed to reach worker: %v", err), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Response from worker %s: %s", id, resp.Status)
 	writeSuccessResponse(w, fmt.Sprintf("Response from worker %s: %s", id, resp.Status))
 }
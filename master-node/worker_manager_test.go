@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLegacyIDMigrationRequiresTheLegacyHost(t *testing.T) {
+	store := useTestMetadata(t)
+	ctx := testContext(t)
+	wm := NewWorkerManager(nil)
+	wm.AddWorker("192.0.2.70", Worker{ID: "192.0.2.70", Address: "192.0.2.70:8081"})
+	must(t, store.StoreFileMetadata(ctx, FileInfo{Filename: "f", Size: 1}))
+	must(t, store.AddChunkRecord(ctx, "f", ChunkRecord{ChunkID: "f_chunk_0", WorkerID: "192.0.2.70", Size: 1}))
+
+	register := func(remoteAddr string, forged bool) int {
+		r := httptest.NewRequest(http.MethodPost, "/register?id=stable-id&addr=192.0.2.70:8081&legacyId=192.0.2.70", nil)
+		r.RemoteAddr = remoteAddr
+		if forged {
+			r.Header.Set(ForwardedHeader, "master9")
+			r.Header.Set(ClientAddrHeader, "192.0.2.70:40000")
+		}
+		w := httptest.NewRecorder()
+		forwardToLeader(store, http.HandlerFunc(wm.registerWorker)).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := register("203.0.113.7:40000", true); code != http.StatusForbidden {
+		t.Fatalf("registration with a forged client address returned %d, want %d", code, http.StatusForbidden)
+	}
+	if code := register("203.0.113.7:40000", false); code != http.StatusForbidden {
+		t.Fatalf("registration from another host returned %d, want %d", code, http.StatusForbidden)
+	}
+	doc, err := store.GetFileDocument(ctx, "f")
+	must(t, err)
+	if doc.Chunks[0].WorkerID != "192.0.2.70" {
+		t.Fatalf("refused registration migrated the chunks to %s", doc.Chunks[0].WorkerID)
+	}
+
+	if code := register("192.0.2.70:40000", false); code != http.StatusOK {
+		t.Fatalf("registration from the legacy host returned %d, want %d", code, http.StatusOK)
+	}
+	doc, err = store.GetFileDocument(ctx, "f")
+	must(t, err)
+	if doc.Chunks[0].WorkerID != "stable-id" {
+		t.Errorf("chunks still belong to %s after migration", doc.Chunks[0].WorkerID)
+	}
+	if _, exists := wm.GetWorker("192.0.2.70"); exists {
+		t.Errorf("legacy worker is still registered")
+	}
+}
+
+func TestWorkerAddressChangeRequiresTheWorker(t *testing.T) {
+	useTestMetadata(t)
+	wm := NewWorkerManager(nil)
+	wm.AddWorker("w1", Worker{ID: "w1", Address: "192.0.2.70:8081", LastHeartbeat: time.Now()})
+
+	register := func(remoteAddr, address, token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/register?id=w1&addr="+address, nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set(ClusterTokenHeader, token)
+		w := httptest.NewRecorder()
+		requireClusterToken(wm.registerWorker)(w, r)
+		return w.Code
+	}
+	heartbeat := func(remoteAddr, address string) int {
+		r := httptest.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(`{"id":"w1","address":"`+address+`"}`))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		wm.handleHeartbeat(w, r)
+		return w.Code
+	}
+	address := func() string {
+		worker, _ := wm.GetWorker("w1")
+		return worker.Address
+	}
+
+	if code := register("203.0.113.7:40000", "203.0.113.7:8081", ""); code != http.StatusForbidden {
+		t.Fatalf("registration moving the worker from another host returned %d, want %d", code, http.StatusForbidden)
+	}
+	if code := heartbeat("203.0.113.7:40000", "203.0.113.7:8081"); code != http.StatusForbidden {
+		t.Fatalf("heartbeat moving the worker from another host returned %d, want %d", code, http.StatusForbidden)
+	}
+	if got := address(); got != "192.0.2.70:8081" {
+		t.Fatalf("refused requests moved the worker to %s", got)
+	}
+	if code := register("192.0.2.70:40000", "192.0.2.71:8081", ""); code != http.StatusOK || address() != "192.0.2.71:8081" {
+		t.Fatalf("registration from the host of the worker returned %d and left it at %s", code, address())
+	}
+
+	// With a cluster token, the token identifies workers wherever they register from
+	previousToken := ClusterToken
+	ClusterToken = "cluster-secret"
+	t.Cleanup(func() { ClusterToken = previousToken })
+	if code := register("203.0.113.7:40000", "203.0.113.7:8081", "wrong"); code != http.StatusForbidden || address() != "192.0.2.71:8081" {
+		t.Fatalf("registration with a wrong token returned %d and left the worker at %s", code, address())
+	}
+	if code := register("203.0.113.7:40000", "203.0.113.7:8081", "cluster-secret"); code != http.StatusOK || address() != "203.0.113.7:8081" {
+		t.Fatalf("registration with the token returned %d and left the worker at %s", code, address())
+	}
+}
+
+func TestWorkerDeregistrationRequiresTheWorker(t *testing.T) {
+	useTestMetadata(t)
+	wm := NewWorkerManager(nil)
+	wm.AddWorker("w1", Worker{ID: "w1", Address: "192.0.2.70:8081", LastHeartbeat: time.Now()})
+
+	deregister := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodPost, "/deregister?id=w1", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		wm.deregisterWorker(w, r)
+		return w.Code
+	}
+	offline := func() bool {
+		worker, _ := wm.GetWorker("w1")
+		return worker.Offline
+	}
+
+	if code := deregister("203.0.113.7:40000"); code != http.StatusForbidden || offline() {
+		t.Fatalf("deregistration from another host returned %d, offline: %t", code, offline())
+	}
+	if code := deregister("192.0.2.70:40000"); code != http.StatusOK || !offline() {
+		t.Fatalf("deregistration from the host of the worker returned %d, offline: %t", code, offline())
+	}
+}
+
+func sendHeartbeat(wm *WorkerManager, id string) int {
+	body := `{"id":"` + id + `","disks":[{"path":"/data","state":"healthy"}]}`
+	w := httptest.NewRecorder()
+	wm.handleHeartbeat(w, httptest.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(body)))
+	return w.Code
+}
+
+func TestWorkersWithoutHeartbeatsTimeOut(t *testing.T) {
+	useTestMetadata(t)
+	previousTimeout := WorkerTimeout
+	WorkerTimeout = time.Minute
+	t.Cleanup(func() { WorkerTimeout = previousTimeout })
+
+	// w1 died while the master was down, w2 is alive
+	wm := NewWorkerManager(&roundRobinPlacement{})
+	wm.AddWorker("w1", Worker{ID: "w1", Address: "192.0.2.1:8081", LastHeartbeat: time.Now().Add(-2 * time.Minute)})
+	wm.AddWorker("w2", Worker{ID: "w2", Address: "192.0.2.2:8081", LastHeartbeat: time.Now()})
+
+	restarted := NewWorkerManager(&roundRobinPlacement{})
+	must(t, restarted.LoadRegistry(testContext(t)))
+	if selected := restarted.SelectWorkers(2, nil, nil); len(selected) != 1 || selected[0] != "w2" {
+		t.Fatalf("selected %v after loading the registry, want only w2", selected)
+	}
+
+	// A timed out worker has to register again before it is selected
+	if code := sendHeartbeat(restarted, "w1"); code != http.StatusNotFound {
+		t.Fatalf("heartbeat of a timed out worker returned %d, want %d", code, http.StatusNotFound)
+	}
+	w := httptest.NewRecorder()
+	restarted.registerWorker(w, httptest.NewRequest(http.MethodPost, "/register?id=w1&addr=192.0.2.1:8081", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("registration returned %d", w.Code)
+	}
+	if code := sendHeartbeat(restarted, "w1"); code != http.StatusOK {
+		t.Fatalf("heartbeat after registering again returned %d", code)
+	}
+	if selected := restarted.SelectWorkers(2, nil, nil); len(selected) != 2 {
+		t.Fatalf("selected %v after w1 came back, want both workers", selected)
+	}
+
+	// The liveness check takes workers out of rotation once they stop sending heartbeats
+	restarted.checkLiveness(time.Now().Add(2 * time.Minute))
+	records, err := LoadWorkerRecords(testContext(t))
+	must(t, err)
+	for _, record := range records {
+		if !record.Offline {
+			t.Errorf("worker %s without heartbeats was not persisted as offline", record.ID)
+		}
+	}
+	if selected := restarted.SelectWorkers(1, nil, nil); len(selected) != 0 {
+		t.Fatalf("selected %v after the workers stopped sending heartbeats", selected)
+	}
+}
+
+func TestWorkerRegistrySurvivesRestart(t *testing.T) {
+	useTestMetadata(t)
+	ctx := testContext(t)
+	wm := NewWorkerManager(&roundRobinPlacement{})
+	topology := Topology{Zone: "a", Rack: "r1", Host: "h1"}
+	wm.AddWorker("w1", Worker{ID: "w1", Address: "192.0.2.1:8081", Topology: topology, LastHeartbeat: time.Now()})
+	wm.AddWorker("w2", Worker{ID: "w2", Address: "192.0.2.2:8081", LastHeartbeat: time.Now()})
+	wm.updateWorker("w2", func(worker *Worker) {
+		worker.State = WorkerStateDraining
+		worker.Drain = &DrainProgress{Total: 5, Moved: 2, Remaining: 3}
+	})
+	wm.persistWorker("w2")
+
+	restarted := NewWorkerManager(&roundRobinPlacement{})
+	must(t, restarted.LoadRegistry(ctx))
+	w1, known := restarted.GetWorker("w1")
+	if !known || w1.Address != "192.0.2.1:8081" || w1.Topology != topology || w1.State != WorkerStateActive || w1.Offline {
+		t.Fatalf("w1 after restart: %+v", w1)
+	}
+	w2, known := restarted.GetWorker("w2")
+	if !known || w2.State != WorkerStateDraining || w2.Drain == nil || w2.Drain.Moved != 2 || w2.Drain.Remaining != 3 {
+		t.Fatalf("w2 after restart: %+v", w2)
+	}
+
+	// Registering again does not bring a draining worker back into rotation
+	restarted.AddWorker("w2", Worker{ID: "w2", Address: "192.0.2.2:8081", LastHeartbeat: time.Now()})
+	if selected := restarted.SelectWorkers(2, nil, nil); len(selected) != 1 || selected[0] != "w1" {
+		t.Fatalf("selected %v, want only w1", selected)
+	}
+	if w2, _ := restarted.GetWorker("w2"); w2.State != WorkerStateDraining {
+		t.Fatalf("w2 is %s after registering again", w2.State)
+	}
+}
@@ -1,10 +1,240 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
 const (
 	// Server configuration
-	DefaultWorkerPort = "8081"
-	DefaultMasterPort = "8080"
+	DefaultWorkerPort  = "8081"
+	DefaultMasterAddr  = "master:8080"
+	DefaultPprofAddr   = "localhost:6060"
+	DefaultDataDir     = "./chunks"
+	DefaultSyncDataDir = true
+
+	// Interval at which every data directory is checked for disk failures
+	DefaultDiskCheckInterval = 30 * time.Second
+
+	// Storage engines: one file per chunk, or append-only segment files
+	StorageEngineFile = "file"
+	StorageEngineLog  = "log"
+
+	// Log storage engine configuration
+	DefaultStorageEngine       = StorageEngineFile
+	DefaultSegmentSize         = 256 * 1024 * 1024
+	DefaultCompactionThreshold = 50 // Percent of a segment that is dead
+	DefaultCompactionInterval  = 10 * time.Minute
+
+	// Time in-flight requests get to finish on shutdown
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// File in the data directory holding the stable worker ID
+	WorkerIDFile = ".worker-id"
+	// File in the data directory holding the hostname the worker's chunks are
+	// recorded under until the master has migrated them to the stable ID
+	LegacyIDFile = ".legacy-id"
+
+	// Interval at which capacity and load are reported to the master
+	DefaultHeartbeatInterval = 10 * time.Second
+
+	// Backoff between registration attempts while the master is unreachable
+	DefaultRegisterInitialBackoff = 1 * time.Second
+	DefaultRegisterMaxBackoff     = 30 * time.Second
+
+	// Timeout of registration, heartbeats and other requests to the master
+	DefaultMasterTimeout = 10 * time.Second
 
 	// HTTP configuration
+	ContentTypeJSON        = "application/json"
 	ContentTypeOctetStream = "application/octet-stream"
+
+	// Headers reporting what was stored, so the master can record it
+	ChunkChecksumHeader = "X-Chunk-Checksum"
+	ChunkSizeHeader     = "X-Chunk-Size"
+
+	// Tracing configuration
+	DefaultTraceExporter = TraceExporterNone
+	DefaultTraceFile     = "traces.jsonl"
+
+	// Logging configuration
+	DefaultLogFormat = LogFormatText
+	DefaultLogLevel  = "info"
+
+	// Header carrying the ID of the master request a chunk request belongs to
+	RequestIDHeader = "X-Request-ID"
+
+	// Header carrying the cluster token on requests to the master
+	ClusterTokenHeader = "X-Frostbyte-Cluster-Token"
+)
+
+// Server settings: the port the worker listens on, the host:port of the master,
+// the address of the pprof server and the comma-separated directories chunks are
+// stored in, one per disk
+var (
+	WorkerPort = DefaultWorkerPort
+	MasterAddr = DefaultMasterAddr
+	PprofAddr  = DefaultPprofAddr
+	DataDir    = DefaultDataDir
+)
+
+// SyncDataDir makes chunk writes also sync the data directory after renaming a
+// chunk into place, so the chunk survives a power loss, at some cost in throughput
+var SyncDataDir = DefaultSyncDataDir
+
+// Storage engine settings: the engine chunks are stored with and, for the log
+// engine, the size at which a segment is sealed and the share of dead records
+// at which, and interval at which, sealed segments are compacted
+var (
+	StorageEngine       = DefaultStorageEngine
+	SegmentSize         = int64(DefaultSegmentSize)
+	CompactionThreshold = DefaultCompactionThreshold
+	CompactionInterval  = DefaultCompactionInterval
+)
+
+// DiskCheckInterval is the interval between health checks of the data directories
+var DiskCheckInterval = DefaultDiskCheckInterval
+
+// ShutdownTimeout is the time in-flight requests get to finish on shutdown
+var ShutdownTimeout = DefaultShutdownTimeout
+
+// Identity settings: the host:port advertised to the master for chunk traffic, and
+// the failure domains of the worker. The advertised address and host default to the
+// hostname when empty.
+var (
+	AdvertiseAddr string
+	Zone          string
+	Rack          string
+	Host          string
+)
+
+// Registration settings
+var (
+	HeartbeatInterval      = DefaultHeartbeatInterval
+	RegisterInitialBackoff = DefaultRegisterInitialBackoff
+	RegisterMaxBackoff     = DefaultRegisterMaxBackoff
+	MasterTimeout          = DefaultMasterTimeout
+)
+
+// ClusterToken is presented to the master on every request, which needs it if
+// the master has one configured
+var ClusterToken string
+
+// Tracing settings: the exporter spans are sent to, and the file used by the file exporter
+var (
+	TraceExporter = DefaultTraceExporter
+	TraceFile     = DefaultTraceFile
 )
+
+// Logging settings: text or json output, and the minimum level (debug, info, warn or error)
+var (
+	LogFormat = DefaultLogFormat
+	LogLevel  = DefaultLogLevel
+)
+
+// loadConfig fills the settings above from the configuration file, the environment
+// and the command line, and validates them
+func loadConfig(args []string) (*configLoader, error) {
+	c := newConfigLoader("dfs-worker")
+	c.String(&WorkerPort, "port", "FROSTBYTE_PORT", "port the worker listens on")
+	c.String(&MasterAddr, "master-addr", "FROSTBYTE_MASTER_ADDR", "host:port of the master, or of several masters comma separated, which the worker fails over between")
+	c.String(&PprofAddr, "pprof-addr", "FROSTBYTE_PPROF_ADDR", "address of the pprof server")
+	c.String(&DataDir, "data-dir", "FROSTBYTE_DATA_DIR", "directories chunks are stored in, comma separated, one per disk")
+	c.Bool(&SyncDataDir, "sync-data-dir", "FROSTBYTE_SYNC_DATA_DIR", "sync the data directory after each chunk write")
+	c.Duration(&DiskCheckInterval, "disk-check-interval", "FROSTBYTE_DISK_CHECK_INTERVAL", "interval between health checks of the data directories")
+	c.String(&StorageEngine, "storage-engine", "FROSTBYTE_STORAGE_ENGINE", "chunk storage engine: file or log")
+	c.Int64(&SegmentSize, "segment-size", "FROSTBYTE_SEGMENT_SIZE", "size in bytes at which the log engine starts a new segment")
+	c.Int(&CompactionThreshold, "compaction-threshold", "FROSTBYTE_COMPACTION_THRESHOLD", "percentage of dead records at which the log engine compacts a segment")
+	c.Duration(&CompactionInterval, "compaction-interval", "FROSTBYTE_COMPACTION_INTERVAL", "interval between log engine compactions")
+	c.String(&AdvertiseAddr, "advertise-addr", "WORKER_ADVERTISE_ADDR", "host:port advertised to the master (default hostname and port)")
+	c.String(&Zone, "zone", "WORKER_ZONE", "zone of the worker")
+	c.String(&Rack, "rack", "WORKER_RACK", "rack of the worker")
+	c.String(&Host, "host", "WORKER_HOST", "physical host of the worker (default hostname)")
+	c.Duration(&HeartbeatInterval, "heartbeat-interval", "FROSTBYTE_HEARTBEAT_INTERVAL", "interval between heartbeats to the master")
+	c.Duration(&RegisterInitialBackoff, "register-initial-backoff", "FROSTBYTE_REGISTER_INITIAL_BACKOFF", "first delay between registration attempts")
+	c.Duration(&ShutdownTimeout, "shutdown-timeout", "FROSTBYTE_SHUTDOWN_TIMEOUT", "time in-flight requests get to finish on shutdown")
+	c.Duration(&RegisterMaxBackoff, "register-max-backoff", "FROSTBYTE_REGISTER_MAX_BACKOFF", "longest delay between registration attempts")
+	c.Duration(&MasterTimeout, "master-timeout", "FROSTBYTE_MASTER_TIMEOUT", "timeout of requests to the master")
+	c.Secret(&ClusterToken, "cluster-token", "FROSTBYTE_CLUSTER_TOKEN", "token presented to the master (prefer the environment)")
+	c.String(&TraceExporter, "trace-exporter", "FROSTBYTE_TRACE_EXPORTER", "span exporter: none, stdout, file or otlp")
+	c.String(&TraceFile, "trace-file", "FROSTBYTE_TRACE_FILE", "file written by the file span exporter")
+	c.String(&LogFormat, "log-format", "FROSTBYTE_LOG_FORMAT", "log format: text or json")
+	c.String(&LogLevel, "log-level", "FROSTBYTE_LOG_LEVEL", "minimum log level: debug, info, warn or error")
+
+	if _, err := c.Load(args); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// masterAddrs returns the masters listed in MasterAddr
+func masterAddrs() []string {
+	var addrs []string
+	for _, addr := range strings.Split(MasterAddr, ",") {
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+	return addrs
+}
+
+// dataDirs returns the directories listed in DataDir
+func dataDirs() []string {
+	var dirs []string
+	for _, dir := range strings.Split(DataDir, ",") {
+		dirs = append(dirs, filepath.Clean(strings.TrimSpace(dir)))
+	}
+	return dirs
+}
+
+// validateConfig reports every invalid setting at once
+func validateConfig() error {
+	var level slog.Level
+	errs := []error{
+		checkPort("port", WorkerPort),
+		checkPositive("heartbeat-interval", HeartbeatInterval),
+		checkPositive("shutdown-timeout", ShutdownTimeout),
+		checkPositive("disk-check-interval", DiskCheckInterval),
+		checkPositive("register-initial-backoff", RegisterInitialBackoff),
+		checkPositive("register-max-backoff", RegisterMaxBackoff),
+		checkPositive("master-timeout", MasterTimeout),
+		checkOneOf("storage-engine", StorageEngine, StorageEngineFile, StorageEngineLog),
+		checkPositive("segment-size", SegmentSize),
+		checkPositive("compaction-interval", CompactionInterval),
+		checkOneOf("trace-exporter", TraceExporter, TraceExporterNone, TraceExporterStdout, TraceExporterFile, TraceExporterOTLP),
+		checkOneOf("log-format", LogFormat, LogFormatText, LogFormatJSON),
+	}
+	if MasterAddr == "" {
+		errs = append(errs, errors.New("master-addr must not be empty"))
+	} else if slices.Contains(masterAddrs(), "") {
+		errs = append(errs, fmt.Errorf("master-addr must not contain empty addresses, got %q", MasterAddr))
+	}
+	seen := make(map[string]bool)
+	for _, dir := range strings.Split(DataDir, ",") {
+		if strings.TrimSpace(dir) == "" {
+			errs = append(errs, fmt.Errorf("data-dir must not contain empty directories, got %q", DataDir))
+			continue
+		}
+		dir = filepath.Clean(strings.TrimSpace(dir))
+		if seen[dir] {
+			errs = append(errs, fmt.Errorf("data-dir lists %s more than once", dir))
+		}
+		seen[dir] = true
+	}
+	if CompactionThreshold < 1 || CompactionThreshold > 100 {
+		errs = append(errs, fmt.Errorf("compaction-threshold must be between 1 and 100, got %d", CompactionThreshold))
+	}
+	if RegisterMaxBackoff < RegisterInitialBackoff {
+		errs = append(errs, fmt.Errorf("register-max-backoff must not be below register-initial-backoff, got %v", RegisterMaxBackoff))
+	}
+	if err := level.UnmarshalText([]byte(LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("log-level must be debug, info, warn or error, got %q", LogLevel))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// diskUsage returns the total and available bytes of the filesystem holding path
+func diskUsage(path string) (capacity uint64, free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Disk states
+const (
+	DiskStateHealthy = "healthy"
+	DiskStateFailed  = "failed"
+)
+
+// diskProbeFile is written and removed by every health check of a data directory
+const diskProbeFile = ".disk-probe"
+
+// DiskStatus is the capacity and health of one data directory
+type DiskStatus struct {
+	Path          string `json:"path"`
+	State         string `json:"state"`
+	Error         string `json:"error,omitempty"`
+	CapacityBytes uint64 `json:"capacityBytes"`
+	FreeBytes     uint64 `json:"freeBytes"`
+	UsedBytes     int64  `json:"usedBytes"`
+	ChunkCount    int    `json:"chunkCount"`
+}
+
+// disk is one data directory and the storage engine running on it
+type disk struct {
+	path    string
+	storage ChunkStorage
+	err     error // Why the disk failed, nil while it is healthy
+
+	chunkCount int   // Chunks stored on the disk
+	usedBytes  int64 // Total size of the chunks stored on the disk
+}
+
+// MultiDiskStorage spreads chunks over several data directories, one per disk,
+// each with its own storage engine. New chunks go to a healthy disk picked at
+// random, weighted by its free space, and the disk holding each chunk is kept in
+// memory. A disk whose operations fail and which then fails a health check is
+// taken out of service: its chunks are forgotten and queued as lost, so the
+// master can replace them, and the worker keeps serving from the other disks.
+// The chunk count and usage of each disk are taken from a scan at startup and
+// kept up to date by every write and delete.
+type MultiDiskStorage struct {
+	disks []*disk
+
+	mu        sync.RWMutex // Guards locations, sizes, lost and the state and usage of the disks
+	locations map[string]*disk
+	sizes     map[string]int64 // Size of every located chunk
+	lost      []string         // Chunks of failed disks not yet reported to the master
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMultiDiskStorage opens every directory with open and checks the health of
+// the disks at the given interval. Directories that cannot be opened start out
+// failed; it is an error if none can be opened.
+func NewMultiDiskStorage(dirs []string, open func(dir string) (ChunkStorage, error), interval time.Duration) (*MultiDiskStorage, error) {
+	ms := &MultiDiskStorage{
+		locations: make(map[string]*disk),
+		sizes:     make(map[string]int64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	healthy := 0
+	for _, dir := range dirs {
+		d := &disk{path: dir}
+		ms.disks = append(ms.disks, d)
+		storage, err := open(dir)
+		if err == nil {
+			err = probeDisk(dir)
+		}
+		if err != nil {
+			if storage != nil {
+				storage.Close()
+			}
+			d.err = err
+			slog.Error("Data directory failed, continuing without it", "dir", dir, "error", err)
+			continue
+		}
+		d.storage = storage
+		healthy++
+	}
+	if healthy == 0 {
+		return nil, fmt.Errorf("no usable data directory: %v", ms.disks[0].err)
+	}
+
+	if err := ms.loadLocations(); err != nil {
+		for _, d := range ms.disks {
+			if d.storage != nil {
+				d.storage.Close()
+			}
+		}
+		return nil, err
+	}
+
+	go ms.checkLoop(interval)
+	return ms, nil
+}
+
+// loadLocations records the disk and size of every stored chunk. A chunk found
+// on two disks, left behind by an interrupted write, keeps its newest copy.
+func (ms *MultiDiskStorage) loadLocations() error {
+	modTimes := make(map[string]time.Time)
+	for _, d := range ms.disks {
+		if d.storage == nil {
+			continue
+		}
+		chunks, err := d.storage.List()
+		if err != nil {
+			return fmt.Errorf("failed to list chunks in %s: %v", d.path, err)
+		}
+		for _, chunk := range chunks {
+			if other, ok := ms.locations[chunk.ChunkID]; ok {
+				stale := d
+				if chunk.ModTime.After(modTimes[chunk.ChunkID]) {
+					stale = other
+				}
+				slog.Warn("Removing older copy of a chunk stored on two disks", "chunk", chunk.ChunkID, "dir", stale.path)
+				if err := stale.storage.Delete(chunk.ChunkID); err != nil {
+					return err
+				}
+				if stale == d {
+					continue
+				}
+				ms.forget(stale, chunk.ChunkID)
+			}
+			ms.record(d, chunk.ChunkID, chunk.Size)
+			modTimes[chunk.ChunkID] = chunk.ModTime
+		}
+	}
+	return nil
+}
+
+// probeDisk writes, syncs and removes a small file in dir
+func probeDisk(dir string) error {
+	path := filepath.Join(dir, diskProbeFile)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(time.Now().UTC().Format(time.RFC3339Nano)))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(path); err == nil {
+		err = removeErr
+	}
+	if err == nil {
+		_, _, err = diskUsage(dir)
+	}
+	return err
+}
+
+// checkLoop checks the health of every disk at the given interval until Close is called
+func (ms *MultiDiskStorage) checkLoop(interval time.Duration) {
+	defer close(ms.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ms.stop:
+			return
+		}
+		for _, d := range ms.disks {
+			ms.checkDisk(d)
+		}
+	}
+}
+
+// checkDisk probes a healthy disk and takes it out of service if the probe fails
+func (ms *MultiDiskStorage) checkDisk(d *disk) {
+	if !ms.healthy(d) {
+		return
+	}
+	if err := probeDisk(d.path); err != nil {
+		ms.failDisk(d, err)
+	}
+}
+
+// failDisk takes a disk out of service and queues the chunks it held as lost
+func (ms *MultiDiskStorage) failDisk(d *disk, err error) {
+	ms.mu.Lock()
+	if d.err != nil {
+		ms.mu.Unlock()
+		return
+	}
+	d.err = err
+	lost := 0
+	for chunkID, location := range ms.locations {
+		if location == d {
+			ms.lost = append(ms.lost, chunkID)
+			delete(ms.locations, chunkID)
+			delete(ms.sizes, chunkID)
+			lost++
+		}
+	}
+	d.chunkCount = 0
+	d.usedBytes = 0
+	ms.mu.Unlock()
+
+	slog.Error("Data directory failed, serving from the remaining disks", "dir", d.path, "lostChunks", lost, "error", err)
+	// Closing can hang on a dead disk
+	go func() {
+		if err := d.storage.Close(); err != nil {
+			slog.Warn("Failed to close storage of failed data directory", "dir", d.path, "error", err)
+		}
+	}()
+}
+
+// LostChunks returns the chunks of failed disks that are not yet reported to the master
+func (ms *MultiDiskStorage) LostChunks() []string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return append([]string(nil), ms.lost...)
+}
+
+// ReportedLost removes the first n chunks returned by LostChunks from the queue
+func (ms *MultiDiskStorage) ReportedLost(n int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.lost = ms.lost[n:]
+}
+
+// checkAfter probes the disk after an operation on it failed with an error
+// that may come from the disk, and returns the error
+func (ms *MultiDiskStorage) checkAfter(d *disk, err error) error {
+	if err != nil && !errors.Is(err, errInvalidChunkID) && !errors.Is(err, errAppendOffset) && !errors.Is(err, fs.ErrNotExist) {
+		ms.checkDisk(d)
+	}
+	return err
+}
+
+func (ms *MultiDiskStorage) healthy(d *disk) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return d.err == nil
+}
+
+// locate returns the disk holding a chunk, or nil if no healthy disk holds it
+func (ms *MultiDiskStorage) locate(chunkID string) (*disk, error) {
+	if !validChunkID(chunkID) {
+		return nil, errInvalidChunkID
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.locations[chunkID], nil
+}
+
+// place returns the disk a chunk is written to: the disk already holding it, or
+// a new one that is recorded as its location right away, so concurrent writes
+// of the same chunk go to the same disk. placed reports whether the disk is new.
+func (ms *MultiDiskStorage) place(chunkID string) (d *disk, placed bool, err error) {
+	if !validChunkID(chunkID) {
+		return nil, false, errInvalidChunkID
+	}
+	if d, _ := ms.locate(chunkID); d != nil {
+		return d, false, nil
+	}
+
+	var candidates []*disk
+	var weights []uint64
+	var total uint64
+	for _, d := range ms.disks {
+		if !ms.healthy(d) {
+			continue
+		}
+		_, free, err := diskUsage(d.path)
+		if err != nil {
+			ms.checkDisk(d)
+			continue
+		}
+		candidates = append(candidates, d)
+		weights = append(weights, free)
+		total += free
+	}
+	if len(candidates) == 0 {
+		return nil, false, errors.New("no healthy data directory")
+	}
+
+	d = candidates[0]
+	if total > 0 {
+		pick := rand.Uint64() % total
+		for i, weight := range weights {
+			if pick < weight {
+				d = candidates[i]
+				break
+			}
+			pick -= weight
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if existing := ms.locations[chunkID]; existing != nil {
+		return existing, false, nil
+	}
+	ms.locations[chunkID] = d
+	return d, true, nil
+}
+
+// unplace forgets a new location after the write to it failed, unless the chunk got stored anyway
+func (ms *MultiDiskStorage) unplace(d *disk, chunkID string) {
+	if info, err := d.storage.Stat(chunkID); err == nil && info != nil {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		ms.record(d, chunkID, info.Size)
+		return
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.locations[chunkID] == d {
+		delete(ms.locations, chunkID)
+	}
+}
+
+// record sets the location and size of a chunk and updates the usage of its
+// disk. The caller must hold mu.
+func (ms *MultiDiskStorage) record(d *disk, chunkID string, size int64) {
+	ms.locations[chunkID] = d
+	if old, ok := ms.sizes[chunkID]; ok {
+		d.usedBytes -= old
+	} else {
+		d.chunkCount++
+	}
+	d.usedBytes += size
+	ms.sizes[chunkID] = size
+}
+
+// forget removes a chunk from the usage of its disk and drops its location.
+// The caller must hold mu.
+func (ms *MultiDiskStorage) forget(d *disk, chunkID string) {
+	if size, ok := ms.sizes[chunkID]; ok {
+		d.chunkCount--
+		d.usedBytes -= size
+		delete(ms.sizes, chunkID)
+	}
+	delete(ms.locations, chunkID)
+}
+
+// written records the new size of a chunk after a successful write to d
+func (ms *MultiDiskStorage) written(d *disk, chunkID string) error {
+	info, err := d.storage.Stat(chunkID)
+	if err != nil || info == nil {
+		return ms.checkAfter(d, err)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.locations[chunkID] == d {
+		ms.record(d, chunkID, info.Size)
+	}
+	return nil
+}
+
+func (ms *MultiDiskStorage) Store(chunkID string, data []byte) error {
+	return ms.write(chunkID, func(storage ChunkStorage) error {
+		return storage.Store(chunkID, data)
+	})
+}
+
+func (ms *MultiDiskStorage) StoreStream(chunkID string, r io.Reader) error {
+	return ms.write(chunkID, func(storage ChunkStorage) error {
+		return storage.StoreStream(chunkID, r)
+	})
+}
+
+// write stores a chunk on the disk chosen by place
+func (ms *MultiDiskStorage) write(chunkID string, store func(storage ChunkStorage) error) error {
+	d, placed, err := ms.place(chunkID)
+	if err != nil {
+		return err
+	}
+	if err := store(d.storage); err != nil {
+		if placed {
+			ms.unplace(d, chunkID)
+		}
+		return ms.checkAfter(d, err)
+	}
+	return ms.written(d, chunkID)
+}
+
+// Append adds r to a chunk on the disk holding it, or creates the chunk when offset is 0
+func (ms *MultiDiskStorage) Append(chunkID string, offset int64, r io.Reader) error {
+	if offset == 0 {
+		return ms.StoreStream(chunkID, r)
+	}
+	d, err := ms.locate(chunkID)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return errAppendOffset
+	}
+	if err := d.storage.Append(chunkID, offset, r); err != nil {
+		return ms.checkAfter(d, err)
+	}
+	return ms.written(d, chunkID)
+}
+
+func (ms *MultiDiskStorage) Retrieve(chunkID string) ([]byte, error) {
+	d, err := ms.locate(chunkID)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	data, err := d.storage.Retrieve(chunkID)
+	return data, ms.checkAfter(d, err)
+}
+
+// RetrieveStream opens a chunk for reading, or returns nil if it does not exist
+func (ms *MultiDiskStorage) RetrieveStream(chunkID string) (io.ReadSeekCloser, error) {
+	d, err := ms.locate(chunkID)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	chunk, err := d.storage.RetrieveStream(chunkID)
+	return chunk, ms.checkAfter(d, err)
+}
+
+func (ms *MultiDiskStorage) Delete(chunkID string) error {
+	d, err := ms.locate(chunkID)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return &fs.PathError{Op: "delete", Path: chunkID, Err: fs.ErrNotExist}
+	}
+	if err := d.storage.Delete(chunkID); err != nil {
+		return ms.checkAfter(d, err)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.locations[chunkID] == d {
+		ms.forget(d, chunkID)
+	}
+	return nil
+}
+
+func (ms *MultiDiskStorage) Exists(chunkID string) (bool, error) {
+	info, err := ms.Stat(chunkID)
+	return info != nil, err
+}
+
+// Stat returns information about a chunk, or nil if it does not exist
+func (ms *MultiDiskStorage) Stat(chunkID string) (*ChunkInfo, error) {
+	d, err := ms.locate(chunkID)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	info, err := d.storage.Stat(chunkID)
+	return info, ms.checkAfter(d, err)
+}
+
+// List returns the chunks of every healthy disk
+func (ms *MultiDiskStorage) List() ([]ChunkInfo, error) {
+	chunks := make([]ChunkInfo, 0)
+	for _, d := range ms.disks {
+		if !ms.healthy(d) {
+			continue
+		}
+		diskChunks, err := d.storage.List()
+		if err != nil {
+			ms.checkAfter(d, err)
+			if ms.healthy(d) {
+				return nil, err
+			}
+			continue
+		}
+		chunks = append(chunks, diskChunks...)
+	}
+	return chunks, nil
+}
+
+func (ms *MultiDiskStorage) WriteSidecar(chunkID string, sidecar ChunkSidecar) error {
+	d, err := ms.locate(chunkID)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return &fs.PathError{Op: "write sidecar", Path: chunkID, Err: fs.ErrNotExist}
+	}
+	return ms.checkAfter(d, d.storage.WriteSidecar(chunkID, sidecar))
+}
+
+// ReadSidecar returns the sidecar of a chunk, or nil if the chunk has none
+func (ms *MultiDiskStorage) ReadSidecar(chunkID string) (*ChunkSidecar, error) {
+	d, err := ms.locate(chunkID)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	sidecar, err := d.storage.ReadSidecar(chunkID)
+	return sidecar, ms.checkAfter(d, err)
+}
+
+// Status reports the capacity, usage and health of every disk
+func (ms *MultiDiskStorage) Status() []DiskStatus {
+	statuses := make([]DiskStatus, 0, len(ms.disks))
+	for _, d := range ms.disks {
+		status := DiskStatus{Path: d.path, State: DiskStateHealthy}
+		ms.mu.RLock()
+		err := d.err
+		status.ChunkCount = d.chunkCount
+		status.UsedBytes = d.usedBytes
+		ms.mu.RUnlock()
+		if err != nil {
+			status.State = DiskStateFailed
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
+		}
+
+		capacity, free, err := diskUsage(d.path)
+		if err != nil {
+			slog.Warn("Failed to read disk usage", "dir", d.path, "error", err)
+		}
+		status.CapacityBytes = capacity
+		status.FreeBytes = free
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Close stops the health checks and closes the storage of every healthy disk
+func (ms *MultiDiskStorage) Close() error {
+	close(ms.stop)
+	<-ms.done
+
+	var errs []error
+	for _, d := range ms.disks {
+		if ms.healthy(d) {
+			errs = append(errs, d.storage.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
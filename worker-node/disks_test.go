@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// expectUsage checks the chunk count and used bytes that Status reports over all disks
+func expectUsage(t *testing.T, ms *MultiDiskStorage, chunks int, used int64) {
+	t.Helper()
+	var gotChunks int
+	var gotUsed int64
+	for _, status := range ms.Status() {
+		gotChunks += status.ChunkCount
+		gotUsed += status.UsedBytes
+	}
+	if gotChunks != chunks || gotUsed != used {
+		t.Fatalf("usage is %d chunks, %d bytes; want %d chunks, %d bytes", gotChunks, gotUsed, chunks, used)
+	}
+}
+
+func TestMultiDiskUsage(t *testing.T) {
+	for _, engine := range storageEngines {
+		t.Run(engine.name, func(t *testing.T) {
+			dirs := []string{t.TempDir(), t.TempDir()}
+			open := func() *MultiDiskStorage {
+				ms, err := NewMultiDiskStorage(dirs, engine.open, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return ms
+			}
+
+			ms := open()
+			expectUsage(t, ms, 0, 0)
+			must(t, ms.Store("a", chunkData(1, 100)))
+			must(t, ms.StoreStream("b", bytes.NewReader(chunkData(2, 50))))
+			expectUsage(t, ms, 2, 150)
+
+			// Overwrites and appends replace the old size instead of adding to it
+			must(t, ms.Store("a", chunkData(3, 30)))
+			expectUsage(t, ms, 2, 80)
+			must(t, ms.Append("b", 50, bytes.NewReader(chunkData(4, 20))))
+			expectUsage(t, ms, 2, 100)
+			must(t, ms.Append("c", 0, bytes.NewReader(chunkData(5, 10))))
+			expectUsage(t, ms, 3, 110)
+
+			must(t, ms.Delete("a"))
+			expectUsage(t, ms, 2, 80)
+			if err := ms.Delete("a"); err == nil {
+				t.Fatal("deleting a missing chunk succeeded")
+			}
+			expectUsage(t, ms, 2, 80)
+
+			// A restart takes the usage from a scan of the disks
+			must(t, ms.Close())
+			ms = open()
+			defer ms.Close()
+			expectUsage(t, ms, 2, 80)
+		})
+	}
+}
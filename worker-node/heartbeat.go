@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// WorkerStatus is the capacity and load report sent to the master with each
+// heartbeat. The totals only count healthy disks.
+type WorkerStatus struct {
+	ID            string       `json:"id"`
+	Address       string       `json:"address"`
+	CapacityBytes uint64       `json:"capacityBytes"`
+	FreeBytes     uint64       `json:"freeBytes"`
+	UsedBytes     int64        `json:"usedBytes"`
+	ChunkCount    int          `json:"chunkCount"`
+	InFlight      int64        `json:"inFlight"`
+	Disks         []DiskStatus `json:"disks"`
+}
+
+// collectStatus gathers the current disk usage and request load of this worker
+func (ws *WorkerServer) collectStatus() WorkerStatus {
+	status := WorkerStatus{
+		ID:       ws.id,
+		Address:  ws.address,
+		InFlight: atomic.LoadInt64(&ws.inFlight),
+	}
+
+	status.Disks = ws.disks.Status()
+	for _, disk := range status.Disks {
+		if disk.State != DiskStateHealthy {
+			continue
+		}
+		status.CapacityBytes += disk.CapacityBytes
+		status.FreeBytes += disk.FreeBytes
+		status.UsedBytes += disk.UsedBytes
+		status.ChunkCount += disk.ChunkCount
+	}
+	return status
+}
+
+// errNotRegistered is returned by heartbeats the master does not recognise
+var errNotRegistered = errors.New("worker is not registered with the master")
+
+// errHeartbeatRefused is returned by heartbeats the master does not accept from
+// this worker, such as an address change it cannot prove
+var errHeartbeatRefused = errors.New("master refused the heartbeat")
+
+// sendHeartbeat reports the worker status to the master
+func (ws *WorkerServer) sendHeartbeat() error {
+	body, err := json.Marshal(ws.collectStatus())
+	if err != nil {
+		return err
+	}
+
+	url := masterURL("/heartbeat")
+	resp, err := ws.master.Post(url, ContentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotRegistered
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return errHeartbeatRefused
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master returned %s", resp.Status)
+	}
+	return nil
+}
+
+// LostChunkReport tells the master which chunks of this worker were lost with a failed disk
+type LostChunkReport struct {
+	WorkerID string   `json:"workerId"`
+	ChunkIDs []string `json:"chunkIds"`
+}
+
+// reportLostChunks sends the chunks of failed disks to the master, so it can
+// replace them from other replicas. Chunks stay queued until the master accepts them.
+func (ws *WorkerServer) reportLostChunks() error {
+	chunkIDs := ws.disks.LostChunks()
+	if len(chunkIDs) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(LostChunkReport{WorkerID: ws.id, ChunkIDs: chunkIDs})
+	if err != nil {
+		return err
+	}
+
+	url := masterURL("/chunks/lost")
+	resp, err := ws.master.Post(url, ContentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("master returned %s", resp.Status)
+	}
+	ws.disks.ReportedLost(len(chunkIDs))
+	slog.Info("Reported lost chunks to master", "chunks", len(chunkIDs))
+	return nil
+}
+
+// maintainRegistration registers with the master and then sends heartbeats, and
+// any lost chunks, at the given interval. Whenever the master has forgotten this
+// worker, it registers again.
+func (ws *WorkerServer) maintainRegistration(interval time.Duration) {
+	ws.registerWithMaster()
+
+	for !ws.stopping() {
+		err := ws.sendHeartbeat()
+		if errors.Is(err, errNotRegistered) {
+			slog.Warn("Master does not know this worker, registering again")
+			ws.registerWithMaster()
+			continue
+		}
+		if errors.Is(err, errHeartbeatRefused) {
+			refusedByMaster("heartbeat", ws.id, ws.address)
+		}
+		if err != nil {
+			slog.Warn("Heartbeat to master failed", "error", err)
+		} else if err := ws.reportLostChunks(); err != nil {
+			slog.Warn("Failed to report lost chunks to master", "error", err)
+		}
+		ws.sleep(interval)
+	}
+}
+
+// trackInFlight counts requests that are currently being served
+func (ws *WorkerServer) trackInFlight(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&ws.inFlight, 1)
+		defer atomic.AddInt64(&ws.inFlight, -1)
+		next(w, r)
+	}
+}
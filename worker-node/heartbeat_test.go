@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatToHungMasterTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer master.Close()
+	defer close(release)
+
+	oldAddr := MasterAddr
+	MasterAddr = strings.TrimPrefix(master.URL, "http://")
+	defer func() { MasterAddr = oldAddr }()
+
+	disks, err := NewMultiDiskStorage([]string{t.TempDir()}, storageEngines[0].open, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disks.Close()
+	ws := &WorkerServer{storage: disks, disks: disks, id: "w1", master: &http.Client{Timeout: 50 * time.Millisecond}}
+
+	done := make(chan error, 1)
+	go func() { done <- ws.sendHeartbeat() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("heartbeat to a hung master succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat to a hung master did not time out")
+	}
+}
+
+func TestHeartbeatFailsOverToAnotherMaster(t *testing.T) {
+	var heartbeats atomic.Int64
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		heartbeats.Add(1)
+	}))
+	defer master.Close()
+
+	// Nothing listens on the first master any more
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	oldAddr := MasterAddr
+	MasterAddr = down + ", " + strings.TrimPrefix(master.URL, "http://")
+	defer func() { MasterAddr = oldAddr }()
+
+	disks, err := NewMultiDiskStorage([]string{t.TempDir()}, storageEngines[0].open, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disks.Close()
+	failover := newMasterFailover(masterAddrs(), http.DefaultTransport)
+	ws := &WorkerServer{storage: disks, disks: disks, id: "w1", master: &http.Client{Timeout: 5 * time.Second, Transport: failover}}
+
+	for range 2 {
+		if err := ws.sendHeartbeat(); err != nil {
+			t.Fatalf("heartbeat with one master down failed: %v", err)
+		}
+	}
+	if got := heartbeats.Load(); got != 2 {
+		t.Fatalf("reachable master got %d heartbeats, want 2", got)
+	}
+	if got := failover.current.Load(); got != 1 {
+		t.Fatalf("worker sends to master %d first, want the reachable master 1", got)
+	}
+}
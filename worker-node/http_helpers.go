@@ -1,17 +1,98 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync/atomic"
 )
 
-// writeErrorResponse writes an error response with logging
+// writeJSONResponse writes a JSON response with the provided data
+func writeJSONResponse(w http.ResponseWriter, data interface{}) error {
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	return json.NewEncoder(w).Encode(data)
+}
+
+// writeErrorResponse writes an error response. The message is logged with the
+// access log line of the request.
 func writeErrorResponse(w http.ResponseWriter, message string, statusCode int) {
-	log.Printf("Error: %s", message)
+	if recorder := responseRecorder(w); recorder != nil {
+		recorder.errorMessage = message
+	} else {
+		slog.Warn("Request failed", "status", statusCode, "error", message)
+	}
 	http.Error(w, message, statusCode)
 }
 
+// clusterTokenTransport adds the cluster token to requests to the master
+type clusterTokenTransport struct {
+	next http.RoundTripper
+}
+
+func (t clusterTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if ClusterToken == "" {
+		return t.next.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set(ClusterTokenHeader, ClusterToken)
+	return t.next.RoundTrip(r)
+}
+
+// masterFailover sends each request to the master that answered the last one.
+// When it cannot connect, it tries the other masters in turn and sticks with the
+// first that answers. The host of the request URL is replaced, so callers may
+// name any master. Followers forward requests to the Raft leader, so any master
+// of the cluster will do.
+type masterFailover struct {
+	next    http.RoundTripper
+	masters []string
+	current atomic.Int64 // Index of the master to try first
+}
+
+func newMasterFailover(masters []string, next http.RoundTripper) *masterFailover {
+	return &masterFailover{next: next, masters: masters}
+}
+
+func (t *masterFailover) RoundTrip(r *http.Request) (*http.Response, error) {
+	first := int(t.current.Load())
+	var err error
+	for i := range t.masters {
+		n := (first + i) % len(t.masters)
+		req := r.Clone(r.Context())
+		req.URL.Host, req.Host = t.masters[n], ""
+		if i > 0 && r.Body != nil && r.Body != http.NoBody {
+			// The body was sent to the previous master
+			if r.GetBody == nil {
+				return nil, err
+			}
+			if req.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		var resp *http.Response
+		if resp, err = t.next.RoundTrip(req); err == nil {
+			if n != first {
+				slog.Info("Failed over to another master", "master", t.masters[n])
+				t.current.Store(int64(n))
+			}
+			return resp, nil
+		}
+		if r.Context().Err() != nil || len(t.masters) == 1 {
+			return nil, err
+		}
+		slog.Warn("Master unreachable, trying the next one", "master", t.masters[n], "error", err)
+	}
+	return nil, err
+}
+
+// masterURL returns the URL of a path on the master. Requests through ws.master
+// fail over to the other masters.
+func masterURL(path string) string {
+	return "http://" + masterAddrs()[0] + path
+}
+
 // writeSuccessResponse writes a success message response
 func writeSuccessResponse(w http.ResponseWriter, message string) {
 	fmt.Fprintf(w, "%s", message)
@@ -26,6 +107,19 @@ func getRequiredParam(r *http.Request, param string) (string, error) {
 	return value, nil
 }
 
+// getChunkIDParam extracts the chunkID query parameter and rejects IDs that
+// could address files outside the data directory
+func getChunkIDParam(r *http.Request) (string, error) {
+	chunkID, err := getRequiredParam(r, "chunkID")
+	if err != nil {
+		return "", err
+	}
+	if !validChunkID(chunkID) {
+		return "", fmt.Errorf("%w %q", errInvalidChunkID, chunkID)
+	}
+	return chunkID, nil
+}
+
 // validateHTTPMethod checks if the request method matches the expected method
 func validateHTTPMethod(w http.ResponseWriter, r *http.Request, expectedMethod string) bool {
 	if r.Method != expectedMethod {
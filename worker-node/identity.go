@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadOrCreateWorkerID returns the stable ID stored in the data directories,
+// creating a new random UUID on first start. The ID is kept in every directory,
+// so it survives the loss of any one disk. A new ID is preceded by a marker
+// holding legacyID, so the migration of the chunks recorded under it is
+// retried across restarts until the master has done it.
+func loadOrCreateWorkerID(dirs []string, legacyID string) (id string, err error) {
+	created := false
+	var missing []string
+	for _, dir := range dirs {
+		path := filepath.Join(dir, WorkerIDFile)
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			missing = append(missing, path)
+			continue
+		}
+		if err != nil {
+			slog.Warn("Failed to read worker ID", "file", path, "error", err)
+			continue
+		}
+
+		stored := strings.TrimSpace(string(data))
+		switch {
+		case stored == "":
+			return "", fmt.Errorf("worker ID file %s is empty", path)
+		case id == "":
+			id = stored
+		case stored != id:
+			return "", fmt.Errorf("worker ID file %s holds %s, other data directories hold %s", path, stored, id)
+		}
+	}
+
+	if id == "" {
+		if len(missing) == 0 {
+			return "", fmt.Errorf("failed to read the worker ID from any data directory")
+		}
+		id, err = newUUID()
+		if err != nil {
+			return "", err
+		}
+		created = true
+	}
+	written := 0
+	for _, path := range missing {
+		if created {
+			marker := filepath.Join(filepath.Dir(path), LegacyIDFile)
+			if err := os.WriteFile(marker, []byte(legacyID+"\n"), 0644); err != nil {
+				slog.Warn("Failed to store legacy worker ID", "file", marker, "error", err)
+				continue
+			}
+		}
+		if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+			slog.Warn("Failed to store worker ID", "file", path, "error", err)
+			continue
+		}
+		written++
+	}
+	if created && written == 0 {
+		return "", fmt.Errorf("failed to store worker ID in any data directory")
+	}
+	return id, nil
+}
+
+// pendingLegacyID returns the legacy ID whose chunks still have to be migrated
+// to the stable ID, or "" if there is none
+func pendingLegacyID(dirs []string) string {
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, LegacyIDFile))
+		if err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ""
+}
+
+// clearLegacyID removes the migration marker once the master has migrated the chunks
+func clearLegacyID(dirs []string) {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, LegacyIDFile)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to remove legacy worker ID", "file", path, "error", err)
+		}
+	}
+}
+
+// newUUID generates a random version 4 UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,1181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record types of the segment log
+const (
+	recordChunk   byte = 1 // Value is the chunk data
+	recordSidecar byte = 2 // Value is the JSON sidecar of the chunk
+	recordDelete  byte = 3 // Tombstone for the chunk and its sidecar
+	recordSeal    byte = 4 // Last record of a segment that is no longer written
+	recordAppend  byte = 5 // Value is the chunk offset the bytes go to, then the bytes appended to the chunk
+)
+
+// Record header layout: the CRC of the rest of the header and the key, then
+// type, sequence number, modification time, value CRC, key length and value length
+const (
+	recordHeaderSize = 4 + 1 + 8 + 8 + 4 + 2 + 8
+	appendPrefixSize = 8
+	segmentPrefix    = "segment-"
+	segmentSuffix    = ".log"
+	spoolPrefix      = ".spool-"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCompactionStopped is returned by a compaction cut short by Close
+var errCompactionStopped = errors.New("compaction stopped")
+
+// logRecord is the decoded header and key of a segment record
+type logRecord struct {
+	typ      byte
+	seq      uint64
+	modTime  time.Time
+	valueCRC uint32
+	key      string
+	size     int64 // Length of the value
+	offset   int64 // Offset of the value in the segment
+	at       int64 // Chunk offset the bytes of an append record go to
+}
+
+// recordSize is the space a record takes up in its segment
+func (r logRecord) recordSize() int64 {
+	return recordHeaderSize + int64(len(r.key)) + r.size
+}
+
+func (r logRecord) encodeHeader() []byte {
+	buf := make([]byte, recordHeaderSize+len(r.key))
+	buf[4] = r.typ
+	binary.BigEndian.PutUint64(buf[5:], r.seq)
+	binary.BigEndian.PutUint64(buf[13:], uint64(r.modTime.UnixNano()))
+	binary.BigEndian.PutUint32(buf[21:], r.valueCRC)
+	binary.BigEndian.PutUint16(buf[25:], uint16(len(r.key)))
+	binary.BigEndian.PutUint64(buf[27:], uint64(r.size))
+	copy(buf[recordHeaderSize:], r.key)
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+// logEntry locates the latest value of a key in the segments. A chunk that was
+// appended to is made of its chunk record followed by the append records.
+type logEntry struct {
+	segment int
+	record  logRecord
+	length  int64      // Bytes of the record that belong to the value
+	appends []logEntry // Append records that extend the value, oldest first
+}
+
+// sameRecord reports whether two entries point at the same record
+func (e logEntry) sameRecord(other logEntry) bool {
+	return e.segment == other.segment && e.record.offset == other.record.offset
+}
+
+// dataOffset is the offset in the segment of the bytes the record adds to the value
+func (e logEntry) dataOffset() int64 {
+	if e.record.typ == recordAppend {
+		return e.record.offset + appendPrefixSize
+	}
+	return e.record.offset
+}
+
+// parts returns the records the value is made of, in order
+func (e logEntry) parts() []logEntry {
+	head := e
+	head.appends = nil
+	return append([]logEntry{head}, e.appends...)
+}
+
+// size is the length of the value
+func (e logEntry) size() int64 {
+	size := e.length
+	for _, app := range e.appends {
+		size += app.length
+	}
+	return size
+}
+
+// modTime is the time the value was last written
+func (e logEntry) modTime() time.Time {
+	if n := len(e.appends); n > 0 {
+		return e.appends[n-1].record.modTime
+	}
+	return e.record.modTime
+}
+
+// holds reports whether the value is made of other's record
+func (e logEntry) holds(other logEntry) bool {
+	for _, part := range e.parts() {
+		if part.sameRecord(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveRecord returns e with the record of from replaced by the one of to, and
+// whether e held it
+func (e logEntry) moveRecord(from, to logEntry) (logEntry, bool) {
+	if e.sameRecord(from) {
+		e.segment, e.record = to.segment, to.record
+		return e, true
+	}
+	for i, app := range e.appends {
+		if app.sameRecord(from) {
+			e.appends = slices.Clone(e.appends)
+			e.appends[i].segment, e.appends[i].record = to.segment, to.record
+			return e, true
+		}
+	}
+	return e, false
+}
+
+// linkAppend returns the chunk entry extended by an append record, with the
+// bytes past the offset the append starts at cut off, and the records that no
+// longer hold any bytes of the chunk. It fails if the chunk is shorter than the
+// offset.
+func linkAppend(entry, app logEntry) (logEntry, []logEntry, bool) {
+	at := app.record.at
+	if at <= 0 || at > entry.size() {
+		return entry, nil, false
+	}
+	var kept, dropped []logEntry
+	var pos int64
+	for _, part := range entry.parts() {
+		length := part.length
+		if pos >= at {
+			dropped = append(dropped, part)
+		} else {
+			part.length = min(length, at-pos)
+			kept = append(kept, part)
+		}
+		pos += length
+	}
+	app.length = app.record.size - appendPrefixSize
+	linked := kept[0]
+	linked.appends = append(kept[1:], app)
+	return linked, dropped, true
+}
+
+// logSegment tracks the space of one segment file
+type logSegment struct {
+	id     int
+	size   int64  // Bytes written
+	live   int64  // Bytes of the records the index points to, and of tombstones
+	minSeq uint64 // Lowest sequence number of any record, math.MaxUint64 while empty
+}
+
+func (seg *logSegment) deadShare() float64 {
+	if seg.size == 0 {
+		return 0
+	}
+	return float64(seg.size-seg.live) / float64(seg.size)
+}
+
+// LogChunkStorage appends chunks and sidecars as records to large segment files
+// and keeps an in-memory index of where the latest record of each chunk lives.
+// Deletes append tombstones. Sealed segments whose share of overwritten and
+// deleted records reaches the compaction threshold have their live records
+// copied to a new segment and are removed. Tombstones are small and count as
+// live, so they do not make a segment qualify by themselves. Appends to a chunk
+// are written as append records holding only the new bytes, which the index links
+// to the records the chunk already has. The index is rebuilt from the segments on
+// startup, and records torn by a crash are cut off.
+type LogChunkStorage struct {
+	baseDir     string
+	segmentSize int64
+	threshold   float64 // Share of dead bytes at which a sealed segment is compacted
+	syncDir     bool
+
+	mu       sync.RWMutex // Guards the index and the segment table
+	chunks   map[string]logEntry
+	sidecars map[string]logEntry
+	segments map[int]*logSegment
+	nextID   int
+
+	// The active segment is written under writeMu, and replaced under both locks
+	writeMu sync.Mutex
+	active  *os.File
+	current *logSegment
+	seq     uint64
+
+	compactMu sync.Mutex // Serializes compactions
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewLogChunkStorage opens the segments in baseDir, rebuilds the index from them
+// and compacts segments in the background at the given interval
+func NewLogChunkStorage(baseDir string, segmentSize int64, thresholdPercent int, interval time.Duration, syncDir bool) (*LogChunkStorage, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, err
+	}
+	s := &LogChunkStorage{
+		baseDir:     baseDir,
+		segmentSize: segmentSize,
+		threshold:   float64(thresholdPercent) / 100,
+		syncDir:     syncDir,
+		chunks:      make(map[string]logEntry),
+		sidecars:    make(map[string]logEntry),
+		segments:    make(map[int]*logSegment),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if err := s.removeSpoolFiles(); err != nil {
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("failed to recover segments: %v", err)
+	}
+	if err := s.openSegment(); err != nil {
+		return nil, err
+	}
+
+	go s.compactLoop(interval)
+	return s, nil
+}
+
+func (s *LogChunkStorage) segmentPath(id int) string {
+	return filepath.Join(s.baseDir, fmt.Sprintf("%s%08d%s", segmentPrefix, id, segmentSuffix))
+}
+
+// removeSpoolFiles deletes the leftovers of writes interrupted by a crash
+func (s *LogChunkStorage) removeSpoolFiles() error {
+	spools, err := filepath.Glob(filepath.Join(s.baseDir, spoolPrefix+"*"+tempFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range spools {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(spools) > 0 {
+		slog.Info("Removed unfinished chunk writes", "files", len(spools))
+	}
+	return nil
+}
+
+// recover rebuilds the index from every segment. The latest record of a key
+// wins; a tombstone removes the chunk and sidecar records older than it. Append
+// records newer than the chunk record are then linked in the order they were
+// written, as they were when the worker ran.
+func (s *LogChunkStorage) recover() error {
+	paths, err := filepath.Glob(filepath.Join(s.baseDir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+
+	deleted := make(map[string]uint64)
+	appends := make(map[string][]logEntry)
+	newer := func(index map[string]logEntry, id int, rec logRecord) {
+		if current, ok := index[rec.key]; !ok || rec.seq > current.record.seq {
+			index[rec.key] = logEntry{segment: id, record: rec, length: rec.size}
+		}
+	}
+	for _, path := range paths {
+		var id int
+		name := filepath.Base(path)
+		if _, err := fmt.Sscanf(strings.TrimPrefix(name, segmentPrefix), "%d", &id); err != nil {
+			slog.Warn("Ignoring file that is not a segment", "file", name)
+			continue
+		}
+		records, err := s.recoverSegment(id)
+		if err != nil {
+			return fmt.Errorf("segment %d: %v", id, err)
+		}
+		s.nextID = max(s.nextID, id+1)
+		if len(records) == 0 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		seg := &logSegment{id: id, minSeq: math.MaxUint64}
+		s.segments[id] = seg
+		for _, rec := range records {
+			seg.size = rec.offset + rec.size
+			seg.minSeq = min(seg.minSeq, rec.seq)
+			s.seq = max(s.seq, rec.seq)
+			switch rec.typ {
+			case recordChunk:
+				newer(s.chunks, id, rec)
+			case recordSidecar:
+				newer(s.sidecars, id, rec)
+			case recordAppend:
+				appends[rec.key] = append(appends[rec.key], logEntry{segment: id, record: rec})
+			case recordDelete:
+				deleted[rec.key] = max(deleted[rec.key], rec.seq)
+				seg.live += rec.recordSize()
+			}
+		}
+		// The seal follows the last record
+		seg.size += recordHeaderSize
+	}
+
+	for key, seq := range deleted {
+		if entry, ok := s.chunks[key]; ok && entry.record.seq < seq {
+			delete(s.chunks, key)
+		}
+		if entry, ok := s.sidecars[key]; ok && entry.record.seq < seq {
+			delete(s.sidecars, key)
+		}
+	}
+	for key, records := range appends {
+		sort.Slice(records, func(i, j int) bool { return records[i].record.seq < records[j].record.seq })
+		for _, app := range records {
+			entry, ok := s.chunks[key]
+			if !ok || app.record.seq < entry.record.seq {
+				continue
+			}
+			if linked, _, ok := linkAppend(entry, app); ok {
+				s.chunks[key] = linked
+			}
+		}
+	}
+	for _, index := range []map[string]logEntry{s.chunks, s.sidecars} {
+		for _, entry := range index {
+			for _, part := range entry.parts() {
+				s.segments[part.segment].live += part.record.recordSize()
+			}
+		}
+	}
+
+	if len(s.segments) > 0 {
+		slog.Info("Recovered chunk segments", "segments", len(s.segments), "chunks", len(s.chunks))
+	}
+	return nil
+}
+
+// recoverSegment returns the records of a segment, seals included. A segment
+// that does not end with a seal was being written when the worker stopped: its
+// values are verified, anything after the last intact record is cut off and the
+// segment is sealed.
+func (s *LogChunkStorage) recoverSegment(id int) ([]logRecord, error) {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, end, err := scanSegment(f, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && records[len(records)-1].typ == recordSeal {
+		return dataRecords(records), nil
+	}
+
+	records, end, err = scanSegment(f, true)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > end {
+		slog.Warn("Cutting off torn records at the end of a segment", "segment", id, "offset", end, "bytes", info.Size()-end)
+	}
+	records = dataRecords(records)
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	if err := f.Truncate(end); err != nil {
+		return nil, err
+	}
+	seal := logRecord{typ: recordSeal, modTime: time.Now()}
+	if _, err := f.WriteAt(seal.encodeHeader(), end); err != nil {
+		return nil, err
+	}
+	return records, f.Sync()
+}
+
+// dataRecords drops the seals from records
+func dataRecords(records []logRecord) []logRecord {
+	kept := records[:0]
+	for _, rec := range records {
+		if rec.typ != recordSeal {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// scanSegment decodes the records of a segment up to the first one that is
+// incomplete or corrupt, and returns them with the offset where they end. With
+// verify set the values are read and checked against their CRC as well.
+func scanSegment(f *os.File, verify bool) ([]logRecord, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	fileSize := info.Size()
+
+	var records []logRecord
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for offset+recordHeaderSize <= fileSize {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return nil, 0, err
+		}
+		keyLen := int64(binary.BigEndian.Uint16(header[25:]))
+		rec := logRecord{
+			typ:      header[4],
+			seq:      binary.BigEndian.Uint64(header[5:]),
+			modTime:  time.Unix(0, int64(binary.BigEndian.Uint64(header[13:]))),
+			valueCRC: binary.BigEndian.Uint32(header[21:]),
+			size:     int64(binary.BigEndian.Uint64(header[27:])),
+			offset:   offset + recordHeaderSize + keyLen,
+		}
+		if rec.typ < recordChunk || rec.typ > recordAppend || keyLen > MaxChunkIDLength ||
+			rec.size < 0 || rec.offset+rec.size > fileSize {
+			break
+		}
+
+		key := make([]byte, keyLen)
+		if _, err := f.ReadAt(key, offset+recordHeaderSize); err != nil {
+			return nil, 0, err
+		}
+		crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, key)
+		if crc != binary.BigEndian.Uint32(header) {
+			break
+		}
+		rec.key = string(key)
+		if rec.typ != recordSeal && !validChunkID(rec.key) {
+			break
+		}
+		if rec.typ == recordAppend {
+			if rec.size < appendPrefixSize {
+				break
+			}
+			prefix := make([]byte, appendPrefixSize)
+			if _, err := f.ReadAt(prefix, rec.offset); err != nil {
+				return nil, 0, err
+			}
+			rec.at = int64(binary.BigEndian.Uint64(prefix))
+		}
+
+		if verify && rec.size > 0 {
+			hash := crc32.New(crcTable)
+			if _, err := io.Copy(hash, io.NewSectionReader(f, rec.offset, rec.size)); err != nil {
+				return nil, 0, err
+			}
+			if hash.Sum32() != rec.valueCRC {
+				break
+			}
+		}
+
+		records = append(records, rec)
+		offset = rec.offset + rec.size
+		if rec.typ == recordSeal {
+			break
+		}
+	}
+	return records, offset, nil
+}
+
+// openSegment starts a new active segment. The caller holds writeMu, or is the constructor.
+func (s *LogChunkStorage) openSegment() error {
+	id := s.allocateID()
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if s.syncDir {
+		if err := syncDir(s.baseDir); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = f
+	s.current = &logSegment{id: id, minSeq: math.MaxUint64}
+	s.segments[id] = s.current
+	return nil
+}
+
+// sealSegment marks the active segment as complete and closes it. An empty
+// segment is removed instead. The caller holds writeMu.
+func (s *LogChunkStorage) sealSegment() error {
+	f, seg := s.active, s.current
+	if f == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.active, s.current = nil, nil
+	s.mu.Unlock()
+
+	if seg.size == 0 {
+		f.Close()
+		s.mu.Lock()
+		delete(s.segments, seg.id)
+		s.mu.Unlock()
+		return os.Remove(f.Name())
+	}
+
+	seal := logRecord{typ: recordSeal, modTime: time.Now()}
+	_, err := f.WriteAt(seal.encodeHeader(), seg.size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	s.mu.Lock()
+	seg.size += recordHeaderSize
+	s.mu.Unlock()
+	return err
+}
+
+// appendRecord writes rec with rec.size bytes of value from r to the active
+// segment, syncs it and points the index at it. Records are numbered in the
+// order they are written, and the index is updated in the same order. An append
+// record that does not fit the chunk any more is left dead, with errAppendOffset.
+func (s *LogChunkStorage) appendRecord(rec logRecord, r io.Reader) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	typ, key, size := rec.typ, rec.key, rec.size
+	rec.seq, rec.modTime = s.seq+1, time.Now()
+	if s.current != nil && s.current.size > 0 && s.current.size+rec.recordSize()+recordHeaderSize > s.segmentSize {
+		if err := s.sealSegment(); err != nil {
+			slog.Warn("Failed to seal segment", "error", err)
+		}
+	}
+	if s.active == nil {
+		if err := s.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	f, seg := s.active, s.current
+	start := seg.size
+	rec.offset = start + recordHeaderSize + int64(len(key))
+	err := s.writeRecord(f, rec, r)
+	if err != nil {
+		// Cut the partial record off, so later records are not lost behind it
+		if truncErr := f.Truncate(start); truncErr != nil {
+			slog.Error("Failed to cut off a partial record, starting a new segment", "segment", seg.id, "error", truncErr)
+			f.Close()
+			s.mu.Lock()
+			s.active, s.current = nil, nil
+			s.mu.Unlock()
+		}
+		return err
+	}
+	s.seq = rec.seq
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seg.size = rec.offset + size
+	seg.minSeq = min(seg.minSeq, rec.seq)
+	switch typ {
+	case recordChunk:
+		s.setEntry(s.chunks, logEntry{segment: seg.id, record: rec, length: size})
+	case recordSidecar:
+		s.setEntry(s.sidecars, logEntry{segment: seg.id, record: rec, length: size})
+	case recordAppend:
+		entry, ok := s.chunks[key]
+		if !ok {
+			return errAppendOffset
+		}
+		linked, dropped, ok := linkAppend(entry, logEntry{segment: seg.id, record: rec})
+		if !ok {
+			return errAppendOffset
+		}
+		s.chunks[key] = linked
+		seg.live += rec.recordSize()
+		for _, part := range dropped {
+			if old := s.segments[part.segment]; old != nil {
+				old.live -= part.record.recordSize()
+			}
+		}
+	case recordDelete:
+		s.removeEntry(s.chunks, key)
+		s.removeEntry(s.sidecars, key)
+		seg.live += rec.recordSize()
+	}
+	return nil
+}
+
+// writeRecord writes the header, key and value of rec at its place in f and syncs f
+func (s *LogChunkStorage) writeRecord(f *os.File, rec logRecord, r io.Reader) error {
+	header := rec.encodeHeader()
+	if _, err := f.WriteAt(header, rec.offset-int64(len(header))); err != nil {
+		return err
+	}
+	if rec.size > 0 {
+		n, err := io.Copy(io.NewOffsetWriter(f, rec.offset), io.LimitReader(r, rec.size))
+		if err != nil {
+			return err
+		}
+		if n != rec.size {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return f.Sync()
+}
+
+// setEntry points the index at a new record. The caller holds mu.
+func (s *LogChunkStorage) setEntry(index map[string]logEntry, entry logEntry) {
+	s.removeEntry(index, entry.record.key)
+	index[entry.record.key] = entry
+	s.segments[entry.segment].live += entry.record.recordSize()
+}
+
+// removeEntry drops a key from the index. The caller holds mu.
+func (s *LogChunkStorage) removeEntry(index map[string]logEntry, key string) {
+	if old, ok := index[key]; ok {
+		for _, part := range old.parts() {
+			if seg := s.segments[part.segment]; seg != nil {
+				seg.live -= part.record.recordSize()
+			}
+		}
+		delete(index, key)
+	}
+}
+
+func (s *LogChunkStorage) Store(chunkID string, data []byte) error {
+	if !validChunkID(chunkID) {
+		return errInvalidChunkID
+	}
+	rec := logRecord{typ: recordChunk, key: chunkID, size: int64(len(data)), valueCRC: crc32.Checksum(data, crcTable)}
+	return s.appendRecord(rec, bytes.NewReader(data))
+}
+
+// StoreStream spools r to a temp file first, so the size and CRC of the record
+// are known before it is written and slow uploads do not hold up other writes
+func (s *LogChunkStorage) StoreStream(chunkID string, r io.Reader) error {
+	if !validChunkID(chunkID) {
+		return errInvalidChunkID
+	}
+	return s.spool(r, func(spool *os.File, size int64, crc uint32) error {
+		return s.appendRecord(logRecord{typ: recordChunk, key: chunkID, size: size, valueCRC: crc}, spool)
+	})
+}
+
+// spool copies r to a temp file and calls write with the file rewound
+func (s *LogChunkStorage) spool(r io.Reader, write func(spool *os.File, size int64, crc uint32) error) error {
+	f, err := os.CreateTemp(s.baseDir, spoolPrefix+"*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := crc32.New(crcTable)
+	size, err := io.Copy(io.MultiWriter(f, hash), r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return write(f, size, hash.Sum32())
+}
+
+// Append adds r to a chunk holding at least offset bytes, or creates the chunk
+// when offset is 0. Only r is written, as an append record that the index links
+// to the records the chunk is made of; bytes past offset are cut off the chunk
+// when the record is linked. A failed append leaves the chunk unchanged.
+func (s *LogChunkStorage) Append(chunkID string, offset int64, r io.Reader) error {
+	if offset == 0 {
+		return s.StoreStream(chunkID, r)
+	}
+	info, err := s.Stat(chunkID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.Size < offset {
+		return errAppendOffset
+	}
+	prefix := binary.BigEndian.AppendUint64(nil, uint64(offset))
+	return s.spool(io.MultiReader(bytes.NewReader(prefix), r), func(spool *os.File, size int64, crc uint32) error {
+		return s.appendRecord(logRecord{typ: recordAppend, key: chunkID, size: size, valueCRC: crc, at: offset}, spool)
+	})
+}
+
+func (s *LogChunkStorage) Retrieve(chunkID string) ([]byte, error) {
+	chunk, err := s.RetrieveStream(chunkID)
+	if err != nil || chunk == nil {
+		return nil, err
+	}
+	defer chunk.Close()
+	return io.ReadAll(chunk)
+}
+
+// segmentReader reads one value from its own handles on the segments, so
+// compaction can remove a segment while the value is still being read
+type segmentReader struct {
+	*io.SectionReader
+	files []*os.File
+}
+
+func (r *segmentReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// valuePart is the part of a value held by one record
+type valuePart struct {
+	*io.SectionReader
+	start int64 // Offset of the part in the value
+}
+
+// partsReader reads a value that is spread over several records
+type partsReader []valuePart
+
+func (p partsReader) ReadAt(buf []byte, off int64) (int, error) {
+	var n int
+	for _, part := range p {
+		end := part.start + part.Size()
+		if len(buf) == 0 {
+			break
+		}
+		if off >= end {
+			continue
+		}
+		want := min(int64(len(buf)), end-off)
+		read, err := part.ReadAt(buf[:want], off-part.start)
+		n += read
+		if int64(read) < want {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		buf, off = buf[read:], off+int64(read)
+	}
+	if len(buf) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// openValue opens the value of a key, or returns nil if the key is not in the index
+func (s *LogChunkStorage) openValue(index map[string]logEntry, key string) (*segmentReader, error) {
+	if !validChunkID(key) {
+		return nil, errInvalidChunkID
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := index[key]
+	if !ok {
+		return nil, nil
+	}
+	value := &segmentReader{}
+	files := make(map[int]*os.File)
+	var parts partsReader
+	var start int64
+	for _, part := range entry.parts() {
+		f, ok := files[part.segment]
+		if !ok {
+			var err error
+			if f, err = os.Open(s.segmentPath(part.segment)); err != nil {
+				value.Close()
+				return nil, err
+			}
+			files[part.segment] = f
+			value.files = append(value.files, f)
+		}
+		parts = append(parts, valuePart{SectionReader: io.NewSectionReader(f, part.dataOffset(), part.length), start: start})
+		start += part.length
+	}
+	if len(parts) == 1 {
+		value.SectionReader = parts[0].SectionReader
+	} else {
+		value.SectionReader = io.NewSectionReader(parts, 0, start)
+	}
+	return value, nil
+}
+
+// RetrieveStream opens a chunk for reading, or returns nil if it does not exist
+func (s *LogChunkStorage) RetrieveStream(chunkID string) (io.ReadSeekCloser, error) {
+	chunk, err := s.openValue(s.chunks, chunkID)
+	if err != nil || chunk == nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// Delete writes a tombstone for the chunk and its sidecar
+func (s *LogChunkStorage) Delete(chunkID string) error {
+	exists, err := s.Exists(chunkID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &fs.PathError{Op: "delete", Path: chunkID, Err: fs.ErrNotExist}
+	}
+	return s.appendRecord(logRecord{typ: recordDelete, key: chunkID}, nil)
+}
+
+func (s *LogChunkStorage) Exists(chunkID string) (bool, error) {
+	info, err := s.Stat(chunkID)
+	return info != nil, err
+}
+
+// Stat returns information about a chunk, or nil if it does not exist
+func (s *LogChunkStorage) Stat(chunkID string) (*ChunkInfo, error) {
+	if !validChunkID(chunkID) {
+		return nil, errInvalidChunkID
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.chunks[chunkID]
+	if !ok {
+		return nil, nil
+	}
+	return &ChunkInfo{ChunkID: chunkID, Size: entry.size(), ModTime: entry.modTime()}, nil
+}
+
+// List returns every chunk in the index
+func (s *LogChunkStorage) List() ([]ChunkInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chunks := make([]ChunkInfo, 0, len(s.chunks))
+	for chunkID, entry := range s.chunks {
+		chunks = append(chunks, ChunkInfo{ChunkID: chunkID, Size: entry.size(), ModTime: entry.modTime()})
+	}
+	return chunks, nil
+}
+
+func (s *LogChunkStorage) WriteSidecar(chunkID string, sidecar ChunkSidecar) error {
+	if !validChunkID(chunkID) {
+		return errInvalidChunkID
+	}
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	rec := logRecord{typ: recordSidecar, key: chunkID, size: int64(len(data)), valueCRC: crc32.Checksum(data, crcTable)}
+	return s.appendRecord(rec, bytes.NewReader(data))
+}
+
+// ReadSidecar returns the sidecar of a chunk, or nil if the chunk has none
+func (s *LogChunkStorage) ReadSidecar(chunkID string) (*ChunkSidecar, error) {
+	value, err := s.openValue(s.sidecars, chunkID)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	defer value.Close()
+
+	var sidecar ChunkSidecar
+	if err := json.NewDecoder(value).Decode(&sidecar); err != nil {
+		return nil, err
+	}
+	return &sidecar, nil
+}
+
+// Close stops compaction and seals the active segment
+func (s *LogChunkStorage) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.sealSegment()
+}
+
+// compactLoop compacts segments at the given interval until Close is called
+func (s *LogChunkStorage) compactLoop(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		compacted, reclaimed, err := s.Compact()
+		if err != nil {
+			if !errors.Is(err, errCompactionStopped) {
+				slog.Error("Segment compaction failed", "error", err)
+			}
+			continue
+		}
+		if compacted > 0 {
+			slog.Info("Compacted segments", "segments", compacted, "reclaimedBytes", reclaimed)
+		}
+	}
+}
+
+// compactionMove records a live record copied by compaction
+type compactionMove struct {
+	index    map[string]logEntry
+	from, to logEntry
+}
+
+// Compact copies the live records of the sealed segments whose dead share reaches
+// the threshold to new segments and removes the old ones. Tombstones are kept
+// while an older segment outside the compaction may hold a record they delete.
+// It returns the number of segments removed and the bytes reclaimed.
+func (s *LogChunkStorage) Compact() (int, int64, error) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	// Segments created from here on only hold records newer than any seen so far
+	s.mu.RLock()
+	var candidates []int
+	var before int64
+	oldestOutside := uint64(math.MaxUint64)
+	for id, seg := range s.segments {
+		if seg != s.current && seg.deadShare() >= s.threshold {
+			candidates = append(candidates, id)
+			before += seg.size
+		} else {
+			oldestOutside = min(oldestOutside, seg.minSeq)
+		}
+	}
+	s.mu.RUnlock()
+	if len(candidates) == 0 {
+		return 0, 0, nil
+	}
+	sort.Ints(candidates)
+
+	c := &compaction{storage: s}
+	err := c.run(candidates, oldestOutside)
+	if err == nil {
+		err = c.finish()
+	}
+	if err != nil {
+		c.abort()
+		return 0, 0, err
+	}
+
+	// Records that changed during the copy stay where they are
+	s.mu.Lock()
+	for _, seg := range c.outputs {
+		s.segments[seg.id] = seg
+	}
+	var after int64
+	for _, move := range c.moves {
+		key := move.from.record.key
+		if current, ok := move.index[key]; ok {
+			if moved, held := current.moveRecord(move.from, move.to); held {
+				move.index[key] = moved
+				s.segments[move.to.segment].live += move.to.record.recordSize()
+			}
+		}
+	}
+	for _, seg := range c.outputs {
+		after += seg.size
+	}
+	for _, id := range candidates {
+		delete(s.segments, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range candidates {
+		if err := os.Remove(s.segmentPath(id)); err != nil {
+			slog.Warn("Failed to remove compacted segment", "segment", id, "error", err)
+		}
+	}
+	if s.syncDir {
+		if err := syncDir(s.baseDir); err != nil {
+			return 0, 0, err
+		}
+	}
+	compactedBytesTotal.Add(float64(before - after))
+	return len(candidates), before - after, nil
+}
+
+// compaction copies records into new segments
+type compaction struct {
+	storage *LogChunkStorage
+	outputs []*logSegment
+	moves   []compactionMove
+	file    *os.File
+}
+
+// run copies the records of the candidate segments that are still needed
+func (c *compaction) run(candidates []int, oldestOutside uint64) error {
+	s := c.storage
+	for _, id := range candidates {
+		f, err := os.Open(s.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		records, _, err := scanSegment(f, false)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		for _, rec := range records {
+			select {
+			case <-s.stop:
+				f.Close()
+				return errCompactionStopped
+			default:
+			}
+
+			var index map[string]logEntry
+			switch rec.typ {
+			case recordChunk, recordAppend:
+				index = s.chunks
+			case recordSidecar:
+				index = s.sidecars
+			case recordDelete:
+				if rec.seq < oldestOutside {
+					continue
+				}
+			default:
+				continue
+			}
+			from := logEntry{segment: id, record: rec}
+			if index != nil {
+				s.mu.RLock()
+				current, ok := index[rec.key]
+				s.mu.RUnlock()
+				if !ok || !current.holds(from) {
+					continue
+				}
+			}
+
+			to, err := c.copyRecord(f, rec)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("failed to copy record of %s from segment %d: %v", rec.key, id, err)
+			}
+			if index != nil {
+				c.moves = append(c.moves, compactionMove{index: index, from: from, to: to})
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// copyRecord appends a record read from f to the current output segment and
+// checks its value on the way
+func (c *compaction) copyRecord(f *os.File, rec logRecord) (logEntry, error) {
+	s := c.storage
+	seg := c.output()
+	if c.file != nil && seg.size > 0 && seg.size+rec.recordSize()+recordHeaderSize > s.segmentSize {
+		if err := c.seal(); err != nil {
+			return logEntry{}, err
+		}
+	}
+	if c.file == nil {
+		id := s.allocateID()
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return logEntry{}, err
+		}
+		c.file = file
+		c.outputs = append(c.outputs, &logSegment{id: id, minSeq: math.MaxUint64})
+		seg = c.output()
+	}
+
+	hash := crc32.New(crcTable)
+	value := io.TeeReader(io.NewSectionReader(f, rec.offset, rec.size), hash)
+	moved := rec
+	moved.offset = seg.size + recordHeaderSize + int64(len(rec.key))
+	header := moved.encodeHeader()
+	if _, err := c.file.WriteAt(header, seg.size); err != nil {
+		return logEntry{}, err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(c.file, moved.offset), value); err != nil {
+		return logEntry{}, err
+	}
+	if hash.Sum32() != rec.valueCRC {
+		return logEntry{}, errors.New("value does not match its checksum")
+	}
+
+	seg.size = moved.offset + moved.size
+	seg.minSeq = min(seg.minSeq, moved.seq)
+	if moved.typ == recordDelete {
+		seg.live += moved.recordSize()
+	}
+	return logEntry{segment: seg.id, record: moved}, nil
+}
+
+// output returns the segment being written, or nil before the first record
+func (c *compaction) output() *logSegment {
+	if len(c.outputs) == 0 || c.file == nil {
+		return nil
+	}
+	return c.outputs[len(c.outputs)-1]
+}
+
+// seal completes the output segment being written
+func (c *compaction) seal() error {
+	seg := c.output()
+	seal := logRecord{typ: recordSeal, modTime: time.Now()}
+	_, err := c.file.WriteAt(seal.encodeHeader(), seg.size)
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file = nil
+	seg.size += recordHeaderSize
+	return err
+}
+
+// finish seals the last output segment and makes the outputs durable
+func (c *compaction) finish() error {
+	if c.file != nil {
+		if err := c.seal(); err != nil {
+			return err
+		}
+	}
+	if c.storage.syncDir {
+		return syncDir(c.storage.baseDir)
+	}
+	return nil
+}
+
+// abort removes the output segments of a failed compaction
+func (c *compaction) abort() {
+	if c.file != nil {
+		c.file.Close()
+	}
+	for _, seg := range c.outputs {
+		os.Remove(c.storage.segmentPath(seg.id))
+	}
+}
+
+// allocateID reserves the ID of a new segment
+func (s *LogChunkStorage) allocateID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID++
+	return id
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		redacted bool
+	}{
+		{"Authorization", true},
+		{"Proxy-Authorization", true},
+		{"Cookie", true},
+		{"Set-Cookie", true},
+		{"X-Api-Key", true},
+		{ClusterTokenHeader, true},
+		{"x-frostbyte-cluster-token", true},
+		{RequestIDHeader, false},
+		{"Content-Type", false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set(test.name, "secret-value")
+		got := redactHeaders(header)[http.CanonicalHeaderKey(test.name)]
+		if redacted := got == "[REDACTED]"; redacted != test.redacted {
+			t.Errorf("header %s logged as %q, redacted %t, want %t", test.name, got, redacted, test.redacted)
+		}
+	}
+}
+
+// captureLogs sends the log to a buffer at debug level until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestLogRequestsRedactsSensitiveHeaders(t *testing.T) {
+	logs := captureLogs(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/get?chunkID=c", nil)
+	for name := range sensitiveHeaders {
+		r.Header.Set(name, "secret-"+name)
+	}
+	r.Header.Set("Content-Type", "visible-value")
+	logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), r)
+
+	for name := range sensitiveHeaders {
+		if strings.Contains(logs.String(), "secret-"+name) {
+			t.Errorf("value of %s written to the log", name)
+		}
+	}
+	if !strings.Contains(logs.String(), "[REDACTED]") || !strings.Contains(logs.String(), "visible-value") {
+		t.Fatalf("request headers missing from the log: %s", logs)
+	}
+}
+
+func TestLogRequestsKeepsTheMastersRequestID(t *testing.T) {
+	logs := captureLogs(t)
+	var seen string
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/store?chunkID=c", nil)
+	r.Header.Set(RequestIDHeader, "from-master")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if seen != "from-master" || w.Header().Get(RequestIDHeader) != "from-master" {
+		t.Fatalf("request ID of the master became %q in the handler and %q in the response", seen, w.Header().Get(RequestIDHeader))
+	}
+	if !strings.Contains(logs.String(), `"request_id":"from-master"`) {
+		t.Fatalf("request ID of the master missing from the log: %s", logs)
+	}
+
+	// An ID that is not safe to log is replaced
+	r = httptest.NewRequest(http.MethodPost, "/store?chunkID=c", nil)
+	r.Header.Set(RequestIDHeader, "bad id\nlevel=ERROR")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !validRequestID(seen) || seen != w.Header().Get(RequestIDHeader) {
+		t.Fatalf("unsafe request ID replaced by %q, response carries %q", seen, w.Header().Get(RequestIDHeader))
+	}
+}
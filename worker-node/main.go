@@ -1,25 +1,71 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
-
-	_ "net/http/pprof"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	go func() {
-		log.Println("pprof listening on :6060")
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-	}()
+	config, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := setupLogging(LogFormat, LogLevel); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	go servePprof(PprofAddr)
 
-	server, err := NewWorkerServer("./chunks")
+	server, err := NewWorkerServer(dataDirs(), config)
 	if err != nil {
-		log.Fatalf("Failed to create worker server: %v", err)
+		fatal("Failed to create worker server", "error", err)
 	}
 	defer server.Close()
 
-	if err := server.Start(DefaultWorkerPort); err != nil {
-		log.Fatalf("Failed to start worker server: %v", err)
+	shutdownTracing, err := initTracing(context.Background(), server.id)
+	if err != nil {
+		fatal("Failed to set up tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Start(WorkerPort)
+	}()
+
+	select {
+	case err := <-served:
+		fatal("Failed to start worker server", "error", err)
+	case <-ctx.Done():
 	}
+
+	slog.Info("Shutting down", "timeout", ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown was not graceful", "error", err)
+	}
+	slog.Info("Worker stopped", "worker", server.id)
+}
+
+// servePprof serves the profiling endpoints on a mux of their own, so the pprof
+// address exposes nothing but profiles
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	slog.Info("pprof listening", "addr", addr)
+	slog.Error("pprof server stopped", "error", http.ListenAndServe(addr, mux))
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	chunkOperationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frostbyte_worker",
+		Name:      "chunk_operations_total",
+		Help:      "Chunk requests by operation and HTTP status code.",
+	}, []string{"operation", "code"})
+
+	chunkOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frostbyte_worker",
+		Name:      "chunk_operation_duration_seconds",
+		Help:      "Duration of chunk requests by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"operation"})
+
+	bytesStoredTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "frostbyte_worker",
+		Name:      "bytes_stored_total",
+		Help:      "Chunk bytes written to disk.",
+	})
+
+	bytesServedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "frostbyte_worker",
+		Name:      "bytes_served_total",
+		Help:      "Chunk bytes sent to the master.",
+	})
+
+	compactedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "frostbyte_worker",
+		Name:      "segment_compacted_bytes_total",
+		Help:      "Segment bytes reclaimed by compaction of the log storage engine.",
+	})
+)
+
+// instrumentChunkOperation counts and times the requests of one chunk operation
+func instrumentChunkOperation(operation string, next http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"operation": operation}
+	handler := promhttp.InstrumentHandlerCounter(chunkOperationsTotal.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(chunkOperationDuration.MustCurryWith(labels), next))
+	return handler.ServeHTTP
+}
+
+// statusCollector reports disk usage, stored chunks and load at scrape time,
+// from the same status the worker sends with its heartbeats
+type statusCollector struct {
+	worker        *WorkerServer
+	capacityBytes *prometheus.Desc
+	freeBytes     *prometheus.Desc
+	usedBytes     *prometheus.Desc
+	chunks        *prometheus.Desc
+	inFlight      *prometheus.Desc
+	disks         *prometheus.Desc
+}
+
+func newStatusCollector(ws *WorkerServer) *statusCollector {
+	return &statusCollector{
+		worker:        ws,
+		capacityBytes: prometheus.NewDesc("frostbyte_worker_disk_capacity_bytes", "Capacity of the healthy disks holding the chunks.", nil, nil),
+		freeBytes:     prometheus.NewDesc("frostbyte_worker_disk_free_bytes", "Free space on the healthy disks holding the chunks.", nil, nil),
+		usedBytes:     prometheus.NewDesc("frostbyte_worker_chunk_bytes", "Bytes of chunk data stored.", nil, nil),
+		chunks:        prometheus.NewDesc("frostbyte_worker_chunks", "Number of chunks stored.", nil, nil),
+		inFlight:      prometheus.NewDesc("frostbyte_worker_in_flight_requests", "Chunk requests currently being served.", nil, nil),
+		disks:         prometheus.NewDesc("frostbyte_worker_disks", "Data directories by state.", []string{"state"}, nil),
+	}
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.capacityBytes
+	ch <- c.freeBytes
+	ch <- c.usedBytes
+	ch <- c.chunks
+	ch <- c.inFlight
+	ch <- c.disks
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	status := c.worker.collectStatus()
+	ch <- prometheus.MustNewConstMetric(c.capacityBytes, prometheus.GaugeValue, float64(status.CapacityBytes))
+	ch <- prometheus.MustNewConstMetric(c.freeBytes, prometheus.GaugeValue, float64(status.FreeBytes))
+	ch <- prometheus.MustNewConstMetric(c.usedBytes, prometheus.GaugeValue, float64(status.UsedBytes))
+	ch <- prometheus.MustNewConstMetric(c.chunks, prometheus.GaugeValue, float64(status.ChunkCount))
+	ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(status.InFlight))
+
+	states := map[string]int{DiskStateHealthy: 0, DiskStateFailed: 0}
+	for _, disk := range status.Disks {
+		states[disk.State]++
+	}
+	for state, count := range states {
+		ch <- prometheus.MustNewConstMetric(c.disks, prometheus.GaugeValue, float64(count), state)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsEndpointReportsWorkerStatus(t *testing.T) {
+	disks, err := NewMultiDiskStorage([]string{t.TempDir()}, storageEngines[0].open, time.Hour)
+	must(t, err)
+	defer disks.Close()
+	ws := &WorkerServer{storage: disks, disks: disks, mux: http.NewServeMux()}
+	ws.setupRoutes()
+	collector := newStatusCollector(ws)
+	must(t, prometheus.Register(collector))
+	t.Cleanup(func() { prometheus.Unregister(collector) })
+
+	w := httptest.NewRecorder()
+	ws.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/store?chunkID=scraped", bytes.NewReader(chunkData(1, 100))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("store returned %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	ws.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"frostbyte_worker_chunks 1",
+		"frostbyte_worker_chunk_bytes 100",
+		`frostbyte_worker_disks{state="healthy"} 1`,
+		`frostbyte_worker_disks{state="failed"} 0`,
+		`frostbyte_worker_chunk_operations_total{code="200",operation="store"}`,
+		"frostbyte_worker_bytes_stored_total",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics are missing %s", line)
+		}
+	}
+}
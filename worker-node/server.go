@@ -1,65 +1,178 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type WorkerServer struct {
 	storage  ChunkStorage
-	hostname string
+	disks    *MultiDiskStorage // The same storage, for disk health and capacity
+	dataDirs []string
+	id       string // Stable ID referenced by the master's chunk metadata
+	legacyID string // Hostname the worker was known by before it had a stable ID
+	address  string // host:port advertised to the master for chunk traffic
+	topology Topology
+	inFlight int64 // Requests currently being served, updated atomically
+	config   *configLoader
+	mux      *http.ServeMux
+	server   *http.Server
+	master   *http.Client  // Requests to the master, which time out so a hung master cannot stall the worker
+	stop     chan struct{} // Closed on shutdown to end registration and heartbeats
+}
+
+// newChunkStorage opens one data directory with the configured storage engine
+func newChunkStorage(baseDir string) (ChunkStorage, error) {
+	if StorageEngine == StorageEngineLog {
+		return NewLogChunkStorage(baseDir, SegmentSize, CompactionThreshold, CompactionInterval, SyncDataDir)
+	}
+	return NewFileChunkStorage(baseDir, SyncDataDir)
+}
+
+// Topology places a worker in the failure domains of the cluster
+type Topology struct {
+	Zone string
+	Rack string
+	Host string
 }
 
-func NewWorkerServer(baseDir string) (*WorkerServer, error) {
-	storage, err := NewFileChunkStorage(baseDir)
+func NewWorkerServer(dataDirs []string, config *configLoader) (*WorkerServer, error) {
+	disks, err := NewMultiDiskStorage(dataDirs, newChunkStorage, DiskCheckInterval)
 	if err != nil {
 		return nil, err
 	}
 
+	// Chunks stored before the worker had a stable ID are recorded under its hostname
 	hostname, _ := os.Hostname()
-	return &WorkerServer{
-		storage:  storage,
-		hostname: hostname,
-	}, nil
+	id, err := loadOrCreateWorkerID(dataDirs, hostname)
+	if err != nil {
+		disks.Close()
+		return nil, err
+	}
+
+	ws := &WorkerServer{
+		storage:  disks,
+		disks:    disks,
+		dataDirs: dataDirs,
+		id:       id,
+		legacyID: pendingLegacyID(dataDirs),
+		address:  AdvertiseAddr,
+		topology: Topology{
+			Zone: Zone,
+			Rack: Rack,
+			Host: Host,
+		},
+		config: config,
+		mux:    http.NewServeMux(),
+		server: &http.Server{},
+		master: &http.Client{Timeout: MasterTimeout, Transport: clusterTokenTransport{newMasterFailover(masterAddrs(), http.DefaultTransport)}},
+		stop:   make(chan struct{}),
+	}
+	if ws.address == "" {
+		ws.address = hostname + ":" + WorkerPort
+	}
+	if ws.topology.Host == "" {
+		ws.topology.Host = hostname
+	}
+	return ws, nil
 }
 
+// registerWithMaster registers this worker with the master, retrying with
+// exponential backoff until the master accepts the registration
 func (ws *WorkerServer) registerWithMaster() {
-	masterURL := fmt.Sprintf("http://master:%s/register?id=%s", DefaultMasterPort, ws.hostname)
-
-	maxRetries := 10
-	retryDelay := 2 * time.Second
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		log.Printf("Attempting to register with master (attempt %d/%d)...", attempt, maxRetries)
-
-		resp, err := http.Get(masterURL)
-		if err != nil {
-			log.Printf("Failed to register with master (attempt %d): %v", attempt, err)
-			if attempt < maxRetries {
-				log.Printf("Retrying in %v...", retryDelay)
-				time.Sleep(retryDelay)
-				continue
+	retryDelay := RegisterInitialBackoff
+	for attempt := 1; !ws.stopping(); attempt++ {
+		slog.Info("Registering with master", "attempt", attempt)
+
+		resp, err := ws.master.Get(ws.registrationURL())
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				slog.Info("Registered with master", "worker", ws.id, "address", ws.address)
+				if ws.legacyID != "" {
+					clearLegacyID(ws.dataDirs)
+					ws.legacyID = ""
+				}
+				return
 			}
-			log.Fatalf("Failed to register with master after %d attempts: %v", maxRetries, err)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			log.Printf("Successfully registered with master: %s", ws.hostname)
-			return
-		} else {
-			log.Printf("Master returned error status: %s (attempt %d)", resp.Status, attempt)
-			if attempt < maxRetries {
-				time.Sleep(retryDelay)
+			// The marker is kept, so the migration is tried again on the next start
+			if resp.StatusCode == http.StatusForbidden && ws.legacyID != "" {
+				slog.Error("Master refused to migrate the chunks recorded under the legacy ID, registering without them",
+					"legacyId", ws.legacyID)
+				ws.legacyID = ""
 				continue
 			}
-			log.Fatalf("Failed to register with master after %d attempts: status %s", maxRetries, resp.Status)
+			if resp.StatusCode == http.StatusForbidden {
+				refusedByMaster("registration", ws.id, ws.address)
+			}
+			err = fmt.Errorf("master returned error status: %s", resp.Status)
 		}
+
+		slog.Warn("Failed to register with master", "attempt", attempt, "error", err, "retryIn", retryDelay)
+		ws.sleep(retryDelay)
+		retryDelay = min(retryDelay*2, RegisterMaxBackoff)
+	}
+}
+
+// refusedByMaster stops the worker when the master refuses to let it register or
+// report its status. Retrying cannot help: without the cluster token, the master
+// only accepts a worker at a new address, such as a recreated container, if the
+// request comes from the host of the old one.
+func refusedByMaster(request, id, address string) {
+	fatal("Master refused the "+request+" of this worker. Set FROSTBYTE_CLUSTER_TOKEN to the same secret on the master and every worker",
+		"worker", id, "address", address)
+}
+
+// registrationURL builds the registration request, asking the master to migrate
+// the chunks of the legacy ID while that is pending
+func (ws *WorkerServer) registrationURL() string {
+	params := url.Values{}
+	params.Set("id", ws.id)
+	params.Set("addr", ws.address)
+	if ws.legacyID != "" {
+		params.Set("legacyId", ws.legacyID)
+	}
+	params.Set("zone", ws.topology.Zone)
+	params.Set("rack", ws.topology.Rack)
+	params.Set("host", ws.topology.Host)
+	return masterURL("/register?" + params.Encode())
+}
+
+// deregisterFromMaster asks the master to stop placing chunks on this worker
+func (ws *WorkerServer) deregisterFromMaster(ctx context.Context) error {
+	params := url.Values{}
+	params.Set("id", ws.id)
+	masterURL := masterURL("/deregister?" + params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, masterURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ws.master.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("master returned error status: %s", resp.Status)
 	}
+	return nil
 }
 
 func (ws *WorkerServer) handleStoreChunk(w http.ResponseWriter, r *http.Request) {
@@ -67,52 +180,214 @@ func (ws *WorkerServer) handleStoreChunk(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	chunkID, err := getRequiredParam(r, "chunkID")
+	chunkID, err := getChunkIDParam(r)
 	if err != nil {
 		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = ws.storage.StoreStream(chunkID, r.Body)
+	err = ws.storeAndReport(w, r, chunkID)
 	if err != nil {
-		writeErrorResponse(w, "Failed to store chunk in file", http.StatusInternalServerError)
+		writeErrorResponse(w, fmt.Sprintf("Failed to store chunk in file: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Chunk %s stored successfully", chunkID)
+	slog.DebugContext(r.Context(), "Chunk stored", "chunk", chunkID)
 	writeSuccessResponse(w, fmt.Sprintf("Chunk %s stored successfully", chunkID))
 }
 
+// storeAndReport stores a chunk while hashing it, and reports the checksum
+// and size of the stored data in the response headers. If the master names the
+// file and index of the chunk, they are kept in a sidecar next to it.
+func (ws *WorkerServer) storeAndReport(w http.ResponseWriter, r *http.Request, chunkID string) error {
+	hash := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(r.Body, hash)}
+
+	if err := ws.storage.StoreStream(chunkID, counter); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	bytesStoredTotal.Add(float64(counter.count))
+
+	if filename := r.URL.Query().Get("filename"); filename != "" {
+		index, _ := strconv.Atoi(r.URL.Query().Get("index"))
+		sidecar := ChunkSidecar{Filename: filename, Index: index, Size: counter.count, Checksum: checksum}
+		// The chunk itself is stored, so a missing sidecar only weakens recovery
+		if err := ws.storage.WriteSidecar(chunkID, sidecar); err != nil {
+			slog.WarnContext(r.Context(), "Failed to write chunk sidecar", "chunk", chunkID, "error", err)
+		}
+	}
+
+	w.Header().Set(ChunkChecksumHeader, checksum)
+	w.Header().Set(ChunkSizeHeader, strconv.FormatInt(counter.count, 10))
+	return nil
+}
+
+// handleAppendChunk appends to a pack chunk the master fills with small files.
+// The offset is the size of the chunk the master has recorded; the checksum and
+// size reported back cover the whole chunk.
+func (ws *WorkerServer) handleAppendChunk(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	chunkID, err := getChunkIDParam(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeErrorResponse(w, "offset must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+
+	// The sidecar keeps the hash state of the chunk, so the checksum is carried on
+	// over the appended bytes instead of rereading the whole chunk
+	previous, err := ws.storage.ReadSidecar(chunkID)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to read chunk sidecar", "chunk", chunkID, "error", err)
+		previous = nil
+	}
+	body := io.Reader(r.Body)
+	hash := resumeHash(previous, offset)
+	if hash != nil {
+		body = io.TeeReader(r.Body, hash)
+	}
+
+	counter := &countingReader{reader: body}
+	err = ws.storage.Append(chunkID, offset, counter)
+	if errors.Is(err, errAppendOffset) {
+		writeErrorResponse(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeErrorResponse(w, fmt.Sprintf("Failed to append to chunk: %v", err), http.StatusInternalServerError)
+		return
+	}
+	bytesStoredTotal.Add(float64(counter.count))
+
+	if hash == nil {
+		if hash, err = ws.chunkHash(chunkID); err != nil {
+			writeErrorResponse(w, "Failed to read chunk", http.StatusInternalServerError)
+			return
+		}
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	size := offset + counter.count
+
+	if filename := r.URL.Query().Get("filename"); filename != "" {
+		index, _ := strconv.Atoi(r.URL.Query().Get("index"))
+		sidecar := ChunkSidecar{Filename: filename, Index: index, Size: size, Checksum: checksum}
+		if state, err := hash.(encoding.BinaryMarshaler).MarshalBinary(); err == nil {
+			sidecar.HashState = state
+		}
+		if member := r.URL.Query().Get("member"); member != "" {
+			sidecar.Members = packMembers(previous, offset)
+			sidecar.Members = append(sidecar.Members, PackMember{Filename: member, Offset: offset, Length: counter.count, PackedAt: time.Now().UTC()})
+		}
+		if err := ws.storage.WriteSidecar(chunkID, sidecar); err != nil {
+			slog.WarnContext(r.Context(), "Failed to write chunk sidecar", "chunk", chunkID, "error", err)
+		}
+	}
+
+	w.Header().Set(ChunkChecksumHeader, checksum)
+	w.Header().Set(ChunkSizeHeader, strconv.FormatInt(size, 10))
+	slog.DebugContext(r.Context(), "Chunk appended", "chunk", chunkID, "offset", offset, "bytes", counter.count)
+	writeSuccessResponse(w, fmt.Sprintf("Appended %d bytes to chunk %s", counter.count, chunkID))
+}
+
+// resumeHash returns the hash of the first offset bytes of a chunk, restored from
+// the state its sidecar keeps, or nil if the sidecar does not describe those bytes
+func resumeHash(sidecar *ChunkSidecar, offset int64) hash.Hash {
+	h := sha256.New()
+	if offset == 0 {
+		return h
+	}
+	if sidecar == nil || sidecar.Size != offset || len(sidecar.HashState) == 0 {
+		return nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(sidecar.HashState); err != nil {
+		return nil
+	}
+	return h
+}
+
+// packMembers returns the files the sidecar of a pack chunk lists before offset.
+// Files recorded beyond it belonged to appends the master gave up on.
+func packMembers(sidecar *ChunkSidecar, offset int64) []PackMember {
+	if sidecar == nil {
+		return nil
+	}
+	members := make([]PackMember, 0, len(sidecar.Members)+1)
+	for _, member := range sidecar.Members {
+		if member.Offset+member.Length <= offset {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
 func (ws *WorkerServer) handleGetChunk(w http.ResponseWriter, r *http.Request) {
 	if !validateHTTPMethod(w, r, http.MethodGet) {
 		return
 	}
 
-	chunkID, err := getRequiredParam(r, "chunkID")
+	chunkID, err := getChunkIDParam(r)
 	if err != nil {
 		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	chunkData, err := ws.storage.Retrieve(chunkID)
+	chunk, err := ws.storage.RetrieveStream(chunkID)
 	if err != nil {
 		writeErrorResponse(w, "Failed to retrieve chunk from database", http.StatusInternalServerError)
 		return
 	}
 
-	if chunkData == nil {
+	if chunk == nil {
 		writeErrorResponse(w, "Chunk not found", http.StatusNotFound)
 		return
 	}
+	defer chunk.Close()
 
+	// ServeContent streams the chunk and answers range requests, which the master
+	// uses to resume a download from another replica
 	w.Header().Set("Content-Type", ContentTypeOctetStream)
-	_, err = w.Write(chunkData)
-	if err != nil {
-		log.Printf("Failed to write chunk %s data: %v", chunkID, err)
-		return
-	}
+	counter := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(counter, r, "", time.Time{}, chunk)
+	bytesServedTotal.Add(float64(counter.count))
+
+	slog.DebugContext(r.Context(), "Chunk retrieved", "chunk", chunkID, "bytes", counter.count)
+}
 
-	log.Printf("Chunk %s retrieved successfully", chunkID)
+// countingResponseWriter counts the body bytes written through it
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (c *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
 }
 
 func (ws *WorkerServer) handleDeleteChunk(w http.ResponseWriter, r *http.Request) {
@@ -120,7 +395,7 @@ func (ws *WorkerServer) handleDeleteChunk(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	chunkID, err := getRequiredParam(r, "chunkID")
+	chunkID, err := getChunkIDParam(r)
 	if err != nil {
 		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
@@ -144,12 +419,12 @@ func (ws *WorkerServer) handleDeleteChunk(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	log.Printf("Chunk %s deleted successfully", chunkID)
+	slog.DebugContext(r.Context(), "Chunk deleted", "chunk", chunkID)
 	writeSuccessResponse(w, fmt.Sprintf("Chunk %s successfully deleted from database", chunkID))
 }
 
 func (ws *WorkerServer) handleWorkerTest(w http.ResponseWriter, r *http.Request) {
-	writeSuccessResponse(w, fmt.Sprintf("Worker %s responding", ws.hostname))
+	writeSuccessResponse(w, fmt.Sprintf("Worker %s responding", ws.id))
 }
 
 func (ws *WorkerServer) handleStreamStore(w http.ResponseWriter, r *http.Request) {
@@ -157,37 +432,192 @@ func (ws *WorkerServer) handleStreamStore(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	chunkID, err := getRequiredParam(r, "chunkID")
+	chunkID, err := getChunkIDParam(r)
 	if err != nil {
 		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = ws.storage.StoreStream(chunkID, r.Body)
+	err = ws.storeAndReport(w, r, chunkID)
 	if err != nil {
-		writeErrorResponse(w, "Failed to store streamed chunk in file", http.StatusInternalServerError)
-		log.Printf("Error: %s", err)
+		writeErrorResponse(w, fmt.Sprintf("Failed to store streamed chunk in file: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Streamed chunk %s stored successfully", chunkID)
+	slog.DebugContext(r.Context(), "Streamed chunk stored", "chunk", chunkID)
 	writeSuccessResponse(w, fmt.Sprintf("Chunk %s stored successfully", chunkID))
 }
 
+// handleListChunks returns every chunk stored on this worker.
+// With sidecars=true the sidecar of each chunk is included.
+func (ws *WorkerServer) handleListChunks(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	chunks, err := ws.storage.List()
+	if err != nil {
+		writeErrorResponse(w, "Failed to list chunks", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("sidecars") == "true" {
+		for i := range chunks {
+			sidecar, err := ws.storage.ReadSidecar(chunks[i].ChunkID)
+			if err != nil {
+				slog.WarnContext(r.Context(), "Failed to read chunk sidecar", "chunk", chunks[i].ChunkID, "error", err)
+				continue
+			}
+			chunks[i].Sidecar = sidecar
+		}
+	}
+
+	if err := writeJSONResponse(w, chunks); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode chunk list", "error", err)
+	}
+}
+
+// ChunkStat is the response of the stat endpoint
+type ChunkStat struct {
+	ChunkID  string `json:"chunkId"`
+	Exists   bool   `json:"exists"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// handleStatChunk reports whether a chunk exists and its size.
+// With checksum=true the chunk is read and its SHA-256 checksum is included.
+func (ws *WorkerServer) handleStatChunk(w http.ResponseWriter, r *http.Request) {
+	if !validateHTTPMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	chunkID, err := getChunkIDParam(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := ws.storage.Stat(chunkID)
+	if err != nil {
+		writeErrorResponse(w, "Failed to stat chunk", http.StatusInternalServerError)
+		return
+	}
+
+	stat := ChunkStat{ChunkID: chunkID}
+	if info != nil {
+		stat.Exists = true
+		stat.Size = info.Size
+
+		if r.URL.Query().Get("checksum") == "true" {
+			checksum, err := ws.chunkChecksum(chunkID)
+			if err != nil {
+				writeErrorResponse(w, "Failed to read chunk", http.StatusInternalServerError)
+				return
+			}
+			stat.Checksum = checksum
+		}
+	}
+
+	if err := writeJSONResponse(w, stat); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode chunk stat", "error", err)
+	}
+}
+
+// chunkChecksum hashes a chunk without reading it into memory
+func (ws *WorkerServer) chunkChecksum(chunkID string) (string, error) {
+	hash, err := ws.chunkHash(chunkID)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// chunkHash feeds a whole chunk to a SHA-256 hash
+func (ws *WorkerServer) chunkHash(chunkID string) (hash.Hash, error) {
+	chunk, err := ws.storage.RetrieveStream(chunkID)
+	if err != nil {
+		return nil, err
+	}
+	if chunk == nil {
+		return nil, os.ErrNotExist
+	}
+	defer chunk.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, chunk); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
 func (ws *WorkerServer) setupRoutes() {
-	http.HandleFunc("/worker-test", ws.handleWorkerTest)
-	http.HandleFunc("/store", ws.handleStoreChunk)
-	http.HandleFunc("/stream-store", ws.handleStreamStore) // New streaming endpoint
-	http.HandleFunc("/get", ws.handleGetChunk)
-	http.HandleFunc("/delete", ws.handleDeleteChunk)
+	ws.mux.HandleFunc("/worker-test", ws.handleWorkerTest)
+	ws.mux.HandleFunc("/store", ws.trackInFlight(instrumentChunkOperation("store", ws.handleStoreChunk)))
+	ws.mux.HandleFunc("/stream-store", ws.trackInFlight(instrumentChunkOperation("store", ws.handleStreamStore))) // New streaming endpoint
+	ws.mux.HandleFunc("/append", ws.trackInFlight(instrumentChunkOperation("append", ws.handleAppendChunk)))
+	ws.mux.HandleFunc("/get", ws.trackInFlight(instrumentChunkOperation("get", ws.handleGetChunk)))
+	ws.mux.HandleFunc("/delete", ws.trackInFlight(instrumentChunkOperation("delete", ws.handleDeleteChunk)))
+	ws.mux.HandleFunc("/chunks", ws.handleListChunks)
+	ws.mux.HandleFunc("/stat", ws.handleStatChunk)
+	ws.mux.Handle("/metrics", promhttp.Handler())
+	ws.mux.HandleFunc("/config", ws.config.handleConfig)
 }
 
+// Start serves requests until Shutdown is called, after which it returns http.ErrServerClosed
 func (ws *WorkerServer) Start(port string) error {
-	ws.registerWithMaster()
+	prometheus.MustRegister(newStatusCollector(ws))
 	ws.setupRoutes()
 
-	log.Printf("Worker %s listening on :%s", ws.hostname, port)
-	return http.ListenAndServe(":"+port, nil)
+	ws.server.Addr = ":" + port
+	ws.server.Handler = traceRequests(ws.mux, logRequests(ws.mux))
+	// Listen before registering, as the master lists the chunks of a worker once it registers
+	listener, err := net.Listen("tcp", ws.server.Addr)
+	if err != nil {
+		return err
+	}
+	go ws.maintainRegistration(HeartbeatInterval)
+
+	slog.Info("Worker listening", "worker", ws.id, "port", port)
+	return ws.server.Serve(listener)
+}
+
+// Shutdown deregisters from the master, so no new chunks are sent here, stops
+// accepting connections and waits for in-flight chunk transfers to finish.
+// Transfers still running when ctx expires are cut off.
+func (ws *WorkerServer) Shutdown(ctx context.Context) error {
+	close(ws.stop)
+	if err := ws.deregisterFromMaster(ctx); err != nil {
+		slog.Warn("Failed to deregister from master", "error", err)
+	} else {
+		slog.Info("Deregistered from master", "worker", ws.id)
+	}
+
+	if err := ws.server.Shutdown(ctx); err != nil {
+		ws.server.Close()
+		return fmt.Errorf("in-flight requests did not finish: %v", err)
+	}
+	return nil
+}
+
+// stopping reports whether the worker is shutting down
+func (ws *WorkerServer) stopping() bool {
+	select {
+	case <-ws.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, or until the worker starts shutting down
+func (ws *WorkerServer) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ws.stop:
+	}
 }
 
 func (ws *WorkerServer) Close() error {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestAppendCarriesTheChecksumOn appends to a pack chunk and checks the checksum
+// the worker reports, whether it is carried on from the sidecar or, after an
+// append the master gave up on, computed over the whole chunk again
+func TestAppendCarriesTheChecksumOn(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		defer s.Close()
+		ws := &WorkerServer{storage: s}
+
+		var chunk []byte
+		appendChunk := func(offset int, data []byte) {
+			t.Helper()
+			target := fmt.Sprintf("/append?chunkID=pack&filename=.packs/1&index=0&offset=%d&member=f%d", offset, offset)
+			w := httptest.NewRecorder()
+			ws.handleAppendChunk(w, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("append at %d returned %d: %s", offset, w.Code, w.Body)
+			}
+			chunk = append(chunk[:offset], data...)
+			sum := sha256.Sum256(chunk)
+			if got := w.Header().Get(ChunkChecksumHeader); got != hex.EncodeToString(sum[:]) {
+				t.Fatalf("append at %d reported checksum %s, want %x", offset, got, sum)
+			}
+		}
+
+		appendChunk(0, chunkData(1, 300))
+		appendChunk(300, chunkData(2, 200))
+		sidecar, err := s.ReadSidecar("pack")
+		if err != nil || sidecar == nil || sidecar.Size != 500 || len(sidecar.HashState) == 0 {
+			t.Fatalf("sidecar after appending: %+v, %v", sidecar, err)
+		}
+
+		// A retry at an earlier offset does not match the hash state in the sidecar
+		appendChunk(300, chunkData(3, 100))
+		appendChunk(400, chunkData(4, 100))
+		if sidecar, err := s.ReadSidecar("pack"); err != nil || len(sidecar.Members) != 3 {
+			t.Fatalf("sidecar members after the retry: %+v, %v", sidecar, err)
+		}
+	})
+}
+
+// TestShutdownFinishesUploadsAndDeregisters starts a shutdown while a chunk is
+// being uploaded, and checks that the worker deregisters first and only stops
+// once the upload is stored
+func TestShutdownFinishesUploadsAndDeregisters(t *testing.T) {
+	deregistered := make(chan string, 1)
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/deregister" {
+			deregistered <- r.URL.Query().Get("id")
+		}
+	}))
+	defer master.Close()
+	oldAddr := MasterAddr
+	MasterAddr = strings.TrimPrefix(master.URL, "http://")
+	defer func() { MasterAddr = oldAddr }()
+
+	ws, err := NewWorkerServer([]string{t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.setupRoutes()
+	ws.server.Handler = ws.mux
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ws.server.Serve(listener)
+
+	// The upload sends half of the chunk and waits
+	data := chunkData(1, 64*1024)
+	body, upload := io.Pipe()
+	uploaded := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+listener.Addr().String()+"/stream-store?chunkID=slow", "application/octet-stream", body)
+		if err != nil {
+			uploaded <- 0
+			return
+		}
+		resp.Body.Close()
+		uploaded <- resp.StatusCode
+	}()
+	upload.Write(data[:len(data)/2])
+	for atomic.LoadInt64(&ws.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- ws.Shutdown(context.Background()) }()
+	select {
+	case id := <-deregistered:
+		if id != ws.id {
+			t.Fatalf("deregistered %q, want %q", id, ws.id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not deregister")
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown returned during an upload: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	upload.Write(data[len(data)/2:])
+	upload.Close()
+	if code := <-uploaded; code != http.StatusOK {
+		t.Fatalf("upload during shutdown returned %d", code)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	expectChunk(t, ws.storage, "slow", data)
+}
@@ -1,54 +1,341 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// ChunkInfo describes a stored chunk
+type ChunkInfo struct {
+	ChunkID string        `json:"chunkId"`
+	Size    int64         `json:"size"`
+	ModTime time.Time     `json:"modTime"`
+	Sidecar *ChunkSidecar `json:"sidecar,omitempty"`
+}
+
+// ChunkSidecar records which file a chunk belongs to, so the master can rebuild
+// its metadata from a scan of the workers. The sidecar of a pack chunk also lists
+// the small files appended to it.
+type ChunkSidecar struct {
+	Filename string       `json:"filename"`
+	Index    int          `json:"index"`
+	Size     int64        `json:"size"`
+	Checksum string       `json:"checksum"`
+	Members  []PackMember `json:"members,omitempty"`
+	// SHA-256 state after the Size bytes, so an append carries the checksum on
+	HashState []byte `json:"hashState,omitempty"`
+}
+
+// PackMember is a file appended to a pack chunk
+type PackMember struct {
+	Filename string    `json:"filename"`
+	Offset   int64     `json:"offset"`
+	Length   int64     `json:"length"`
+	PackedAt time.Time `json:"packedAt"`
+}
+
 type ChunkStorage interface {
 	Store(chunkID string, data []byte) error
 	StoreStream(chunkID string, r io.Reader) error
+	Append(chunkID string, offset int64, r io.Reader) error
 	Retrieve(chunkID string) ([]byte, error)
+	RetrieveStream(chunkID string) (io.ReadSeekCloser, error)
 	Delete(chunkID string) error
 	Exists(chunkID string) (bool, error)
+	Stat(chunkID string) (*ChunkInfo, error)
+	List() ([]ChunkInfo, error)
+	WriteSidecar(chunkID string, sidecar ChunkSidecar) error
+	ReadSidecar(chunkID string) (*ChunkSidecar, error)
 	Close() error
 }
 
+// tempFileSuffix marks chunks and sidecars that are still being written
+const tempFileSuffix = ".tmp"
+
+// MaxChunkIDLength leaves room in the 255 byte file name limit for the hidden
+// sidecar and temp file names derived from a chunk ID
+const MaxChunkIDLength = 200
+
+// errInvalidChunkID is returned for chunk IDs that could escape the data directory
+var errInvalidChunkID = errors.New("invalid chunk ID")
+
+// errAppendOffset is returned when an append does not start at the end of the
+// data the chunk is known to hold
+var errAppendOffset = errors.New("chunk is shorter than the append offset")
+
+// validChunkID accepts the IDs the master generates: a sanitized file name and
+// chunk index without dots, path separators or control characters
+func validChunkID(chunkID string) bool {
+	if chunkID == "" || len(chunkID) > MaxChunkIDLength || !utf8.ValidString(chunkID) {
+		return false
+	}
+	for _, c := range chunkID {
+		if c == '.' || c == '/' || c == '\\' || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// FileChunkStorage keeps every chunk in a file named after its ID, in a two-level
+// directory tree fanned out by the hash of the ID. Files are written to a hidden
+// temp file and renamed into place once complete, so a chunk is either stored in
+// full or not at all.
 type FileChunkStorage struct {
 	baseDir string
+	syncDir bool // Also sync the directory after a rename
 }
 
-func NewFileChunkStorage(baseDir string) (*FileChunkStorage, error) {
+// NewFileChunkStorage opens the chunk directory, moves chunks stored by older
+// versions into the directory tree and removes temp files left behind by writes
+// that never finished
+func NewFileChunkStorage(baseDir string, syncDir bool) (*FileChunkStorage, error) {
 	err := os.MkdirAll(baseDir, 0755)
 	if err != nil {
 		return nil, err
 	}
-	return &FileChunkStorage{baseDir: baseDir}, nil
+	s := &FileChunkStorage{baseDir: baseDir, syncDir: syncDir}
+	if err := s.migrateFlatLayout(); err != nil {
+		return nil, fmt.Errorf("failed to migrate chunks to the sharded layout: %v", err)
+	}
+	if err := s.removeTempFiles(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrateFlatLayout moves chunks and sidecars stored directly in the data
+// directory into their shard directories
+func (s *FileChunkStorage) migrateFlatLayout() error {
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		chunkID := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(chunkID, ".") {
+			continue
+		}
+		if !validChunkID(chunkID) {
+			slog.Warn("Leaving file with an invalid chunk ID in the data directory", "file", chunkID)
+			continue
+		}
+
+		chunkPath, _ := s.chunkPath(chunkID)
+		if err := s.ensureDir(filepath.Dir(chunkPath)); err != nil {
+			return err
+		}
+		// The sidecar goes first, so an interrupted migration never leaves a moved chunk without it
+		sidecarPath, _ := s.sidecarPath(chunkID)
+		err := os.Rename(filepath.Join(s.baseDir, "."+chunkID+".meta"), sidecarPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(filepath.Join(s.baseDir, chunkID), chunkPath); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		if s.syncDir {
+			if err := syncDir(s.baseDir); err != nil {
+				return err
+			}
+		}
+		slog.Info("Migrated chunks to the sharded layout", "chunks", migrated)
+	}
+	return nil
+}
+
+// removeTempFiles deletes the leftovers of writes interrupted by a crash
+func (s *FileChunkStorage) removeTempFiles() error {
+	removed := 0
+	err := filepath.WalkDir(s.baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, tempFileSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		slog.Info("Removed unfinished chunk writes", "files", removed)
+	}
+	return nil
+}
+
+// shardDir returns the directory a chunk is stored in, two levels named after
+// the first two bytes of the SHA-256 of its ID
+func (s *FileChunkStorage) shardDir(chunkID string) string {
+	sum := sha256.Sum256([]byte(chunkID))
+	return filepath.Join(s.baseDir, hex.EncodeToString(sum[:1]), hex.EncodeToString(sum[1:2]))
+}
+
+func (s *FileChunkStorage) chunkPath(chunkID string) (string, error) {
+	if !validChunkID(chunkID) {
+		return "", errInvalidChunkID
+	}
+	return filepath.Join(s.shardDir(chunkID), chunkID), nil
 }
 
-func (s *FileChunkStorage) chunkPath(chunkID string) string {
-	return filepath.Join(s.baseDir, chunkID)
+// sidecarPath is hidden, so sidecars are not listed as chunks
+func (s *FileChunkStorage) sidecarPath(chunkID string) (string, error) {
+	if !validChunkID(chunkID) {
+		return "", errInvalidChunkID
+	}
+	return filepath.Join(s.shardDir(chunkID), "."+chunkID+".meta"), nil
+}
+
+// ensureDir creates a shard directory. New directories are synced into their
+// parents, so chunks renamed into them are not lost with the directory.
+func (s *FileChunkStorage) ensureDir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if !s.syncDir {
+		return nil
+	}
+	for parent := filepath.Dir(dir); ; parent = filepath.Dir(parent) {
+		if err := syncDir(parent); err != nil {
+			return err
+		}
+		if parent == filepath.Clean(s.baseDir) || parent == filepath.Dir(parent) {
+			return nil
+		}
+	}
 }
 
 func (s *FileChunkStorage) Store(chunkID string, data []byte) error {
-	path := s.chunkPath(chunkID)
-	return os.WriteFile(path, data, 0644)
+	return s.StoreStream(chunkID, bytes.NewReader(data))
 }
 
 func (s *FileChunkStorage) StoreStream(chunkID string, r io.Reader) error {
-	path := s.chunkPath(chunkID)
-	f, err := os.Create(path)
+	path, err := s.chunkPath(chunkID)
+	if err != nil {
+		return err
+	}
+	return s.writeAtomic(path, r)
+}
+
+// Append adds r to a chunk holding offset bytes, or creates the chunk when offset
+// is 0. Bytes past offset, left by an append the master gave up on, are dropped.
+// The chunk is extended in place, so an append costs only the bytes it adds; when
+// it fails, or the worker crashes during it, the chunk may hold a partial tail
+// past offset, which the master's retry at the same offset cuts off again.
+func (s *FileChunkStorage) Append(chunkID string, offset int64, r io.Reader) (err error) {
+	if offset == 0 {
+		return s.StoreStream(chunkID, r)
+	}
+	path, err := s.chunkPath(chunkID)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, r)
-	return err
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return errAppendOffset
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset {
+		return errAppendOffset
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(f, offset), r); err != nil {
+		// Best effort: leave the chunk as the master knows it
+		f.Truncate(offset)
+		return err
+	}
+	return f.Sync()
+}
+
+// writeAtomic writes r to a hidden temp file next to path, syncs it and renames it
+// to path. Nothing is left at path when the write fails.
+func (s *FileChunkStorage) writeAtomic(path string, r io.Reader) (err error) {
+	dir := filepath.Dir(path)
+	if err := s.ensureDir(dir); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	if s.syncDir {
+		return syncDir(dir)
+	}
+	return nil
 }
 
 func (s *FileChunkStorage) Retrieve(chunkID string) ([]byte, error) {
-	path := s.chunkPath(chunkID)
+	path, err := s.chunkPath(chunkID)
+	if err != nil {
+		return nil, err
+	}
 	data, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
 		return nil, nil
@@ -56,14 +343,43 @@ func (s *FileChunkStorage) Retrieve(chunkID string) ([]byte, error) {
 	return data, err
 }
 
+// RetrieveStream opens a chunk for reading, or returns nil if it does not exist
+func (s *FileChunkStorage) RetrieveStream(chunkID string) (io.ReadSeekCloser, error) {
+	path, err := s.chunkPath(chunkID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (s *FileChunkStorage) Delete(chunkID string) error {
-	path := s.chunkPath(chunkID)
-	return os.Remove(path)
+	path, err := s.chunkPath(chunkID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	sidecarPath, _ := s.sidecarPath(chunkID)
+	if err := os.Remove(sidecarPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func (s *FileChunkStorage) Exists(chunkID string) (bool, error) {
-	path := s.chunkPath(chunkID)
-	_, err := os.Stat(path)
+	path, err := s.chunkPath(chunkID)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -73,6 +389,90 @@ func (s *FileChunkStorage) Exists(chunkID string) (bool, error) {
 	return false, err
 }
 
+// Stat returns information about a chunk, or nil if it does not exist
+func (s *FileChunkStorage) Stat(chunkID string) (*ChunkInfo, error) {
+	path, err := s.chunkPath(chunkID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkInfo{ChunkID: chunkID, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List returns every chunk in the shard directories
+func (s *FileChunkStorage) List() ([]ChunkInfo, error) {
+	shards, err := filepath.Glob(filepath.Join(s.baseDir, "[0-9a-f][0-9a-f]", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make([]ChunkInfo, 0)
+	for _, shard := range shards {
+		entries, err := os.ReadDir(shard)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			// Hidden files such as sidecars and temp files are not chunks
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				continue // deleted while listing
+			}
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, ChunkInfo{
+				ChunkID: entry.Name(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			})
+		}
+	}
+	return chunks, nil
+}
+
+func (s *FileChunkStorage) WriteSidecar(chunkID string, sidecar ChunkSidecar) error {
+	data, err := json.Marshal(sidecar)
+	if err != nil {
+		return err
+	}
+	path, err := s.sidecarPath(chunkID)
+	if err != nil {
+		return err
+	}
+	return s.writeAtomic(path, bytes.NewReader(data))
+}
+
+// ReadSidecar returns the sidecar of a chunk, or nil if the chunk has none
+func (s *FileChunkStorage) ReadSidecar(chunkID string) (*ChunkSidecar, error) {
+	path, err := s.sidecarPath(chunkID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sidecar ChunkSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, err
+	}
+	return &sidecar, nil
+}
+
 func (s *FileChunkStorage) Close() error {
 	return nil
 }
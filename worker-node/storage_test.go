@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// storageEngine opens one ChunkStorage implementation for the shared suite
+type storageEngine struct {
+	name string
+	open func(dir string) (ChunkStorage, error)
+	// crash abandons a storage without closing it, as a worker crash would
+	crash func(s ChunkStorage)
+	// tearTail leaves behind what a write cut short by a crash leaves in dir
+	tearTail func(t *testing.T, dir string)
+}
+
+var storageEngines = []storageEngine{
+	{
+		name: StorageEngineFile,
+		open: func(dir string) (ChunkStorage, error) {
+			return NewFileChunkStorage(dir, false)
+		},
+		crash: func(ChunkStorage) {},
+		tearTail: func(t *testing.T, dir string) {
+			// A chunk is written to a hidden temp file that is renamed once complete
+			s := &FileChunkStorage{baseDir: dir}
+			shard := s.shardDir("torn")
+			if err := os.MkdirAll(shard, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(shard, ".torn.123"+tempFileSuffix), []byte("partial"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+	{
+		name: StorageEngineLog,
+		open: func(dir string) (ChunkStorage, error) {
+			return NewLogChunkStorage(dir, 4096, 50, time.Hour, false)
+		},
+		crash: func(s ChunkStorage) {
+			storage := s.(*LogChunkStorage)
+			close(storage.stop)
+			<-storage.done
+			storage.writeMu.Lock()
+			storage.active.Close()
+			storage.writeMu.Unlock()
+		},
+		tearTail: func(t *testing.T, dir string) {
+			// Cut the last record short and leave part of a header behind it
+			segments, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentSuffix))
+			if err != nil || len(segments) == 0 {
+				t.Fatalf("no segments to tear: %v", err)
+			}
+			sort.Strings(segments)
+			last := segments[len(segments)-1]
+			info, err := os.Stat(last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(last, info.Size()-10); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte{1, 2, 3, 4, 5, 6, 7})
+			f.Close()
+			if err := os.WriteFile(filepath.Join(dir, spoolPrefix+"123"+tempFileSuffix), []byte("partial"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	},
+}
+
+// forEachEngine runs a test against every storage engine in its own directory
+func forEachEngine(t *testing.T, test func(t *testing.T, engine storageEngine, dir string, s ChunkStorage)) {
+	for _, engine := range storageEngines {
+		t.Run(engine.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openStorage(t, engine, dir)
+			test(t, engine, dir, s)
+		})
+	}
+}
+
+func openStorage(t *testing.T, engine storageEngine, dir string) ChunkStorage {
+	t.Helper()
+	s, err := engine.open(dir)
+	if err != nil {
+		t.Fatalf("failed to open %s storage: %v", engine.name, err)
+	}
+	return s
+}
+
+func chunkData(seed, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(seed))).Read(data)
+	return data
+}
+
+// expectChunk fails unless the chunk holds exactly want, or is missing when want is nil
+func expectChunk(t *testing.T, s ChunkStorage, chunkID string, want []byte) {
+	t.Helper()
+
+	data, err := s.Retrieve(chunkID)
+	if err != nil {
+		t.Fatalf("retrieving %s: %v", chunkID, err)
+	}
+	if want == nil {
+		if data != nil {
+			t.Fatalf("chunk %s holds %d bytes, want none", chunkID, len(data))
+		}
+		if exists, err := s.Exists(chunkID); err != nil || exists {
+			t.Fatalf("chunk %s exists: %t, %v", chunkID, exists, err)
+		}
+		return
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("chunk %s holds %d bytes that differ from the %d stored", chunkID, len(data), len(want))
+	}
+
+	stream, err := s.RetrieveStream(chunkID)
+	if err != nil || stream == nil {
+		t.Fatalf("streaming %s: %v", chunkID, err)
+	}
+	streamed, err := io.ReadAll(stream)
+	stream.Close()
+	if err != nil || !bytes.Equal(streamed, want) {
+		t.Fatalf("streamed chunk %s differs: %v", chunkID, err)
+	}
+
+	info, err := s.Stat(chunkID)
+	if err != nil || info == nil || info.Size != int64(len(want)) {
+		t.Fatalf("stat of %s returned %+v, %v", chunkID, info, err)
+	}
+}
+
+// expectList fails unless List returns exactly the given chunks
+func expectList(t *testing.T, s ChunkStorage, want map[string][]byte) {
+	t.Helper()
+
+	chunks, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int64, len(chunks))
+	for _, chunk := range chunks {
+		got[chunk.ChunkID] = chunk.Size
+	}
+	if len(got) != len(want) {
+		t.Fatalf("listed %d chunks, want %d: %v", len(got), len(want), got)
+	}
+	for chunkID, data := range want {
+		if size, ok := got[chunkID]; !ok || size != int64(len(data)) {
+			t.Fatalf("listed %s with %d bytes (present: %t), want %d", chunkID, size, ok, len(data))
+		}
+	}
+}
+
+func TestStorageStoreAndRetrieve(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		defer s.Close()
+
+		small := chunkData(1, 100)
+		large := chunkData(2, 10000) // Larger than a log segment
+		if err := s.Store("small_chunk_00000000", small); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.StoreStream("large_chunk_00000000", bytes.NewReader(large)); err != nil {
+			t.Fatal(err)
+		}
+		expectChunk(t, s, "small_chunk_00000000", small)
+		expectChunk(t, s, "large_chunk_00000000", large)
+		expectChunk(t, s, "missing", nil)
+
+		// Storing again replaces the chunk
+		replacement := chunkData(3, 50)
+		if err := s.Store("small_chunk_00000000", replacement); err != nil {
+			t.Fatal(err)
+		}
+		expectChunk(t, s, "small_chunk_00000000", replacement)
+
+		// A failed stream leaves the previous chunk in place
+		failing := io.MultiReader(bytes.NewReader(chunkData(4, 10)), iotest.ErrReader(errors.New("connection reset")))
+		if err := s.StoreStream("small_chunk_00000000", failing); err == nil {
+			t.Fatal("store from a failing reader succeeded")
+		}
+		expectChunk(t, s, "small_chunk_00000000", replacement)
+
+		// Empty chunks are chunks too
+		if err := s.Store("empty", []byte{}); err != nil {
+			t.Fatal(err)
+		}
+		expectChunk(t, s, "empty", []byte{})
+	})
+}
+
+func TestStorageRejectsInvalidChunkIDs(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		defer s.Close()
+
+		for _, chunkID := range []string{"", "../escape", "a/b", `a\b`, "dot.ted", "ctrl\x00", strings.Repeat("x", MaxChunkIDLength+1)} {
+			if err := s.Store(chunkID, []byte("x")); !errors.Is(err, errInvalidChunkID) {
+				t.Errorf("store of %q returned %v", chunkID, err)
+			}
+			if _, err := s.Stat(chunkID); !errors.Is(err, errInvalidChunkID) {
+				t.Errorf("stat of %q returned %v", chunkID, err)
+			}
+			if err := s.WriteSidecar(chunkID, ChunkSidecar{}); !errors.Is(err, errInvalidChunkID) {
+				t.Errorf("sidecar of %q returned %v", chunkID, err)
+			}
+		}
+		if err := s.Store(strings.Repeat("x", MaxChunkIDLength), []byte("x")); err != nil {
+			t.Errorf("store of the longest chunk ID failed: %v", err)
+		}
+	})
+}
+
+func TestStorageAppend(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		defer s.Close()
+
+		first, second, third := chunkData(1, 300), chunkData(2, 200), chunkData(3, 100)
+		if err := s.Append("pack", 0, bytes.NewReader(first)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Append("pack", int64(len(first)), bytes.NewReader(second)); err != nil {
+			t.Fatal(err)
+		}
+		want := append(append([]byte{}, first...), second...)
+		expectChunk(t, s, "pack", want)
+
+		// An offset past the end and a missing chunk are refused
+		if err := s.Append("pack", int64(len(want))+1, bytes.NewReader(third)); !errors.Is(err, errAppendOffset) {
+			t.Fatalf("append past the end returned %v", err)
+		}
+		if err := s.Append("missing", 10, bytes.NewReader(third)); !errors.Is(err, errAppendOffset) {
+			t.Fatalf("append to a missing chunk returned %v", err)
+		}
+		expectChunk(t, s, "pack", want)
+
+		// A failed append leaves the chunk unchanged
+		failing := io.MultiReader(bytes.NewReader(third), iotest.ErrReader(errors.New("connection reset")))
+		if err := s.Append("pack", int64(len(want)), failing); err == nil {
+			t.Fatal("append from a failing reader succeeded")
+		}
+		expectChunk(t, s, "pack", want)
+
+		// Bytes past the offset, left by an append the master gave up on, are dropped
+		if err := s.Append("pack", int64(len(first)), bytes.NewReader(third)); err != nil {
+			t.Fatal(err)
+		}
+		expectChunk(t, s, "pack", append(append([]byte{}, first...), third...))
+	})
+}
+
+func TestStorageDelete(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		defer s.Close()
+
+		data := chunkData(1, 100)
+		if err := s.Store("doomed", data); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteSidecar("doomed", ChunkSidecar{Filename: "f", Size: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("doomed"); err != nil {
+			t.Fatal(err)
+		}
+		expectChunk(t, s, "doomed", nil)
+		if sidecar, err := s.ReadSidecar("doomed"); err != nil || sidecar != nil {
+			t.Fatalf("sidecar of a deleted chunk: %+v, %v", sidecar, err)
+		}
+		if err := s.Delete("doomed"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("deleting a missing chunk returned %v", err)
+		}
+
+		// A chunk stored again after a delete is back
+		if err := s.Store("doomed", data); err != nil {
+			t.Fatal(err)
+		}
+		expectChunk(t, s, "doomed", data)
+	})
+}
+
+func TestStorageListAndSidecars(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		defer s.Close()
+
+		want := make(map[string][]byte)
+		for i := range 20 {
+			chunkID := fmt.Sprintf("file_chunk_%08d", i)
+			want[chunkID] = chunkData(i, 100+i)
+			if err := s.Store(chunkID, want[chunkID]); err != nil {
+				t.Fatal(err)
+			}
+			sidecar := ChunkSidecar{Filename: "file", Index: i, Size: int64(100 + i), Checksum: fmt.Sprintf("sum%d", i)}
+			if err := s.WriteSidecar(chunkID, sidecar); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Sidecars are not chunks
+		expectList(t, s, want)
+
+		for i := range 20 {
+			chunkID := fmt.Sprintf("file_chunk_%08d", i)
+			sidecar, err := s.ReadSidecar(chunkID)
+			if err != nil || sidecar == nil {
+				t.Fatalf("reading sidecar of %s: %+v, %v", chunkID, sidecar, err)
+			}
+			if sidecar.Filename != "file" || sidecar.Index != i || sidecar.Checksum != fmt.Sprintf("sum%d", i) {
+				t.Fatalf("sidecar of %s is %+v", chunkID, sidecar)
+			}
+		}
+		if sidecar, err := s.ReadSidecar("file_chunk_00000099"); err != nil || sidecar != nil {
+			t.Fatalf("sidecar of a missing chunk: %+v, %v", sidecar, err)
+		}
+
+		// A rewritten sidecar replaces the old one
+		if err := s.WriteSidecar("file_chunk_00000000", ChunkSidecar{Filename: "renamed"}); err != nil {
+			t.Fatal(err)
+		}
+		if sidecar, _ := s.ReadSidecar("file_chunk_00000000"); sidecar == nil || sidecar.Filename != "renamed" {
+			t.Fatalf("rewritten sidecar is %+v", sidecar)
+		}
+	})
+}
+
+func TestStorageReopen(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		kept, deleted, appended := chunkData(1, 3000), chunkData(2, 3000), chunkData(3, 500)
+		must(t, s.Store("kept", kept))
+		must(t, s.WriteSidecar("kept", ChunkSidecar{Filename: "kept"}))
+		must(t, s.Store("deleted", deleted))
+		must(t, s.Delete("deleted"))
+		must(t, s.Append("pack", 0, bytes.NewReader(appended[:200])))
+		must(t, s.Append("pack", 200, bytes.NewReader(appended[200:])))
+		// An append that cuts off the bytes of an earlier one
+		must(t, s.Append("cut", 0, bytes.NewReader(kept[:300])))
+		must(t, s.Append("cut", 300, bytes.NewReader(kept[300:600])))
+		must(t, s.Append("cut", 100, bytes.NewReader(appended[:50])))
+		cut := append(append([]byte{}, kept[:100]...), appended[:50]...)
+		must(t, s.Close())
+
+		s = openStorage(t, engine, dir)
+		defer s.Close()
+		expectChunk(t, s, "kept", kept)
+		expectChunk(t, s, "deleted", nil)
+		expectChunk(t, s, "pack", appended)
+		expectChunk(t, s, "cut", cut)
+		expectList(t, s, map[string][]byte{"kept": kept, "pack": appended, "cut": cut})
+		if sidecar, err := s.ReadSidecar("kept"); err != nil || sidecar == nil || sidecar.Filename != "kept" {
+			t.Fatalf("sidecar after reopening: %+v, %v", sidecar, err)
+		}
+	})
+}
+
+func TestStorageRecoversTornTail(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		kept, torn := chunkData(1, 500), chunkData(2, 500)
+		must(t, s.Store("kept", kept))
+		must(t, s.WriteSidecar("kept", ChunkSidecar{Filename: "kept"}))
+		must(t, s.Store("torn", torn))
+		engine.crash(s)
+		engine.tearTail(t, dir)
+
+		s = openStorage(t, engine, dir)
+		expectChunk(t, s, "kept", kept)
+		if sidecar, err := s.ReadSidecar("kept"); err != nil || sidecar == nil {
+			t.Fatalf("sidecar of an intact chunk lost: %v", err)
+		}
+
+		// A torn chunk is either gone or whole, never cut short
+		data, err := s.Retrieve("torn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]byte{"kept": kept}
+		if data != nil {
+			if !bytes.Equal(data, torn) {
+				t.Fatalf("torn chunk holds %d bytes that differ from the %d stored", len(data), len(torn))
+			}
+			want["torn"] = torn
+		}
+		expectList(t, s, want)
+
+		// Nothing of the interrupted write is left behind
+		filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && strings.HasSuffix(path, tempFileSuffix) {
+				t.Errorf("temp file %s left after recovery", path)
+			}
+			return err
+		})
+
+		// The recovered storage takes writes that survive the next restart
+		after := chunkData(3, 500)
+		must(t, s.Store("after", after))
+		must(t, s.Close())
+		want["after"] = after
+
+		s = openStorage(t, engine, dir)
+		defer s.Close()
+		for chunkID, data := range want {
+			expectChunk(t, s, chunkID, data)
+		}
+		expectList(t, s, want)
+	})
+}
+
+func TestStorageCrashDuringOverwriteKeepsAWholeChunk(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, engine storageEngine, dir string, s ChunkStorage) {
+		old, replacement := chunkData(1, 500), chunkData(2, 700)
+		must(t, s.Store("torn", old))
+		must(t, s.Store("torn", replacement))
+		engine.crash(s)
+		engine.tearTail(t, dir)
+
+		// The overwrite was cut short, so the chunk holds one version or the other
+		s = openStorage(t, engine, dir)
+		defer s.Close()
+		data, err := s.Retrieve("torn")
+		must(t, err)
+		if !bytes.Equal(data, old) && !bytes.Equal(data, replacement) {
+			t.Fatalf("chunk holds %d bytes that match neither the %d old nor the %d new bytes", len(data), len(old), len(replacement))
+		}
+		expectList(t, s, map[string][]byte{"torn": data})
+	})
+}
+
+// TestFileStorageMigratesFlatLayout opens a data directory in which an earlier
+// start was cut short while moving flat chunks into the shard directories: one
+// chunk was moved, one lost power between its sidecar and the chunk, and the
+// rest are still flat
+func TestFileStorageMigratesFlatLayout(t *testing.T) {
+	dir := t.TempDir()
+	chunks := map[string][]byte{"moved": chunkData(1, 100), "half": chunkData(2, 200), "flat1": chunkData(3, 300), "flat2": chunkData(4, 400)}
+	for chunkID, data := range chunks {
+		must(t, os.WriteFile(filepath.Join(dir, chunkID), data, 0644))
+		sidecar, err := json.Marshal(ChunkSidecar{Filename: chunkID, Size: int64(len(data))})
+		must(t, err)
+		must(t, os.WriteFile(filepath.Join(dir, "."+chunkID+".meta"), sidecar, 0644))
+	}
+	must(t, os.WriteFile(filepath.Join(dir, WorkerIDFile), []byte("w1"), 0644))
+
+	// The interrupted migration, in the order it renames files
+	partial := &FileChunkStorage{baseDir: dir}
+	move := func(from, to string) {
+		must(t, partial.ensureDir(filepath.Dir(to)))
+		must(t, os.Rename(filepath.Join(dir, from), to))
+	}
+	for _, chunkID := range []string{"moved", "half"} {
+		sidecarPath, _ := partial.sidecarPath(chunkID)
+		move("."+chunkID+".meta", sidecarPath)
+	}
+	chunkPath, _ := partial.chunkPath("moved")
+	move("moved", chunkPath)
+
+	s, err := NewFileChunkStorage(dir, false)
+	must(t, err)
+	defer s.Close()
+	for chunkID, data := range chunks {
+		expectChunk(t, s, chunkID, data)
+		if sidecar, err := s.ReadSidecar(chunkID); err != nil || sidecar == nil || sidecar.Filename != chunkID {
+			t.Fatalf("sidecar of %s after the migration: %+v, %v", chunkID, sidecar, err)
+		}
+	}
+	expectList(t, s, chunks)
+
+	// Only the files that are not chunks stay in the data directory
+	entries, err := os.ReadDir(dir)
+	must(t, err)
+	for _, entry := range entries {
+		if !entry.IsDir() && entry.Name() != WorkerIDFile {
+			t.Errorf("%s left in the data directory", entry.Name())
+		}
+	}
+}
+
+// TestLogStorageCompaction runs random stores, appends and deletes against the
+// log engine, compacting and restarting in between, and checks the storage
+// against a model after every step. Compaction must neither resurrect a deleted
+// chunk nor drop a live one, also once the index is rebuilt from the segments.
+func TestLogStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	engine := storageEngines[1]
+	s := openStorage(t, engine, dir)
+	model := make(map[string][]byte)
+	rng := rand.New(rand.NewSource(1))
+
+	check := func(step string) {
+		t.Helper()
+		for i := range 30 {
+			chunkID := fmt.Sprintf("chunk%d", i)
+			data, err := s.Retrieve(chunkID)
+			if err != nil {
+				t.Fatalf("%s: retrieving %s: %v", step, chunkID, err)
+			}
+			want, live := model[chunkID]
+			if !live && data != nil {
+				t.Fatalf("%s: deleted chunk %s is back", step, chunkID)
+			}
+			if live && !bytes.Equal(data, want) {
+				t.Fatalf("%s: chunk %s holds %d bytes, want %d", step, chunkID, len(data), len(want))
+			}
+		}
+		expectList(t, s, model)
+	}
+
+	compacted := 0
+	for round := range 40 {
+		for range 25 {
+			chunkID := fmt.Sprintf("chunk%d", rng.Intn(30))
+			switch op := rng.Intn(10); {
+			case op < 5:
+				data := chunkData(rng.Int(), 50+rng.Intn(400))
+				must(t, s.Store(chunkID, data))
+				model[chunkID] = data
+			case op < 7 && model[chunkID] != nil:
+				// Some appends cut off the end of the chunk, like a retried pack append
+				offset := len(model[chunkID])
+				if rng.Intn(3) == 0 {
+					offset = 1 + rng.Intn(offset)
+				}
+				extra := chunkData(rng.Int(), 1+rng.Intn(100))
+				must(t, s.Append(chunkID, int64(offset), bytes.NewReader(extra)))
+				model[chunkID] = append(append([]byte{}, model[chunkID][:offset]...), extra...)
+			case model[chunkID] != nil:
+				must(t, s.Delete(chunkID))
+				delete(model, chunkID)
+			}
+		}
+
+		removed, _, err := s.(*LogChunkStorage).Compact()
+		if err != nil {
+			t.Fatalf("round %d: compaction failed: %v", round, err)
+		}
+		compacted += removed
+		check(fmt.Sprintf("round %d after compaction", round))
+
+		// Restart, cleanly or not, so the index is rebuilt from what compaction left
+		switch round % 3 {
+		case 1:
+			must(t, s.Close())
+			s = openStorage(t, engine, dir)
+		case 2:
+			engine.crash(s)
+			s = openStorage(t, engine, dir)
+		}
+		check(fmt.Sprintf("round %d after restart", round))
+	}
+	must(t, s.Close())
+
+	if compacted == 0 {
+		t.Fatal("no segment was compacted")
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// syncDir is a no-op on platforms where directories cannot be synced
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters
+const (
+	TraceExporterNone   = "none"
+	TraceExporterStdout = "stdout"
+	TraceExporterFile   = "file"
+	TraceExporterOTLP   = "otlp"
+)
+
+// TracingServiceName identifies workers in exported traces
+const TracingServiceName = "frostbyte-worker"
+
+// initTracing installs the global tracer provider and the W3C trace context
+// propagator, so the spans of a worker join the trace the master started.
+// It returns a function that flushes and stops the exporter.
+func initTracing(ctx context.Context, workerID string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	exporter, err := newTraceExporter(ctx, TraceExporter)
+	if err != nil || exporter == nil {
+		return func(context.Context) error { return nil }, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(TracingServiceName), semconv.ServiceInstanceID(workerID),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+	res, err = resource.Merge(res, resource.Environment())
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	// The sampler can be chosen with OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newTraceExporter creates the exporter selected by name, or nil for none.
+// The OTLP exporter is configured with the standard OTEL_EXPORTER_OTLP_* variables.
+func newTraceExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case TraceExporterNone, "":
+		return nil, nil
+	case TraceExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterFile:
+		file, err := os.OpenFile(TraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	case TraceExporterOTLP:
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", name)
+	}
+}
+
+// traceRequests starts a server span for every request, continuing the trace the
+// master sent with it. Spans are named after the route and carry the chunk ID.
+func traceRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	withChunkID := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chunkID := r.URL.Query().Get("chunkID"); chunkID != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("frostbyte.chunk_id", chunkID))
+		}
+		next.ServeHTTP(w, r)
+	})
+
+	return otelhttp.NewHandler(withChunkID, "worker",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, pattern := mux.Handler(r)
+			return r.Method + " " + pattern
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/metrics"
+		}),
+	)
+}
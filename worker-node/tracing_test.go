@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestChunkRequestsContinueTheMastersTrace checks that a chunk request carrying
+// the master's trace context is handled in that trace
+func TestChunkRequestsContinueTheMastersTrace(t *testing.T) {
+	shutdown, err := initTracing(context.Background(), "w1")
+	must(t, err)
+	t.Cleanup(func() { shutdown(context.Background()) })
+
+	var got trace.TraceID
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		got = trace.SpanContextFromContext(r.Context()).TraceID()
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest(http.MethodGet, "/get?chunkID=c", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	traceRequests(mux, mux).ServeHTTP(httptest.NewRecorder(), r)
+	if got.String() != traceID {
+		t.Fatalf("chunk request handled in trace %s, want the master's trace %s", got, traceID)
+	}
+}